@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"image-compressor/pkg/compressor"
+)
+
+// analyzeEdge is the long edge images are reduced to before their
+// luminance statistics are taken, so sharpness compares across resolutions.
+const analyzeEdge = 1024
+
+// blurThreshold is the sharpness under which an image looks blurry: the
+// variance of the Laplacian of its luminance, at analyzeEdge.
+const blurThreshold = 100
+
+// analyzeOptions holds the flags of the analyze subcommand.
+type analyzeOptions struct {
+	json bool
+}
+
+func analyzeFlagSet(o *analyzeOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	fs.BoolVar(&o.json, "json", false, "print the statistics as a JSON array")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s analyze [-json] image|dir...\n", programName())
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// imageStats describes one image for the analyze subcommand.
+type imageStats struct {
+	Path         string  `json:"path"`
+	Format       string  `json:"format,omitempty"`
+	Width        int     `json:"width,omitempty"`
+	Height       int     `json:"height,omitempty"`
+	Bytes        int64   `json:"bytes"`
+	BitsPerPixel float64 `json:"bits_per_pixel,omitempty"`
+	ColorDepth   string  `json:"color_depth,omitempty"`
+	Alpha        bool    `json:"alpha,omitempty"`
+	// Quality is the estimated JPEG quality, or 0 for other formats.
+	Quality int `json:"quality,omitempty"`
+	// Entropy is that of the luminance histogram, from 0 to 8 bits.
+	Entropy float64 `json:"entropy"`
+	// Sharpness is the variance of the Laplacian of the luminance; under
+	// blurThreshold the image looks blurry.
+	Sharpness float64 `json:"sharpness"`
+	MeanLuma  float64 `json:"mean_luma"`
+	// Shadows and Highlights are the percentages of pixels clipped to black
+	// and white.
+	Shadows    float64 `json:"clipped_shadows"`
+	Highlights float64 `json:"clipped_highlights"`
+	// Upscaled is the factor the image was enlarged by from a smaller
+	// original, if it evidently was.
+	Upscaled float64 `json:"upscaled,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// runAnalyze implements the analyze subcommand, which prints statistics
+// about images that help decide how to compress them and find ones that are
+// already degraded: resolution, estimated quality, entropy, sharpness and
+// color depth.
+func runAnalyze(args []string) error {
+	var opts analyzeOptions
+	fs := analyzeFlagSet(&opts)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no input images")
+	}
+
+	paths, err := imagePaths(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	all := make([]imageStats, 0, len(paths))
+	for _, path := range paths {
+		stats := analyzeImage(path)
+		if opts.json {
+			all = append(all, stats)
+			continue
+		}
+		printStats(stats)
+	}
+	if opts.json {
+		data, err := json.MarshalIndent(all, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	}
+	return nil
+}
+
+// imagePaths expands args, files and directories, to the image files they
+// name. Directories contribute the images directly inside them.
+func imagePaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		arg = longPath(arg)
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			path := filepath.Join(arg, e.Name())
+			if !e.IsDir() && isSupportedImage(path) {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// analyzeImage decodes the image at path and measures it. Errors are
+// recorded in the result.
+func analyzeImage(path string) imageStats {
+	stats := imageStats{Path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		stats.Error = err.Error()
+		return stats
+	}
+	stats.Bytes = info.Size()
+
+	img, format, err := decodeImageFile(path)
+	stats.Format = format
+	if err != nil {
+		stats.Error = err.Error()
+		return stats
+	}
+
+	bounds := img.Bounds()
+	stats.Width, stats.Height = bounds.Dx(), bounds.Dy()
+	stats.BitsPerPixel = float64(stats.Bytes*8) / float64(max(stats.Width*stats.Height, 1))
+	stats.ColorDepth = colorDepth(img)
+	stats.Alpha = !isOpaque(img)
+	if stats.Format == "jpeg" {
+		stats.Quality = estimateJPEGQualityFile(path)
+	}
+	if scale := effectiveScale(img); scale < 1 {
+		stats.Upscaled = 1 / scale
+	}
+
+	// Transparent areas are measured as they'd come out in a JPEG
+	luma, w, h := luminance(compressor.Flatten(fitLongEdge(img, analyzeEdge), flattenColor))
+	stats.Sharpness = sharpness(luma, w, h)
+	var histogram [256]int
+	var sum float64
+	for _, v := range luma {
+		histogram[min(max(int(math.Round(v)), 0), 255)]++
+		sum += v
+	}
+	n := float64(len(luma))
+	for _, count := range histogram {
+		if count > 0 {
+			p := float64(count) / n
+			stats.Entropy -= p * math.Log2(p)
+		}
+	}
+	stats.MeanLuma = sum / n
+	stats.Shadows = 100 * float64(histogram[0]) / n
+	stats.Highlights = 100 * float64(histogram[255]) / n
+	return stats
+}
+
+// sharpness returns the variance of the Laplacian of a w x h luminance
+// plane. Blur removes the fine edges it responds to, so low values mean a
+// soft image.
+func sharpness(luma []float64, w, h int) float64 {
+	if w < 3 || h < 3 {
+		return 0
+	}
+	var sum, sumSq float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			v := luma[i-1] + luma[i+1] + luma[i-w] + luma[i+w] - 4*luma[i]
+			sum += v
+			sumSq += v * v
+		}
+	}
+	n := float64((w - 2) * (h - 2))
+	mean := sum / n
+	return sumSq/n - mean*mean
+}
+
+// colorDepth describes how the decoded img stores its pixels.
+func colorDepth(img image.Image) string {
+	switch m := img.(type) {
+	case *image.YCbCr:
+		return "8-bit YCbCr " + subsamplingName(m.SubsampleRatio)
+	case *image.Gray:
+		return "8-bit gray"
+	case *image.Gray16:
+		return "16-bit gray"
+	case *image.Paletted:
+		return fmt.Sprintf("palette of %d colors", len(m.Palette))
+	case *image.CMYK:
+		return "8-bit CMYK"
+	case *image.RGBA, *image.NRGBA:
+		return "8-bit RGB"
+	case *image.RGBA64, *image.NRGBA64:
+		return "16-bit RGB"
+	default:
+		return fmt.Sprintf("%T", img)
+	}
+}
+
+func subsamplingName(ratio image.YCbCrSubsampleRatio) string {
+	switch ratio {
+	case image.YCbCrSubsampleRatio444:
+		return "4:4:4"
+	case image.YCbCrSubsampleRatio422:
+		return "4:2:2"
+	case image.YCbCrSubsampleRatio420:
+		return "4:2:0"
+	case image.YCbCrSubsampleRatio440:
+		return "4:4:0"
+	case image.YCbCrSubsampleRatio411:
+		return "4:1:1"
+	case image.YCbCrSubsampleRatio410:
+		return "4:1:0"
+	default:
+		return ""
+	}
+}
+
+// printStats prints stats as a short block of text, followed by what
+// stands out about the image.
+func printStats(s imageStats) {
+	name := filepath.Base(s.Path)
+	if s.Error != "" {
+		fmt.Printf("%s: ERROR: %s\n", name, s.Error)
+		return
+	}
+	fmt.Printf("%s: %dx%d %s, %s (%.2f bits/pixel), %s", name, s.Width, s.Height, strings.ToUpper(s.Format), formatSize(int(s.Bytes)), s.BitsPerPixel, s.ColorDepth)
+	if s.Alpha {
+		fmt.Print(" with alpha")
+	}
+	if s.Quality > 0 {
+		fmt.Printf(", q%d", s.Quality)
+	}
+	fmt.Println()
+	fmt.Printf("  entropy %.2f bits, sharpness %.1f, mean luma %.0f, clipped %.1f%% shadows / %.1f%% highlights\n",
+		s.Entropy, s.Sharpness, s.MeanLuma, s.Shadows, s.Highlights)
+	if s.Sharpness < blurThreshold {
+		fmt.Println("  looks blurry")
+	}
+	if s.Quality > 0 && s.Quality <= lowQualityThreshold {
+		fmt.Println("  already heavily compressed")
+	}
+	if s.Upscaled > 0 {
+		fmt.Printf("  upscaled %.2gx from a smaller original\n", s.Upscaled)
+	}
+}
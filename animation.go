@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"math"
+	"sort"
+)
+
+// maxAnimationEncodes bounds how many candidate encodes compressAnimation
+// tries before giving up on meeting the target.
+const maxAnimationEncodes = 12
+
+// animationTradeoff is one way of spending an animation's byte budget: its
+// scale relative to the source, how many source frames each output frame
+// stands for, and the size of its palette.
+type animationTradeoff struct {
+	scale  float64
+	step   int
+	colors int
+}
+
+// cost ranks tradeoffs by how much they visibly give up, lowest first:
+// resolution counts most, then smoothness, then color.
+func (t animationTradeoff) cost() float64 {
+	return 3*(1-t.scale) + float64(t.step-1) + 0.5*math.Log2(256/float64(t.colors))
+}
+
+// predict estimates the encoded size of the tradeoff from full, the size
+// of the animation at full scale with every frame and 256 colors. Bytes
+// scale with pixel count and frame count, and a little with palette bits.
+func (t animationTradeoff) predict(full int) float64 {
+	return float64(full) * t.scale * t.scale / float64(t.step) * (0.5 + 0.5*math.Log2(float64(t.colors))/8)
+}
+
+// animationTradeoffs lists the candidate tradeoffs, cheapest first.
+func animationTradeoffs() []animationTradeoff {
+	var all []animationTradeoff
+	for _, scale := range []float64{1, 0.85, 0.7, 0.55, 0.4, 0.3, 0.2} {
+		for _, step := range []int{1, 2, 3} {
+			for _, colors := range []int{256, 128, 64, 32} {
+				all = append(all, animationTradeoff{scale, step, colors})
+			}
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].cost() < all[j].cost() })
+	return all
+}
+
+// animation is a decoded GIF animation as full frames, each showing what
+// the viewer sees at that point, so frames can be dropped and resampled
+// independently.
+type animation struct {
+	frames    []*image.RGBA
+	delays    []int
+	loopCount int
+	// transparent is set when any frame shows a transparent pixel
+	transparent bool
+}
+
+// readAnimation decodes r as a GIF and returns it as an animation, or nil
+// if it has a single frame.
+func readAnimation(r io.Reader) (*animation, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) < 2 {
+		return nil, nil
+	}
+	width, height := g.Config.Width, g.Config.Height
+	if width == 0 || height == 0 {
+		width, height = g.Image[0].Bounds().Dx(), g.Image[0].Bounds().Dy()
+	}
+	if int64(width)*int64(height)*int64(len(g.Image)) > maxDecodePixels {
+		return nil, fmt.Errorf("%dx%d with %d frames is too large to decode", width, height, len(g.Image))
+	}
+
+	anim := &animation{loopCount: g.LoopCount}
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i, frame := range g.Image {
+		var previous *image.RGBA
+		if i < len(g.Disposal) && g.Disposal[i] == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		shown := cloneRGBA(canvas)
+		anim.frames = append(anim.frames, shown)
+		if i < len(g.Delay) {
+			anim.delays = append(anim.delays, g.Delay[i])
+		} else {
+			anim.delays = append(anim.delays, 0)
+		}
+		if !anim.transparent && !isOpaque(shown) {
+			anim.transparent = true
+		}
+		switch {
+		case previous != nil:
+			canvas = previous
+		case i < len(g.Disposal) && g.Disposal[i] == gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+	return anim, nil
+}
+
+// keepsAnimation reports whether animated GIFs are written as GIFs, rather
+// than converted or fitted to a canvas, which take only the first frame.
+func keepsAnimation() bool {
+	return !convertAll && !heicOutput && canvasWidth == 0 && pipelineFor("gif") != pipelineJPEG && pipelineFor("gif") != pipelinePNG && pipelineFor("gif") != pipelineHEIC
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	out := image.NewRGBA(img.Bounds())
+	copy(out.Pix, img.Pix)
+	return out
+}
+
+// compressAnimation fits anim in targetSize as a GIF. It measures the
+// animation with every frame at full size first, then tries tradeoffs in
+// order of what they give up, skipping those predicted to be far over the
+// target, and writes the first that fits. The tradeoff chosen is logged.
+func compressAnimation(log *fileLog, anim *animation, dstPath string) (string, error) {
+	bounds := anim.frames[0].Bounds()
+	width, height := cappedSize(bounds.Dx(), bounds.Dy())
+	base := float64(width) / float64(bounds.Dx())
+
+	full, err := anim.encode(animationTradeoff{scale: 1, step: 1, colors: 256}, base)
+	if err != nil {
+		return "", err
+	}
+	if traceSearch {
+		log.Line("  full size, all frames, 256 colors: %s", formatSize(len(full)))
+	}
+	if len(full) <= targetSize {
+		log.Printf("(animation: %d frames, %dx%d) ", len(anim.frames), width, height)
+		return dstPath, writeOutput(dstPath, full)
+	}
+
+	// correction is how far predictions have fallen short so far
+	encodes, correction := 0, 1.0
+	for _, t := range animationTradeoffs() {
+		predicted := t.predict(len(full))
+		if t == (animationTradeoff{scale: 1, step: 1, colors: 256}) || predicted*correction > 1.25*float64(targetSize) {
+			continue
+		}
+		if encodes++; encodes > maxAnimationEncodes {
+			break
+		}
+		data, err := anim.encode(t, base)
+		if err != nil {
+			return "", err
+		}
+		fits := len(data) <= targetSize
+		correction = max(correction, float64(len(data))/predicted)
+		if traceSearch {
+			decision := "over target"
+			if fits {
+				decision = "fits"
+			}
+			log.Line("  scale %.2f, %s, %d colors: %s, %s", t.scale, frameStep(t.step), t.colors, formatSize(len(data)), decision)
+		}
+		if fits {
+			frames := (len(anim.frames) + t.step - 1) / t.step
+			log.Printf("(animation: %d of %d frames, %dx%d, %d colors) ", frames, len(anim.frames),
+				max(int(float64(width)*t.scale), 1), max(int(float64(height)*t.scale), 1), t.colors)
+			return dstPath, writeOutput(dstPath, data)
+		}
+	}
+	return "", errCannotMeetTarget
+}
+
+// frameStep describes keeping every n-th frame.
+func frameStep(n int) string {
+	switch n {
+	case 1:
+		return "all frames"
+	case 2:
+		return "every 2nd frame"
+	case 3:
+		return "every 3rd frame"
+	}
+	return fmt.Sprintf("every %dth frame", n)
+}
+
+// encode writes the animation as a GIF with tradeoff t, on top of a base
+// scale that applies the dimension caps. All frames share one palette, and
+// pixels that don't change from the previous frame are left transparent so
+// they compress to almost nothing, unless the animation has transparency of
+// its own.
+func (a *animation) encode(t animationTradeoff, base float64) ([]byte, error) {
+	bounds := a.frames[0].Bounds()
+	width := max(int(float64(bounds.Dx())*base*t.scale), 1)
+	height := max(int(float64(bounds.Dy())*base*t.scale), 1)
+
+	var frames []image.Image
+	var delays []int
+	for i := 0; i < len(a.frames); i += t.step {
+		var frame image.Image = a.frames[i]
+		if width != bounds.Dx() || height != bounds.Dy() {
+			frame = resizeImage(frame, width, height)
+		}
+		delay := 0
+		for j := i; j < min(i+t.step, len(a.frames)); j++ {
+			delay += a.delays[j]
+		}
+		frames = append(frames, frame)
+		delays = append(delays, delay)
+	}
+
+	// One index is kept for transparency
+	palette := sharedPalette(frames, t.colors-1)
+	clear := uint8(len(palette))
+	palette = append(palette, color.Transparent)
+	lookup := newPaletteLookup(palette[:clear])
+
+	out := &gif.GIF{LoopCount: a.loopCount, Config: image.Config{ColorModel: palette, Width: width, Height: height}}
+	var previous *image.Paletted
+	for i, frame := range frames {
+		paletted := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+		fb := frame.Bounds()
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				c := color.NRGBAModel.Convert(frame.At(fb.Min.X+x, fb.Min.Y+y)).(color.NRGBA)
+				index := clear
+				if c.A >= 128 {
+					index = lookup.index(c)
+				}
+				paletted.Pix[paletted.PixOffset(x, y)] = index
+			}
+		}
+		disposal := byte(gif.DisposalNone)
+		if a.transparent {
+			disposal = gif.DisposalBackground
+		} else if previous != nil {
+			// Only what changed is drawn over the previous frame
+			shown := cloneRGBAPaletted(paletted)
+			for p, index := range paletted.Pix {
+				if index == previous.Pix[p] {
+					paletted.Pix[p] = clear
+				}
+			}
+			previous = shown
+		} else {
+			previous = cloneRGBAPaletted(paletted)
+		}
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, delays[i])
+		out.Disposal = append(out.Disposal, disposal)
+	}
+
+	var buffer bytes.Buffer
+	if err := gif.EncodeAll(&buffer, out); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func cloneRGBAPaletted(p *image.Paletted) *image.Paletted {
+	out := image.NewPaletted(p.Bounds(), p.Palette)
+	copy(out.Pix, p.Pix)
+	return out
+}
+
+// sharedPalette picks up to n colors for all of frames by median cut over
+// a sample of their opaque pixels.
+func sharedPalette(frames []image.Image, n int) color.Palette {
+	counts := make(map[color.NRGBA]int)
+	// About a million samples across the animation is plenty
+	bounds := frames[0].Bounds()
+	stride := max(1, int(math.Sqrt(float64(bounds.Dx()*bounds.Dy()*len(frames))/(1<<20))))
+	for _, frame := range frames {
+		fb := frame.Bounds()
+		for y := fb.Min.Y; y < fb.Max.Y; y += stride {
+			for x := fb.Min.X; x < fb.Max.X; x += stride {
+				c := color.NRGBAModel.Convert(frame.At(x, y)).(color.NRGBA)
+				if c.A >= 128 {
+					c.A = 255
+					counts[c]++
+				}
+			}
+		}
+	}
+	if len(counts) == 0 {
+		return color.Palette{color.Black}
+	}
+	colors := make([]colorCount, 0, len(counts))
+	for c, count := range counts {
+		colors = append(colors, colorCount{c, count})
+	}
+	return medianCut(colors, n)
+}
+
+// paletteLookup maps colors to their nearest palette entry, caching by
+// color at 5 bits per channel since animations repeat colors heavily.
+type paletteLookup struct {
+	palette color.Palette
+	cache   [1 << 15]int16
+}
+
+func newPaletteLookup(palette color.Palette) *paletteLookup {
+	l := &paletteLookup{palette: palette}
+	for i := range l.cache {
+		l.cache[i] = -1
+	}
+	return l
+}
+
+func (l *paletteLookup) index(c color.NRGBA) uint8 {
+	key := int(c.R>>3)<<10 | int(c.G>>3)<<5 | int(c.B>>3)
+	if l.cache[key] < 0 {
+		l.cache[key] = int16(l.palette.Index(color.NRGBA{c.R, c.G, c.B, 255}))
+	}
+	return uint8(l.cache[key])
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"image-compressor/pkg/compressor"
+)
+
+const bracketsUsage = "find exposure brackets, frames a camera's auto bracketing shot one after the other per their EXIF: keep compresses only the normal exposure of each, merge blends each into one tone-mapped image compressed in place of the normal exposure (default off)"
+
+// Values of -brackets.
+const (
+	bracketsKeep  = "keep"
+	bracketsMerge = "merge"
+)
+
+// bracketMode is bracketsKeep or bracketsMerge when -brackets is set.
+var bracketMode string
+
+// registerBrackets registers -brackets, which sets bracketMode.
+func registerBrackets(fs *flag.FlagSet) {
+	fs.Func("brackets", bracketsUsage, func(s string) error {
+		switch s {
+		case "", "off":
+			bracketMode = ""
+		case bracketsKeep, bracketsMerge:
+			bracketMode = s
+		default:
+			return fmt.Errorf("unknown bracket mode %q (want keep, merge or off)", s)
+		}
+		return nil
+	})
+}
+
+// exifAutoBracket is the ExposureMode of frames shot by auto bracketing.
+const exifAutoBracket = 2
+
+// bracketGap is the longest time between two frames of a bracket.
+const bracketGap = 2 * time.Second
+
+// maxBracketFrames is the most frames cameras bracket.
+const maxBracketFrames = 9
+
+// bracketFrame is an auto-bracketed frame as its EXIF describes it.
+type bracketFrame struct {
+	path   string
+	camera string
+	taken  time.Time
+	// bias is the exposure compensation in EV and exposure the exposure
+	// time in seconds, 0 if unknown
+	bias     float64
+	exposure float64
+}
+
+// readBracketFrame reads the EXIF of the JPEG at path, reporting false
+// unless auto bracketing shot it.
+func readBracketFrame(path string) (bracketFrame, bool) {
+	segments, err := readJPEGMetadata(path)
+	if err != nil {
+		return bracketFrame{}, false
+	}
+	for _, s := range segments {
+		if metadataKind(s) != metaEXIF {
+			continue
+		}
+		numbers := exifNumbers(s.data)
+		if numbers[tagExposureMode] != exifAutoBracket {
+			return bracketFrame{}, false
+		}
+		fields := exifStrings(s.data)
+		taken := fields[tagDateTimeOriginal]
+		if taken == "" {
+			taken = fields[tagDateTime]
+		}
+		t, err := time.Parse("2006:01:02 15:04:05", taken)
+		if err != nil {
+			return bracketFrame{}, false
+		}
+		return bracketFrame{
+			path:     path,
+			camera:   fmt.Sprintf("%s\x00%s\x00%s", fields[tagMake], fields[tagModel], fields[tagBodySerialNumber]),
+			taken:    t,
+			bias:     numbers[tagExposureBiasValue],
+			exposure: numbers[tagExposureTime],
+		}, true
+	}
+	return bracketFrame{}, false
+}
+
+// bracketFrames finds the brackets among paths, the images of one batch of
+// directory entries, if bracketMode is set: runs of auto-bracketed frames
+// from one camera, each taken within bracketGap of the one before at an
+// exposure the run doesn't have yet. It leaves out all but the normal
+// exposure of each in skip, and with bracketsMerge returns the frames of
+// each bracket by the normal exposure they are merged in place of. Sources
+// skip has already are not considered. Brackets split across two batches
+// are found as two.
+func bracketFrames(paths []string, skip map[string]leftOut) map[string][]string {
+	if bracketMode == "" {
+		return nil
+	}
+	var brackets [][]bracketFrame
+	var run []bracketFrame
+	end := func() {
+		if len(run) >= 2 {
+			brackets = append(brackets, run)
+		}
+		run = nil
+	}
+	for _, path := range paths {
+		if _, ok := skip[path]; ok {
+			continue
+		}
+		frame, ok := readBracketFrame(path)
+		if !ok {
+			end()
+			continue
+		}
+		if len(run) > 0 {
+			last := run[len(run)-1]
+			gap := frame.taken.Sub(last.taken)
+			if frame.camera != last.camera || gap < 0 || gap > bracketGap || len(run) == maxBracketFrames || hasExposure(run, frame) {
+				end()
+			}
+		}
+		run = append(run, frame)
+	}
+	end()
+
+	merges := make(map[string][]string)
+	for _, bracket := range brackets {
+		normal := normalExposure(bracket)
+		frames := make([]string, len(bracket))
+		for i, frame := range bracket {
+			frames[i] = frame.path
+			if frame.path != normal.path {
+				leaveOut(skip, frame.path, normal.path, leftOutBracket)
+			}
+		}
+		if bracketMode == bracketsMerge {
+			merges[normal.path] = frames
+		}
+	}
+	return merges
+}
+
+// hasExposure reports whether one of run was shot at frame's exposure, so
+// frame starts the next bracket.
+func hasExposure(run []bracketFrame, frame bracketFrame) bool {
+	for _, f := range run {
+		if f.bias == frame.bias && f.exposure == frame.exposure {
+			return true
+		}
+	}
+	return false
+}
+
+// normalExposure returns the frame of bracket with the least exposure
+// compensation, or if they all have the same, the median exposure time.
+func normalExposure(bracket []bracketFrame) bracketFrame {
+	frames := append([]bracketFrame(nil), bracket...)
+	sort.SliceStable(frames, func(i, j int) bool { return frames[i].exposure < frames[j].exposure })
+	median := frames[len(frames)/2]
+	sort.SliceStable(frames, func(i, j int) bool { return math.Abs(frames[i].bias) < math.Abs(frames[j].bias) })
+	if frames[0].bias == median.bias {
+		return median
+	}
+	return frames[0]
+}
+
+// bracketMerges holds the merged image of each bracket by the path of the
+// normal exposure, which compressImage compresses it in place of, while
+// that file is processed.
+var bracketMerges sync.Map
+
+// isBracketMerge reports whether the source at path stands for a merged
+// bracket.
+func isBracketMerge(path string) bool {
+	_, ok := bracketMerges.Load(path)
+	return ok
+}
+
+// mergeBracket decodes the frames of a bracket and merges them for
+// compressImage to compress in place of path. If that fails, path is
+// compressed as it is.
+func mergeBracket(path string, frames []string) {
+	log := &fileLog{source: path}
+	defer log.flush()
+	images := make([]image.Image, len(frames))
+	for i, frame := range frames {
+		img, _, err := decodeImageFile(frame)
+		if err != nil {
+			log.Printf("Error merging the bracket of %s: %v\n", frame, err)
+			return
+		}
+		images[i] = img
+	}
+	merged, err := fuseExposures(images)
+	if err != nil {
+		log.Printf("Error merging the bracket of %s: %v\n", path, err)
+		return
+	}
+	bracketMerges.Store(path, merged)
+}
+
+// fusionEdge is the long edge the weights of fuseExposures are worked out
+// at. Weighing whole regions rather than single pixels keeps edges free of
+// halos and seams.
+const fusionEdge = 256
+
+// fuseExposures blends frames, exposures of one scene, into one image by
+// exposure fusion: every pixel is the average of the frames weighted by
+// how well exposed, saturated and detailed they are around it. The result
+// needs no further tone mapping.
+func fuseExposures(frames []image.Image) (*image.NRGBA, error) {
+	size := frames[0].Bounds().Size()
+	for _, frame := range frames[1:] {
+		if frame.Bounds().Size() != size {
+			return nil, fmt.Errorf("frames are %v and %v", size, frame.Bounds().Size())
+		}
+	}
+	sw, sh := compressor.LongEdgeSize(size.X, size.Y, fusionEdge)
+
+	pixels := make([]*image.NRGBA, len(frames))
+	weights := make([][]float64, len(frames))
+	for k, frame := range frames {
+		pixels[k] = toNRGBA(frame)
+		weights[k] = fusionWeights(toNRGBA(resizeImage(pixels[k], sw, sh)))
+	}
+	for i := range weights[0] {
+		var sum float64
+		for k := range weights {
+			sum += weights[k][i]
+		}
+		for k := range weights {
+			if sum > 0 {
+				weights[k][i] /= sum
+			} else {
+				weights[k][i] = 1 / float64(len(weights))
+			}
+		}
+	}
+
+	// Weights are interpolated between the centers of the cells they were
+	// worked out for
+	xs := make([]fusionSample, size.X)
+	for x := range xs {
+		xs[x] = newFusionSample(x, size.X, sw)
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+	for y := 0; y < size.Y; y++ {
+		sy := newFusionSample(y, size.Y, sh)
+		for x := 0; x < size.X; x++ {
+			sx := xs[x]
+			var r, g, b float64
+			for k, p := range pixels {
+				w := weights[k]
+				top := w[sy.i0*sw+sx.i0]*(1-sx.t) + w[sy.i0*sw+sx.i1]*sx.t
+				bottom := w[sy.i1*sw+sx.i0]*(1-sx.t) + w[sy.i1*sw+sx.i1]*sx.t
+				weight := top*(1-sy.t) + bottom*sy.t
+				i := p.PixOffset(p.Rect.Min.X+x, p.Rect.Min.Y+y)
+				r += weight * float64(p.Pix[i])
+				g += weight * float64(p.Pix[i+1])
+				b += weight * float64(p.Pix[i+2])
+			}
+			i := out.PixOffset(x, y)
+			out.Pix[i] = uint8(min(max(math.Round(r), 0), 255))
+			out.Pix[i+1] = uint8(min(max(math.Round(g), 0), 255))
+			out.Pix[i+2] = uint8(min(max(math.Round(b), 0), 255))
+			out.Pix[i+3] = 0xff
+		}
+	}
+	return out, nil
+}
+
+// fusionSample locates a pixel between the two nearest weight cells, i0
+// and i1, t of the way to i1.
+type fusionSample struct {
+	i0, i1 int
+	t      float64
+}
+
+// newFusionSample locates pixel v of n between cells of m.
+func newFusionSample(v, n, m int) fusionSample {
+	f := min(max((float64(v)+0.5)*float64(m)/float64(n)-0.5, 0), float64(m-1))
+	i0 := int(f)
+	return fusionSample{i0: i0, i1: min(i0+1, m-1), t: f - float64(i0)}
+}
+
+// fusionWeights returns how much each pixel of a downscaled frame counts
+// in the fusion: the product of its contrast with its neighbors, its
+// saturation and how close it is to mid-gray, smoothed over its
+// surroundings.
+func fusionWeights(img *image.NRGBA) []float64 {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	luma := make([]float64, w*h)
+	weights := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			r, g, b := float64(img.Pix[i])/255, float64(img.Pix[i+1])/255, float64(img.Pix[i+2])/255
+			luma[y*w+x] = 0.299*r + 0.587*g + 0.114*b
+			mean := (r + g + b) / 3
+			saturation := math.Sqrt(((r-mean)*(r-mean) + (g-mean)*(g-mean) + (b-mean)*(b-mean)) / 3)
+			exposure := math.Exp(-((r-0.5)*(r-0.5) + (g-0.5)*(g-0.5) + (b-0.5)*(b-0.5)) / (2 * 0.2 * 0.2))
+			weights[y*w+x] = (saturation + 0.01) * exposure
+		}
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := luma[y*w+x]
+			laplacian := luma[y*w+max(x-1, 0)] + luma[y*w+min(x+1, w-1)] + luma[max(y-1, 0)*w+x] + luma[min(y+1, h-1)*w+x] - 4*c
+			weights[y*w+x] *= math.Abs(laplacian) + 0.01
+		}
+	}
+	return boxBlur(boxBlur(weights, w, h, 2), w, h, 2)
+}
+
+// boxBlur averages every value of a w x h plane with those within radius
+// of it.
+func boxBlur(plane []float64, w, h, radius int) []float64 {
+	out := make([]float64, len(plane))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum float64
+			n := 0
+			for yy := max(y-radius, 0); yy <= min(y+radius, h-1); yy++ {
+				for xx := max(x-radius, 0); xx <= min(x+radius, w-1); xx++ {
+					sum += plane[yy*w+xx]
+					n++
+				}
+			}
+			out[y*w+x] = sum / float64(n)
+		}
+	}
+	return out
+}
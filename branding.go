@@ -0,0 +1,38 @@
+package main
+
+import "fmt"
+
+// Branding, for companies that bundle the tool for their clients under their
+// own name. Like version, each string is set at build time, so a branded
+// build needs no changes to the source:
+//
+//	go build -ldflags "-X 'main.productName=Acme Photos' -X main.shortName=acme-photos -X main.commandName=acme-photos"
+//
+// A branded build that self-updates also needs its own releaseFeed and
+// update_key.pub; see update_key.go.
+var (
+	// productName is shown in banners, the tray and the service description.
+	productName = "Image Compressor"
+	// shortName names the system service, the release assets the updater
+	// downloads, and temporary directories.
+	shortName = "image-compressor"
+	// commandName, if set, is the command shown in usage messages instead
+	// of the name the binary was invoked as.
+	commandName = ""
+	// exitPrompt is shown when a run without a subcommand waits for Enter
+	// before closing its console window.
+	exitPrompt = "Press Enter to exit..."
+)
+
+// printBanner announces what the binary is starting to do, e.g.
+// "Image Compressor - Watching...".
+func printBanner(activity string) {
+	fmt.Printf("%s - %s...\n", productName, activity)
+}
+
+// waitForExit prints exitPrompt and waits for Enter, so a console window
+// opened by double-clicking the binary stays open until it's been read.
+func waitForExit() {
+	fmt.Println(exitPrompt)
+	<-stdinLines()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+const burstsUsage = "treat photos taken in the same second by the same camera, per their EXIF, as a burst and compress only its sharpest, best-exposed frame, skipping the rest"
+
+// burstMode is set by -bursts.
+var burstMode bool
+
+// registerBursts registers -bursts, which sets burstMode.
+func registerBursts(fs *flag.FlagSet) {
+	fs.BoolVar(&burstMode, "bursts", false, burstsUsage)
+}
+
+// burstKey returns what the frames of a burst share, the camera and the
+// second the JPEG at path was taken in by its EXIF, or "" if it doesn't
+// say when.
+func burstKey(path string) string {
+	segments, err := readJPEGMetadata(path)
+	if err != nil {
+		return ""
+	}
+	for _, s := range segments {
+		if metadataKind(s) != metaEXIF {
+			continue
+		}
+		fields := exifStrings(s.data)
+		taken := fields[tagDateTimeOriginal]
+		if taken == "" {
+			taken = fields[tagDateTime]
+		}
+		if taken == "" {
+			return ""
+		}
+		return fmt.Sprintf("%s\x00%s\x00%s\x00%s", fields[tagMake], fields[tagModel], fields[tagBodySerialNumber], taken)
+	}
+	return ""
+}
+
+// burstFrames groups paths, the images of one batch of directory entries,
+// into bursts if burstMode is set, and leaves out all but the frame of each
+// with the best burstScore in skip. Sources skip has already are not
+// considered. Bursts split across two batches are picked from separately.
+func burstFrames(paths []string, skip map[string]leftOut) {
+	if !burstMode {
+		return
+	}
+	var keys []string
+	bursts := make(map[string][]string)
+	for _, path := range paths {
+		if _, ok := skip[path]; ok {
+			continue
+		}
+		key := burstKey(path)
+		if key == "" {
+			continue
+		}
+		if _, ok := bursts[key]; !ok {
+			keys = append(keys, key)
+		}
+		bursts[key] = append(bursts[key], path)
+	}
+
+	for _, key := range keys {
+		frames := bursts[key]
+		if len(frames) < 2 {
+			continue
+		}
+		best, bestScore := frames[0], -1.0
+		for _, frame := range frames {
+			if score := burstScore(frame); score > bestScore {
+				best, bestScore = frame, score
+			}
+		}
+		for _, frame := range frames {
+			if frame != best {
+				leaveOut(skip, frame, best, leftOutBurst)
+			}
+		}
+	}
+}
+
+// burstScore is the shotScore of the frame at path, or -1 if it can't be
+// decoded.
+func burstScore(path string) float64 {
+	img, _, err := decodeImageFile(path)
+	if err != nil {
+		return -1
+	}
+	return shotScore(img)
+}
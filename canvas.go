@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// canvasWidth and canvasHeight, when set by -canvas, are the exact size of
+// every output, as marketplaces such as Amazon and Etsy require. Images are
+// scaled down to fit inside, keeping their aspect ratio, and centered on
+// padColor.
+var (
+	canvasWidth, canvasHeight int
+	padColor                  color.Color = color.White
+)
+
+// parseCanvas sets the canvas size from WIDTHxHEIGHT, or clears it for "".
+func parseCanvas(s string) error {
+	if s == "" {
+		canvasWidth, canvasHeight = 0, 0
+		return nil
+	}
+	width, height, ok := parseWxH(s)
+	if !ok {
+		return fmt.Errorf("invalid canvas %q, expected WIDTHxHEIGHT such as 1200x1200", s)
+	}
+	canvasWidth, canvasHeight = width, height
+	return nil
+}
+
+// parseWxH parses a positive size written WIDTHxHEIGHT.
+func parseWxH(s string) (int, int, bool) {
+	w, h, ok := strings.Cut(strings.ToLower(s), "x")
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	return width, height, ok && errW == nil && errH == nil && width > 0 && height > 0
+}
+
+// parsePadColor sets padColor.
+func parsePadColor(s string) error {
+	c, err := parseColor(s)
+	padColor = c
+	return err
+}
+
+// matchesCanvas reports whether the image at path already has the canvas
+// size, or no canvas is set, reading only its header.
+func matchesCanvas(path string) bool {
+	if canvasWidth == 0 {
+		return true
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	cfg, _, err := decodeConfig(file)
+	return err == nil && cfg.Width == canvasWidth && cfg.Height == canvasHeight
+}
+
+// fitCanvas returns img scaled down to fit the canvas and centered on it,
+// or img itself if no canvas is set or it already has the canvas size.
+// Images smaller than the canvas are padded, never enlarged.
+func fitCanvas(log *fileLog, img image.Image) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if canvasWidth == 0 || w == canvasWidth && h == canvasHeight {
+		return img
+	}
+	if w > canvasWidth || h > canvasHeight {
+		scale := min(float64(canvasWidth)/float64(w), float64(canvasHeight)/float64(h))
+		w = min(max(int(math.Round(float64(w)*scale)), 1), canvasWidth)
+		h = min(max(int(math.Round(float64(h)*scale)), 1), canvasHeight)
+		img = resizeImage(img, w, h)
+	}
+	log.Printf("(padded to %dx%d) ", canvasWidth, canvasHeight)
+
+	canvas := image.NewRGBA(image.Rect(0, 0, canvasWidth, canvasHeight))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(padColor), image.Point{}, draw.Src)
+	x, y := (canvasWidth-w)/2, (canvasHeight-h)/2
+	draw.Draw(canvas, image.Rect(x, y, x+w, y+h), img, img.Bounds().Min, draw.Src)
+	return canvas
+}
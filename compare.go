@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"slices"
+
+	"image-compressor/pkg/compressor"
+)
+
+// changedThreshold is how far a channel has to move, out of 255, for a
+// pixel to count as changed in a comparison.
+const changedThreshold = 8
+
+// compareOptions holds the flags of the compare subcommand.
+type compareOptions struct {
+	json bool
+	diff string
+}
+
+func compareFlagSet(o *compareOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	fs.BoolVar(&o.json, "json", false, "print the comparison as JSON")
+	fs.StringVar(&o.diff, "diff", "", "write a PNG of the second image's differences, brighter red where it differs more")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compare [-json] [-diff diff.png] original other\n", programName())
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// comparison is what the compare subcommand reports about two images.
+type comparison struct {
+	A imageStats `json:"a"`
+	B imageStats `json:"b"`
+	// MetadataA and MetadataB are the kinds of metadata each carries.
+	MetadataA []string `json:"metadata_a"`
+	MetadataB []string `json:"metadata_b"`
+	// Width and Height are the size the pixels were compared at: the
+	// smaller image's, with the other resampled to it.
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	SSIM   float64 `json:"ssim"`
+	// PSNR is in dB, and +Inf for identical pixels, which JSON gets as 0.
+	PSNR float64 `json:"psnr"`
+	// MeanError and MaxError are per channel, out of 255.
+	MeanError float64 `json:"mean_error"`
+	MaxError  int     `json:"max_error"`
+	// Changed is the percentage of pixels with a channel that moved more
+	// than changedThreshold.
+	Changed     float64  `json:"changed_pixels"`
+	Differences []string `json:"differences"`
+}
+
+// runCompare implements the compare subcommand, which reports how a second
+// image differs from a first, e.g. what another tool did to an asset.
+func runCompare(args []string) error {
+	var opts compareOptions
+	fs := compareFlagSet(&opts)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("need two images")
+	}
+	pathA, pathB := longPath(fs.Arg(0)), longPath(fs.Arg(1))
+	c := comparison{A: analyzeImage(pathA), B: analyzeImage(pathB)}
+	for _, s := range []imageStats{c.A, c.B} {
+		if s.Error != "" {
+			return fmt.Errorf("%s: %s", s.Path, s.Error)
+		}
+	}
+	a, _, err := decodeImageFile(pathA)
+	if err != nil {
+		return err
+	}
+	b, _, err := decodeImageFile(pathB)
+	if err != nil {
+		return err
+	}
+	c.MetadataA, c.MetadataB = metadataKinds(pathA), metadataKinds(pathB)
+	// Pixels are compared as they'd be seen, over the flatten color
+	a, b = compressor.Flatten(a, flattenColor), compressor.Flatten(b, flattenColor)
+	a, b = sameSize(a, b)
+	c.SSIM = ssim(a, b)
+	diff := c.measure(a, b)
+	c.Differences = c.differences()
+
+	if opts.diff != "" {
+		data, err := encodePNG(diff)
+		if err != nil {
+			return err
+		}
+		if err := writeOutput(longPath(opts.diff), data); err != nil {
+			return err
+		}
+	}
+	if opts.json {
+		if math.IsInf(c.PSNR, 1) {
+			c.PSNR = 0
+		}
+		data, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	printStats(c.A)
+	printStats(c.B)
+	fmt.Println()
+	fmt.Printf("Compared at %dx%d:\n", c.Width, c.Height)
+	psnr := "identical"
+	if !math.IsInf(c.PSNR, 1) {
+		psnr = fmt.Sprintf("%.2f dB", c.PSNR)
+	}
+	fmt.Printf("  SSIM %.4f, PSNR %s\n", c.SSIM, psnr)
+	fmt.Printf("  mean error %.2f, max error %d, %.2f%% of pixels changed\n", c.MeanError, c.MaxError, c.Changed)
+	if len(c.Differences) > 0 {
+		fmt.Println("Differences:")
+		for _, d := range c.Differences {
+			fmt.Printf("  %s\n", d)
+		}
+	}
+	if opts.diff != "" {
+		fmt.Printf("Diff image: %s\n", opts.diff)
+	}
+	return nil
+}
+
+// sameSize resamples the larger of a and b to the size of the other.
+func sameSize(a, b image.Image) (image.Image, image.Image) {
+	ab, bb := a.Bounds(), b.Bounds()
+	switch {
+	case ab.Dx() == bb.Dx() && ab.Dy() == bb.Dy():
+	case ab.Dx()*ab.Dy() > bb.Dx()*bb.Dy():
+		a = resizeImage(a, bb.Dx(), bb.Dy())
+	default:
+		b = resizeImage(b, ab.Dx(), ab.Dy())
+	}
+	return a, b
+}
+
+// measure fills in the pixel statistics of a against b, which are the
+// same size, and returns an image of where they differ: a dimmed gray copy
+// of a with differences in red.
+func (c *comparison) measure(a, b image.Image) *image.RGBA {
+	ab, bb := a.Bounds(), b.Bounds()
+	c.Width, c.Height = ab.Dx(), ab.Dy()
+	diff := image.NewRGBA(image.Rect(0, 0, c.Width, c.Height))
+	var sum, squares float64
+	changed := 0
+	for y := 0; y < c.Height; y++ {
+		for x := 0; x < c.Width; x++ {
+			pa := color.RGBAModel.Convert(a.At(ab.Min.X+x, ab.Min.Y+y)).(color.RGBA)
+			pb := color.RGBAModel.Convert(b.At(bb.Min.X+x, bb.Min.Y+y)).(color.RGBA)
+			worst := 0
+			for _, d := range []int{int(pa.R) - int(pb.R), int(pa.G) - int(pb.G), int(pa.B) - int(pb.B)} {
+				if d < 0 {
+					d = -d
+				}
+				sum += float64(d)
+				squares += float64(d * d)
+				worst = max(worst, d)
+			}
+			c.MaxError = max(c.MaxError, worst)
+			if worst > changedThreshold {
+				changed++
+			}
+			gray := uint8((299*int(pa.R) + 587*int(pa.G) + 114*int(pa.B)) / 1000 / 3)
+			// Amplify, since most compression differences are a few levels
+			red := uint8(min(int(gray)+worst*8, 255))
+			diff.SetRGBA(x, y, color.RGBA{red, gray, gray, 0xff})
+		}
+	}
+	samples := float64(c.Width * c.Height * 3)
+	c.MeanError = sum / samples
+	c.PSNR = math.Inf(1)
+	if squares > 0 {
+		c.PSNR = 10 * math.Log10(255*255/(squares/samples))
+	}
+	c.Changed = 100 * float64(changed) / float64(c.Width*c.Height)
+	return diff
+}
+
+// differences lists what differs between the two images besides their
+// pixels.
+func (c *comparison) differences() []string {
+	var out []string
+	if c.A.Width != c.B.Width || c.A.Height != c.B.Height {
+		out = append(out, fmt.Sprintf("dimensions: %dx%d -> %dx%d", c.A.Width, c.A.Height, c.B.Width, c.B.Height))
+	}
+	if c.A.Format != c.B.Format {
+		out = append(out, fmt.Sprintf("format: %s -> %s", c.A.Format, c.B.Format))
+	}
+	if c.A.Bytes != c.B.Bytes {
+		out = append(out, fmt.Sprintf("size: %s -> %s (%.1f%%)", formatSize(int(c.A.Bytes)), formatSize(int(c.B.Bytes)), 100*float64(c.B.Bytes)/float64(max(c.A.Bytes, 1))))
+	}
+	if c.A.Quality != c.B.Quality && c.A.Quality > 0 && c.B.Quality > 0 {
+		out = append(out, fmt.Sprintf("JPEG quality: q%d -> q%d", c.A.Quality, c.B.Quality))
+	}
+	if c.A.ColorDepth != c.B.ColorDepth {
+		out = append(out, fmt.Sprintf("color depth: %s -> %s", c.A.ColorDepth, c.B.ColorDepth))
+	}
+	if c.A.Alpha != c.B.Alpha {
+		out = append(out, fmt.Sprintf("alpha: %t -> %t", c.A.Alpha, c.B.Alpha))
+	}
+	for _, kind := range metadataKindNames {
+		inA, inB := slices.Contains(c.MetadataA, kind), slices.Contains(c.MetadataB, kind)
+		switch {
+		case inA && !inB:
+			out = append(out, kind+" removed")
+		case inB && !inA:
+			out = append(out, kind+" added")
+		}
+	}
+	return out
+}
+
+// metadataKindNames name the metadata kinds, indexed by metaICC and so on.
+var metadataKindNames = []string{"ICC profile", "EXIF", "IPTC", "XMP", "extended XMP", "other metadata"}
+
+// metadataKinds lists the kinds of metadata the image at path carries:
+// everything for JPEGs, and the color profile for other formats.
+func metadataKinds(path string) []string {
+	segments, err := readJPEGMetadata(path)
+	if err != nil || len(segments) == 0 {
+		if readICCProfile(path) != nil {
+			return []string{metadataKindNames[metaICC]}
+		}
+		return nil
+	}
+	found := make([]bool, len(metadataKindNames))
+	for _, s := range segments {
+		found[metadataKind(s)] = true
+	}
+	var kinds []string
+	for kind, ok := range found {
+		if ok {
+			kinds = append(kinds, metadataKindNames[kind])
+		}
+	}
+	return kinds
+}
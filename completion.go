@@ -0,0 +1,236 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var completionShells = []string{"bash", "zsh", "fish", "powershell"}
+
+// completionFlag is a flag as listed in completion scripts.
+type completionFlag struct {
+	name  string
+	usage string
+}
+
+// flagsOf lists the flags registered on fs, or none if fs is nil.
+func flagsOf(fs *flag.FlagSet) []completionFlag {
+	if fs == nil {
+		return nil
+	}
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, completionFlag{name: f.Name, usage: f.Usage})
+	})
+	return flags
+}
+
+// rootFlags lists the flags accepted when no subcommand is given.
+func rootFlags() []completionFlag {
+	fs := flag.NewFlagSet(programName(), flag.ContinueOnError)
+	registerCompressionFlags(fs)
+	return flagsOf(fs)
+}
+
+func commandFlags(cmd command) []completionFlag {
+	if cmd.flags == nil {
+		return nil
+	}
+	return flagsOf(cmd.flags())
+}
+
+// runCompletion implements the completion subcommand, which prints a shell
+// completion script for every subcommand and flag.
+func runCompletion(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s completion %s", programName(), strings.Join(completionShells, "|"))
+	}
+	var script string
+	switch args[0] {
+	case "bash":
+		script = bashCompletion()
+	case "zsh":
+		script = zshCompletion()
+	case "fish":
+		script = fishCompletion()
+	case "powershell":
+		script = powershellCompletion()
+	default:
+		return fmt.Errorf("unsupported shell %q", args[0])
+	}
+	_, err := fmt.Fprint(os.Stdout, script)
+	return err
+}
+
+func commandNames() []string {
+	names := make([]string, len(commands))
+	for i, cmd := range commands {
+		names[i] = cmd.name
+	}
+	return names
+}
+
+// dashed returns "-name" for every flag, the form Go's flag package prints.
+func dashed(flags []completionFlag) []string {
+	words := make([]string, len(flags))
+	for i, f := range flags {
+		words[i] = "-" + f.name
+	}
+	return words
+}
+
+// shellIdent turns the program name into something usable as a shell
+// function name.
+func shellIdent(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func bashCompletion() string {
+	prog := programName()
+	fn := "_" + shellIdent(prog)
+	var b strings.Builder
+	fmt.Fprintf(&b, "# bash completion for %s\n", prog)
+	fmt.Fprintf(&b, "%s() {\n", fn)
+	b.WriteString("    local cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	b.WriteString("    local words=\"\"\n")
+	b.WriteString("    local flags=\"\"\n")
+	b.WriteString("    if [[ ${COMP_CWORD} -eq 1 ]]; then\n")
+	fmt.Fprintf(&b, "        words=%q\n", strings.Join(commandNames(), " "))
+	b.WriteString("    fi\n")
+	b.WriteString("    case \"${COMP_WORDS[1]}\" in\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "        %s)\n", cmd.name)
+		fmt.Fprintf(&b, "            flags=%q\n", strings.Join(dashed(commandFlags(cmd)), " "))
+		if len(cmd.words) > 0 {
+			fmt.Fprintf(&b, "            [[ ${COMP_CWORD} -eq 2 ]] && words=%q\n", strings.Join(cmd.words, " "))
+		}
+		b.WriteString("            ;;\n")
+	}
+	b.WriteString("        *)\n")
+	fmt.Fprintf(&b, "            flags=%q\n", strings.Join(dashed(rootFlags()), " "))
+	b.WriteString("            ;;\n")
+	b.WriteString("    esac\n")
+	b.WriteString("    if [[ \"$cur\" == -* ]]; then\n")
+	b.WriteString("        COMPREPLY=( $(compgen -W \"$flags\" -- \"$cur\") )\n")
+	b.WriteString("    elif [[ -n \"$words\" ]]; then\n")
+	b.WriteString("        COMPREPLY=( $(compgen -W \"$words\" -- \"$cur\") )\n")
+	b.WriteString("    fi\n")
+	b.WriteString("}\n")
+	fmt.Fprintf(&b, "complete -o default -F %s %s\n", fn, prog)
+	return b.String()
+}
+
+func zshCompletion() string {
+	prog := programName()
+	fn := "_" + shellIdent(prog)
+	var b strings.Builder
+	fmt.Fprintf(&b, "#compdef %s\n\n", prog)
+	fmt.Fprintf(&b, "%s() {\n", fn)
+	b.WriteString("    local -a flags choices\n")
+	b.WriteString("    (( CURRENT == 2 )) && choices=(" + strings.Join(commandNames(), " ") + ")\n")
+	b.WriteString("    case ${words[2]} in\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "        %s)\n", cmd.name)
+		fmt.Fprintf(&b, "            flags=(%s)\n", strings.Join(dashed(commandFlags(cmd)), " "))
+		if len(cmd.words) > 0 {
+			fmt.Fprintf(&b, "            (( CURRENT == 3 )) && choices=(%s)\n", strings.Join(cmd.words, " "))
+		}
+		b.WriteString("            ;;\n")
+	}
+	b.WriteString("        *)\n")
+	fmt.Fprintf(&b, "            flags=(%s)\n", strings.Join(dashed(rootFlags()), " "))
+	b.WriteString("            ;;\n")
+	b.WriteString("    esac\n")
+	b.WriteString("    if [[ $PREFIX == -* ]]; then\n")
+	b.WriteString("        compadd -- $flags\n")
+	b.WriteString("    elif (( ${#choices} )); then\n")
+	b.WriteString("        compadd -- $choices\n")
+	b.WriteString("    else\n")
+	b.WriteString("        _files\n")
+	b.WriteString("    fi\n")
+	b.WriteString("}\n\n")
+	fmt.Fprintf(&b, "compdef %s %s\n", fn, prog)
+	return b.String()
+}
+
+// fishQuote single-quotes s for fish.
+func fishQuote(s string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), "'", `\'`) + "'"
+}
+
+func fishCompletion() string {
+	prog := programName()
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %s\n", prog)
+	fmt.Fprintf(&b, "complete -c %s -n __fish_use_subcommand -f -a %s\n", prog, fishQuote(strings.Join(commandNames(), " ")))
+	for _, f := range rootFlags() {
+		fmt.Fprintf(&b, "complete -c %s -n __fish_use_subcommand -o %s -d %s\n", prog, f.name, fishQuote(f.usage))
+	}
+	for _, cmd := range commands {
+		cond := fishQuote("__fish_seen_subcommand_from " + cmd.name)
+		if len(cmd.words) > 0 {
+			fmt.Fprintf(&b, "complete -c %s -n %s -f -a %s\n", prog, cond, fishQuote(strings.Join(cmd.words, " ")))
+		}
+		for _, f := range commandFlags(cmd) {
+			fmt.Fprintf(&b, "complete -c %s -n %s -o %s -d %s\n", prog, cond, f.name, fishQuote(f.usage))
+		}
+	}
+	return b.String()
+}
+
+// psList renders words as a PowerShell array literal.
+func psList(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = "'" + strings.ReplaceAll(w, "'", "''") + "'"
+	}
+	return "@(" + strings.Join(quoted, ", ") + ")"
+}
+
+func powershellCompletion() string {
+	prog := programName()
+	var b strings.Builder
+	fmt.Fprintf(&b, "# PowerShell completion for %s\n", prog)
+	fmt.Fprintf(&b, "Register-ArgumentCompleter -Native -CommandName @('%s', '%s.exe') -ScriptBlock {\n", prog, prog)
+	b.WriteString("    param($wordToComplete, $commandAst, $cursorPosition)\n")
+	fmt.Fprintf(&b, "    $commands = %s\n", psList(commandNames()))
+	b.WriteString("    $flags = @{\n")
+	fmt.Fprintf(&b, "        '' = %s\n", psList(dashed(rootFlags())))
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "        '%s' = %s\n", cmd.name, psList(dashed(commandFlags(cmd))))
+	}
+	b.WriteString("    }\n")
+	b.WriteString("    $words = @{\n")
+	for _, cmd := range commands {
+		if len(cmd.words) > 0 {
+			fmt.Fprintf(&b, "        '%s' = %s\n", cmd.name, psList(cmd.words))
+		}
+	}
+	b.WriteString("    }\n")
+	b.WriteString("    $elements = @($commandAst.CommandElements | ForEach-Object { $_.ToString() })\n")
+	b.WriteString("    $count = $elements.Count\n")
+	b.WriteString("    if ($wordToComplete -ne '') { $count-- }\n")
+	b.WriteString("    $sub = ''\n")
+	b.WriteString("    if ($elements.Count -gt 1 -and $commands -contains $elements[1]) { $sub = $elements[1] }\n")
+	b.WriteString("    if ($wordToComplete.StartsWith('-')) {\n")
+	b.WriteString("        $candidates = $flags[$sub]\n")
+	b.WriteString("    } elseif ($count -eq 1) {\n")
+	b.WriteString("        $candidates = $commands\n")
+	b.WriteString("    } elseif ($count -eq 2 -and $words.ContainsKey($sub)) {\n")
+	b.WriteString("        $candidates = $words[$sub]\n")
+	b.WriteString("    } else {\n")
+	b.WriteString("        return\n")
+	b.WriteString("    }\n")
+	b.WriteString("    $candidates | Where-Object { $_ -like \"$wordToComplete*\" } | ForEach-Object {\n")
+	b.WriteString("        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)\n")
+	b.WriteString("    }\n")
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// compressOptions holds the flags of the compress subcommand.
+type compressOptions struct {
+	dir  string
+	out  string
+	jobs string
+	// config is the file of compression flags
+	config string
+
+	lowPriority bool
+	atomic      bool
+	splitSize   int
+	ifLocked    string
+	checkpoint  string
+	recursive   bool
+	workers     int
+
+	assertReadonly bool
+}
+
+func compressFlagSet(o *compressOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("compress", flag.ExitOnError)
+	registerInputOutput(fs, &o.dir, &o.out)
+	fs.StringVar(&o.dir, "dir", "", "same as -input")
+	fs.StringVar(&o.out, "out", "", "same as -output")
+	fs.StringVar(&o.jobs, "jobs", "", jobsUsage)
+	fs.BoolVar(&o.lowPriority, "low-priority", false, lowPriorityUsage)
+	fs.BoolVar(&o.atomic, "atomic", false, atomicUsage)
+	registerSplitOutput(fs, &o.splitSize)
+	registerCheckpoint(fs, &o.checkpoint)
+	registerRecursive(fs, &o.recursive)
+	registerWorkers(fs, &o.workers)
+	registerFilenameDirectives(fs)
+	registerBrackets(fs)
+	registerBursts(fs)
+	registerDedupe(fs)
+	registerIfLocked(fs, &o.ifLocked)
+	fs.BoolVar(&o.assertReadonly, "assert-readonly", false, readonlyUsage)
+	registerConfigFlag(fs, &o.config)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compress [-input dir] [-output dir] [flags] [file or dir ...]\n", programName())
+		fs.PrintDefaults()
+	}
+	registerCompressionFlags(fs)
+	return fs
+}
+
+// runCompress implements the compress subcommand: one batch over
+// directories and files, like running the binary without a subcommand but
+// without waiting for Enter at the end, so it can be scripted.
+func runCompress(args []string) error {
+	var opts compressOptions
+	fs := compressFlagSet(&opts)
+	if _, err := parseLayered(fs, args, &opts.config); err != nil {
+		return err
+	}
+	inputs, out, err := batchInputs(opts.dir, opts.out, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	var jobs []*jobEntry
+	if opts.jobs != "" {
+		var err error
+		if jobs, err = loadJobs(opts.jobs, currentSettings()); err != nil {
+			return err
+		}
+	}
+
+	printBanner("Starting")
+	applyLowPriority(opts.lowPriority)
+	printSettings()
+	if err := protectSources(opts.assertReadonly, inputs, batchWrites(out, opts.checkpoint)...); err != nil {
+		return err
+	}
+	lock, err := lockOutput(out, opts.ifLocked)
+	if skipLocked(err, opts.ifLocked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	valid, err := compressBatch(inputs, out, jobs, opts.atomic, opts.splitSize, opts.checkpoint, opts.recursive, opts.workers)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errors.New("sampled outputs failed validation")
+	}
+	return nil
+}
+
+const (
+	inputUsage  = "directory of images to compress; files and directories can also follow the flags (default: the binary's directory)"
+	outputUsage = "output directory (default: compressed inside the directory of the first input)"
+)
+
+// registerInputOutput registers -input and -output, storing their values
+// in input and output.
+func registerInputOutput(fs *flag.FlagSet, input, output *string) {
+	fs.StringVar(input, "input", "", inputUsage)
+	fs.StringVar(output, "output", "", outputUsage)
+}
+
+// batchInputs returns the images and directories a batch compresses, the
+// -input directory and then args, or the binary's directory if there are
+// neither, and the directory it writes to, output or the compressed
+// directory inside the first input's directory.
+func batchInputs(input, output string, args []string) ([]string, string, error) {
+	var inputs []string
+	if input != "" {
+		inputs = append(inputs, input)
+	}
+	inputs = append(inputs, args...)
+	if len(inputs) == 0 {
+		dir, err := executableDir()
+		if err != nil {
+			return nil, "", fmt.Errorf("getting executable path: %w", err)
+		}
+		inputs = append(inputs, dir)
+	}
+	for i, path := range inputs {
+		inputs[i] = longPath(path)
+	}
+	if output == "" {
+		dir := inputs[0]
+		if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+			dir = filepath.Dir(dir)
+		}
+		output = filepath.Join(dir, "compressed")
+	}
+	return inputs, longPath(output), nil
+}
+
+// protectSources makes every one of inputs read-only as protectSource
+// does.
+func protectSources(assert bool, inputs []string, writes ...string) error {
+	for _, input := range inputs {
+		if err := protectSource(assert, input, writes...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchWrites lists the paths a batch into out writes to besides out
+// itself: its lock, the -atomic staging and previous directories, the
+// report and the checkpoint.
+func batchWrites(out, checkpoint string) []string {
+	writes := []string{out, lockPath(out), stagingDir(out), previousDir(out)}
+	if reportPath != "" {
+		writes = append(writes, reportPath)
+	}
+	if checkpoint != "" {
+		writes = append(writes, checkpoint)
+	}
+	return writes
+}
+
+// compressBatch compresses inputs, images and every image directly in
+// directories, into compressedDir, applying the first of jobs that matches
+// each file relative to its input directory, prints a summary and writes
+// the report if one was asked for. It reports whether the outputs passed
+// -validate-sample. With recursive, the images in subdirectories are
+// compressed too, into the same subdirectories of compressedDir.
+//
+// With atomic set the batch is written to a staging directory instead,
+// which replaces compressedDir only if every file succeeds and the outputs
+// pass validation; otherwise compressedDir is left as it was. With
+// splitSize set, the outputs are distributed into parts of at most that many
+// bytes before that, and a batch that can't be split isn't swapped in.
+// Without splitSize, a -destination with a batch limit splits by that.
+//
+// Files given directly are one batch, and directories are read
+// scanBatchSize entries at a time, whose files are processed up to workers
+// at once. Unless the report, validation, splitting or atomic replacement
+// needs every result, only those flagged for review are kept, so memory
+// stays bounded however many files there are. With checkpointPath set,
+// finished files are recorded after every batch and skipped if the batch
+// is run again. With -brackets, -bursts or -dedupe-similar, the shots of
+// each batch are picked from before anything is skipped, so a resumed run
+// keeps the same ones.
+func compressBatch(inputs []string, compressedDir string, jobs []*jobEntry, atomic bool, splitSize int, checkpointPath string, recursive bool, workers int) (bool, error) {
+	if workers < 1 {
+		return false, errors.New("-workers must be at least 1")
+	}
+	if atomic && checkpointPath != "" {
+		return false, errors.New("-checkpoint can't resume an -atomic batch, which starts from an empty staging directory")
+	}
+	if splitSize == 0 {
+		splitSize = destinationBatchLimit
+	}
+	if recursive && splitSize > 0 {
+		return false, errors.New("-recursive can't be combined with -split-output or a -destination batch limit, whose parts would flatten the folders")
+	}
+	fmt.Printf("Processing images in: %s\n", strings.Join(inputs, ", "))
+
+	outDir := compressedDir
+	if atomic {
+		outDir = stagingDir(compressedDir)
+		// Whatever a previous failed batch left is stale now
+		if err := os.RemoveAll(outDir); err != nil {
+			return false, fmt.Errorf("clearing staging directory: %w", err)
+		}
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return false, fmt.Errorf("creating compressed directory: %w", err)
+	}
+	fmt.Printf("Output directory: %s\n", outDir)
+	fmt.Printf("Workers: up to %d\n", workers)
+	fmt.Println()
+
+	scanner, err := openSources(inputs, recursive, compressedDir, stagingDir(compressedDir), previousDir(compressedDir))
+	if err != nil {
+		return false, err
+	}
+	defer scanner.close()
+	checkpoint, err := openCheckpoint(checkpointPath)
+	if err != nil {
+		return false, err
+	}
+	if n := checkpoint.resumed(); n > 0 {
+		fmt.Printf("Resuming: %d file(s) finished by an earlier run are skipped\n\n", n)
+	}
+
+	keepAll := reportPath != "" || validateSample > 0 || splitSize > 0 || atomic
+	pause := new(batchPause)
+	stopControl := controlPause(pause, true)
+	processedCount := 0
+	skippedCount := 0
+	taggedCount := 0
+	leftOutCounts := make(map[string]int)
+	var results []fileResult
+	for {
+		batch, err := scanner.next()
+		if err == io.EOF {
+			break
+		}
+		batchDir := filepath.Join(outDir, batch.rel())
+		if err == nil {
+			err = os.MkdirAll(batchDir, 0755)
+		}
+		if err != nil {
+			stopControl()
+			checkpoint.close(false)
+			return false, fmt.Errorf("reading directory: %w", err)
+		}
+		paths := batch.paths
+		skip := make(map[string]leftOut)
+		merges := bracketFrames(paths, skip)
+		burstFrames(paths, skip)
+		similarShots(paths, skip)
+		clashes := nameClashes(paths, skip)
+		var pending []string
+		for _, path := range paths {
+			if !checkpoint.finished(path) {
+				pending = append(pending, path)
+			}
+		}
+		processBatch(pending, workers, pause.wait, func(path string) fileResult {
+			if left, ok := skip[path]; ok {
+				return skipShot(path, left)
+			}
+			if earlier, ok := clashes[path]; ok {
+				return failClash(path, earlier)
+			}
+			if frames, ok := merges[path]; ok {
+				mergeBracket(path, frames)
+				defer bracketMerges.Delete(path)
+			}
+			root := batch.root
+			if root == "" {
+				root = filepath.Dir(path)
+			}
+			return processJobFile(jobs, root, path, batchDir)
+		}, func(path string, result fileResult) {
+			if left, ok := skip[path]; ok {
+				if keepAll {
+					results = append(results, result)
+				}
+				leftOutCounts[left.what]++
+				checkpoint.record(path)
+				return
+			}
+			if keepAll || result.Review != "" {
+				results = append(results, result)
+			}
+			switch result.Outcome {
+			case outcomeCompressed:
+				processedCount++
+			case outcomeCopied:
+				skippedCount++
+			case outcomeSkipped:
+				taggedCount++
+			}
+			if result.Outcome != outcomeFailed {
+				checkpoint.record(path)
+			}
+		})
+		if err := checkpoint.save(); err != nil {
+			fmt.Printf("Error saving checkpoint: %v\n", err)
+		}
+	}
+	stopControl()
+	if err := checkpoint.close(true); err != nil {
+		fmt.Printf("Error closing checkpoint: %v\n", err)
+	}
+
+	if err := manifest.flush(); err != nil {
+		fmt.Printf("Error writing %s: %v\n", manifestName, err)
+	}
+	fmt.Printf("\nCompleted! Compressed %d images, copied %d images.\n", processedCount, skippedCount)
+	if taggedCount > 0 {
+		fmt.Printf("Skipped %d images tagged as processed.\n", taggedCount)
+	}
+	for _, summary := range leftOutSummaries {
+		if n := leftOutCounts[summary.what]; n > 0 {
+			fmt.Printf(summary.format, n)
+		}
+	}
+	printReview(results)
+	valid := validateSample == 0 || validateOutputs(results)
+	if splitSize > 0 {
+		results, err = splitOutputs(outDir, splitSize, results)
+	}
+	if atomic && err == nil {
+		if results, err = commitStaging(outDir, compressedDir, results, valid); err == nil {
+			outDir = compressedDir
+		}
+	}
+	fmt.Printf("All output saved to: %s\n", outDir)
+	if reportPath != "" {
+		if err := writeReport(reportPath, results); err != nil {
+			fmt.Printf("Error writing report: %v\n", err)
+		} else {
+			fmt.Printf("Report saved to: %s\n", reportPath)
+		}
+	}
+	return valid, err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// envPrefix starts the environment variables that set compression flags:
+// -target is IMAGE_COMPRESSOR_TARGET and -io-retry-delay is
+// IMAGE_COMPRESSOR_IO_RETRY_DELAY.
+const envPrefix = "IMAGE_COMPRESSOR_"
+
+// configEnv names a config file to use when -config isn't given.
+const configEnv = envPrefix + "CONFIG"
+
+const configUsage = "file of compression flags, one per line, overridden by the environment and command line (default $" + configEnv + ", or config in the user config directory if it exists)"
+
+func registerConfigFlag(fs *flag.FlagSet, path *string) {
+	fs.StringVar(path, "config", "", configUsage)
+}
+
+// envName is the environment variable for the flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// envValues returns the flags of fs set in the environment, by name.
+func envValues(fs *flag.FlagSet) []configValue {
+	var values []configValue
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			values = append(values, configValue{name: f.Name, value: value, source: "$" + envName(f.Name)})
+		}
+	})
+	return values
+}
+
+// userConfigPath is where the config file is looked for by default, or ""
+// if the system has no user config directory.
+func userConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, shortName, "config")
+}
+
+// defaultConfigPath returns the config file to use without -config: the
+// one named by the environment, or the user's if it exists, or "" for none.
+func defaultConfigPath() string {
+	if path := os.Getenv(configEnv); path != "" {
+		return longPath(path)
+	}
+	path := userConfigPath()
+	if path == "" {
+		return ""
+	}
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+var configActions = []string{"show"}
+
+// configOptions holds the flags of the config subcommand.
+type configOptions struct {
+	config string
+}
+
+func configFlagSet(o *configOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	registerConfigFlag(fs, &o.config)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s config show [-config file] [flags]\n", programName())
+		fs.PrintDefaults()
+	}
+	registerCompressionFlags(fs)
+	return fs
+}
+
+// runConfig implements the config subcommand. config show resolves the
+// settings the way any other command would with the same flags, and prints
+// each one with where its value came from.
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "show" {
+		return fmt.Errorf("usage: %s config %s [-config file] [flags]", programName(), strings.Join(configActions, "|"))
+	}
+	var opts configOptions
+	fs := configFlagSet(&opts)
+	layers, err := parseLayered(fs, args[1:], &opts.config)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected %q", fs.Arg(0))
+	}
+
+	switch {
+	case layers.path != "":
+		fmt.Printf("Config file: %s\n", layers.path)
+	case userConfigPath() != "":
+		fmt.Printf("Config file: none (create %s or set $%s)\n", userConfigPath(), configEnv)
+	default:
+		fmt.Printf("Config file: none (set $%s)\n", configEnv)
+	}
+	fmt.Printf("Environment: %s<FLAG>, e.g. %s\n", envPrefix, envName("target"))
+	fmt.Println("Precedence: command line, environment, config file, defaults")
+	fmt.Println()
+
+	var names []string
+	for name := range compressionFlagNames() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	width := 0
+	for _, name := range names {
+		width = max(width, len(name)+1)
+	}
+	for _, name := range names {
+		values := layers.values[name]
+		if len(values) == 0 {
+			fmt.Printf("  %-*s  %s (default)\n", width, "-"+name, flagDefault(fs.Lookup(name)))
+			continue
+		}
+		effective := values[len(values)-1]
+		fmt.Printf("  %-*s  %s (%s)\n", width, "-"+name, effective.value, effective.source)
+		for i := len(values) - 2; i >= 0; i-- {
+			fmt.Printf("  %-*s    overrides %s (%s)\n", width, "", values[i].value, values[i].source)
+		}
+	}
+	fmt.Println("\nEffective settings:")
+	printSettings()
+	return nil
+}
+
+// flagDefault is the default value shown for f in its usage: DefValue, or
+// the "(default X)" that flags without a plain value put in their usage.
+func flagDefault(f *flag.Flag) string {
+	if _, value, ok := strings.Cut(f.Usage, "(default "); ok {
+		return strings.TrimSuffix(value, ")")
+	}
+	if f.DefValue == "" {
+		return `""`
+	}
+	return f.DefValue
+}
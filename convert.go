@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"image-compressor/pkg/compressor"
+)
+
+// defaultConvertQuality is the JPEG and HEIC quality of convert outputs.
+const defaultConvertQuality = 85
+
+// convertEncoders encode an image, decoded from srcPath, in each format the
+// convert subcommand writes, at a quality where the format has one.
+var convertEncoders = map[string]func(img image.Image, srcPath string, quality int) ([]byte, error){
+	"jpeg": func(img image.Image, srcPath string, quality int) ([]byte, error) {
+		img = compressor.Flatten(img, flattenColor)
+		var buffer bytes.Buffer
+		if err := jpeg.Encode(&buffer, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+		meta := outputMetadata(srcPath, img)
+		setMetadataDimensions(meta, img.Bounds().Dx(), img.Bounds().Dy())
+		return insertJPEGSegments(buffer.Bytes(), meta), nil
+	},
+	"png": func(img image.Image, srcPath string, quality int) ([]byte, error) {
+		return encodePNG(img)
+	},
+	"gif": func(img image.Image, srcPath string, quality int) ([]byte, error) {
+		var buffer bytes.Buffer
+		err := gif.Encode(&buffer, quantize(img), nil)
+		return buffer.Bytes(), err
+	},
+	"tiff": func(img image.Image, srcPath string, quality int) ([]byte, error) {
+		var buffer bytes.Buffer
+		err := encodeTIFF(&buffer, img, readICCProfile(srcPath))
+		return buffer.Bytes(), err
+	},
+	"heic": func(img image.Image, srcPath string, quality int) ([]byte, error) {
+		return encodeHEIC(img, quality)
+	},
+}
+
+// convertExtensions are the extensions convert outputs get.
+var convertExtensions = map[string]string{
+	"jpeg": ".jpg", "png": ".png", "gif": ".gif", "tiff": ".tif", "heic": ".heic",
+}
+
+// convertOptions holds the flags of the convert subcommand.
+type convertOptions struct {
+	to      string
+	quality int
+	out     string
+}
+
+func convertFlagSet(o *convertOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	fs.StringVar(&o.to, "to", "", "output format: jpeg, png, gif, tiff or heic")
+	fs.IntVar(&o.quality, "quality", defaultConvertQuality, "JPEG and HEIC quality from 1 to 100")
+	fs.StringVar(&o.out, "out", "", "output directory (default: converted next to each image)")
+	fs.Func("flatten-color", "background that transparent areas are composited onto for JPEG: white, black, #rrggbb or #rgb (default white)", parseFlattenColor)
+	fs.BoolVar(&keepMetadata, "keep-metadata", false, "carry JPEG metadata over to JPEG outputs")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s convert -to format [-quality n] [-out dir] image|dir...\n", programName())
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// runConvert implements the convert subcommand: it re-encodes images in
+// another format at a fixed quality, without any target size.
+func runConvert(args []string) error {
+	var opts convertOptions
+	fs := convertFlagSet(&opts)
+	fs.Parse(args)
+	format := policyFormat(opts.to)
+	encode, ok := convertEncoders[format]
+	switch {
+	case opts.to == "":
+		fs.Usage()
+		return fmt.Errorf("need -to")
+	case format == "webp":
+		return fmt.Errorf("-to webp: this build has no WebP encoder; use jpeg, png, gif, tiff or heic")
+	case !ok:
+		return fmt.Errorf("-to %s: unknown format (want jpeg, png, gif, tiff or heic)", opts.to)
+	case format == "heic" && !heifSupported:
+		return fmt.Errorf("-to heic: %w", errHEICUnsupported)
+	case opts.quality < 1 || opts.quality > 100:
+		return fmt.Errorf("-quality must be between 1 and 100")
+	case fs.NArg() == 0:
+		fs.Usage()
+		return fmt.Errorf("no input images")
+	}
+	paths, err := imagePaths(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, path := range paths {
+		outDir := opts.out
+		if outDir == "" {
+			outDir = filepath.Join(filepath.Dir(path), "converted")
+		}
+		name := outputFileName(path)
+		outPath := filepath.Join(longPath(outDir), strings.TrimSuffix(name, filepath.Ext(name))+convertExtensions[format])
+		size, err := convertImage(path, outPath, format, encode, opts.quality)
+		if err != nil {
+			fmt.Printf("%s: ERROR: %v\n", filepath.Base(path), err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s -> %s (%s)\n", filepath.Base(path), outPath, formatSize(size))
+	}
+	fmt.Printf("\nConverted %d of %d images to %s.\n", len(paths)-failed, len(paths), format)
+	if failed > 0 {
+		return fmt.Errorf("%d image(s) failed", failed)
+	}
+	return nil
+}
+
+// convertImage decodes srcPath and writes it to dstPath in format, and
+// returns the size written.
+func convertImage(srcPath, dstPath, format string, encode func(image.Image, string, int) ([]byte, error), quality int) (int, error) {
+	if sameFile(srcPath, dstPath) {
+		return 0, fmt.Errorf("output would replace the source; use -out")
+	}
+	img, _, err := decodeImageFile(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	// TIFF keeps the source's color space and depth, with its profile
+	if format != "tiff" {
+		img = prepareForWeb(new(fileLog), srcPath, img)
+	}
+	data, err := encode(img, srcPath, quality)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return 0, err
+	}
+	return len(data), writeOutput(dstPath, data)
+}
+
+// sameFile reports whether a and b are the same existing file.
+func sameFile(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	return err == nil && os.SameFile(infoA, infoB)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// creditArtist and creditCopyright, set by -set-artist and -set-copyright,
+// are written into the EXIF and XMP of JPEG outputs, so that sets delivered
+// to clients carry their attribution. They replace whatever the source
+// recorded, and reach outputs whether or not -keep-metadata is set.
+var (
+	creditArtist    string
+	creditCopyright string
+)
+
+// IFD0 tags crediting the image.
+const (
+	tagArtist    = 0x13b
+	tagCopyright = 0x8298
+)
+
+// setsCredit reports whether -set-artist or -set-copyright is set.
+func setsCredit() bool {
+	return creditArtist != "" || creditCopyright != ""
+}
+
+// formatCredit describes -set-artist and -set-copyright for printSettings.
+func formatCredit() string {
+	var credit []string
+	if creditArtist != "" {
+		credit = append(credit, "artist "+creditArtist)
+	}
+	if creditCopyright != "" {
+		credit = append(credit, "copyright "+creditCopyright)
+	}
+	return strings.Join(credit, ", ")
+}
+
+// creditMetadata returns segments with the credit set in their EXIF and
+// XMP, adding an EXIF or XMP segment holding only the credit where there is
+// none.
+func creditMetadata(segments []jpegSegment) []jpegSegment {
+	if !setsCredit() {
+		return segments
+	}
+	var exif, xmp bool
+	for i, s := range segments {
+		switch metadataKind(s) {
+		case metaEXIF:
+			segments[i].data = creditEXIF(s.data)
+			exif = true
+		case metaXMP:
+			segments[i].data = creditXMP(s.data)
+			xmp = true
+		}
+	}
+	if !exif {
+		empty := append(append([]byte(nil), exifHeader...), "MM\x00\x2a\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00"...)
+		segments = append([]jpegSegment{{marker: 0xe1, data: creditEXIF(empty)}}, segments...)
+	}
+	if !xmp {
+		packet := `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?><x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+			creditDescription() + `</rdf:RDF></x:xmpmeta><?xpacket end="w"?>`
+		segments = append(segments, jpegSegment{marker: 0xe1, data: append(append([]byte(nil), xmpHeader...), packet...)})
+	}
+	return segments
+}
+
+// creditSegments returns the encoded segments of an output that carries no
+// metadata but the credit, or nil if none is set.
+func creditSegments() []byte {
+	return encodeSegments(creditMetadata(nil))
+}
+
+// creditEXIF returns an EXIF APP1 payload with the credit set in IFD0.
+// IFD0 is rewritten after the rest with the credit's fields added or
+// replaced, since growing it in place would move the data after it; all
+// other offsets stay valid. If the result would not fit in an APP1 segment
+// the payload is returned unchanged.
+func creditEXIF(payload []byte) []byte {
+	if !bytes.HasPrefix(payload, exifHeader) {
+		return payload
+	}
+	t, ifd0, ok := parseTIFF(payload[len(exifHeader):])
+	if !ok {
+		return payload
+	}
+	entries, next, ok := t.ifd(ifd0)
+	if !ok {
+		return payload
+	}
+	var fields []tiffField
+	for _, f := range []struct {
+		tag   uint16
+		value string
+	}{{tagArtist, creditArtist}, {tagCopyright, creditCopyright}} {
+		if f.value != "" {
+			data := []byte(f.value + "\x00")
+			fields = append(fields, tiffField{f.tag, tiffASCII, uint32(len(data)), data})
+		}
+	}
+
+	out := append([]byte(nil), payload...)
+	// IFD offsets must be even
+	if (len(out)-len(exifHeader))%2 == 1 {
+		out = append(out, 0)
+	}
+	ifd := uint32(len(out) - len(exifHeader))
+	var raws [][]byte
+	for _, e := range entries {
+		replaced := false
+		for _, f := range fields {
+			replaced = replaced || e.tag == f.tag
+		}
+		if !replaced {
+			raws = append(raws, t.buf[e.pos:e.pos+12])
+		}
+	}
+	valuePos := ifd + 2 + 12*uint32(len(raws)+len(fields)) + 4
+	var values []byte
+	for _, f := range fields {
+		raw := make([]byte, 12)
+		t.order.PutUint16(raw, f.tag)
+		t.order.PutUint16(raw[2:], f.kind)
+		t.order.PutUint32(raw[4:], f.count)
+		if len(f.data) <= 4 {
+			copy(raw[8:], f.data)
+		} else {
+			t.order.PutUint32(raw[8:], valuePos+uint32(len(values)))
+			values = append(values, f.data...)
+			if len(values)%2 == 1 {
+				values = append(values, 0)
+			}
+		}
+		raws = append(raws, raw)
+	}
+	// Tags must be in ascending order
+	sort.SliceStable(raws, func(i, j int) bool { return t.order.Uint16(raws[i]) < t.order.Uint16(raws[j]) })
+
+	count := make([]byte, 2)
+	t.order.PutUint16(count, uint16(len(raws)))
+	out = append(out, count...)
+	for _, raw := range raws {
+		out = append(out, raw...)
+	}
+	// The next IFD, holding the thumbnail, stays linked
+	out = append(out, t.buf[next:next+4]...)
+	out = append(out, values...)
+	if len(out) > maxAPP1Payload {
+		return payload
+	}
+	t.order.PutUint32(out[len(exifHeader)+4:], ifd)
+	return out
+}
+
+// xmpCreatorPattern and xmpRightsPattern match the XMP properties the
+// credit replaces.
+var (
+	xmpCreatorPattern = regexp.MustCompile(`(?s)<dc:creator\b.*?</dc:creator>`)
+	xmpRightsPattern  = regexp.MustCompile(`(?s)<dc:rights\b.*?</dc:rights>`)
+)
+
+// creditXMP returns an XMP APP1 payload with the properties the credit sets
+// removed and a description of its own holding them added. Payloads
+// without an RDF element, or that would no longer fit in an APP1 segment,
+// are returned unchanged.
+func creditXMP(payload []byte) []byte {
+	end := bytes.LastIndex(payload, []byte("</rdf:RDF>"))
+	if end < 0 {
+		return payload
+	}
+	out := append([]byte(nil), payload[:end]...)
+	if creditArtist != "" {
+		out = xmpCreatorPattern.ReplaceAll(out, nil)
+	}
+	if creditCopyright != "" {
+		out = xmpRightsPattern.ReplaceAll(out, nil)
+	}
+	out = append(out, creditDescription()...)
+	out = append(out, payload[end:]...)
+	if len(out) > maxAPP1Payload {
+		return payload
+	}
+	return out
+}
+
+// creditDescription returns an RDF description of the credit: the artist as
+// the Dublin Core creator and the copyright as its rights.
+func creditDescription() string {
+	var b strings.Builder
+	b.WriteString(`<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">`)
+	if creditArtist != "" {
+		fmt.Fprintf(&b, `<dc:creator><rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq></dc:creator>`, escapeXML(creditArtist))
+	}
+	if creditCopyright != "" {
+		fmt.Fprintf(&b, `<dc:rights><rdf:Alt><rdf:li xml:lang="x-default">%s</rdf:li></rdf:Alt></dc:rights>`, escapeXML(creditCopyright))
+	}
+	b.WriteString(`</rdf:Description>`)
+	return b.String()
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
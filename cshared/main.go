@@ -0,0 +1,148 @@
+// Command cshared builds the compressor package as a C shared library, so
+// services in Python, Node, Rust or anything else with a C FFI can compress
+// in-process instead of running the command line:
+//
+//	make cshared
+//
+// writes the library and its header, image-compressor.h, to dist/cshared.
+// Call it as:
+//
+//	ic_options opts = {0};
+//	opts.target_size = 500000;
+//	ic_output out;
+//	int status = ic_compress(buf, len, &opts, &out);
+//	if (status == IC_OK) { use out.data, out.len }
+//	else { report out.error }
+//	ic_free(&out);
+//
+// Zero options select the defaults. ic_compress returns IC_OK,
+// IC_CANNOT_MEET_TARGET when even the lowest quality is over the target
+// (out.data then holds that best effort) or IC_ERROR. Whatever it returns,
+// out must be released with ic_free. Calls may run concurrently.
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+enum {
+	IC_OK = 0,
+	IC_CANNOT_MEET_TARGET = 1,
+	IC_ERROR = 2,
+};
+
+typedef struct {
+	// Maximum output size in bytes.
+	int64_t target_size;
+	// Highest JPEG quality tried, from 1 to 100.
+	int max_quality;
+	// CPU time against output bytes, from 1 to 9.
+	int effort;
+	// Cap on the longer side in pixels.
+	int max_dimension;
+	// Nonzero to average colors in linear light when scaling down.
+	int linear_resize;
+	// Color transparent areas are flattened onto, as "#rrggbb"; NULL for
+	// white.
+	const char *background;
+} ic_options;
+
+typedef struct {
+	// The JPEG, or NULL.
+	uint8_t *data;
+	size_t len;
+	// The JPEG quality chosen.
+	int quality;
+	// Why compression failed, or NULL.
+	char *error;
+} ic_output;
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"unsafe"
+
+	"image-compressor/pkg/compressor"
+)
+
+// main is required by -buildmode=c-shared but never runs.
+func main() {}
+
+//export ic_compress
+func ic_compress(buf *C.uint8_t, length C.size_t, opts *C.ic_options, out *C.ic_output) C.int {
+	if out == nil {
+		return C.IC_ERROR
+	}
+	*out = C.ic_output{}
+	fail := func(err error) C.int {
+		out.error = C.CString(err.Error())
+		return C.IC_ERROR
+	}
+	if buf == nil {
+		return fail(errors.New("ic_compress needs an input buffer"))
+	}
+	o, err := optionsOf(opts)
+	if err != nil {
+		return fail(err)
+	}
+	quality := 0
+	o.Trace = func(a compressor.Attempt) {
+		if a.Fits {
+			quality = max(quality, a.Quality)
+		} else if a.Next == 0 && quality == 0 {
+			// The lowest quality, kept as the best effort
+			quality = a.Quality
+		}
+	}
+
+	data, err := compressor.CompressBytes(C.GoBytes(unsafe.Pointer(buf), C.int(length)), o)
+	if data != nil {
+		out.data = (*C.uint8_t)(C.CBytes(data))
+		out.len = C.size_t(len(data))
+		out.quality = C.int(quality)
+	}
+	switch {
+	case err == nil:
+		return C.IC_OK
+	case errors.Is(err, compressor.ErrCannotMeetTarget):
+		out.error = C.CString(err.Error())
+		return C.IC_CANNOT_MEET_TARGET
+	}
+	return fail(err)
+}
+
+//export ic_free
+func ic_free(out *C.ic_output) {
+	if out == nil {
+		return
+	}
+	C.free(unsafe.Pointer(out.data))
+	C.free(unsafe.Pointer(out.error))
+	*out = C.ic_output{}
+}
+
+// optionsOf converts C options to compressor.Options. A nil opts selects
+// the defaults.
+func optionsOf(opts *C.ic_options) (compressor.Options, error) {
+	var o compressor.Options
+	if opts == nil {
+		return o, nil
+	}
+	o.TargetSize = int(opts.target_size)
+	o.MaxQuality = int(opts.max_quality)
+	o.Effort = int(opts.effort)
+	o.MaxDimension = int(opts.max_dimension)
+	o.LinearResize = opts.linear_resize != 0
+	if opts.background != nil {
+		background := C.GoString(opts.background)
+		var r, g, b uint8
+		if _, err := fmt.Sscanf(background, "#%02x%02x%02x", &r, &g, &b); err != nil {
+			return o, fmt.Errorf("background %q is not #rrggbb", background)
+		}
+		o.Background = color.RGBA{R: r, G: g, B: b, A: 0xff}
+	}
+	return o, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxDecodePixels bounds the images that are decoded at all. A few hundred
+// bytes of crafted header can claim billions of pixels, and decoding that
+// would exhaust memory before anything could fail gracefully.
+const maxDecodePixels = 1 << 30
+
+// checkDecodeSize rejects image headers claiming more than maxDecodePixels.
+func checkDecodeSize(cfg image.Config) error {
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return fmt.Errorf("invalid dimensions %dx%d", cfg.Width, cfg.Height)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxDecodePixels {
+		return fmt.Errorf("%dx%d is too large to decode", cfg.Width, cfg.Height)
+	}
+	return nil
+}
+
+// decodeLimited decodes the image in r after checking its header with
+// checkDecodeSize.
+func decodeLimited(r io.ReadSeeker) (image.Image, string, error) {
+	cfg, _, err := decodeConfig(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkDecodeSize(cfg); err != nil {
+		return nil, "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	return decodeImage(r)
+}
+
+// decodeConfig is image.DecodeConfig, with the JPEGs image/jpeg doesn't
+// support read by decodeExtendedJPEGConfig.
+func decodeConfig(r io.ReadSeeker) (image.Config, string, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if !isUnsupportedJPEG(err) {
+		return cfg, format, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return image.Config{}, "", err
+	}
+	cfg, err = decodeExtendedJPEGConfig(r)
+	return cfg, "jpeg", err
+}
+
+// decodeImage is image.Decode, with the JPEGs image/jpeg doesn't support
+// decoded by decodeExtendedJPEG.
+func decodeImage(r io.ReadSeeker) (image.Image, string, error) {
+	img, format, err := image.Decode(r)
+	if !isUnsupportedJPEG(err) {
+		return img, format, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	img, err = decodeExtendedJPEG(r)
+	return img, "jpeg", err
+}
+
+// isUnsupportedJPEG reports whether err is image/jpeg rejecting a valid
+// JPEG it doesn't implement, such as a 12-bit or arithmetic-coded one.
+func isUnsupportedJPEG(err error) bool {
+	var unsupported jpeg.UnsupportedError
+	return errors.As(err, &unsupported)
+}
+
+// decodeImageFile decodes the image at path, HEIC included, and returns its
+// format.
+func decodeImageFile(path string) (image.Image, string, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".heic" || ext == ".heif" {
+		img, err := decodeHEIC(path)
+		return img, "heic", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	return decodeLimited(file)
+}
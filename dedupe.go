@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"image-compressor/pkg/compressor"
+)
+
+const dedupeUsage = "collapse near-identical shots whose SSIM reaches this similarity, e.g. 0.97, into their sharpest, best-exposed one, skipping the rest and listing them in the report (default off)"
+
+// dedupeSimilarity is the SSIM from which -dedupe-similar takes two shots
+// for the same one, or 0 when batches aren't deduplicated.
+var dedupeSimilarity float64
+
+// registerDedupe registers -dedupe-similar, which sets dedupeSimilarity.
+func registerDedupe(fs *flag.FlagSet) {
+	fs.Func("dedupe-similar", dedupeUsage, func(s string) error {
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || v < 0 || v > 1 {
+			return fmt.Errorf("invalid similarity %q, want an SSIM from 0 to 1", s)
+		}
+		dedupeSimilarity = v
+		return nil
+	})
+}
+
+// dedupeEdge is the long edge shots are compared at. Near-duplicates differ
+// in framing and expression, not in fine detail.
+const dedupeEdge = 128
+
+// dedupeHashDistance is how many of their 64 average hash bits two shots
+// may differ in and still be compared by SSIM, which is far slower.
+const dedupeHashDistance = 16
+
+// dedupeAspectTolerance is how much the aspect ratios of near-duplicates
+// may differ.
+const dedupeAspectTolerance = 0.05
+
+// shot is a source as similarShots compares it.
+type shot struct {
+	path   string
+	thumb  image.Image
+	hash   uint64
+	aspect float64
+	score  float64
+}
+
+// similarShots clusters paths, the images of one batch of directory
+// entries, into shots of the same scene if dedupeSimilarity is set, and
+// leaves out all but the one of each with the best shotScore in skip.
+// Sources skip has already are not considered. Duplicates split across two
+// batches are picked from separately.
+func similarShots(paths []string, skip map[string]leftOut) {
+	if dedupeSimilarity == 0 {
+		return
+	}
+	// Each cluster is compared by its first shot, so it can't drift through
+	// a series of shots that are each only a little different
+	var clusters [][]*shot
+	for _, path := range paths {
+		if _, ok := skip[path]; ok {
+			continue
+		}
+		s := loadShot(path)
+		if s == nil {
+			continue
+		}
+		found := false
+		for i, cluster := range clusters {
+			if similar(cluster[0], s) {
+				clusters[i] = append(cluster, s)
+				found = true
+				break
+			}
+		}
+		if !found {
+			clusters = append(clusters, []*shot{s})
+		}
+	}
+
+	for _, cluster := range clusters {
+		best := cluster[0]
+		for _, s := range cluster[1:] {
+			if s.score > best.score {
+				best = s
+			}
+		}
+		for _, s := range cluster {
+			if s != best {
+				leaveOut(skip, s.path, best.path, leftOutDuplicate)
+			}
+		}
+	}
+}
+
+// loadShot decodes the image at path for similarShots, or returns nil if
+// it can't, leaving it to fail when it is processed.
+func loadShot(path string) *shot {
+	img, _, err := decodeImageFile(path)
+	if err != nil {
+		return nil
+	}
+	bounds := img.Bounds()
+	thumb := compressor.Flatten(fitLongEdge(img, dedupeEdge), flattenColor)
+	return &shot{
+		path:   path,
+		thumb:  thumb,
+		hash:   averageHash(thumb),
+		aspect: float64(bounds.Dx()) / float64(max(bounds.Dy(), 1)),
+		score:  shotScore(img),
+	}
+}
+
+// similar reports whether a and b are shots of the same scene.
+func similar(a, b *shot) bool {
+	if math.Abs(a.aspect-b.aspect) > dedupeAspectTolerance*a.aspect ||
+		bits.OnesCount64(a.hash^b.hash) > dedupeHashDistance {
+		return false
+	}
+	return ssim(a.thumb, b.thumb) >= dedupeSimilarity
+}
+
+// averageHash returns a bit per cell of an 8x8 grid over img, set where
+// the cell is brighter than the image on average.
+func averageHash(img image.Image) uint64 {
+	luma, w, h := luminance(resizeImage(img, 8, 8))
+	var mean float64
+	for _, v := range luma {
+		mean += v
+	}
+	mean /= float64(w * h)
+	var hash uint64
+	for i, v := range luma {
+		if v > mean {
+			hash |= 1 << i
+		}
+	}
+	return hash
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// destinationsFeed is where destinations -update downloads the limits
+// database from. Branded builds can point it elsewhere with -ldflags
+// "-X main.destinationsFeed=...".
+var destinationsFeed = "https://raw.githubusercontent.com/hoangtrieu96/image-compressor/main/destinations.json"
+
+// destination is what a service accepts for images uploaded to it.
+type destination struct {
+	Name string `json:"name"`
+	// Hosts are the URL hosts that identify the service, subdomains
+	// included.
+	Hosts []string `json:"hosts,omitempty"`
+	// FileLimit is the largest image accepted, in bytes.
+	FileLimit int `json:"file_limit"`
+	// BatchLimit is the most one upload of several images may add up to,
+	// in bytes, or 0 if there is no such limit.
+	BatchLimit   int `json:"batch_limit,omitempty"`
+	MaxDimension int `json:"max_dimension,omitempty"`
+	// Source is where the limits are documented.
+	Source string `json:"source,omitempty"`
+}
+
+// destinationsFile is the limits database as published and cached.
+type destinationsFile struct {
+	Destinations []destination `json:"destinations"`
+}
+
+// builtinDestinations are the limits known at build time. destinations
+// -update fetches newer ones, which take precedence by name.
+var builtinDestinations = []destination{
+	{Name: "discord", Hosts: []string{"discord.com", "discordapp.com"}, FileLimit: 10 << 20},
+	{Name: "github", Hosts: []string{"github.com"}, FileLimit: 10 * 1000 * 1000},
+	{Name: "imgur", Hosts: []string{"imgur.com"}, FileLimit: 20 * 1000 * 1000},
+	{Name: "reddit", Hosts: []string{"reddit.com"}, FileLimit: 20 * 1000 * 1000},
+	{Name: "x", Hosts: []string{"x.com", "twitter.com"}, FileLimit: 5 * 1000 * 1000},
+	{Name: "gmail", Hosts: []string{"mail.google.com"}, FileLimit: 25 * 1000 * 1000, BatchLimit: 25 * 1000 * 1000},
+	{Name: "outlook", Hosts: []string{"outlook.com", "outlook.live.com", "outlook.office.com"}, FileLimit: 20 * 1000 * 1000, BatchLimit: 20 * 1000 * 1000},
+}
+
+// The destination in effect: its name, or "" for none, and its batch
+// limit, which batches split their outputs by unless -split-output says
+// otherwise.
+var (
+	destinationName       string
+	destinationBatchLimit int
+)
+
+const destinationUsage = "set -target, -max-dimension and the batch -split-output from a destination's limits: a name from the limits database (see the destinations command) or the URL of a service, which is looked up by host or asked for its limits (flags after it override it)"
+
+// destinationsCachePath is where destinations -update stores the database,
+// or "" if the system has no user cache directory.
+func destinationsCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, shortName, "destinations.json")
+}
+
+// knownDestinations returns the built-in limits with the downloaded ones,
+// if any, in their place, sorted by name.
+func knownDestinations() []destination {
+	byName := make(map[string]destination)
+	for _, d := range builtinDestinations {
+		byName[d.Name] = d
+	}
+	if path := destinationsCachePath(); path != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			var file destinationsFile
+			if json.Unmarshal(data, &file) == nil {
+				for _, d := range file.Destinations {
+					byName[d.Name] = d
+				}
+			}
+		}
+	}
+	known := make([]destination, 0, len(byName))
+	for _, d := range byName {
+		known = append(known, d)
+	}
+	sort.Slice(known, func(i, j int) bool { return known[i].Name < known[j].Name })
+	return known
+}
+
+// applyDestination sets the target, dimension cap and batch limit from the
+// destination named by s.
+func applyDestination(s string) error {
+	d, err := findDestination(s)
+	if err != nil {
+		return err
+	}
+	uploadLimit = d.FileLimit
+	updateTarget()
+	maxDimension = d.MaxDimension
+	destinationName = d.Name
+	destinationBatchLimit = d.BatchLimit
+	return nil
+}
+
+// findDestination resolves a -destination value: a name in the database,
+// or a URL whose host is in it or whose service reports its limits.
+func findDestination(s string) (destination, error) {
+	known := knownDestinations()
+	if !strings.Contains(s, "://") {
+		for _, d := range known {
+			if strings.EqualFold(d.Name, s) {
+				return d, nil
+			}
+		}
+		return destination{}, fmt.Errorf("unknown destination %q (see %s destinations, or give its URL)", s, programName())
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return destination{}, fmt.Errorf("destination %q isn't a URL", s)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, d := range known {
+		for _, h := range d.Hosts {
+			if host == h || strings.HasSuffix(host, "."+h) {
+				return d, nil
+			}
+		}
+	}
+	return probeDestination(u)
+}
+
+// probeClient asks services for their limits. Probing happens while flags
+// are parsed, so it mustn't hold up startup for long.
+var probeClient = &http.Client{Timeout: 10 * time.Second}
+
+// destinationProbes ask a service for its limits in the ways services
+// document them, returning errNoLimits if it doesn't answer that way.
+var destinationProbes = []func(u *url.URL) (destination, error){
+	probeMastodon,
+	probeTus,
+}
+
+var errNoLimits = errors.New("no limits reported")
+
+// probeDestination tries destinationProbes on u in order.
+func probeDestination(u *url.URL) (destination, error) {
+	for _, probe := range destinationProbes {
+		d, err := probe(u)
+		if err == nil {
+			d.Name = u.Host
+			return d, nil
+		}
+		if !errors.Is(err, errNoLimits) {
+			return destination{}, fmt.Errorf("probing %s: %w", u.Host, err)
+		}
+	}
+	return destination{}, fmt.Errorf("%s isn't in the limits database and doesn't report its limits; pass -target instead", u.Host)
+}
+
+// probeMastodon reads the media limits Mastodon and compatible servers
+// publish in their instance information.
+func probeMastodon(u *url.URL) (destination, error) {
+	resp, err := probeClient.Get(u.Scheme + "://" + u.Host + "/api/v2/instance")
+	if err != nil {
+		return destination{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return destination{}, errNoLimits
+	}
+	var instance struct {
+		Configuration struct {
+			MediaAttachments struct {
+				ImageSizeLimit int `json:"image_size_limit"`
+			} `json:"media_attachments"`
+		} `json:"configuration"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&instance); err != nil {
+		return destination{}, errNoLimits
+	}
+	limit := instance.Configuration.MediaAttachments.ImageSizeLimit
+	if limit <= 0 {
+		return destination{}, errNoLimits
+	}
+	return destination{FileLimit: limit, Source: u.Host + "/api/v2/instance"}, nil
+}
+
+// probeTus reads the Tus-Max-Size a tus resumable upload endpoint sends in
+// reply to OPTIONS.
+func probeTus(u *url.URL) (destination, error) {
+	req, err := http.NewRequest(http.MethodOptions, u.String(), nil)
+	if err != nil {
+		return destination{}, err
+	}
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return destination{}, err
+	}
+	resp.Body.Close()
+	limit, err := strconv.Atoi(resp.Header.Get("Tus-Max-Size"))
+	if err != nil || limit <= 0 {
+		return destination{}, errNoLimits
+	}
+	return destination{FileLimit: limit, Source: u.String() + " Tus-Max-Size"}, nil
+}
+
+// destinationsOptions holds the flags of the destinations subcommand.
+type destinationsOptions struct {
+	update bool
+	feed   string
+	probe  string
+}
+
+func destinationsFlagSet(o *destinationsOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("destinations", flag.ExitOnError)
+	fs.BoolVar(&o.update, "update", false, "download the latest limits database first")
+	fs.StringVar(&o.feed, "feed", destinationsFeed, "limits database URL")
+	fs.StringVar(&o.probe, "probe", "", "show the limits -destination would use for this name or URL instead of listing them all")
+	return fs
+}
+
+// runDestinations implements the destinations subcommand, which lists the
+// upload limits -destination knows and keeps them up to date.
+func runDestinations(args []string) error {
+	var opts destinationsOptions
+	destinationsFlagSet(&opts).Parse(args)
+
+	if opts.update {
+		if err := updateDestinations(opts.feed); err != nil {
+			return fmt.Errorf("updating limits: %w", err)
+		}
+	}
+	if opts.probe != "" {
+		d, err := findDestination(opts.probe)
+		if err != nil {
+			return err
+		}
+		printDestination(d)
+		return nil
+	}
+	for _, d := range knownDestinations() {
+		printDestination(d)
+	}
+	return nil
+}
+
+// updateDestinations downloads the limits database from feed and caches
+// it where knownDestinations reads it.
+func updateDestinations(feed string) error {
+	path := destinationsCachePath()
+	if path == "" {
+		return errors.New("no user cache directory to keep it in")
+	}
+	data, err := download(feed)
+	if err != nil {
+		return err
+	}
+	var file destinationsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s: %w", feed, err)
+	}
+	for _, d := range file.Destinations {
+		if d.Name == "" || d.FileLimit <= 0 {
+			return fmt.Errorf("%s: destination %q has no name or file limit", feed, d.Name)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := writeOutput(path, data); err != nil {
+		return err
+	}
+	fmt.Printf("Updated %d destination(s) from %s\n\n", len(file.Destinations), feed)
+	return nil
+}
+
+func printDestination(d destination) {
+	fmt.Printf("%s: %s per file", d.Name, formatSize(d.FileLimit))
+	if d.BatchLimit > 0 {
+		fmt.Printf(", %s per batch", formatSize(d.BatchLimit))
+	}
+	if d.MaxDimension > 0 {
+		fmt.Printf(", %d px", d.MaxDimension)
+	}
+	fmt.Println()
+	if len(d.Hosts) > 0 {
+		fmt.Printf("  hosts: %s\n", strings.Join(d.Hosts, ", "))
+	}
+	if d.Source != "" {
+		fmt.Printf("  source: %s\n", d.Source)
+	}
+}
@@ -0,0 +1,805 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// dicomTag is a DICOM data element tag, its group in the high 16 bits.
+type dicomTag uint32
+
+// The data elements DICOM previews are made from.
+const (
+	dicomTransferSyntax      dicomTag = 0x00020010
+	dicomSamplesPerPixel     dicomTag = 0x00280002
+	dicomPhotometric         dicomTag = 0x00280004
+	dicomPlanarConfiguration dicomTag = 0x00280006
+	dicomNumberOfFrames      dicomTag = 0x00280008
+	dicomRows                dicomTag = 0x00280010
+	dicomColumns             dicomTag = 0x00280011
+	dicomBitsAllocated       dicomTag = 0x00280100
+	dicomBitsStored          dicomTag = 0x00280101
+	dicomPixelRepresentation dicomTag = 0x00280103
+	dicomBurnedInAnnotation  dicomTag = 0x00280301
+	dicomWindowCenter        dicomTag = 0x00281050
+	dicomWindowWidth         dicomTag = 0x00281051
+	dicomRescaleIntercept    dicomTag = 0x00281052
+	dicomRescaleSlope        dicomTag = 0x00281053
+	dicomPixelData           dicomTag = 0x7fe00010
+	dicomItem                dicomTag = 0xfffee000
+	dicomItemDelimiter       dicomTag = 0xfffee00d
+	dicomSequenceDelimiter   dicomTag = 0xfffee0dd
+)
+
+// Transfer syntaxes that change how the data set is read. The others
+// encapsulate compressed pixel data in explicit VR little endian.
+const (
+	implicitLittleEndian = "1.2.840.10008.1.2"
+	explicitLittleEndian = "1.2.840.10008.1.2.1"
+	deflatedLittleEndian = "1.2.840.10008.1.2.1.99"
+	explicitBigEndian    = "1.2.840.10008.1.2.2"
+	rleLossless          = "1.2.840.10008.1.2.5"
+)
+
+// undefinedLength marks elements whose end is a delimiter item instead.
+const undefinedLength = 0xffffffff
+
+var errNotDICOM = errors.New("not a DICOM file (no DICM prefix)")
+
+// isDICOM reports whether the file at path starts like a DICOM Part 10
+// file: a 128-byte preamble and "DICM".
+func isDICOM(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	header := make([]byte, 132)
+	_, err = io.ReadFull(file, header)
+	return err == nil && string(header[128:]) == "DICM"
+}
+
+// dicomReader reads data elements from a DICOM data set.
+type dicomReader struct {
+	data     []byte
+	pos      int
+	order    binary.ByteOrder
+	explicit bool
+}
+
+// longVRs are the explicit VRs with a 4-byte length after 2 reserved bytes.
+var longVRs = map[string]bool{
+	"OB": true, "OD": true, "OF": true, "OL": true, "OV": true, "OW": true,
+	"SQ": true, "SV": true, "UC": true, "UN": true, "UR": true, "UT": true, "UV": true,
+}
+
+// element reads the next element's header and returns its tag, VR ("" in
+// implicit VR and for items) and length, leaving pos at its value.
+func (r *dicomReader) element() (dicomTag, string, uint32, error) {
+	if len(r.data)-r.pos < 8 {
+		return 0, "", 0, io.ErrUnexpectedEOF
+	}
+	tag := dicomTag(r.order.Uint16(r.data[r.pos:]))<<16 | dicomTag(r.order.Uint16(r.data[r.pos+2:]))
+	r.pos += 4
+	if tag>>16 == 0xfffe || !r.explicit {
+		length := r.order.Uint32(r.data[r.pos:])
+		r.pos += 4
+		return tag, "", length, nil
+	}
+	vr := string(r.data[r.pos : r.pos+2])
+	if !longVRs[vr] {
+		length := uint32(r.order.Uint16(r.data[r.pos+2:]))
+		r.pos += 4
+		return tag, vr, length, nil
+	}
+	if len(r.data)-r.pos < 8 {
+		return 0, "", 0, io.ErrUnexpectedEOF
+	}
+	length := r.order.Uint32(r.data[r.pos+4:])
+	r.pos += 8
+	return tag, vr, length, nil
+}
+
+// value returns the next length bytes.
+func (r *dicomReader) value(length uint32) ([]byte, error) {
+	if uint64(length) > uint64(len(r.data)-r.pos) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	v := r.data[r.pos : r.pos+int(length)]
+	r.pos += int(length)
+	return v, nil
+}
+
+// skipUntil skips elements, nested sequences and items included, up to and
+// past the delimiter end.
+func (r *dicomReader) skipUntil(end dicomTag) error {
+	for {
+		tag, vr, length, err := r.element()
+		if err != nil {
+			return err
+		}
+		if tag == end {
+			return nil
+		}
+		if length != undefinedLength {
+			if _, err := r.value(length); err != nil {
+				return err
+			}
+			continue
+		}
+		if tag == dicomItem {
+			err = r.skipUntil(dicomItemDelimiter)
+		} else if vr == "UN" {
+			// An unknown VR of undefined length holds implicit VR data
+			explicit := r.explicit
+			r.explicit = false
+			err = r.skipUntil(dicomSequenceDelimiter)
+			r.explicit = explicit
+		} else {
+			err = r.skipUntil(dicomSequenceDelimiter)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dicomFile is the image of a DICOM file: its pixel module and the values
+// that turn stored pixels into displayed ones.
+type dicomFile struct {
+	transferSyntax string
+	order          binary.ByteOrder
+
+	rows, columns int
+	frames        int
+	samples       int
+	photometric   string
+	planar        bool
+	bitsAllocated int
+	bitsStored    int
+	signed        bool
+
+	slope, intercept          float64
+	windowCenter, windowWidth float64
+	burnedIn                  bool
+
+	// native is uncompressed pixel data; fragments are the compressed
+	// frames of encapsulated pixel data instead
+	native    []byte
+	fragments [][]byte
+}
+
+// readDICOM parses the DICOM Part 10 file in data up to its pixel data.
+func readDICOM(data []byte) (*dicomFile, error) {
+	if len(data) < 132 || string(data[128:132]) != "DICM" {
+		return nil, errNotDICOM
+	}
+	// The file meta information is always explicit VR little endian
+	r := &dicomReader{data: data, pos: 132, order: binary.LittleEndian, explicit: true}
+	d := &dicomFile{frames: 1, samples: 1, slope: 1, photometric: "MONOCHROME2"}
+	for r.pos+2 <= len(data) && binary.LittleEndian.Uint16(data[r.pos:]) == 0x0002 {
+		tag, _, length, err := r.element()
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.value(length)
+		if err != nil {
+			return nil, err
+		}
+		if tag == dicomTransferSyntax {
+			d.transferSyntax = dicomString(value)
+		}
+	}
+
+	switch d.transferSyntax {
+	case implicitLittleEndian:
+		r.explicit = false
+	case explicitBigEndian:
+		r.order = binary.BigEndian
+	case deflatedLittleEndian:
+		inflated, err := io.ReadAll(flate.NewReader(bytes.NewReader(data[r.pos:])))
+		if err != nil {
+			return nil, fmt.Errorf("inflating data set: %w", err)
+		}
+		r.data, r.pos = inflated, 0
+	}
+	d.order = r.order
+
+	values := make(map[dicomTag][]byte)
+	for {
+		if r.pos >= len(r.data) {
+			return nil, errors.New("no pixel data")
+		}
+		tag, _, length, err := r.element()
+		if err != nil {
+			return nil, err
+		}
+		if tag == dicomPixelData {
+			if length == undefinedLength {
+				if d.fragments, err = readFragments(r); err != nil {
+					return nil, fmt.Errorf("reading pixel data: %w", err)
+				}
+			} else if d.native, err = r.value(length); err != nil {
+				return nil, fmt.Errorf("reading pixel data: %w", err)
+			}
+			break
+		}
+		if length == undefinedLength {
+			if err := r.skipUntil(dicomSequenceDelimiter); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		value, err := r.value(length)
+		if err != nil {
+			return nil, err
+		}
+		values[tag] = value
+	}
+
+	unsigned := func(tag dicomTag, def int) int {
+		if v := values[tag]; len(v) >= 2 {
+			return int(r.order.Uint16(v))
+		}
+		return def
+	}
+	decimal := func(tag dicomTag, def float64) float64 {
+		// Multi-valued strings, such as several windows, give their first
+		first, _, _ := strings.Cut(dicomString(values[tag]), `\`)
+		if f, err := strconv.ParseFloat(strings.TrimSpace(first), 64); err == nil {
+			return f
+		}
+		return def
+	}
+	d.rows = unsigned(dicomRows, 0)
+	d.columns = unsigned(dicomColumns, 0)
+	if n, err := strconv.Atoi(dicomString(values[dicomNumberOfFrames])); err == nil {
+		d.frames = max(n, 1)
+	}
+	d.samples = unsigned(dicomSamplesPerPixel, 1)
+	d.planar = unsigned(dicomPlanarConfiguration, 0) == 1
+	d.bitsAllocated = unsigned(dicomBitsAllocated, 8)
+	d.bitsStored = unsigned(dicomBitsStored, d.bitsAllocated)
+	d.signed = unsigned(dicomPixelRepresentation, 0) == 1
+	if p := dicomString(values[dicomPhotometric]); p != "" {
+		d.photometric = p
+	}
+	d.slope = decimal(dicomRescaleSlope, 1)
+	d.intercept = decimal(dicomRescaleIntercept, 0)
+	d.windowCenter = decimal(dicomWindowCenter, 0)
+	d.windowWidth = decimal(dicomWindowWidth, 0)
+	d.burnedIn = dicomString(values[dicomBurnedInAnnotation]) == "YES"
+	if d.transferSyntax == rleLossless {
+		// frameData decodes RLE to little endian sample planes
+		d.planar = d.samples > 1
+		d.order = binary.LittleEndian
+	}
+
+	switch {
+	case d.rows <= 0 || d.columns <= 0:
+		return nil, errors.New("no image dimensions")
+	case d.samples != 1 && d.samples != 3:
+		return nil, fmt.Errorf("%d samples per pixel aren't supported", d.samples)
+	case d.bitsAllocated != 8 && d.bitsAllocated != 16 && d.bitsAllocated != 32:
+		return nil, fmt.Errorf("%d bits allocated per sample aren't supported", d.bitsAllocated)
+	case d.bitsStored < 1 || d.bitsStored > d.bitsAllocated:
+		return nil, fmt.Errorf("invalid bits stored %d", d.bitsStored)
+	}
+	return d, nil
+}
+
+// readFragments reads encapsulated pixel data and returns its frames. The
+// first item is the basic offset table, which locates each frame's
+// fragments; without one, each fragment is a frame if the counts match, and
+// otherwise frames start at fragments that start with a JPEG or JPEG 2000
+// marker.
+func readFragments(r *dicomReader) ([][]byte, error) {
+	var offsets []uint32
+	var fragments [][]byte
+	var positions []uint32
+	position := uint32(0)
+	for first := true; ; first = false {
+		tag, _, length, err := r.element()
+		if err != nil {
+			return nil, err
+		}
+		if tag == dicomSequenceDelimiter {
+			break
+		}
+		if tag != dicomItem || length == undefinedLength {
+			return nil, fmt.Errorf("unexpected element %08x in encapsulated pixel data", uint32(tag))
+		}
+		value, err := r.value(length)
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			for i := 0; i+4 <= len(value); i += 4 {
+				offsets = append(offsets, binary.LittleEndian.Uint32(value[i:]))
+			}
+			continue
+		}
+		fragments = append(fragments, value)
+		positions = append(positions, position)
+		position += 8 + length
+	}
+	if len(fragments) == 0 {
+		return nil, errors.New("no fragments")
+	}
+
+	var frames [][]byte
+	startsFrame := func(i int) bool {
+		if len(offsets) > 0 {
+			for _, o := range offsets {
+				if o == positions[i] {
+					return true
+				}
+			}
+			return false
+		}
+		f := fragments[i]
+		return len(f) >= 4 && (f[0] == 0xff && f[1] == 0xd8 && f[2] == 0xff || string(f[:4]) == jpeg2000Signatures[1])
+	}
+	for i, f := range fragments {
+		if i == 0 || startsFrame(i) {
+			frames = append(frames, nil)
+		}
+		frames[len(frames)-1] = append(frames[len(frames)-1], f...)
+	}
+	return frames, nil
+}
+
+// dicomString is a string value without its padding.
+func dicomString(v []byte) string {
+	return strings.TrimRight(strings.TrimSpace(string(v)), "\x00")
+}
+
+// grayscale reports whether the image is monochrome, so window/level
+// applies.
+func (d *dicomFile) grayscale() bool {
+	return d.photometric == "MONOCHROME1" || d.photometric == "MONOCHROME2"
+}
+
+// frameCount is how many frames the file holds.
+func (d *dicomFile) frameCount() int {
+	if d.fragments != nil {
+		return len(d.fragments)
+	}
+	return d.frames
+}
+
+// frameData returns frame i as uncompressed samples in d.order, interleaved
+// unless d.planar, decoding RLE fragments. It returns nil, nil for frames
+// in other compressed syntaxes, which frameImage decodes.
+func (d *dicomFile) frameData(i int) ([]byte, error) {
+	sampleBytes := d.bitsAllocated / 8
+	size := d.rows * d.columns * d.samples * sampleBytes
+	if d.photometric == "YBR_FULL_422" && d.fragments == nil {
+		size = d.rows * d.columns * 2 * sampleBytes
+	}
+	if d.fragments == nil {
+		if len(d.native) < (i+1)*size {
+			return nil, fmt.Errorf("pixel data is too short for frame %d", i+1)
+		}
+		return d.native[i*size : (i+1)*size], nil
+	}
+	if d.transferSyntax != rleLossless {
+		return nil, nil
+	}
+	planes, err := decodeDICOMRLE(d.fragments[i], d.samples*sampleBytes, d.rows*d.columns)
+	if err != nil {
+		return nil, err
+	}
+	// Segments hold each sample's bytes most significant first; reassemble
+	// them little endian, one sample plane after the other
+	out := make([]byte, size)
+	pixels := d.rows * d.columns
+	for s := 0; s < d.samples; s++ {
+		for b := 0; b < sampleBytes; b++ {
+			plane := planes[s*sampleBytes+b]
+			for p := 0; p < pixels; p++ {
+				out[(s*pixels+p)*sampleBytes+sampleBytes-1-b] = plane[p]
+			}
+		}
+	}
+	return out, nil
+}
+
+// decodeDICOMRLE decodes a DICOM RLE frame into its segments of n bytes.
+func decodeDICOMRLE(data []byte, segments, n int) ([][]byte, error) {
+	if len(data) < 64 || int(binary.LittleEndian.Uint32(data)) != segments {
+		return nil, errors.New("RLE header doesn't match the image")
+	}
+	out := make([][]byte, segments)
+	for s := range out {
+		start := int(binary.LittleEndian.Uint32(data[4+4*s:]))
+		end := len(data)
+		if s+1 < segments {
+			end = int(binary.LittleEndian.Uint32(data[8+4*s:]))
+		}
+		if start < 64 || start > end || end > len(data) {
+			return nil, errors.New("invalid RLE segment offsets")
+		}
+		src := data[start:end]
+		segment := make([]byte, 0, n)
+		for len(src) > 0 && len(segment) < n {
+			count := int(int8(src[0]))
+			src = src[1:]
+			switch {
+			case count >= 0 && len(src) > count:
+				segment = append(segment, src[:count+1]...)
+				src = src[count+1:]
+			case count >= -127 && count < 0 && len(src) > 0:
+				segment = append(segment, bytes.Repeat(src[:1], 1-count)...)
+				src = src[1:]
+			case count != -128:
+				src = nil
+			}
+		}
+		if len(segment) < n {
+			return nil, errors.New("RLE segment is too short")
+		}
+		out[s] = segment[:n]
+	}
+	return out, nil
+}
+
+// dicomWindow is a window/level: the center and width of the range of
+// values shown from black to white.
+type dicomWindow struct {
+	center, width float64
+}
+
+// dicomWindowPresets are common CT windows, by name.
+var dicomWindowPresets = map[string]dicomWindow{
+	"brain":       {40, 80},
+	"soft-tissue": {40, 400},
+	"liver":       {30, 150},
+	"lung":        {-600, 1500},
+	"bone":        {400, 1800},
+}
+
+// parseDICOMWindow parses a -window value: center,width or a preset name.
+func parseDICOMWindow(s string) (dicomWindow, error) {
+	if w, ok := dicomWindowPresets[strings.ToLower(s)]; ok {
+		return w, nil
+	}
+	center, width, ok := strings.Cut(s, ",")
+	c, err1 := strconv.ParseFloat(strings.TrimSpace(center), 64)
+	w, err2 := strconv.ParseFloat(strings.TrimSpace(width), 64)
+	if !ok || err1 != nil || err2 != nil || w < 1 {
+		return dicomWindow{}, fmt.Errorf("invalid window %q, expected CENTER,WIDTH such as 40,400 or one of brain, soft-tissue, liver, lung, bone", s)
+	}
+	return dicomWindow{c, w}, nil
+}
+
+// frameImage returns frame i for display: color frames as they are, and
+// grayscale ones rescaled to modality values and mapped through window,
+// or, if it's zero, the file's own window or else the frame's full range.
+func (d *dicomFile) frameImage(i int, window dicomWindow) (image.Image, error) {
+	data, err := d.frameData(i)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return d.decodeFragment(i, window)
+	}
+	if !d.grayscale() {
+		return d.colorImage(data)
+	}
+
+	pixels := d.rows * d.columns
+	values := make([]float64, pixels)
+	mask := uint32(1)<<d.bitsStored - 1
+	sampleBytes := d.bitsAllocated / 8
+	for p := range values {
+		var raw uint32
+		switch sampleBytes {
+		case 1:
+			raw = uint32(data[p])
+		case 2:
+			raw = uint32(d.order.Uint16(data[2*p:]))
+		default:
+			raw = d.order.Uint32(data[4*p:])
+		}
+		raw &= mask
+		stored := int64(raw)
+		if d.signed && raw&(1<<(d.bitsStored-1)) != 0 {
+			stored -= int64(mask) + 1
+		}
+		values[p] = float64(stored)*d.slope + d.intercept
+	}
+	return d.windowed(values, window), nil
+}
+
+// decodeFragment decodes compressed frame i with the image decoders: JPEG,
+// its 12-bit variant, and JPEG 2000 in builds with libopenjp2.
+func (d *dicomFile) decodeFragment(i int, window dicomWindow) (image.Image, error) {
+	img, _, err := decodeImage(bytes.NewReader(d.fragments[i]))
+	if err != nil {
+		return nil, fmt.Errorf("frame %d (transfer syntax %s): %w", i+1, d.transferSyntax, err)
+	}
+	if !d.grayscale() {
+		return img, nil
+	}
+	// Decoders scale samples to 16 bits; undo that to get stored values
+	bounds := img.Bounds()
+	maxStored := float64(uint32(1)<<d.bitsStored - 1)
+	values := make([]float64, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray := color.Gray16Model.Convert(img.At(x, y)).(color.Gray16).Y
+			stored := math.Round(float64(gray) * maxStored / 0xffff)
+			if d.signed {
+				stored -= (maxStored + 1) / 2
+			}
+			values = append(values, stored*d.slope+d.intercept)
+		}
+	}
+	if len(values) != d.rows*d.columns {
+		return nil, fmt.Errorf("frame %d is %dx%d, not %dx%d", i+1, bounds.Dx(), bounds.Dy(), d.columns, d.rows)
+	}
+	return d.windowed(values, window), nil
+}
+
+// windowed maps modality values to an 8-bit grayscale image through a
+// linear window/level, as DICOM defines it, inverting MONOCHROME1.
+func (d *dicomFile) windowed(values []float64, window dicomWindow) *image.Gray {
+	if window.width == 0 && d.windowWidth >= 1 {
+		window = dicomWindow{d.windowCenter, d.windowWidth}
+	}
+	if window.width == 0 {
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for _, v := range values {
+			lo, hi = min(lo, v), max(hi, v)
+		}
+		window = dicomWindow{(lo + hi + 1) / 2, max(hi-lo+1, 1)}
+	}
+	img := image.NewGray(image.Rect(0, 0, d.columns, d.rows))
+	low := window.center - 0.5 - (window.width-1)/2
+	high := window.center - 0.5 + (window.width-1)/2
+	for p, v := range values {
+		var y float64
+		switch {
+		case v <= low:
+			y = 0
+		case v > high:
+			y = 255
+		default:
+			y = ((v-(window.center-0.5))/(window.width-1) + 0.5) * 255
+		}
+		if d.photometric == "MONOCHROME1" {
+			y = 255 - y
+		}
+		img.Pix[p] = uint8(min(max(math.Round(y), 0), 255))
+	}
+	return img
+}
+
+// colorImage converts uncompressed RGB or YBR samples to an image.
+func (d *dicomFile) colorImage(data []byte) (image.Image, error) {
+	sampleBytes := d.bitsAllocated / 8
+	pixels := d.rows * d.columns
+	sample := func(index int) float64 {
+		switch sampleBytes {
+		case 1:
+			return float64(data[index])
+		case 2:
+			return float64(d.order.Uint16(data[2*index:])) / 257
+		}
+		return float64(d.order.Uint32(data[4*index:])) / 16843009
+	}
+	img := image.NewRGBA(image.Rect(0, 0, d.columns, d.rows))
+	for p := 0; p < pixels; p++ {
+		var a, b, c float64
+		switch {
+		case d.photometric == "YBR_FULL_422":
+			// Two lumas share a Cb and Cr: Y1 Y2 Cb Cr
+			pair := p / 2 * 4
+			a, b, c = sample(pair+p%2), sample(pair+2), sample(pair+3)
+		case d.planar:
+			a, b, c = sample(p), sample(pixels+p), sample(2*pixels+p)
+		default:
+			a, b, c = sample(3*p), sample(3*p+1), sample(3*p+2)
+		}
+		switch d.photometric {
+		case "RGB":
+		case "YBR_FULL", "YBR_FULL_422":
+			a, b, c = a+1.402*(c-128), a-0.344136*(b-128)-0.714136*(c-128), a+1.772*(b-128)
+		default:
+			return nil, fmt.Errorf("photometric interpretation %s isn't supported", d.photometric)
+		}
+		img.Pix[4*p] = uint8(min(max(math.Round(a), 0), 255))
+		img.Pix[4*p+1] = uint8(min(max(math.Round(b), 0), 255))
+		img.Pix[4*p+2] = uint8(min(max(math.Round(c), 0), 255))
+		img.Pix[4*p+3] = 0xff
+	}
+	return img, nil
+}
+
+// dicomOptions holds the flags of the dicom subcommand.
+type dicomOptions struct {
+	out    string
+	format string
+	window string
+	frame  int
+	config string
+}
+
+func dicomFlagSet(o *dicomOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("dicom", flag.ExitOnError)
+	fs.StringVar(&o.out, "out", "", "output directory, mirroring the folders given (default: previews next to each file)")
+	fs.StringVar(&o.format, "format", "jpeg", "preview format: jpeg, or png, which is converted to JPEG if it's over the target")
+	fs.StringVar(&o.window, "window", "", "window/level for grayscale images as CENTER,WIDTH, e.g. 40,400, or brain, soft-tissue, liver, lung or bone (default: the file's own window, or the full range)")
+	fs.IntVar(&o.frame, "frame", 1, "frame of multi-frame images to extract, or 0 for every frame")
+	registerConfigFlag(fs, &o.config)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s dicom [-out dir] [-format jpeg|png] [-window c,w] [flags] file|dir...\n", programName())
+		fs.PrintDefaults()
+	}
+	registerCompressionFlags(fs)
+	return fs
+}
+
+// runDICOM implements the dicom subcommand, which extracts shareable
+// previews from DICOM files: the pixel data with window/level applied,
+// written as JPEG or PNG within the target size. Previews carry none of
+// the files' data elements, so no patient details go with them, except
+// any burned into the pixels, which is warned about.
+func runDICOM(args []string) error {
+	var opts dicomOptions
+	fs := dicomFlagSet(&opts)
+	if _, err := parseLayered(fs, args, &opts.config); err != nil {
+		return err
+	}
+	var window dicomWindow
+	if opts.window != "" {
+		var err error
+		if window, err = parseDICOMWindow(opts.window); err != nil {
+			return err
+		}
+	}
+	switch {
+	case opts.format != "jpeg" && opts.format != "png":
+		return fmt.Errorf("-format %s: want jpeg or png", opts.format)
+	case opts.frame < 0:
+		return fmt.Errorf("-frame must be 0 or more")
+	case fs.NArg() == 0:
+		fs.Usage()
+		return fmt.Errorf("no DICOM files")
+	}
+
+	failed, written := 0, 0
+	for _, arg := range fs.Args() {
+		arg = longPath(arg)
+		files, err := dicomPaths(arg)
+		if err != nil {
+			return err
+		}
+		for _, path := range files {
+			outDir := filepath.Join(filepath.Dir(path), "previews")
+			if opts.out != "" {
+				outDir = longPath(opts.out)
+				if path != arg {
+					rel, _ := filepath.Rel(arg, filepath.Dir(path))
+					outDir = filepath.Join(outDir, rel)
+				}
+			}
+			n, err := extractDICOM(path, outDir, opts.format, opts.frame, window)
+			written += n
+			if err != nil {
+				fmt.Printf("%s: ERROR: %v\n", filepath.Base(path), err)
+				failed++
+			}
+		}
+	}
+	fmt.Printf("\nWrote %d preview(s).\n", written)
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) failed", failed)
+	}
+	return nil
+}
+
+// dicomPaths lists the DICOM files at path: path itself if it's a file, or
+// those found anywhere under it, since studies nest series in folders and
+// their files often have no extension.
+func dicomPaths(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var paths []string
+	err = filepath.WalkDir(path, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() && e.Name() == "previews" && p != path {
+			return filepath.SkipDir
+		}
+		if e.Type().IsRegular() && isDICOM(p) {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// extractDICOM writes previews of the DICOM file at path into outDir, of
+// every frame or only the given one, and returns how many it wrote.
+func extractDICOM(path, outDir, format string, frame int, window dicomWindow) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	d, err := readDICOM(data)
+	if err != nil {
+		return 0, err
+	}
+	frames := d.frameCount()
+	first, last := frame-1, frame-1
+	if frame == 0 {
+		first, last = 0, frames-1
+	}
+	if last >= frames {
+		return 0, fmt.Errorf("has %d frame(s), not %d", frames, frame)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return 0, err
+	}
+
+	base := filepath.Base(path)
+	if ext := strings.ToLower(filepath.Ext(base)); ext == ".dcm" || ext == ".dicom" {
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	written := 0
+	for i := first; i <= last; i++ {
+		img, err := d.frameImage(i, window)
+		if err != nil {
+			return written, err
+		}
+		log := new(fileLog)
+		img = fitCanvas(log, capDimensions(img))
+		name := base
+		if frames > 1 {
+			name += fmt.Sprintf("-%04d", i+1)
+		}
+		outPath := filepath.Join(outDir, name+".jpg")
+		if format == "png" {
+			outPath, err = compressPNG(log, path, filepath.Join(outDir, name+".png"), img)
+		} else {
+			err = compressJPEG(log, outPath, img)
+		}
+		if err != nil {
+			return written, err
+		}
+		written++
+		info, err := os.Stat(outPath)
+		if err != nil {
+			return written, err
+		}
+		fmt.Printf("%s -> %s (%s) %s\n", filepath.Base(path), outPath, formatSize(int(info.Size())), strings.TrimSpace(log.buf.String()))
+		if info.Size() > int64(targetSize) {
+			fmt.Printf("  over the %s target\n", formatSize(targetSize))
+		}
+	}
+	if d.burnedIn {
+		fmt.Printf("  note: %s has burned-in annotation; the preview may show patient details\n", filepath.Base(path))
+	}
+	return written, nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readDICOMSample(t *testing.T, name string) *dicomFile {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "dicom", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := readDICOM(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// linearWindow maps modality value v through the window center/width the
+// way PS3.3 C.11.2.1.2.1 defines it.
+func linearWindow(v, center, width float64) uint8 {
+	switch {
+	case v <= center-0.5-(width-1)/2:
+		return 0
+	case v > center-0.5+(width-1)/2:
+		return 255
+	}
+	return uint8(math.Round(((v-(center-0.5))/(width-1) + 0.5) * 255))
+}
+
+// ctStored is the CT's samples: a 0-4095 ramp written into signed 12-bit
+// samples, so its upper half reads as negative.
+func ctStored(x, y, _ int) float64 {
+	v := (x + y) * 4095 / 126
+	if v >= 2048 {
+		v -= 4096
+	}
+	return float64(v)
+}
+
+// TestDICOMPixelData checks every pixel of the native samples against the
+// stored values they were written with, rescaled and windowed.
+func TestDICOMPixelData(t *testing.T) {
+	tests := []struct {
+		file   string
+		window dicomWindow
+		frames int
+		// stored is the value written for each pixel
+		stored func(x, y, frame int) float64
+		// modality rescales a stored value, and display windows it
+		modality func(stored float64) float64
+		display  func(modality float64, frame int) uint8
+	}{
+		{
+			// The file's own soft-tissue window, over Hounsfield units
+			file:     "ct-implicit.dcm",
+			frames:   1,
+			stored:   ctStored,
+			modality: func(s float64) float64 { return s - 1024 },
+			display:  func(v float64, _ int) uint8 { return linearWindow(v, 40, 400) },
+		},
+		{
+			file:     "ct-deflated.dcm",
+			frames:   1,
+			stored:   ctStored,
+			modality: func(s float64) float64 { return s - 1024 },
+			display:  func(v float64, _ int) uint8 { return linearWindow(v, 40, 400) },
+		},
+		{
+			// -window overrides the file's
+			file:     "ct-implicit.dcm",
+			window:   dicomWindowPresets["lung"],
+			frames:   1,
+			stored:   ctStored,
+			modality: func(s float64) float64 { return s - 1024 },
+			display:  func(v float64, _ int) uint8 { return linearWindow(v, -600, 1500) },
+		},
+		{
+			// No window in the file: each frame's full range, inverted
+			// for MONOCHROME1
+			file:     "cine.dcm",
+			frames:   3,
+			stored:   func(x, _, frame int) float64 { return float64(x + 40*frame) },
+			modality: func(s float64) float64 { return s },
+			display: func(v float64, frame int) uint8 {
+				lo, hi := float64(40*frame), float64(63+40*frame)
+				return 255 - linearWindow(v, (lo+hi+1)/2, hi-lo+1)
+			},
+		},
+		{
+			file:     "rle.dcm",
+			frames:   1,
+			stored:   func(x, y, _ int) float64 { return float64(x * y) },
+			modality: func(s float64) float64 { return s },
+			display:  func(v float64, _ int) uint8 { return linearWindow(v, (0+1521+1)/2, 1521+1) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			d := readDICOMSample(t, tt.file)
+			if n := d.frameCount(); n != tt.frames {
+				t.Fatalf("%d frames, want %d", n, tt.frames)
+			}
+			for frame := 0; frame < tt.frames; frame++ {
+				img, err := d.frameImage(frame, tt.window)
+				if err != nil {
+					t.Fatal(err)
+				}
+				gray, ok := img.(*image.Gray)
+				if !ok || gray.Rect != image.Rect(0, 0, d.columns, d.rows) {
+					t.Fatalf("frame %d is a %T of %v", frame, img, img.Bounds())
+				}
+				for y := 0; y < d.rows; y++ {
+					for x := 0; x < d.columns; x++ {
+						want := tt.display(tt.modality(tt.stored(x, y, frame)), frame)
+						if got := gray.GrayAt(x, y).Y; got != want {
+							t.Fatalf("frame %d, pixel %d,%d is %d, want %d", frame, x, y, got, want)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestDICOMBigEndian checks that the MR's samples are read in its byte
+// order, spreading their full range from black to white.
+func TestDICOMBigEndian(t *testing.T) {
+	d := readDICOMSample(t, "mr-big-endian.dcm")
+	if d.order != binary.BigEndian {
+		t.Fatalf("byte order %v", d.order)
+	}
+	stored := make([]float64, d.rows*d.columns)
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for p := range stored {
+		stored[p] = float64(binary.BigEndian.Uint16(d.native[2*p:]))
+		lo, hi = min(lo, stored[p]), max(hi, stored[p])
+	}
+	if stored[0] != 1000 {
+		t.Fatalf("first sample is %v, want 1000", stored[0])
+	}
+	img, err := d.frameImage(0, dicomWindow{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray := img.(*image.Gray)
+	for p, v := range stored {
+		if want := linearWindow(v, (lo+hi+1)/2, hi-lo+1); gray.Pix[p] != want {
+			t.Fatalf("pixel %d is %d, want %d", p, gray.Pix[p], want)
+		}
+	}
+}
+
+func TestDICOMColor(t *testing.T) {
+	d := readDICOMSample(t, "rgb.dcm")
+	img, err := d.frameImage(0, dicomWindow{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Red grows across, green down, over planar samples
+	for _, p := range []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{0, 0, color.RGBA{0, 0, 128, 255}},
+		{63, 0, color.RGBA{255, 0, 128, 255}},
+		{0, 47, color.RGBA{0, 255, 128, 255}},
+		{63, 47, color.RGBA{255, 255, 128, 255}},
+	} {
+		if got := color.RGBAModel.Convert(img.At(p.x, p.y)); got != p.want {
+			t.Errorf("pixel %d,%d is %v, want %v", p.x, p.y, got, p.want)
+		}
+	}
+}
+
+// TestDICOMEncapsulated decodes the JPEG frames, which hold small.jpg.
+// Grayscale frames are shown over their full range, so they are compared
+// with small.jpg's luma stretched the same way.
+func TestDICOMEncapsulated(t *testing.T) {
+	refData, err := os.ReadFile(filepath.Join("testdata", "small.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := jpeg.Decode(bytes.NewReader(refData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounds := ref.Bounds()
+	luma := image.NewGray(bounds)
+	lo, hi := 255.0, 0.0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			v := color.GrayModel.Convert(ref.At(x, y)).(color.Gray).Y
+			luma.SetGray(x, y, color.Gray{v})
+			lo, hi = min(lo, float64(v)), max(hi, float64(v))
+		}
+	}
+	stretched := image.NewGray(bounds)
+	for i, v := range luma.Pix {
+		stretched.Pix[i] = linearWindow(float64(v), (lo+hi+1)/2, hi-lo+1)
+	}
+
+	for _, tt := range []struct {
+		file   string
+		frames int
+		want   image.Image
+	}{
+		{"jpeg.dcm", 1, ref},
+		{"multi.dcm", 2, stretched},
+		{"jpeg12.dcm", 1, stretched},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			d := readDICOMSample(t, tt.file)
+			if n := d.frameCount(); n != tt.frames {
+				t.Fatalf("%d frames, want %d", n, tt.frames)
+			}
+			for frame := 0; frame < tt.frames; frame++ {
+				img, err := d.frameImage(frame, dicomWindow{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if img.Bounds() != bounds {
+					t.Fatalf("frame %d is %v, want %v", frame, img.Bounds(), bounds)
+				}
+				if diff := meanDifference(img, tt.want, false); diff > 3 {
+					t.Errorf("frame %d differs from small.jpg by %.2f on average", frame, diff)
+				}
+			}
+		})
+	}
+}
+
+// TestDICOMTruncated cuts every sample short everywhere: in the preamble,
+// the file meta information, the data set and the pixel data. None of it
+// may decode or panic.
+func TestDICOMTruncated(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "dicom", "*.dcm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			step := 1
+			if testing.Short() {
+				step = 17
+			}
+		cuts:
+			for n := 0; n < len(data); n += step {
+				d, err := readDICOM(data[:n])
+				if err != nil {
+					continue
+				}
+				for i := 0; i < d.frameCount(); i++ {
+					if _, err := d.frameImage(i, dicomWindow{}); err != nil {
+						continue cuts
+					}
+				}
+				t.Fatalf("cut to %d of %d bytes, it still decodes", n, len(data))
+			}
+		})
+	}
+}
+
+func TestParseDICOMWindow(t *testing.T) {
+	tests := map[string]dicomWindow{
+		"40,400":       {40, 400},
+		" -600 , 1500": {-600, 1500},
+		"Bone":         {400, 1800},
+	}
+	for s, want := range tests {
+		if got, err := parseDICOMWindow(s); err != nil || got != want {
+			t.Errorf("parseDICOMWindow(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "40", "40,0", "40,x", "skin"} {
+		if _, err := parseDICOMWindow(s); err == nil {
+			t.Errorf("parseDICOMWindow(%q) has no error", s)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultDirectivePattern finds directives after a double underscore at the
+// end of a name, as in banner__q80_w1600.png.
+const defaultDirectivePattern = `__([a-zA-Z0-9_]+)$`
+
+const directivesUsage = "read per-file settings from file names, e.g. banner__q80_w1600.png: on for name__directives, or a regular expression whose group captures the directives in the name without its extension, separated by _, spaces or commas. Directives are q<quality>, w<max width>, h<max height>, d<max dimension>, t<target size> and e<effort>, and are removed from output names"
+
+// filenameDirectives finds the directives in a file name, or is nil when
+// batches don't read any.
+var filenameDirectives *regexp.Regexp
+
+// registerFilenameDirectives registers -filename-directives, which sets
+// filenameDirectives.
+func registerFilenameDirectives(fs *flag.FlagSet) {
+	fs.Func("filename-directives", directivesUsage, func(s string) error {
+		switch s {
+		case "", "off":
+			filenameDirectives = nil
+			return nil
+		case "on":
+			s = defaultDirectivePattern
+		}
+		pattern, err := regexp.Compile(s)
+		if err != nil {
+			return err
+		}
+		if pattern.NumSubexp() != 1 {
+			return fmt.Errorf("pattern needs exactly one group around the directives")
+		}
+		filenameDirectives = pattern
+		return nil
+	})
+}
+
+// splitDirectives returns the directives in the file name of path and the
+// name with them removed. A name that is nothing but directives keeps them.
+func splitDirectives(path string) (directives []string, name string) {
+	name = filepath.Base(path)
+	if filenameDirectives == nil {
+		return nil, name
+	}
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	match := filenameDirectives.FindStringSubmatchIndex(stem)
+	if match == nil || match[2] < 0 || match[0] == 0 && match[1] == len(stem) {
+		return nil, name
+	}
+	directives = strings.FieldsFunc(stem[match[2]:match[3]], func(r rune) bool {
+		return r == '_' || r == ' ' || r == ','
+	})
+	return directives, stem[:match[0]] + stem[match[1]:] + ext
+}
+
+// applyDirectives changes s as the directives ask.
+func applyDirectives(s *compressionSettings, directives []string) error {
+	for _, directive := range directives {
+		key, value := strings.ToLower(directive[:1]), directive[1:]
+		if key == "t" {
+			limit, err := parseSize(value)
+			if err != nil {
+				return fmt.Errorf("directive %s: %w", directive, err)
+			}
+			s.uploadLimit = limit
+			s.targetSize = s.sizeMargin.below(limit)
+			if s.targetSize <= 0 {
+				return fmt.Errorf("directive %s leaves nothing after the %s margin", directive, s.sizeMargin)
+			}
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("directive %s: want a positive number after %s", directive, key)
+		}
+		switch key {
+		case "q":
+			if n > 100 {
+				return fmt.Errorf("directive %s: quality must be at most 100", directive)
+			}
+			s.qualityCap = n
+		case "w":
+			s.maxWidth = n
+		case "h":
+			s.maxHeight = n
+		case "d":
+			s.maxDimension = n
+		case "e":
+			if n < minEffort || n > maxEffort {
+				return fmt.Errorf("directive %s: effort must be between %d and %d", directive, minEffort, maxEffort)
+			}
+			s.effort = n
+		default:
+			return fmt.Errorf("unknown directive %s", directive)
+		}
+	}
+	return nil
+}
+
+// nameClashes returns the sources among paths whose output name, with the
+// directives removed, an earlier source already has, mapped to that
+// source, as photo__q50.jpg after photo.jpg. Both would write the same
+// output, so the later one fails instead. Sources in skip write nothing.
+func nameClashes(paths []string, skip map[string]leftOut) map[string]string {
+	clashes := make(map[string]string)
+	if filenameDirectives == nil {
+		return clashes
+	}
+	first := make(map[string]string)
+	for _, path := range paths {
+		if _, ok := skip[path]; ok {
+			continue
+		}
+		name := outputFileName(path)
+		if earlier, ok := first[name]; ok {
+			clashes[path] = earlier
+			continue
+		}
+		first[name] = path
+	}
+	return clashes
+}
+
+// failClash fails path, whose output name earlier's output already has.
+func failClash(path, earlier string) fileResult {
+	err := fmt.Errorf("output name %s is already %s's", outputFileName(path), filepath.Base(earlier))
+	log := &fileLog{source: path}
+	log.Printf("Processing %s... ERROR: %v\n", filepath.Base(path), err)
+	log.flush()
+	return fileResult{Source: path}.failed(err)
+}
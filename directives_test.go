@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirectiveNameClash(t *testing.T) {
+	t.Cleanup(func() { filenameDirectives = nil })
+	src, dir := t.TempDir(), t.TempDir()
+	writeTestImage(t, filepath.Join(src, "photo.jpg"), testImage(64, 48, 20, 1))
+	writeTestImage(t, filepath.Join(src, "photo__q50.jpg"), testImage(80, 60, 20, 2))
+	writeTestImage(t, filepath.Join(src, "other__q50.jpg"), testImage(64, 48, 20, 3))
+	out, report := filepath.Join(dir, "out"), filepath.Join(dir, "report.json")
+	if err := runBatch(t, "-input", src, "-output", out, "-workers", "4", "-filename-directives", "on", "-report", report); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := readReport(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("report has %d results, want 3", len(results))
+	}
+	for _, r := range results {
+		clash := filepath.Base(r.Source) == "photo__q50.jpg"
+		if failed := r.Outcome == outcomeFailed; failed != clash {
+			t.Errorf("%s: outcome %v (%s)", filepath.Base(r.Source), r.Outcome, r.Error)
+		}
+		if clash && !strings.Contains(r.Error, "photo.jpg") {
+			t.Errorf("clash fails with %q, which doesn't name photo.jpg", r.Error)
+		}
+	}
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if got := strings.Join(names, " "); got != "other.jpg photo.jpg" {
+		t.Errorf("outputs %s, want other.jpg photo.jpg", got)
+	}
+	if img, _ := decodeTestImage(t, filepath.Join(out, "photo.jpg")); img.Bounds().Dx() != 64 {
+		t.Errorf("photo.jpg is %v, not photo.jpg's output", img.Bounds())
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"image"
+
+	"image-compressor/pkg/compressor"
+)
+
+const (
+	minEffort     = compressor.MinEffort
+	maxEffort     = compressor.MaxEffort
+	defaultEffort = compressor.DefaultEffort
+)
+
+// effort trades CPU time for output bytes. Low values settle for the first
+// JPEG quality that fits and cheap PNG settings; high values search for the
+// highest quality that fits and try extra lossless PNG encodings.
+var effort = defaultEffort
+
+// encodePNG encodes img at the compression level chosen by effort; see
+// compressor.EncodePNG.
+func encodePNG(img image.Image) ([]byte, error) {
+	return compressor.EncodePNG(img, effort)
+}
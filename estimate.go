@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+
+	"image-compressor/pkg/compressor"
+)
+
+// maxEstimatePoints bounds the points= parameter of /estimate.
+const maxEstimatePoints = 32
+
+// estimateResponse is the body /estimate answers with: the JPEG size the
+// uploaded image would have at a range of qualities, lowest first.
+type estimateResponse struct {
+	Width      int             `json:"width"`
+	Height     int             `json:"height"`
+	TargetSize int             `json:"target_size"`
+	Exact      bool            `json:"exact"`
+	Points     []estimatePoint `json:"points"`
+}
+
+type estimatePoint struct {
+	Quality int  `json:"quality"`
+	Size    int  `json:"size"`
+	Fits    bool `json:"fits"`
+}
+
+// handleEstimate answers with the size curve of a POSTed image, so a
+// frontend can label a quality slider before asking /compress for the
+// final encode. ?points=N sets how many qualities are sampled (default 8).
+// Estimates are for a JPEG at the requester's -max-dimension; they don't
+// cover conversions processFile might make on the way.
+func (s *server) handleEstimate(rw http.ResponseWriter, r *http.Request) {
+	q := s.newRequest(rw, r)
+	in, ok := s.accept(q)
+	if !ok {
+		return
+	}
+	points := compressor.DefaultCurvePoints
+	if v := r.URL.Query().Get("points"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxEstimatePoints {
+			q.fail("points must be between 1 and "+strconv.Itoa(maxEstimatePoints), http.StatusBadRequest)
+			return
+		}
+		points = n
+	}
+
+	opts := compressor.Options{
+		TargetSize:   in.settings.targetSize,
+		MaxQuality:   maxJPEGQuality,
+		MaxDimension: in.settings.maxDimension,
+		LinearResize: in.settings.linearResize,
+		Filter:       in.settings.resizeFilter,
+		Background:   in.settings.flattenColor,
+	}
+	est, status, err := s.estimate(r.Header, in, opts, points)
+	if err != nil {
+		q.fail(err.Error(), status)
+		return
+	}
+
+	width, height := est.bounds.Dx(), est.bounds.Dy()
+	if opts.MaxDimension > 0 {
+		width, height = compressor.LongEdgeSize(width, height, opts.MaxDimension)
+	}
+	response := estimateResponse{Width: width, Height: height, TargetSize: opts.TargetSize, Exact: est.exact}
+	for _, p := range est.curve {
+		response.Points = append(response.Points, estimatePoint{Quality: p.Quality, Size: p.Size, Fits: p.Size <= opts.TargetSize})
+	}
+	q.entry.Status = http.StatusOK
+	s.audit.record(q.entry)
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(response)
+}
+
+// sizeEstimate is what estimate finds for an upload.
+type sizeEstimate struct {
+	bounds image.Rectangle
+	curve  []compressor.SizePoint
+	exact  bool
+}
+
+// estimate decodes in and samples its size curve. Decoding reads the
+// package-level settings too, e.g. whether documents are flattened from
+// their layers, so it happens under the lock with the requester's settings
+// applied, as compress does. The lock is released however it ends, and a
+// panic in a decoder or encoder fails only this request, as in
+// processFile. A failure comes with the status to answer it with.
+func (s *server) estimate(header http.Header, in upload, opts compressor.Options, points int) (est sizeEstimate, status int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	end := startRequestSpan(header, "estimate request", "format", in.format, "input_bytes", len(in.body))
+	defer func() { end(err) }()
+	defer func() {
+		if r := recover(); r != nil {
+			est, status, err = sizeEstimate{}, http.StatusInternalServerError, fmt.Errorf("internal error: %v", r)
+		}
+	}()
+
+	in.settings.apply()
+	img, _, err := decodeImage(bytes.NewReader(in.body))
+	if err != nil {
+		return est, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported image: %w", err)
+	}
+	est.curve, est.exact, err = compressor.SizeCurve(img, opts, points)
+	if err != nil {
+		return est, http.StatusUnprocessableEntity, err
+	}
+	est.bounds = img.Bounds()
+	return est, http.StatusOK, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// panicMagic starts uploads whose decoder panics while decoderPanics is
+// set, standing in for a decoder bug a malformed file hits. Otherwise they
+// fail to decode, so fuzzing can't trip over it.
+const panicMagic = "PANICIMG"
+
+var decoderPanics atomic.Bool
+
+func init() {
+	image.RegisterFormat("panic-test", panicMagic, func(io.Reader) (image.Image, error) {
+		if decoderPanics.Load() {
+			panic("decoder bug")
+		}
+		return nil, errors.New("panic-test: not an image")
+	}, func(io.Reader) (image.Config, error) {
+		return image.Config{ColorModel: color.RGBAModel, Width: 8, Height: 8}, nil
+	})
+}
+
+func TestEstimateSurvivesPanics(t *testing.T) {
+	saved := currentSettings()
+	defer saved.apply()
+	s := &server{base: currentSettings()}
+	post := func(body []byte) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handleEstimate(rec, httptest.NewRequest(http.MethodPost, "/estimate?points=3", bytes.NewReader(body)))
+		return rec
+	}
+
+	decoderPanics.Store(true)
+	rec := post([]byte(panicMagic))
+	decoderPanics.Store(false)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("panicking decoder answered %d: %s", rec.Code, rec.Body)
+	}
+
+	// The lock was released, so the next request is answered
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, testImage(64, 48, 20, 1), &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- post(photo.Bytes()) }()
+	select {
+	case rec := <-done:
+		var response estimateResponse
+		if rec.Code != http.StatusOK {
+			t.Fatalf("answered %d: %s", rec.Code, rec.Body)
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil || response.Width != 64 || len(response.Points) != 3 {
+			t.Errorf("answered %+v, %v", response, err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("the request after a panic hung on the server lock")
+	}
+}
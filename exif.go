@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// exifHeader starts the APP1 payload of an EXIF segment, followed by a TIFF
+// structure.
+var exifHeader = []byte("Exif\x00\x00")
+
+// TIFF tags that point at nested IFDs.
+const (
+	tagExifIFD    = 0x8769
+	tagGPSIFD     = 0x8825
+	tagInteropIFD = 0xa005
+)
+
+// tiffTypeSizes is the byte size of one value of each TIFF field type.
+var tiffTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// tiffData is a TIFF structure, as embedded in EXIF.
+type tiffData struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+// parseTIFF checks the TIFF header of buf and returns it with the offset of
+// the first IFD.
+func parseTIFF(buf []byte) (*tiffData, uint32, bool) {
+	if len(buf) < 8 {
+		return nil, 0, false
+	}
+	var order binary.ByteOrder
+	switch string(buf[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, false
+	}
+	if order.Uint16(buf[2:]) != 42 {
+		return nil, 0, false
+	}
+	return &tiffData{buf: buf, order: order}, order.Uint32(buf[4:]), true
+}
+
+// tiffEntry is one field of an IFD. pos is the offset of the 12-byte entry.
+type tiffEntry struct {
+	pos   uint32
+	tag   uint16
+	typ   uint16
+	count uint32
+}
+
+// size is the byte size of the entry's value.
+func (e tiffEntry) size() uint32 {
+	return tiffTypeSizes[e.typ] * e.count
+}
+
+// valuePos is the offset of the entry's value: inline in the entry when it
+// fits in four bytes, elsewhere in the buffer otherwise.
+func (t *tiffData) valuePos(e tiffEntry) uint32 {
+	if e.size() <= 4 {
+		return e.pos + 8
+	}
+	return t.order.Uint32(t.buf[e.pos+8:])
+}
+
+// ifd returns the entries of the IFD at off and the offset of the field
+// holding the next IFD's offset.
+func (t *tiffData) ifd(off uint32) ([]tiffEntry, uint32, bool) {
+	if uint64(off)+2 > uint64(len(t.buf)) {
+		return nil, 0, false
+	}
+	n := uint32(t.order.Uint16(t.buf[off:]))
+	next := off + 2 + 12*n
+	if uint64(next)+4 > uint64(len(t.buf)) {
+		return nil, 0, false
+	}
+	entries := make([]tiffEntry, n)
+	for i := range entries {
+		pos := off + 2 + 12*uint32(i)
+		entries[i] = tiffEntry{
+			pos:   pos,
+			tag:   t.order.Uint16(t.buf[pos:]),
+			typ:   t.order.Uint16(t.buf[pos+2:]),
+			count: t.order.Uint32(t.buf[pos+4:]),
+		}
+	}
+	return entries, next, true
+}
+
+// end returns the offset just past the IFD at off, the values it points to
+// and any nested IFDs. depth guards against reference loops.
+func (t *tiffData) end(off uint32, depth int) uint32 {
+	entries, next, ok := t.ifd(off)
+	if !ok || depth > 4 {
+		return off
+	}
+	end := next + 4
+	for _, e := range entries {
+		if e.size() > 4 {
+			end = max(end, t.valuePos(e)+e.size())
+		}
+		if e.tag == tagExifIFD || e.tag == tagGPSIFD || e.tag == tagInteropIFD {
+			end = max(end, t.end(t.order.Uint32(t.buf[e.pos+8:]), depth+1))
+		}
+	}
+	return end
+}
+
+// stripEXIFThumbnail returns the EXIF APP1 payload without its embedded
+// thumbnail (IFD1). The thumbnail is unlinked, and cut off when it sits after
+// all of the main IFD data, which is where cameras put it.
+func stripEXIFThumbnail(payload []byte) []byte {
+	if !bytes.HasPrefix(payload, exifHeader) {
+		return payload
+	}
+	t, ifd0, ok := parseTIFF(payload[len(exifHeader):])
+	if !ok {
+		return payload
+	}
+	_, next, ok := t.ifd(ifd0)
+	if !ok {
+		return payload
+	}
+	ifd1 := t.order.Uint32(t.buf[next:])
+	if ifd1 == 0 {
+		return payload
+	}
+
+	out := append([]byte(nil), payload...)
+	tiff := out[len(exifHeader):]
+	t.order.PutUint32(tiff[next:], 0)
+	if end := t.end(ifd0, 0); ifd1 >= end && int(ifd1) <= len(tiff) {
+		out = out[:len(exifHeader)+int(ifd1)]
+	}
+	return out
+}
+
+// exifThumbnailEdge is the long edge of regenerated EXIF thumbnails; EXIF
+// recommends 160x120.
+const exifThumbnailEdge = 160
+
+// exifThumbnailQuality is the JPEG quality of regenerated thumbnails.
+const exifThumbnailQuality = 75
+
+// maxAPP1Payload is the most an APP1 segment can hold after its length.
+const maxAPP1Payload = 0xffff - 2
+
+// IFD1 tags locating a JPEG thumbnail.
+const (
+	tagJPEGInterchangeFormat       = 0x201
+	tagJPEGInterchangeFormatLength = 0x202
+)
+
+// Exif IFD tags holding the size of the main image.
+const (
+	tagPixelXDimension = 0xa002
+	tagPixelYDimension = 0xa003
+)
+
+// replaceEXIFThumbnail returns the EXIF APP1 payload with its thumbnail
+// replaced by thumb, a JPEG, or added if it had none. The old thumbnail is
+// removed as by stripEXIFThumbnail and a new IFD1 is appended after the
+// rest. If the result would not fit in an APP1 segment the payload is
+// returned without a thumbnail.
+func replaceEXIFThumbnail(payload, thumb []byte) []byte {
+	payload = stripEXIFThumbnail(payload)
+	if !bytes.HasPrefix(payload, exifHeader) {
+		return payload
+	}
+	t, ifd0, ok := parseTIFF(payload[len(exifHeader):])
+	if !ok {
+		return payload
+	}
+	_, next, ok := t.ifd(ifd0)
+	if !ok {
+		return payload
+	}
+
+	// IFD offsets must be even
+	ifd1 := uint32(len(t.buf) + len(t.buf)%2)
+	const entries = 6
+	rationals := ifd1 + 2 + 12*entries + 4
+	data := rationals + 16
+	if int(data)+len(thumb)+len(exifHeader) > maxAPP1Payload {
+		return payload
+	}
+
+	out := make([]byte, len(exifHeader)+int(data)+len(thumb))
+	copy(out, payload)
+	tiff := out[len(exifHeader):]
+	order := t.order
+	order.PutUint32(tiff[next:], ifd1)
+
+	pos := ifd1
+	order.PutUint16(tiff[pos:], entries)
+	pos += 2
+	entry := func(tag, typ uint16, value uint32) {
+		order.PutUint16(tiff[pos:], tag)
+		order.PutUint16(tiff[pos+2:], typ)
+		order.PutUint32(tiff[pos+4:], 1)
+		if typ == tiffShort {
+			order.PutUint16(tiff[pos+8:], uint16(value))
+		} else {
+			order.PutUint32(tiff[pos+8:], value)
+		}
+		pos += 12
+	}
+	// Tags must be in ascending order
+	entry(tagCompression, tiffShort, 6) // JPEG
+	entry(tagXResolution, tiffRational, rationals)
+	entry(tagYResolution, tiffRational, rationals+8)
+	entry(tagResolutionUnit, tiffShort, 2) // inches
+	entry(tagJPEGInterchangeFormat, tiffLong, data)
+	entry(tagJPEGInterchangeFormatLength, tiffLong, uint32(len(thumb)))
+	order.PutUint32(tiff[pos:], 0)
+
+	for _, off := range []uint32{rationals, rationals + 8} {
+		order.PutUint32(tiff[off:], 72)
+		order.PutUint32(tiff[off+4:], 1)
+	}
+	copy(tiff[data:], thumb)
+	return out
+}
+
+// setEXIFDimensions records width and height as the image size in the Exif
+// IFD of an EXIF APP1 payload, in place. Only fields already present are
+// changed, since adding any would move the data after them.
+func setEXIFDimensions(payload []byte, width, height int) {
+	if !bytes.HasPrefix(payload, exifHeader) {
+		return
+	}
+	t, ifd0, ok := parseTIFF(payload[len(exifHeader):])
+	if !ok {
+		return
+	}
+	entries, _, ok := t.ifd(ifd0)
+	if !ok {
+		return
+	}
+	for _, e := range entries {
+		if e.tag != tagExifIFD {
+			continue
+		}
+		exif, _, ok := t.ifd(t.order.Uint32(t.buf[e.pos+8:]))
+		if !ok {
+			return
+		}
+		for _, f := range exif {
+			var value int
+			switch f.tag {
+			case tagPixelXDimension:
+				value = width
+			case tagPixelYDimension:
+				value = height
+			default:
+				continue
+			}
+			switch {
+			case f.count != 1:
+			case f.typ == tiffShort && value <= 0xffff:
+				t.order.PutUint16(t.buf[f.pos+8:], uint16(value))
+			case f.typ == tiffLong:
+				t.order.PutUint32(t.buf[f.pos+8:], uint32(value))
+			}
+		}
+	}
+}
+
+// TIFF field types read by exifStrings and exifNumbers, besides those
+// encodeTIFF writes.
+const (
+	tiffASCII     = 2
+	tiffSLong     = 9
+	tiffSRational = 10
+)
+
+// TIFF and Exif IFD tags saying when, with which camera and at which
+// exposure a photo was taken.
+const (
+	tagMake                = 0x10f
+	tagModel               = 0x110
+	tagDateTime            = 0x132
+	tagExposureTime        = 0x829a
+	tagDateTimeOriginal    = 0x9003
+	tagDateTimeDigitized   = 0x9004
+	tagOffsetTime          = 0x9010
+	tagOffsetTimeOriginal  = 0x9011
+	tagOffsetTimeDigitized = 0x9012
+	tagExposureBiasValue   = 0x9204
+	tagExposureMode        = 0xa402
+	tagBodySerialNumber    = 0xa431
+)
+
+// exifEntries returns the entries of IFD0 and the Exif IFD of an EXIF APP1
+// payload whose values lie within it.
+func exifEntries(payload []byte) (*tiffData, []tiffEntry) {
+	if !bytes.HasPrefix(payload, exifHeader) {
+		return nil, nil
+	}
+	t, ifd0, ok := parseTIFF(payload[len(exifHeader):])
+	if !ok {
+		return nil, nil
+	}
+	entries, _, ok := t.ifd(ifd0)
+	if !ok {
+		return nil, nil
+	}
+	for _, e := range entries {
+		if e.tag == tagExifIFD {
+			if exif, _, ok := t.ifd(t.order.Uint32(t.buf[e.pos+8:])); ok {
+				entries = append(entries, exif...)
+			}
+			break
+		}
+	}
+	valid := entries[:0]
+	for _, e := range entries {
+		if e.count > 0 && uint64(t.valuePos(e))+uint64(e.size()) <= uint64(len(t.buf)) {
+			valid = append(valid, e)
+		}
+	}
+	return t, valid
+}
+
+// exifStrings returns the ASCII fields of IFD0 and the Exif IFD of an EXIF
+// APP1 payload by tag, without their trailing NULs and spaces.
+func exifStrings(payload []byte) map[uint16]string {
+	t, entries := exifEntries(payload)
+	fields := make(map[uint16]string)
+	for _, e := range entries {
+		if e.typ == tiffASCII {
+			pos := t.valuePos(e)
+			fields[e.tag] = strings.TrimRight(string(t.buf[pos:pos+e.size()]), "\x00 ")
+		}
+	}
+	return fields
+}
+
+// exifNumbers returns the first value of the integer and rational fields of
+// IFD0 and the Exif IFD of an EXIF APP1 payload by tag.
+func exifNumbers(payload []byte) map[uint16]float64 {
+	t, entries := exifEntries(payload)
+	fields := make(map[uint16]float64)
+	for _, e := range entries {
+		b := t.buf[t.valuePos(e):]
+		switch e.typ {
+		case tiffShort:
+			fields[e.tag] = float64(t.order.Uint16(b))
+		case tiffLong:
+			fields[e.tag] = float64(t.order.Uint32(b))
+		case tiffSLong:
+			fields[e.tag] = float64(int32(t.order.Uint32(b)))
+		case tiffRational:
+			if d := t.order.Uint32(b[4:]); d != 0 {
+				fields[e.tag] = float64(t.order.Uint32(b)) / float64(d)
+			}
+		case tiffSRational:
+			if d := int32(t.order.Uint32(b[4:])); d != 0 {
+				fields[e.tag] = float64(int32(t.order.Uint32(b))) / float64(d)
+			}
+		}
+	}
+	return fields
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// exifTimeLayout is how EXIF writes dates and times.
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// timeShift, set by -shift-time, is added to the dates and times in the
+// EXIF of outputs, for photos from a camera whose clock was off. timeOffset,
+// set by -set-offset, replaces the time zone offsets recorded with them.
+// Both only reach outputs that carry metadata: with -keep-metadata, or
+// copied without -strip-copies.
+var (
+	timeShift  time.Duration
+	timeOffset string
+)
+
+// offsetPattern matches the time zone offsets EXIF records.
+var offsetPattern = regexp.MustCompile(`^[+-](0\d|1[0-4]):[0-5]\d$`)
+
+// parseTimeOffset sets timeOffset from a +HH:MM or -HH:MM offset, or
+// clears it for "".
+func parseTimeOffset(s string) error {
+	s = strings.TrimSpace(s)
+	if s != "" && !offsetPattern.MatchString(s) {
+		return fmt.Errorf("invalid time zone offset %q, expected +HH:MM or -HH:MM such as -07:00", s)
+	}
+	timeOffset = s
+	return nil
+}
+
+// fixesTimes reports whether -shift-time or -set-offset is set.
+func fixesTimes() bool {
+	return timeShift != 0 || timeOffset != ""
+}
+
+// formatTimeFixes describes -shift-time and -set-offset for printSettings.
+func formatTimeFixes() string {
+	var fixes []string
+	if timeShift != 0 {
+		fixes = append(fixes, "shifted by "+timeShift.String())
+	}
+	if timeOffset != "" {
+		fixes = append(fixes, "offset set to "+timeOffset)
+	}
+	return strings.Join(fixes, ", ")
+}
+
+// fixEXIFTimes applies timeShift and timeOffset to the date, time and
+// offset fields of an EXIF APP1 payload, in place. Fields that are blank or
+// missing are left so, since adding any would move the data after them.
+func fixEXIFTimes(payload []byte) {
+	if !fixesTimes() {
+		return
+	}
+	t, entries := exifEntries(payload)
+	for _, e := range entries {
+		if e.typ != tiffASCII {
+			continue
+		}
+		pos := t.valuePos(e)
+		value := t.buf[pos : pos+e.size()]
+		switch e.tag {
+		case tagDateTime, tagDateTimeOriginal, tagDateTimeDigitized:
+			taken, err := time.Parse(exifTimeLayout, strings.TrimRight(string(value), "\x00 "))
+			if timeShift == 0 || err != nil {
+				continue
+			}
+			if shifted := taken.Add(timeShift).Format(exifTimeLayout); len(shifted) <= len(value) {
+				copy(value, shifted)
+			}
+		case tagOffsetTime, tagOffsetTimeOriginal, tagOffsetTimeDigitized:
+			if timeOffset == "" || len(value) < len(timeOffset) {
+				continue
+			}
+			clear(value[copy(value, timeOffset):])
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"strings"
+
+	"image-compressor/pkg/compressor"
+)
+
+// Fallback strategies, tried in the order of -fallback when an output is
+// still over the target.
+const (
+	// fallbackLowQuality encodes a JPEG at quality 5
+	fallbackLowQuality = "lowq"
+	// fallbackDownscale searches JPEG qualities at smaller and smaller sizes
+	fallbackDownscale = "downscale"
+	// fallbackHEIC searches HEIC qualities, in builds with libheif
+	fallbackHEIC = "heic"
+)
+
+// lowFallbackQuality is the JPEG quality of fallbackLowQuality.
+const lowFallbackQuality = 5
+
+// fallbackScales are the sizes fallbackDownscale tries, relative to the
+// output that was over the target.
+var fallbackScales = []float64{0.75, 0.5, 0.35, 0.25}
+
+// defaultFallbacks is the chain used unless -fallback says otherwise.
+var defaultFallbacks = []string{fallbackLowQuality, fallbackDownscale}
+
+// fallbackChain is the chain in effect.
+var fallbackChain = defaultFallbacks
+
+const fallbackUsage = "comma-separated strategies tried in order when an output is still over the target, or none: lowq (JPEG at quality 5), downscale (JPEG at 75%, 50%, 35% and 25% of the size) or heic (needs libheif) (default lowq,downscale)"
+
+// fallbackStrategies write img, the decoded output that was over the
+// target, within targetSize next to dstPath, and return the path written.
+// They return errCannotMeetTarget, writing nothing, if they can't.
+var fallbackStrategies = map[string]func(log *fileLog, dstPath string, img image.Image) (string, error){
+	fallbackLowQuality: func(log *fileLog, dstPath string, img image.Image) (string, error) {
+		var buffer bytes.Buffer
+		if err := jpeg.Encode(&buffer, compressor.Flatten(img, flattenColor), &jpeg.Options{Quality: lowFallbackQuality}); err != nil {
+			return "", err
+		}
+		meta := creditSegments()
+		if buffer.Len()+len(meta) > targetSize {
+			return "", errCannotMeetTarget
+		}
+		log.Printf("(JPEG q%d) ", lowFallbackQuality)
+		jpegPath := jpegOutputPath(dstPath)
+		return jpegPath, writeOutput(jpegPath, insertJPEGSegments(buffer.Bytes(), meta))
+	},
+	fallbackDownscale: func(log *fileLog, dstPath string, img image.Image) (string, error) {
+		bounds := img.Bounds()
+		meta := creditSegments()
+		for _, scale := range fallbackScales {
+			w := max(int(float64(bounds.Dx())*scale), 1)
+			h := max(int(float64(bounds.Dy())*scale), 1)
+			data, err := encodeJPEGWithin(log, resizeImage(img, w, h), targetSize-len(meta), startQuality())
+			if errors.Is(err, errCannotMeetTarget) {
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			log.Printf("(downscaled to %dx%d) ", w, h)
+			jpegPath := jpegOutputPath(dstPath)
+			return jpegPath, writeOutput(jpegPath, insertJPEGSegments(data, meta))
+		}
+		return "", errCannotMeetTarget
+	},
+	fallbackHEIC: compressHEICOutput,
+}
+
+// parseFallback sets fallbackChain from -fallback.
+func parseFallback(s string) error {
+	if s = strings.TrimSpace(s); s == "none" || s == "" {
+		fallbackChain = nil
+		return nil
+	}
+	var chain []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch _, ok := fallbackStrategies[name]; {
+		case name == "webp" || name == "avif":
+			return fmt.Errorf("%s: this build has no %s encoder", name, strings.ToUpper(name))
+		case !ok:
+			return fmt.Errorf("unknown fallback %q (want lowq, downscale or heic)", name)
+		case name == fallbackHEIC && !heifSupported:
+			return fmt.Errorf("%s: %w", name, errHEICUnsupported)
+		}
+		chain = append(chain, name)
+	}
+	fallbackChain = chain
+	return nil
+}
+
+// runFallbacks tries fallbackChain on outputPath, an output that is over
+// the target. It returns the output that replaces it and its size, or
+// errCannotMeetTarget with outputPath removed if no strategy fits.
+func runFallbacks(log *fileLog, outputPath string) (string, int64, error) {
+	img, _, err := decodeImageFile(outputPath)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", 0, err
+	}
+	for _, name := range fallbackChain {
+		if traceSearch {
+			log.Line("  fallback %s", name)
+		}
+		path, err := fallbackStrategies[name](log, outputPath, img)
+		if errors.Is(err, errCannotMeetTarget) {
+			continue
+		}
+		if err != nil {
+			os.Remove(outputPath)
+			return "", 0, err
+		}
+		if path != outputPath {
+			os.Remove(outputPath)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", 0, err
+		}
+		return path, info.Size(), nil
+	}
+	os.Remove(outputPath)
+	return "", 0, errCannotMeetTarget
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"path/filepath"
+	"strings"
+)
+
+// faviconProfile is set by -sizes favicon, which emits a website's icons
+// from each image instead of long-edge sizes.
+var faviconProfile bool
+
+// faviconSizes are the PNG icons of the favicon profile: the browser tab
+// sizes, Apple's touch icon and the sizes web app manifests ask for.
+var faviconSizes = []int{16, 32, 180, 192, 512}
+
+// faviconICOSizes are the icons bundled in the .ico, for browsers and
+// Windows shortcuts that still look for /favicon.ico.
+var faviconICOSizes = []int{16, 32, 48}
+
+// compressFavicon decodes srcPath once and writes outName's base name as a
+// .ico and as a PNG at every favicon size into dstDir, e.g. logo.ico and
+// logo_16.png to logo_512.png. Images that aren't square are centered on a
+// transparent square rather than cropped.
+func compressFavicon(log *fileLog, srcPath, dstDir, outName string) error {
+	img, _, err := decodeProfileSource(log, srcPath)
+	if err != nil {
+		return err
+	}
+	img = squareIcon(img)
+	if side := img.Bounds().Dx(); side < faviconSizes[len(faviconSizes)-1] {
+		log.Printf("(enlarging the %dpx source, use at least %dpx for sharp icons) ", side, faviconSizes[len(faviconSizes)-1])
+	}
+
+	base := strings.TrimSuffix(outName, filepath.Ext(outName))
+	icons := make([][]byte, len(faviconICOSizes))
+	for i, size := range faviconICOSizes {
+		if icons[i], err = encodePNG(resizeImage(img, size, size)); err != nil {
+			return fmt.Errorf("%dpx icon: %w", size, err)
+		}
+	}
+	if err := writeFaviconFile(filepath.Join(dstDir, base+".ico"), encodeICO(faviconICOSizes, icons)); err != nil {
+		return err
+	}
+	log.Printf(".ico ")
+
+	for _, size := range faviconSizes {
+		data, err := encodePNG(resizeImage(img, size, size))
+		if err != nil {
+			return fmt.Errorf("%dpx: %w", size, err)
+		}
+		if err := writeFaviconFile(profilePath(dstDir, base+".png", size), data); err != nil {
+			return fmt.Errorf("%dpx: %w", size, err)
+		}
+		log.Printf("%dpx ", size)
+	}
+	return nil
+}
+
+// writeFaviconFile writes one favicon output, which like any profile output
+// has to meet the target, and names it for -name.
+func writeFaviconFile(path string, data []byte) error {
+	if len(data) > targetSize {
+		return fmt.Errorf("%s: %w", filepath.Base(path), errCannotMeetTarget)
+	}
+	if err := writeOutput(path, data); err != nil {
+		return err
+	}
+	_, err := nameOutput(path)
+	return err
+}
+
+// squareIcon returns img centered on a transparent square as wide as its
+// longer side, or img itself if it is square already.
+func squareIcon(img image.Image) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == h {
+		return img
+	}
+	side := max(w, h)
+	square := image.NewNRGBA(image.Rect(0, 0, side, side))
+	x, y := (side-w)/2, (side-h)/2
+	draw.Draw(square, image.Rect(x, y, x+w, y+h), img, bounds.Min, draw.Src)
+	return square
+}
+
+// encodeICO bundles PNG icons of the given sizes into a .ico file. Every
+// browser and Windows since Vista read PNG entries.
+func encodeICO(sizes []int, icons [][]byte) []byte {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, [3]uint16{0, 1, uint16(len(icons))})
+	offset := 6 + 16*len(icons)
+	for i, icon := range icons {
+		// Sizes are stored in a byte, 0 meaning 256
+		side := uint8(sizes[i] % 256)
+		buffer.Write([]byte{side, side, 0, 0})
+		binary.Write(&buffer, binary.LittleEndian, [2]uint16{1, 32})
+		binary.Write(&buffer, binary.LittleEndian, [2]uint32{uint32(len(icon)), uint32(offset)})
+		offset += len(icon)
+	}
+	for _, icon := range icons {
+		buffer.Write(icon)
+	}
+	return buffer.Bytes()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"runtime"
+)
+
+// Builds come in two feature sets. The default is pure Go and cross-compiles
+// anywhere with CGO_ENABLED=0. Building with -tags full adds everything that
+// needs cgo or large dependencies: HEIC via libheif, JPEG 2000 via
+// libopenjp2, OpenTelemetry tracing and the tray icon. Each is also available
+// on its own with -tags heif, jp2, otel or tray.
+
+// feature is an optional capability and whether this build has it.
+type feature struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Detail  string `json:"detail"`
+}
+
+// codecSignatures are the first bytes of each format the tool reads, used
+// to ask the image package whether a decoder for it is compiled in.
+var codecSignatures = []struct {
+	name      string
+	signature string
+}{
+	{"jpeg", "\xff\xd8\xff"},
+	{"png", "\x89PNG\r\n\x1a\n"},
+	{"gif", "GIF89a"},
+	{"webp", "RIFF\x00\x00\x00\x00WEBPVP8 "},
+	{"psd", "8BPS"},
+	{"xcf", xcfSignature},
+	{"ora", oraSignature},
+}
+
+// hasDecoder reports whether a decoder is registered for data's format.
+func hasDecoder(signature string) bool {
+	_, _, err := image.DecodeConfig(bytes.NewReader([]byte(signature)))
+	return !errors.Is(err, image.ErrFormat)
+}
+
+// buildFeatures lists the codecs and optional features of this build.
+func buildFeatures() []feature {
+	var features []feature
+	for _, codec := range codecSignatures {
+		detail := "decode"
+		switch codec.name {
+		case "jpeg":
+			detail = "decode (12-bit and arithmetic-coded too), encode"
+		case "png", "gif":
+			detail = "decode, encode"
+		case "psd":
+			detail = "decode (the flattened composite, or layers composited as Normal)"
+		case "xcf":
+			detail = "decode (layers composited as Normal)"
+		case "ora":
+			detail = "decode (the merged image, or layers composited as Normal)"
+		}
+		features = append(features, feature{Name: codec.name, Enabled: hasDecoder(codec.signature), Detail: detail})
+	}
+	return append(features,
+		feature{Name: "heic", Enabled: heifSupported, Detail: "decode, encode (-tags heif or full, cgo and libheif)"},
+		feature{Name: "jpeg2000", Enabled: jpeg2000Supported, Detail: "decode (-tags jp2 or full, cgo and libopenjp2)"},
+		feature{Name: "tiff", Enabled: true, Detail: "encode (-intent print)"},
+		feature{Name: "otel", Enabled: tracingSupported, Detail: "OpenTelemetry tracing (-tags otel or full)"},
+		feature{Name: "tray", Enabled: traySupported, Detail: "system tray icon (-tags tray or full)"},
+		feature{Name: "updater", Enabled: updaterSupported, Detail: "self-update to signed releases (-tags updater and update_key.pub)"},
+	)
+}
+
+// versionOptions holds the flags of the version subcommand.
+type versionOptions struct {
+	features bool
+	json     bool
+}
+
+func versionFlagSet(o *versionOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.BoolVar(&o.features, "features", false, "also list the codecs and optional features compiled into this build")
+	fs.BoolVar(&o.json, "json", false, "print as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s version [-features] [-json]\n", programName())
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// buildInfo describes this build for the version subcommand and the
+// server's /features endpoint.
+type buildInfo struct {
+	Version  string    `json:"version"`
+	Go       string    `json:"go"`
+	Platform string    `json:"platform"`
+	Features []feature `json:"features,omitempty"`
+}
+
+func currentBuild(withFeatures bool) buildInfo {
+	info := buildInfo{Version: version, Go: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	if withFeatures {
+		info.Features = buildFeatures()
+	}
+	return info
+}
+
+// runVersion implements the version subcommand.
+func runVersion(args []string) error {
+	var opts versionOptions
+	versionFlagSet(&opts).Parse(args)
+	info := currentBuild(opts.features)
+	if opts.json {
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	fmt.Printf("%s %s (%s, %s)\n", programName(), info.Version, info.Go, info.Platform)
+	if !opts.features {
+		return nil
+	}
+	fmt.Println("\nFeatures:")
+	for _, f := range info.Features {
+		mark := "-"
+		if f.Enabled {
+			mark = "+"
+		}
+		fmt.Printf("  %s %-8s  %s\n", mark, f.Name, f.Detail)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// flattenColor is what transparent areas are composited onto when an image
+// is converted to JPEG, which can't store transparency.
+var flattenColor color.Color = color.White
+
+// parseFlattenColor sets flattenColor.
+func parseFlattenColor(s string) error {
+	c, err := parseColor(s)
+	flattenColor = c
+	return err
+}
+
+// parseColor parses an opaque color given as white, black, #rrggbb or #rgb.
+func parseColor(s string) (color.Color, error) {
+	switch strings.ToLower(s) {
+	case "white":
+		return color.White, nil
+	case "black":
+		return color.Black, nil
+	}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return color.White, fmt.Errorf("invalid color %q, expected white, black, #rrggbb or #rgb", s)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// formatColor returns c as #rrggbb.
+func formatColor(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fuzzMaxPixels bounds the images the fuzz targets decode, so that a
+// header claiming a huge image costs one skipped input rather than the
+// whole run's memory. decodeLimited's own bound is far larger.
+const fuzzMaxPixels = 1 << 20
+
+// addFuzzSeeds seeds f with every sample in testdata: the golden corpus and
+// the JPEG extensions, PSD, XCF, DICOM and OpenRaster files.
+func addFuzzSeeds(f *testing.F) {
+	err := filepath.WalkDir("testdata", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) == ".md" {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		f.Add(data)
+		return nil
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+}
+
+// fuzzDecode decodes data as the tool reads sources: DICOM files by their
+// first frame, everything else with decodeImage once the header has been
+// checked. It returns false for data that doesn't decode, and fails t if
+// the decoded image doesn't have the size its header claims.
+func fuzzDecode(t *testing.T, data []byte) (image.Image, string, bool) {
+	if d, err := readDICOM(data); err == nil {
+		if d.rows*d.columns > fuzzMaxPixels {
+			return nil, "", false
+		}
+		img, err := d.frameImage(0, dicomWindow{})
+		return img, "dicom", err == nil
+	}
+	cfg, _, err := decodeConfig(bytes.NewReader(data))
+	if err != nil || checkDecodeSize(cfg) != nil || cfg.Width*cfg.Height > fuzzMaxPixels {
+		return nil, "", false
+	}
+	img, format, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", false
+	}
+	if b := img.Bounds(); b.Dx() != cfg.Width || b.Dy() != cfg.Height {
+		t.Fatalf("%s header says %dx%d, decoded image is %dx%d", format, cfg.Width, cfg.Height, b.Dx(), b.Dy())
+	}
+	return img, format, true
+}
+
+func FuzzDecode(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		img, _, ok := fuzzDecode(t, data)
+		if !ok {
+			return
+		}
+		// Every pixel must be readable, which catches planes shorter than
+		// the bounds
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				img.At(x, y).RGBA()
+			}
+		}
+	})
+}
+
+func FuzzCompress(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		img, format, ok := fuzzDecode(t, data)
+		if !ok {
+			return
+		}
+		saved := currentSettings()
+		defer saved.apply()
+		targetSize = 8000
+
+		dir := t.TempDir()
+		src := filepath.Join(dir, "source")
+		if err := os.WriteFile(src, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		log := &fileLog{source: src}
+		out, err := encodeDecoded(log, format, src, filepath.Join(dir, "output"+convertExtensions[format]), img)
+		if err != nil {
+			return
+		}
+		file, err := os.Open(out)
+		if err != nil {
+			t.Fatalf("encoding reported %s but wrote nothing: %v", out, err)
+		}
+		defer file.Close()
+		if _, _, err := decodeImage(file); err != nil {
+			t.Fatalf("output %s doesn't decode: %v", filepath.Base(out), err)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// compressFile runs processFile on src into out with the compression
+// flags in args, restoring the settings they change once it is done.
+func compressFile(t *testing.T, src, out string, args ...string) fileResult {
+	t.Helper()
+	saved := currentSettings()
+	defer saved.apply()
+	fs := flag.NewFlagSet("compress", flag.ContinueOnError)
+	registerCompressionFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return processFile(src, out)
+}
+
+// goldenCases are the expected results of compressing each file in
+// testdata to a 40 KB target: whether it is compressed, copied or fails,
+// the output's name and format, its dimensions and a range its size must
+// fall in. The ranges are loose enough for encoder noise but catch a codec
+// or search change that makes outputs much larger or smaller.
+var goldenCases = []struct {
+	file          string
+	target        string
+	outcome       fileOutcome
+	output        string
+	format        string
+	width, height int
+	minKB, maxKB  float64
+}{
+	// Photos: the quality search lands just under the target
+	{file: "photo.jpg", outcome: outcomeCompressed, output: "photo.jpg", format: "jpeg", width: 400, height: 300, minKB: 32, maxKB: 39.6},
+	{file: "progressive.jpg", outcome: outcomeCompressed, output: "progressive.jpg", format: "jpeg", width: 640, height: 480, minKB: 28, maxKB: 39.6},
+	{file: "gray.jpg", outcome: outcomeCompressed, output: "gray.jpg", format: "jpeg", width: 400, height: 300, minKB: 30, maxKB: 39.6},
+	{file: "cmyk.jpg", outcome: outcomeCompressed, output: "cmyk.jpg", format: "jpeg", width: 320, height: 240, minKB: 15, maxKB: 39.6},
+	{file: "portrait.jpg", outcome: outcomeCompressed, output: "portrait.jpg", format: "jpeg", width: 150, height: 225, minKB: 14, maxKB: 24},
+	// Orientation is left to the EXIF tag, so the stored pixels keep their
+	// landscape dimensions whatever the tag says
+	{file: "orientation-3.jpg", outcome: outcomeCompressed, output: "orientation-3.jpg", format: "jpeg", width: 160, height: 120, minKB: 7, maxKB: 12},
+	{file: "orientation-6.jpg", outcome: outcomeCompressed, output: "orientation-6.jpg", format: "jpeg", width: 160, height: 120, minKB: 7, maxKB: 12},
+	{file: "orientation-8.jpg", outcome: outcomeCompressed, output: "orientation-8.jpg", format: "jpeg", width: 160, height: 120, minKB: 7, maxKB: 12},
+	{file: "small.jpg", outcome: outcomeCopied, output: "small.jpg", format: "jpeg", width: 160, height: 120, minKB: 3.054, maxKB: 3.054},
+	// PNGs keep their format when it can meet the target and are
+	// converted to JPEG when it can't
+	{file: "rgb.png", outcome: outcomeCompressed, output: "rgb.jpg", format: "jpeg", width: 320, height: 200, minKB: 32, maxKB: 39.6},
+	{file: "paletted.png", outcome: outcomeCompressed, output: "paletted.jpg", format: "jpeg", width: 300, height: 200, minKB: 30, maxKB: 39.6},
+	{file: "rgba.png", outcome: outcomeCompressed, output: "rgba.png", format: "png", width: 320, height: 240, minKB: 20, maxKB: 33},
+	{file: "gray16.png", outcome: outcomeCompressed, output: "gray16.png", format: "png", width: 256, height: 192, minKB: 24, maxKB: 36},
+	{file: "logo.png", outcome: outcomeCopied, output: "logo.png", format: "png", width: 128, height: 128, minKB: 0.44, maxKB: 0.44},
+	{file: "animated.gif", outcome: outcomeCompressed, output: "animated.gif", format: "gif", width: 88, height: 66, minKB: 28, maxKB: 39.6},
+	// Corrupt files fail rather than being copied or written half-decoded
+	{file: "corrupt/truncated.jpg", outcome: outcomeFailed},
+	{file: "corrupt/truncated.png", outcome: outcomeFailed},
+	{file: "corrupt/bad-crc.png", outcome: outcomeFailed},
+	{file: "corrupt/garbage.jpg", outcome: outcomeFailed},
+	{file: "corrupt/empty.png", outcome: outcomeFailed},
+	{file: "corrupt/header-only.jpg", target: "0.5KB", outcome: outcomeFailed},
+}
+
+func TestGolden(t *testing.T) {
+	for _, tt := range goldenCases {
+		t.Run(tt.file, func(t *testing.T) {
+			target := tt.target
+			if target == "" {
+				target = "40KB"
+			}
+			out := t.TempDir()
+			result := compressFile(t, filepath.Join("testdata", tt.file), out, "-target", target)
+			if result.Outcome != tt.outcome {
+				t.Fatalf("outcome %v (%s), want %v", result.Outcome, result.Error, tt.outcome)
+			}
+			if tt.outcome == outcomeFailed {
+				if entries, _ := os.ReadDir(out); len(entries) > 0 {
+					t.Errorf("failed file left %s in the output directory", entries[0].Name())
+				}
+				return
+			}
+			if got := filepath.Base(result.Output); got != tt.output {
+				t.Errorf("output %s, want %s", got, tt.output)
+			}
+			file, err := os.Open(result.Output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			cfg, format, err := decodeConfig(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tt.format || cfg.Width != tt.width || cfg.Height != tt.height {
+				t.Errorf("output is a %dx%d %s, want a %dx%d %s", cfg.Width, cfg.Height, format, tt.width, tt.height, tt.format)
+			}
+			info, err := file.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			kb := float64(info.Size()) / 1000
+			if kb < tt.minKB || kb > tt.maxKB || info.Size() != result.OutputBytes {
+				t.Errorf("output is %.2f KB (reported %d bytes), want %.2f to %.2f KB", kb, result.OutputBytes, tt.minKB, tt.maxKB)
+			}
+		})
+	}
+}
+
+func TestGoldenKeepsOrientation(t *testing.T) {
+	for _, name := range []string{"orientation-3.jpg", "orientation-6.jpg", "orientation-8.jpg"} {
+		t.Run(name, func(t *testing.T) {
+			result := compressFile(t, filepath.Join("testdata", name), t.TempDir(), "-target", "40KB", "-keep-metadata")
+			if result.Outcome != outcomeCompressed {
+				t.Fatalf("outcome %v (%s)", result.Outcome, result.Error)
+			}
+			segments, err := readJPEGMetadata(result.Output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := uint16(name[len("orientation-")] - '0')
+			for _, s := range segments {
+				if !bytes.HasPrefix(s.data, exifHeader) {
+					continue
+				}
+				tiff, off, ok := parseTIFF(s.data[len(exifHeader):])
+				entries, _, ok2 := tiff.ifd(off)
+				if !ok || !ok2 {
+					t.Fatal("output has malformed EXIF")
+				}
+				for _, e := range entries {
+					if e.tag == 0x0112 {
+						if got := tiff.order.Uint16(tiff.buf[tiff.valuePos(e):]); got != want {
+							t.Errorf("orientation %v, want %v", got, want)
+						}
+						return
+					}
+				}
+				t.Fatal("output has no orientation")
+			}
+			t.Error("output has no EXIF")
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const gpsPrecisionUsage = "round the GPS coordinates of outputs that carry metadata to this many decimal places of a degree, from 0 to 6, e.g. 2 for about a kilometer, keeping a rough location but not the address (default off)"
+
+// maxGPSPrecision is the most decimal places -gps-precision rounds to,
+// finer than any GPS.
+const maxGPSPrecision = 6
+
+// gpsPrecision is how many decimal places of a degree -gps-precision rounds
+// GPS coordinates to, or -1 when they are kept as they are. It only
+// reaches outputs that carry metadata: with -keep-metadata, or copied
+// without -strip-copies.
+var gpsPrecision = -1
+
+// parseGPSPrecision sets gpsPrecision from a number of decimal places, or
+// turns rounding off for "" and "off".
+func parseGPSPrecision(s string) error {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "off" {
+		gpsPrecision = -1
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > maxGPSPrecision {
+		return fmt.Errorf("invalid GPS precision %q, want 0 to %d decimal places or off", s, maxGPSPrecision)
+	}
+	gpsPrecision = n
+	return nil
+}
+
+// GPS IFD tags holding coordinates, each three rationals: degrees, minutes
+// and seconds.
+const (
+	tagGPSLatitude      = 0x2
+	tagGPSLongitude     = 0x4
+	tagGPSDestLatitude  = 0x14
+	tagGPSDestLongitude = 0x16
+)
+
+// roundedCoordinate returns the magnitude of a coordinate in degrees
+// rounded to gpsPrecision, as whole degrees and minutes over scale.
+func roundedCoordinate(degrees float64) (whole, minutes, scale uint32) {
+	scale = uint32(math.Pow10(gpsPrecision))
+	k := uint32(math.Round(math.Abs(degrees) * float64(scale)))
+	return k / scale, k % scale * 60, scale
+}
+
+// roundEXIFGPS rounds the coordinates in the GPS IFD of an EXIF APP1
+// payload to gpsPrecision, in place. Each becomes whole degrees and
+// minutes, with no seconds.
+func roundEXIFGPS(payload []byte) {
+	if gpsPrecision < 0 || !bytes.HasPrefix(payload, exifHeader) {
+		return
+	}
+	t, ifd0, ok := parseTIFF(payload[len(exifHeader):])
+	if !ok {
+		return
+	}
+	entries, _, ok := t.ifd(ifd0)
+	if !ok {
+		return
+	}
+	for _, e := range entries {
+		if e.tag != tagGPSIFD {
+			continue
+		}
+		gps, _, ok := t.ifd(t.order.Uint32(t.buf[e.pos+8:]))
+		if !ok {
+			return
+		}
+		for _, f := range gps {
+			switch f.tag {
+			case tagGPSLatitude, tagGPSLongitude, tagGPSDestLatitude, tagGPSDestLongitude:
+			default:
+				continue
+			}
+			pos := t.valuePos(f)
+			if f.typ != tiffRational || f.count != 3 || uint64(pos)+24 > uint64(len(t.buf)) {
+				continue
+			}
+			value := t.buf[pos : pos+24]
+			var degrees float64
+			for i, unit := range []float64{1, 60, 3600} {
+				d := t.order.Uint32(value[8*i+4:])
+				if d == 0 {
+					continue
+				}
+				degrees += float64(t.order.Uint32(value[8*i:])) / float64(d) / unit
+			}
+			whole, minutes, scale := roundedCoordinate(degrees)
+			for i, r := range [][2]uint32{{whole, 1}, {minutes, scale}, {0, 1}} {
+				t.order.PutUint32(value[8*i:], r[0])
+				t.order.PutUint32(value[8*i+4:], r[1])
+			}
+		}
+		return
+	}
+}
+
+// xmpGPSPattern matches the coordinates XMP records, as attributes or
+// elements, capturing what precedes the value and the value, such as
+// 37,46.4417N or 37,46,26.5N.
+var xmpGPSPattern = regexp.MustCompile(`(exif:GPS(?:Dest)?(?:Latitude|Longitude)(?:\s*=\s*["']|>))([0-9.,]+[NSEW])`)
+
+// roundXMPGPS returns an XMP APP1 payload with its coordinates rounded to
+// gpsPrecision, written as degrees and decimal minutes.
+func roundXMPGPS(payload []byte) []byte {
+	if gpsPrecision < 0 {
+		return payload
+	}
+	return xmpGPSPattern.ReplaceAllFunc(payload, func(match []byte) []byte {
+		m := xmpGPSPattern.FindSubmatch(match)
+		value := string(m[2])
+		parts := strings.Split(value[:len(value)-1], ",")
+		if len(parts) < 2 || len(parts) > 3 {
+			return match
+		}
+		var degrees float64
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return match
+			}
+			degrees += v / math.Pow(60, float64(i))
+		}
+		whole, minutes, scale := roundedCoordinate(degrees)
+		rounded := fmt.Sprintf("%d,%s%c", whole, strconv.FormatFloat(float64(minutes)/float64(scale), 'f', -1, 64), value[len(value)-1])
+		return append(append([]byte(nil), m[1]...), rounded...)
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// selfCheckTimeout is how long the scratch encode may take before the
+	// encoder is considered wedged.
+	selfCheckTimeout = 10 * time.Second
+	// stuckFileTimeout is how long a single image may be processed before
+	// the watcher is reported unhealthy.
+	stuckFileTimeout = 15 * time.Minute
+)
+
+// serveHealth serves /healthz and /readyz for w on addr until the process
+// exits, along with POST /pause and /resume to hold and restart the queue.
+// The listener is opened before returning so a bad address is reported at
+// startup.
+func serveHealth(addr string, w *watcher) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		writeProbe(rw, w.healthy())
+	})
+	mux.HandleFunc("/readyz", func(rw http.ResponseWriter, r *http.Request) {
+		writeProbe(rw, w.ready())
+	})
+	for path, paused := range map[string]bool{"/pause": true, "/resume": false} {
+		mux.HandleFunc(path, func(rw http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				rw.Header().Set("Allow", http.MethodPost)
+				http.Error(rw, "use POST", http.StatusMethodNotAllowed)
+				return
+			}
+			switchPause(w, paused)
+			writeProbe(rw, nil)
+		})
+	}
+	go http.Serve(listener, mux)
+	return nil
+}
+
+func writeProbe(rw http.ResponseWriter, err error) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(rw, err)
+		return
+	}
+	fmt.Fprintln(rw, "ok")
+}
+
+// healthy reports whether the process can still compress images: a tiny
+// scratch encode must finish in time, and no file may have been in progress
+// for longer than stuckFileTimeout.
+func (w *watcher) healthy() error {
+	w.mu.Lock()
+	var current string
+	var since time.Time
+	for name, started := range w.active {
+		if current == "" || started.Before(since) {
+			current, since = name, started
+		}
+	}
+	w.mu.Unlock()
+	if current != "" && time.Since(since) > stuckFileTimeout {
+		return fmt.Errorf("stuck on %s for %s", current, time.Since(since).Round(time.Second))
+	}
+	return encoderSelfCheck(selfCheckTimeout)
+}
+
+// ready reports whether the watcher is doing its job: it has finished a scan,
+// the last scan succeeded, and it isn't paused.
+func (w *watcher) ready() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case w.lastScan.IsZero():
+		return fmt.Errorf("initial scan not finished")
+	case w.scanErr != nil:
+		return fmt.Errorf("last scan failed: %v", w.scanErr)
+	case w.paused:
+		return fmt.Errorf("paused")
+	case w.onBattery:
+		return fmt.Errorf("paused on battery")
+	}
+	return nil
+}
+
+// encoderSelfCheck encodes and decodes a small test image, failing if that
+// errors or takes longer than timeout.
+func encoderSelfCheck(timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+		for i := range img.Pix {
+			img.Pix[i] = uint8(i)
+		}
+		// Encode directly rather than through the size search, which reads
+		// settings a reload may be changing
+		var buffer bytes.Buffer
+		err := jpeg.Encode(&buffer, img, &jpeg.Options{Quality: maxJPEGQuality})
+		if err == nil {
+			_, err = jpeg.Decode(&buffer)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("encoder self-check: %w", err)
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("encoder self-check timed out after %s", timeout)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"path/filepath"
+	"strings"
+
+	"image-compressor/pkg/compressor"
+)
+
+// heicOutput writes compressed outputs as HEIC instead of JPEG, PNG or GIF.
+// It needs a build with the heif tag, which links libheif.
+var heicOutput bool
+
+// errHEICUnsupported is what HEIC decoding and encoding fail with in builds
+// without libheif.
+var errHEICUnsupported = errors.New("HEIC needs a build with libheif (go build -tags heif)")
+
+// heicQualities bound the HEIC quality search.
+const (
+	minHEICQuality = 10
+	maxHEICQuality = 90
+)
+
+// heicOutputPath is where an output is written when it's encoded as HEIC.
+func heicOutputPath(dstPath string) string {
+	return strings.TrimSuffix(dstPath, filepath.Ext(dstPath)) + ".heic"
+}
+
+// compressHEICOutput writes img as a HEIC within targetSize, using the
+// highest quality that fits.
+func compressHEICOutput(log *fileLog, dstPath string, img image.Image) (string, error) {
+	// Binary search: HEIC encodes are too slow to step down one by one
+	lo, hi := minHEICQuality, maxHEICQuality
+	var best []byte
+	for lo <= hi {
+		quality := (lo + hi) / 2
+		data, err := encodeHEIC(img, quality)
+		if err != nil {
+			return "", err
+		}
+		fits := len(data) <= targetSize
+		if fits {
+			best = data
+			lo = quality + 1
+		} else {
+			hi = quality - 1
+		}
+		if traceSearch {
+			next := 0
+			if lo <= hi {
+				next = (lo + hi) / 2
+			}
+			log.Line("  HEIC q%d: %s, %s", quality, formatSize(len(data)), attemptDecision(compressor.Attempt{Fits: fits, Next: next}))
+		}
+	}
+	if best == nil {
+		return "", errCannotMeetTarget
+	}
+	heicPath := heicOutputPath(dstPath)
+	log.Printf("(HEIC) ")
+	return heicPath, writeOutput(heicPath, best)
+}
+
+// decodeHEICFile decodes a HEIC or HEIF source, pointing out the
+// alternatives when this build can't.
+func decodeHEICFile(log *fileLog, srcPath string) (image.Image, error) {
+	endDecode := startSpan("decode")
+	img, err := decodeHEIC(srcPath)
+	endDecode(err)
+	if errors.Is(err, errHEICUnsupported) {
+		log.Printf("\nNote: this build can't read HEIC. Rebuild with -tags heif and libheif installed,\n")
+		log.Printf("or convert HEIC files to JPEG first using:\n")
+		log.Printf("  - macOS: Preview app or Photos app\n")
+		log.Printf("  - Windows: HEIF Image Extensions from Microsoft Store\n")
+		log.Printf("  - Command line: ImageMagick or libheif tools\n")
+	}
+	return img, err
+}
+
+// toNRGBA returns img as an 8-bit *image.NRGBA, converting it if needed.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if n, ok := img.(*image.NRGBA); ok && n.Bounds().Min == (image.Point{}) {
+		return n
+	}
+	bounds := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Src)
+	return out
+}
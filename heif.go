@@ -0,0 +1,121 @@
+//go:build (heif || full) && cgo
+
+package main
+
+/*
+#cgo pkg-config: libheif
+#include <stdlib.h>
+#include <libheif/heif.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"os"
+	"unsafe"
+)
+
+const heifSupported = true
+
+func heifError(err C.struct_heif_error) error {
+	if err.code == C.heif_error_Ok {
+		return nil
+	}
+	return errors.New("libheif: " + C.GoString(err.message))
+}
+
+// decodeHEIC decodes the primary image of the HEIC or HEIF file at path.
+func decodeHEIC(path string) (image.Image, error) {
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+
+	ctx := C.heif_context_alloc()
+	defer C.heif_context_free(ctx)
+	if err := heifError(C.heif_context_read_from_file(ctx, cpath, nil)); err != nil {
+		return nil, err
+	}
+	var handle *C.struct_heif_image_handle
+	if err := heifError(C.heif_context_get_primary_image_handle(ctx, &handle)); err != nil {
+		return nil, err
+	}
+	defer C.heif_image_handle_release(handle)
+
+	width := int(C.heif_image_handle_get_width(handle))
+	height := int(C.heif_image_handle_get_height(handle))
+	if err := checkDecodeSize(image.Config{Width: width, Height: height}); err != nil {
+		return nil, err
+	}
+
+	var decoded *C.struct_heif_image
+	if err := heifError(C.heif_decode_image(handle, &decoded, C.heif_colorspace_RGB, C.heif_chroma_interleaved_RGBA, nil)); err != nil {
+		return nil, err
+	}
+	defer C.heif_image_release(decoded)
+
+	var stride C.int
+	plane := C.heif_image_get_plane_readonly(decoded, C.heif_channel_interleaved, &stride)
+	if plane == nil {
+		return nil, errors.New("libheif: decoded image has no RGBA plane")
+	}
+	src := unsafe.Slice((*byte)(unsafe.Pointer(plane)), int(stride)*height)
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		copy(img.Pix[y*img.Stride:y*img.Stride+4*width], src[y*int(stride):])
+	}
+	return img, nil
+}
+
+// encodeHEIC encodes img as HEVC-compressed HEIC at quality, 0 to 100.
+func encodeHEIC(img image.Image, quality int) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	rgba := toNRGBA(img)
+
+	ctx := C.heif_context_alloc()
+	defer C.heif_context_free(ctx)
+
+	var encoder *C.struct_heif_encoder
+	if err := heifError(C.heif_context_get_encoder_for_format(ctx, C.heif_compression_HEVC, &encoder)); err != nil {
+		return nil, err
+	}
+	defer C.heif_encoder_release(encoder)
+	if err := heifError(C.heif_encoder_set_lossy_quality(encoder, C.int(quality))); err != nil {
+		return nil, err
+	}
+
+	var frame *C.struct_heif_image
+	if err := heifError(C.heif_image_create(C.int(width), C.int(height), C.heif_colorspace_RGB, C.heif_chroma_interleaved_RGBA, &frame)); err != nil {
+		return nil, err
+	}
+	defer C.heif_image_release(frame)
+	if err := heifError(C.heif_image_add_plane(frame, C.heif_channel_interleaved, C.int(width), C.int(height), 8)); err != nil {
+		return nil, err
+	}
+	var stride C.int
+	plane := C.heif_image_get_plane(frame, C.heif_channel_interleaved, &stride)
+	dst := unsafe.Slice((*byte)(unsafe.Pointer(plane)), int(stride)*height)
+	for y := 0; y < height; y++ {
+		copy(dst[y*int(stride):], rgba.Pix[y*rgba.Stride:y*rgba.Stride+4*width])
+	}
+
+	if err := heifError(C.heif_context_encode_image(ctx, frame, encoder, nil, nil)); err != nil {
+		return nil, err
+	}
+
+	// libheif writes to files or through callbacks; a temporary file keeps
+	// the binding simple
+	tmp, err := os.CreateTemp("", shortName+"-*.heic")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+	cpath := C.CString(tmpPath)
+	defer C.free(unsafe.Pointer(cpath))
+	if err := heifError(C.heif_context_write_to_file(ctx, cpath)); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(tmpPath)
+}
@@ -0,0 +1,15 @@
+//go:build !(heif || full) || !cgo
+
+package main
+
+import "image"
+
+const heifSupported = false
+
+func decodeHEIC(path string) (image.Image, error) {
+	return nil, errHEICUnsupported
+}
+
+func encodeHEIC(img image.Image, quality int) ([]byte, error) {
+	return nil, errHEICUnsupported
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// printUsage is the usage of the binary itself: the flags for a batch
+// without a subcommand, and the list of subcommands.
+func printUsage() {
+	writeUsage(flag.CommandLine.Output())
+}
+
+func writeUsage(w io.Writer) {
+	name := programName()
+	fmt.Fprintf(w, "Usage: %s [flags] [file or dir ...]  compress images, by default those next to the binary\n", name)
+	fmt.Fprintf(w, "       %s <command> [flags]\n\n", name)
+	fmt.Fprintln(w, "Commands:")
+	width := 0
+	for _, cmd := range commands {
+		width = max(width, len(cmd.name))
+	}
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun '%s help <command>' for the flags of a command.\n\nFlags:\n", name)
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	registerCompressionFlags(fs)
+	registerInputOutput(fs, new(string), new(string))
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// runHelp implements the help subcommand, which prints the usage of the
+// binary or of one command.
+func runHelp(args []string) error {
+	if len(args) == 0 {
+		writeUsage(os.Stdout)
+		return nil
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("usage: %s help [command]", programName())
+	}
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		fmt.Printf("%s %s: %s\n\n", programName(), cmd.name, cmd.summary)
+		if cmd.flags == nil {
+			usage := fmt.Sprintf("Usage: %s %s", programName(), cmd.name)
+			if len(cmd.words) > 0 {
+				usage += " " + strings.Join(cmd.words, "|")
+			}
+			fmt.Println(usage)
+			return nil
+		}
+		fs := cmd.flags()
+		fs.SetOutput(os.Stdout)
+		fs.Usage()
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// iccProfile is an RGB matrix/TRC ICC profile: per-channel tone curves into
+// linear light, then a matrix into the D50 XYZ connection space. Display
+// profiles such as Adobe RGB, Display P3 and ProPhoto RGB all take this
+// form.
+type iccProfile struct {
+	curves [3]func(float64) float64
+	matrix [3][3]float64
+}
+
+// srgbD50 is the sRGB to D50 XYZ matrix as the standard sRGB profile
+// states it; srgbFromXYZ is its inverse.
+var (
+	srgbD50 = [3][3]float64{
+		{0.4360747, 0.3850649, 0.1430804},
+		{0.2225045, 0.7168786, 0.0606169},
+		{0.0139322, 0.0971045, 0.7141733},
+	}
+	srgbFromXYZ = invert3(srgbD50)
+)
+
+// readICCProfile returns the ICC profile embedded in the JPEG or PNG at
+// path, or nil if it has none.
+func readICCProfile(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return jpegICCProfile(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return pngICCProfile(data[8:])
+	}
+	return nil
+}
+
+// jpegICCProfile reassembles the profile split across the APP2 segments of
+// a JPEG.
+func jpegICCProfile(data []byte) []byte {
+	segments, err := readJPEGMetadataFrom(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	type chunk struct {
+		seq  byte
+		data []byte
+	}
+	var chunks []chunk
+	for _, s := range segments {
+		if metadataKind(s) == metaICC && len(s.data) >= 14 {
+			chunks = append(chunks, chunk{s.data[12], s.data[14:]})
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].seq < chunks[j].seq })
+	var profile []byte
+	for _, c := range chunks {
+		profile = append(profile, c.data...)
+	}
+	return profile
+}
+
+// pngICCProfile inflates the iCCP chunk of the PNG chunks in data.
+func pngICCProfile(data []byte) []byte {
+	for len(data) >= 12 {
+		length := int(binary.BigEndian.Uint32(data))
+		if length < 0 || len(data) < 12+length {
+			return nil
+		}
+		kind, body := string(data[4:8]), data[8:8+length]
+		switch kind {
+		case "iCCP":
+			// Profile name, NUL, compression method, zlib stream
+			nul := bytes.IndexByte(body, 0)
+			if nul < 0 || nul+2 > len(body) {
+				return nil
+			}
+			r, err := zlib.NewReader(bytes.NewReader(body[nul+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := io.ReadAll(io.LimitReader(r, 16<<20))
+			if err != nil {
+				return nil
+			}
+			return profile
+		case "IDAT", "IEND":
+			// The profile has to come before the image data
+			return nil
+		}
+		data = data[12+length:]
+	}
+	return nil
+}
+
+// parseICCProfile parses an RGB matrix/TRC profile. It returns false for
+// anything else, such as CMYK or lookup-table profiles, which are left
+// alone.
+func parseICCProfile(data []byte) (*iccProfile, bool) {
+	if len(data) < 132 || string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return nil, false
+	}
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + 12*i
+		if entry+12 > len(data) {
+			return nil, false
+		}
+		offset := int(binary.BigEndian.Uint32(data[entry+4:]))
+		size := int(binary.BigEndian.Uint32(data[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, false
+		}
+		tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+
+	p := new(iccProfile)
+	for i, name := range []string{"r", "g", "b"} {
+		xyz := tags[name+"XYZ"]
+		if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, false
+		}
+		for row := 0; row < 3; row++ {
+			p.matrix[row][i] = s15Fixed16(xyz[8+4*row:])
+		}
+		curve, ok := parseICCCurve(tags[name+"TRC"])
+		if !ok {
+			return nil, false
+		}
+		p.curves[i] = curve
+	}
+	return p, true
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseICCCurve parses a curv or para tone curve.
+func parseICCCurve(data []byte) (func(float64) float64, bool) {
+	if len(data) < 12 {
+		return nil, false
+	}
+	switch string(data[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(data[8:]))
+		if len(data) < 12+2*n {
+			return nil, false
+		}
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, true
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(data[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, true
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(data[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := min(int(pos), n-2)
+			t := pos - float64(i)
+			return table[i]*(1-t) + table[i+1]*t
+		}, true
+	case "para":
+		kind := binary.BigEndian.Uint16(data[8:])
+		counts := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+		n, ok := counts[kind]
+		if !ok || len(data) < 12+4*n {
+			return nil, false
+		}
+		// Parameters g, a, b, c, d, e, f as in the ICC specification
+		var v [7]float64
+		for i := 0; i < n; i++ {
+			v[i] = s15Fixed16(data[12+4*i:])
+		}
+		g, a, b, c, d, e, f := v[0], v[1], v[2], v[3], v[4], v[5], v[6]
+		switch kind {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, g) }, true
+		case 1, 2:
+			if a == 0 {
+				return nil, false
+			}
+			if kind == 1 {
+				c = 0
+			}
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			}, true
+		default:
+			if kind == 3 {
+				e, f = 0, 0
+			}
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// toSRGB returns the matrix from the profile's linear RGB to linear sRGB,
+// and whether the profile is sRGB itself to within rounding, in which case
+// no conversion is needed.
+func (p *iccProfile) toSRGB() ([3][3]float64, bool) {
+	m := multiply3(srgbFromXYZ, p.matrix)
+	same := true
+	for i := range m {
+		for j := range m[i] {
+			want := 0.0
+			if i == j {
+				want = 1
+			}
+			same = same && math.Abs(m[i][j]-want) < 0.01
+		}
+		same = same && math.Abs(p.curves[i](0.5)-srgbToLinear(0.5)) < 0.01
+	}
+	return m, same
+}
+
+// convertToSRGB converts img from the color space of profile to 8-bit
+// sRGB.
+func convertToSRGB(img image.Image, p *iccProfile) *image.NRGBA {
+	m, _ := p.toSRGB()
+
+	// Tone curves on 16-bit input, and the sRGB curve on linear light
+	var curves [3][]float32
+	for i := range curves {
+		curves[i] = make([]float32, 1<<16)
+		for v := range curves[i] {
+			curves[i][v] = float32(p.curves[i](float64(v) / 0xffff))
+		}
+	}
+	const encodeSteps = 1 << 14
+	encode := make([]uint8, encodeSteps+1)
+	for i := range encode {
+		encode[i] = uint8(math.Round(linearToSRGB(float64(i)/encodeSteps) * 255))
+	}
+
+	bounds := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		i := out.PixOffset(0, y-bounds.Min.Y)
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a != 0 && a != 0xffff {
+				r, g, b = r*0xffff/a, g*0xffff/a, b*0xffff/a
+			}
+			lr, lg, lb := float64(curves[0][r]), float64(curves[1][g]), float64(curves[2][b])
+			for c := 0; c < 3; c++ {
+				v := m[c][0]*lr + m[c][1]*lg + m[c][2]*lb
+				out.Pix[i+c] = encode[int(min(max(v, 0), 1)*encodeSteps+0.5)]
+			}
+			out.Pix[i+3] = uint8(a >> 8)
+			i += 4
+		}
+	}
+	return out
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func multiply3(a, b [3][3]float64) (m [3][3]float64) {
+	for i := range m {
+		for j := range m[i] {
+			for k := 0; k < 3; k++ {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+func invert3(a [3][3]float64) (m [3][3]float64) {
+	det := a[0][0]*(a[1][1]*a[2][2]-a[1][2]*a[2][1]) -
+		a[0][1]*(a[1][0]*a[2][2]-a[1][2]*a[2][0]) +
+		a[0][2]*(a[1][0]*a[2][1]-a[1][1]*a[2][0])
+	for i := range m {
+		for j := range m[i] {
+			// Cofactor of a[j][i], for the transpose
+			r0, r1 := (j+1)%3, (j+2)%3
+			c0, c1 := (i+1)%3, (i+2)%3
+			m[i][j] = (a[r0][c0]*a[r1][c1] - a[r0][c1]*a[r1][c0]) / det
+		}
+	}
+	return m
+}
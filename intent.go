@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Output intents. Web outputs are 8-bit sRGB sized to the target; print
+// outputs keep the source's color space and bit depth and are never made
+// lossy to meet a size.
+const (
+	intentWeb   = "web"
+	intentPrint = "print"
+)
+
+var intent = intentWeb
+
+func parseIntent(s string) error {
+	switch s {
+	case intentWeb, intentPrint:
+		intent = s
+		return nil
+	}
+	return fmt.Errorf("unknown intent %q (want web or print)", s)
+}
+
+// prepareForWeb converts img, decoded from srcPath, to 8-bit sRGB:
+// sources tagged with another RGB profile such as Adobe RGB are converted
+// through it, since browsers and messaging apps mostly ignore profiles, and
+// 16-bit images are reduced to 8 bits.
+func prepareForWeb(log *fileLog, srcPath string, img image.Image) image.Image {
+	if intent != intentWeb {
+		return img
+	}
+	if profile, ok := parseICCProfile(readICCProfile(srcPath)); ok {
+		if _, same := profile.toSRGB(); !same {
+			log.Printf("(converting to sRGB) ")
+			return convertToSRGB(img, profile)
+		}
+	}
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64:
+		return toNRGBA(img)
+	case *image.Gray16:
+		bounds := img.Bounds()
+		out := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Src)
+		return out
+	}
+	return img
+}
+
+// needsWebConversion reports whether the source at srcPath is tagged with
+// a color profile prepareForWeb converts from, so it can't be used as is.
+func needsWebConversion(srcPath string) bool {
+	if intent != intentWeb {
+		return false
+	}
+	profile, ok := parseICCProfile(readICCProfile(srcPath))
+	if !ok {
+		return false
+	}
+	_, same := profile.toSRGB()
+	return !same
+}
+
+// dropsICCProfile reports whether outputs of the JPEG at srcPath leave its
+// color profile out, because prepareForWeb has converted the pixels to
+// sRGB.
+func dropsICCProfile(srcPath string) bool {
+	if intent != intentWeb {
+		return false
+	}
+	_, ok := parseICCProfile(readICCProfile(srcPath))
+	return ok
+}
+
+// tiffOutputPath is where a print output is written.
+func tiffOutputPath(dstPath string) string {
+	return strings.TrimSuffix(dstPath, filepath.Ext(dstPath)) + ".tif"
+}
+
+// compressPrint writes the print output for srcPath and returns its path.
+// JPEG sources are copied as they are, since re-encoding them could only
+// lose more, unless they have regions to redact. Everything else is written as a lossless TIFF at the source's
+// bit depth with its color profile embedded. The target size doesn't
+// apply; only -max-dimension does.
+func compressPrint(log *fileLog, srcPath, dstPath string) (string, error) {
+	if sniffImageExt(srcPath) == ".jpg" && !exceedsMaxDimension(srcPath) && !redacts(srcPath) {
+		data, err := os.ReadFile(srcPath)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("(JPEG kept as is) ")
+		return dstPath, writeOutput(dstPath, data)
+	}
+
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	endDecode := startSpan("decode")
+	img, _, err := decodeLimited(file)
+	endDecode(err)
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+	if img, err = redact(log, srcPath, img); err != nil {
+		return "", err
+	}
+
+	tiffPath := tiffOutputPath(dstPath)
+	var buffer bytes.Buffer
+	if err := encodeTIFF(&buffer, capDimensions(img), readICCProfile(srcPath)); err != nil {
+		return "", err
+	}
+	log.Printf("(lossless TIFF) ")
+	return tiffPath, writeOutput(tiffPath, buffer.Bytes())
+}
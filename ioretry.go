@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// A file whose processing fails with a transient I/O error is processed
+// again up to ioRetries times, waiting ioRetryDelay before the first retry
+// and twice as long before each one after it.
+var (
+	ioRetries    = 3
+	ioRetryDelay = time.Second
+)
+
+// isTransientIOError reports whether err is an I/O error that network
+// shares report while a connection drops or a server is slow, and that can
+// go away on its own. Decode errors, which mean a file is damaged, are not.
+func isTransientIOError(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && slices.Contains(transientErrnos, errno)
+}
+
+// processFileRetrying runs processFile, running it again from the start
+// while it fails with a transient I/O error and retries remain.
+func processFileRetrying(filePath, compressedDir string) fileResult {
+	delay := ioRetryDelay
+	for attempt := 0; ; attempt++ {
+		result := processFile(filePath, compressedDir)
+		if !result.Transient || attempt >= ioRetries {
+			return result
+		}
+		log := &fileLog{source: filePath}
+		log.Printf("Transient I/O error on %s, retrying in %s (%d of %d)...\n", filepath.Base(filePath), delay, attempt+1, ioRetries)
+		log.flush()
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !unix && !windows
+
+package main
+
+import "syscall"
+
+var transientErrnos []syscall.Errno
@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// transientErrnos are the errors NFS and SMB mounts fail reads and writes
+// with while the server or the network is having trouble. EIO is among
+// them because soft mounts report timeouts that way.
+var transientErrnos = []syscall.Errno{
+	syscall.EIO,
+	syscall.EINTR,
+	syscall.EAGAIN,
+	syscall.EBUSY,
+	syscall.ESTALE,
+	syscall.ETIMEDOUT,
+	syscall.ECONNRESET,
+	syscall.ECONNABORTED,
+	syscall.ECONNREFUSED,
+	syscall.ENETDOWN,
+	syscall.ENETUNREACH,
+	syscall.ENETRESET,
+	syscall.EHOSTDOWN,
+	syscall.EHOSTUNREACH,
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import "syscall"
+
+// transientErrnos are the errors Windows fails reads and writes on network
+// shares with while the server or the network is having trouble, plus
+// sharing violations from other programs briefly holding a file.
+var transientErrnos = []syscall.Errno{
+	32,   // ERROR_SHARING_VIOLATION
+	33,   // ERROR_LOCK_VIOLATION
+	51,   // ERROR_REM_NOT_LIST
+	53,   // ERROR_BAD_NETPATH
+	54,   // ERROR_NETWORK_BUSY
+	59,   // ERROR_UNEXP_NET_ERR
+	64,   // ERROR_NETNAME_DELETED
+	121,  // ERROR_SEM_TIMEOUT
+	1231, // ERROR_NETWORK_UNREACHABLE
+	1236, // ERROR_CONNECTION_ABORTED
+}
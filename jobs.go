@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// jobEntry overrides the compression settings of the files matching
+// Match, a path pattern relative to the batch directory such as cover.jpg
+// or icons/*.png.
+type jobEntry struct {
+	Match        string `json:"match"`
+	Target       string `json:"target"`
+	MaxDimension int    `json:"max_dimension"`
+	Effort       int    `json:"effort"`
+	// Format is "jpeg" to convert matching files to JPEG, "original" to
+	// keep their own format, or empty to decide as usual.
+	Format string `json:"format"`
+	// Lossless keeps matching files in their own format and resolution,
+	// so PNG and GIF sources are only ever re-encoded without loss.
+	Lossless bool `json:"lossless"`
+	// Layers and HiddenLayers pick the layers layered documents are
+	// flattened from, as -layers and -hidden-layers do.
+	Layers       string `json:"layers"`
+	HiddenLayers bool   `json:"hidden_layers"`
+
+	settings compressionSettings
+}
+
+// jobsUsage is the usage of the -jobs flag of batch runs.
+const jobsUsage = "JSON or CSV file of per-file overrides (match, target, max_dimension, effort, format, lossless, layers, hidden_layers); the first matching entry applies"
+
+// loadJobs reads a job file and resolves each entry against base, the
+// settings of the files no entry matches. A .csv file has a header row
+// naming its columns; anything else is read as a JSON array.
+func loadJobs(name string, base compressionSettings) ([]*jobEntry, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*jobEntry
+	if strings.EqualFold(filepath.Ext(name), ".csv") {
+		jobs, err = parseJobsCSV(string(data))
+	} else {
+		err = json.Unmarshal(data, &jobs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	for i, job := range jobs {
+		if err := job.resolve(base); err != nil {
+			return nil, fmt.Errorf("%s: entry %d (%s): %w", name, i+1, job.Match, err)
+		}
+	}
+	return jobs, nil
+}
+
+// parseJobsCSV reads job entries from CSV, matching columns by name.
+func parseJobsCSV(data string) ([]*jobEntry, error) {
+	records, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["match"]; !ok {
+		return nil, fmt.Errorf("no match column")
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	var jobs []*jobEntry
+	for line, record := range records[1:] {
+		job := &jobEntry{
+			Match:  field(record, "match"),
+			Target: field(record, "target"),
+			Format: field(record, "format"),
+			Layers: field(record, "layers"),
+		}
+		var err error
+		if s := field(record, "max_dimension"); s != "" {
+			job.MaxDimension, err = strconv.Atoi(s)
+		}
+		if s := field(record, "effort"); s != "" && err == nil {
+			job.Effort, err = strconv.Atoi(s)
+		}
+		if s := field(record, "lossless"); s != "" && err == nil {
+			job.Lossless, err = strconv.ParseBool(s)
+		}
+		if s := field(record, "hidden_layers"); s != "" && err == nil {
+			job.HiddenLayers, err = strconv.ParseBool(s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line+2, err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// resolve validates the entry and works out its settings.
+func (j *jobEntry) resolve(base compressionSettings) error {
+	j.Match = filepath.ToSlash(j.Match)
+	if _, err := path.Match(j.Match, ""); err != nil || j.Match == "" {
+		return fmt.Errorf("invalid match pattern %q", j.Match)
+	}
+	if j.Effort != 0 && (j.Effort < minEffort || j.Effort > maxEffort) {
+		return fmt.Errorf("effort must be between %d and %d", minEffort, maxEffort)
+	}
+	if j.MaxDimension < 0 {
+		return fmt.Errorf("max_dimension must not be negative")
+	}
+
+	j.settings = base
+	if j.Target != "" {
+		limit, err := parseSize(j.Target)
+		if err != nil {
+			return err
+		}
+		j.settings.uploadLimit = limit
+		j.settings.targetSize = j.settings.sizeMargin.below(limit)
+		if j.settings.targetSize <= 0 {
+			return fmt.Errorf("target %s leaves nothing after the %s margin", j.Target, j.settings.sizeMargin)
+		}
+	}
+	if j.MaxDimension > 0 {
+		j.settings.maxDimension = j.MaxDimension
+	}
+	if j.Effort > 0 {
+		j.settings.effort = j.Effort
+	}
+	switch strings.ToLower(j.Format) {
+	case "":
+	case "jpeg", "jpg":
+		if j.Lossless {
+			return fmt.Errorf("jpeg output can't be lossless")
+		}
+		j.settings.convertAll = true
+		j.settings.noConvert = false
+	case "original":
+		j.settings.noConvert = true
+		j.settings.convertAll = false
+	default:
+		return fmt.Errorf("unknown format %q (want jpeg or original)", j.Format)
+	}
+	if j.Lossless {
+		j.settings.noConvert = true
+		j.settings.convertAll = false
+		j.settings.keepBoth = false
+		j.settings.skipUpscaleCheck = true
+		j.settings.maxDimension = j.MaxDimension
+	}
+	if j.settings.noConvert {
+		j.settings.keepBoth = false
+	}
+	if names := splitLayerNames(j.Layers); len(names) > 0 {
+		j.settings.layerNames = names
+	}
+	if j.HiddenLayers {
+		j.settings.hiddenLayers = true
+	}
+	return nil
+}
+
+// matchJob returns the first of jobs whose pattern matches rel, a slash
+// separated path relative to the batch directory, or nil. Patterns without
+// a slash also match the file name alone.
+func matchJob(jobs []*jobEntry, rel string) *jobEntry {
+	for _, job := range jobs {
+		if ok, _ := path.Match(job.Match, rel); ok {
+			return job
+		}
+		if !strings.Contains(job.Match, "/") {
+			if ok, _ := path.Match(job.Match, path.Base(rel)); ok {
+				return job
+			}
+		}
+	}
+	return nil
+}
+
+// processJobFile is processFile under the settings of the job entry that
+// matches filePath, if any, and then of the directives in its name. A file
+// with settings of its own runs while no other file of the batch does.
+func processJobFile(jobs []*jobEntry, dir, filePath, compressedDir string) fileResult {
+	rel, err := filepath.Rel(dir, filePath)
+	if err != nil {
+		rel = filepath.Base(filePath)
+	}
+	job := matchJob(jobs, filepath.ToSlash(rel))
+	directives, _ := splitDirectives(filePath)
+	if job == nil && directives == nil {
+		settingsMu.RLock()
+		defer settingsMu.RUnlock()
+		return processFileRetrying(filePath, compressedDir)
+	}
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	base := currentSettings()
+	defer base.apply()
+	settings := base
+	if job != nil {
+		settings = job.settings
+	}
+	if err := applyDirectives(&settings, directives); err != nil {
+		log := &fileLog{source: filePath}
+		log.Printf("Processing %s... ERROR: %v\n", filepath.Base(filePath), err)
+		log.flush()
+		return fileResult{Source: filePath}.failed(err)
+	}
+	settings.apply()
+	return processFileRetrying(filePath, compressedDir)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"image"
+)
+
+// errJPEG2000Unsupported is what JPEG 2000 decoding fails with in builds
+// without libopenjp2.
+var errJPEG2000Unsupported = errors.New("JPEG 2000 needs a build with libopenjp2 (go build -tags jp2)")
+
+// jpeg2000Signatures start JPEG 2000 files: the JP2 (and JPX) signature box,
+// and a bare codestream's SOC and SIZ markers, as .j2k and .j2c files and
+// DICOM store them.
+var jpeg2000Signatures = []string{
+	"\x00\x00\x00\x0cjP  \r\n\x87\n",
+	"\xff\x4f\xff\x51",
+}
+
+// isJPEG2000 reports whether the file at path is JPEG 2000. Few viewers
+// open those, so they are converted even when they are under the target.
+func isJPEG2000(path string) bool {
+	ext := sniffImageExt(path)
+	return ext == ".jp2" || ext == ".j2k"
+}
+
+// JPEG 2000 goes through image.Decode like the formats of the standard
+// library. Builds without libopenjp2 still recognize it, so the error says
+// what's missing instead of "unknown format".
+func init() {
+	for _, signature := range jpeg2000Signatures {
+		image.RegisterFormat("jpeg2000", signature, decodeJPEG2000, decodeJPEG2000Config)
+	}
+}
@@ -0,0 +1,1281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// decodeExtendedJPEG decodes the JPEGs image/jpeg rejects: 12-bit samples,
+// as scanners and medical imaging write, and arithmetic coding, both
+// sequential and progressive, along with sampling ratios image/jpeg
+// doesn't support. 12-bit images come out as 16-bit sRGB, each sample
+// scaled by 65535/4095 so white stays white, rather than truncated to 8
+// bits before resizing.
+func decodeExtendedJPEG(r io.Reader) (image.Image, error) {
+	d, err := readExtendedJPEG(r, readFrame)
+	if err != nil {
+		return nil, err
+	}
+	return d.image(), nil
+}
+
+// jpegStrips decodes a sequential JPEG a row of MCUs at a time, holding
+// only that row's coefficients and samples. Its frame must be coded in one
+// scan, as nearly every sequential JPEG is.
+type jpegStrips struct {
+	d      *extJPEG
+	row    int
+	planes [][]uint16
+	band   *image.RGBA
+}
+
+// openJPEGStrips reads the headers of the JPEG in r for jpegStrips, or
+// returns nil if it is progressive or splits its frame over several
+// scans, which can only be decoded whole.
+func openJPEGStrips(r io.Reader) (*jpegStrips, error) {
+	d, err := readExtendedJPEG(r, readFirstScan)
+	if err != nil {
+		return nil, err
+	}
+	if d.progressive || d.scan == nil || len(d.scan.comps) != len(d.comps) {
+		return nil, nil
+	}
+	j := &jpegStrips{d: d, planes: make([][]uint16, len(d.comps))}
+	for i, c := range d.comps {
+		c.coefs = make([]int32, c.blocksW*c.v*64)
+		j.planes[i] = make([]uint16, c.blocksW*8*c.v*8)
+	}
+	j.band = image.NewRGBA(image.Rect(0, 0, d.width, min(8*d.vmax, d.height)))
+	return j, nil
+}
+
+func (j *jpegStrips) bounds() image.Rectangle {
+	return image.Rect(0, 0, j.d.width, j.d.height)
+}
+
+func (j *jpegStrips) close() {}
+
+// next decodes the next row of MCUs into a band of RGBA rows, reused by
+// the next call, or returns io.EOF after the last.
+func (j *jpegStrips) next() (*image.RGBA, error) {
+	d := j.d
+	if j.row == d.scan.rows {
+		return nil, io.EOF
+	}
+	for _, c := range d.comps {
+		c.firstRow = j.row * c.v
+		clear(c.coefs)
+	}
+	if err := d.scan.decodeRow(j.row); err != nil {
+		return nil, err
+	}
+	for i, c := range d.comps {
+		d.transform(c, j.planes[i])
+	}
+	top := j.row * 8 * d.vmax
+	j.band.Rect = image.Rect(0, top, d.width, min(top+8*d.vmax, d.height))
+	pixel := d.pixels(j.planes)
+	for y := top; y < j.band.Rect.Max.Y; y++ {
+		i := j.band.PixOffset(0, y)
+		for x := 0; x < d.width; x++ {
+			r, g, b := pixel(x, y)
+			j.band.Pix[i], j.band.Pix[i+1], j.band.Pix[i+2], j.band.Pix[i+3] = uint8(r>>8), uint8(g>>8), uint8(b>>8), 0xff
+			i += 4
+		}
+	}
+	j.row++
+	return j.band, nil
+}
+
+// decodeExtendedJPEGConfig returns the size and color model
+// decodeExtendedJPEG would decode r to.
+func decodeExtendedJPEGConfig(r io.Reader) (image.Config, error) {
+	d, err := readExtendedJPEG(r, readConfig)
+	if err != nil {
+		return image.Config{}, err
+	}
+	model := color.Model(color.RGBAModel)
+	switch {
+	case len(d.comps) == 1 && d.precision > 8:
+		model = color.Gray16Model
+	case len(d.comps) == 1:
+		model = color.GrayModel
+	case d.precision > 8:
+		model = color.RGBA64Model
+	}
+	return image.Config{ColorModel: model, Width: d.width, Height: d.height}, nil
+}
+
+// JPEG markers the extended decoder handles. See Table B.1 of ITU T.81.
+const (
+	markerSOF0  = 0xc0 // baseline
+	markerSOF1  = 0xc1 // extended sequential, Huffman
+	markerSOF2  = 0xc2 // progressive, Huffman
+	markerDHT   = 0xc4
+	markerSOF9  = 0xc9 // extended sequential, arithmetic
+	markerSOF10 = 0xca // progressive, arithmetic
+	markerDAC   = 0xcc
+	markerRST0  = 0xd0
+	markerRST7  = 0xd7
+	markerSOI   = 0xd8
+	markerEOI   = 0xd9
+	markerSOS   = 0xda
+	markerDQT   = 0xdb
+	markerDNL   = 0xdc
+	markerDRI   = 0xdd
+	markerAPP14 = 0xee
+)
+
+var errExtendedTruncated = errors.New("jpeg: truncated data")
+
+// zigzag maps the order coefficients are coded in to their position in a
+// block.
+var zigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// extComponent is one color component of the frame, with its coefficients
+// kept until every scan has been read.
+type extComponent struct {
+	id   byte
+	h, v int
+	tq   int
+	// blocksW and blocksH count the component's blocks, padded to whole
+	// MCUs; coefs holds 64 per block in natural order, for the rows of
+	// blocks from firstRow on: all of them, or one MCU row's when the
+	// frame is decoded in strips.
+	blocksW, blocksH int
+	coefs            []int32
+	firstRow         int
+	// The table selectors and predictors of the scan being read
+	td, ta    int
+	dcPred    int32
+	dcContext int
+}
+
+func (c *extComponent) block(bx, by int) []int32 {
+	i := ((by-c.firstRow)*c.blocksW + bx) * 64
+	return c.coefs[i : i+64 : i+64]
+}
+
+// extJPEG is a frame being decoded by decodeExtendedJPEG.
+type extJPEG struct {
+	precision     int
+	width, height int
+	progressive   bool
+	arithmetic    bool
+	comps         []*extComponent
+	hmax, vmax    int
+	mcusX, mcusY  int
+	quant         [4][64]int32
+	huffman       [2][4]*extHuffman
+	// Arithmetic conditioning per table: the DC L and U bounds and the AC
+	// K threshold, set by DAC
+	dcL, dcU, acK [4]int
+	restart       int
+	// adobe is the APP14 color transform, or -1 without an APP14 segment
+	adobe int
+	// scan is the first scan, not yet decoded, when reading stopped there
+	scan *extScan
+}
+
+// How far readExtendedJPEG reads.
+const (
+	// readFrame reads every scan
+	readFrame = iota
+	// readConfig stops after the frame header
+	readConfig
+	// readFirstScan stops after the header of the first scan, leaving its
+	// data to be decoded
+	readFirstScan
+)
+
+func readExtendedJPEG(r io.Reader, stop int) (*extJPEG, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || data[0] != 0xff || data[1] != markerSOI {
+		return nil, errors.New("jpeg: missing SOI marker")
+	}
+	d := &extJPEG{adobe: -1}
+	for i := range d.dcU {
+		d.dcU[i], d.acK[i] = 1, 5
+	}
+	s := &extSegment{data: data, pos: 2}
+	scans := 0
+	for {
+		s.seekMarker()
+		if s.pos+1 >= len(data) {
+			if scans > 0 {
+				// A file cut short after its scans still has a picture
+				return d, nil
+			}
+			return nil, errExtendedTruncated
+		}
+		marker := data[s.pos+1]
+		s.pos += 2
+		switch {
+		case marker == markerEOI:
+			if scans == 0 {
+				return nil, errors.New("jpeg: no image data")
+			}
+			return d, nil
+		case marker == markerSOI || marker >= markerRST0 && marker <= markerRST7 || marker == 0x01:
+			continue
+		}
+		if s.pos+2 > len(data) || s.pos+(int(data[s.pos])<<8|int(data[s.pos+1])) > len(data) {
+			if scans > 0 {
+				// So does one cut short in the tables between its scans
+				return d, nil
+			}
+			return nil, errExtendedTruncated
+		}
+		n := int(data[s.pos])<<8 | int(data[s.pos+1])
+		if n < 2 {
+			return nil, errExtendedTruncated
+		}
+		segment := data[s.pos+2 : s.pos+n]
+		s.pos += n
+		switch marker {
+		case markerSOF0, markerSOF1, markerSOF2, markerSOF9, markerSOF10:
+			if d.comps != nil {
+				return nil, errors.New("jpeg: more than one frame")
+			}
+			d.progressive = marker == markerSOF2 || marker == markerSOF10
+			d.arithmetic = marker == markerSOF9 || marker == markerSOF10
+			if err := d.readSOF(segment); err != nil {
+				return nil, err
+			}
+			if stop == readConfig {
+				return d, nil
+			}
+		case markerDHT:
+			if err := d.readDHT(segment); err != nil {
+				return nil, err
+			}
+		case markerDAC:
+			if err := d.readDAC(segment); err != nil {
+				return nil, err
+			}
+		case markerDQT:
+			if err := d.readDQT(segment); err != nil {
+				return nil, err
+			}
+		case markerDRI:
+			if len(segment) != 2 {
+				return nil, errors.New("jpeg: bad DRI length")
+			}
+			d.restart = int(segment[0])<<8 | int(segment[1])
+		case markerAPP14:
+			if len(segment) >= 12 && string(segment[:5]) == "Adobe" {
+				d.adobe = int(segment[11])
+			}
+		case markerSOS:
+			if d.comps == nil {
+				return nil, errors.New("jpeg: scan before frame")
+			}
+			scan, err := d.readScanHeader(s, segment)
+			if err != nil {
+				return nil, err
+			}
+			if stop == readFirstScan {
+				d.scan = scan
+				return d, nil
+			}
+			if d.comps[0].coefs == nil {
+				for _, c := range d.comps {
+					c.coefs = make([]int32, c.blocksW*c.blocksH*64)
+				}
+			}
+			for row := 0; row < scan.rows; row++ {
+				if err := scan.decodeRow(row); err != nil {
+					return nil, err
+				}
+			}
+			scans++
+		case markerDNL:
+			return nil, errors.New("jpeg: DNL marker not supported")
+		default:
+			if marker >= 0xc0 && marker <= 0xcf {
+				// The rest of the SOF range: lossless and hierarchical
+				return nil, fmt.Errorf("jpeg: unsupported frame type %#x", marker)
+			}
+			// APPn, COM and the like
+		}
+	}
+}
+
+func (d *extJPEG) readSOF(segment []byte) error {
+	if len(segment) < 6 {
+		return errExtendedTruncated
+	}
+	d.precision = int(segment[0])
+	d.height = int(segment[1])<<8 | int(segment[2])
+	d.width = int(segment[3])<<8 | int(segment[4])
+	n := int(segment[5])
+	if d.precision != 8 && d.precision != 12 {
+		return fmt.Errorf("jpeg: %d-bit samples not supported", d.precision)
+	}
+	if d.height == 0 {
+		return errors.New("jpeg: DNL-defined height not supported")
+	}
+	if d.width == 0 {
+		return errors.New("jpeg: zero width")
+	}
+	if n != 1 && n != 3 && n != 4 {
+		return fmt.Errorf("jpeg: %d components not supported", n)
+	}
+	if len(segment) < 6+3*n {
+		return errExtendedTruncated
+	}
+	if err := checkDecodeSize(image.Config{Width: d.width, Height: d.height}); err != nil {
+		return err
+	}
+	d.hmax, d.vmax = 1, 1
+	for i := 0; i < n; i++ {
+		c := &extComponent{id: segment[6+3*i], h: int(segment[7+3*i] >> 4), v: int(segment[7+3*i] & 0x0f), tq: int(segment[8+3*i])}
+		if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 || c.tq > 3 {
+			return errors.New("jpeg: bad component parameters")
+		}
+		if n == 1 {
+			// A lone component's scans are never interleaved
+			c.h, c.v = 1, 1
+		}
+		d.hmax, d.vmax = max(d.hmax, c.h), max(d.vmax, c.v)
+		d.comps = append(d.comps, c)
+	}
+	d.mcusX = (d.width + 8*d.hmax - 1) / (8 * d.hmax)
+	d.mcusY = (d.height + 8*d.vmax - 1) / (8 * d.vmax)
+	for _, c := range d.comps {
+		c.blocksW, c.blocksH = d.mcusX*c.h, d.mcusY*c.v
+	}
+	return nil
+}
+
+func (d *extJPEG) readDHT(segment []byte) error {
+	for len(segment) > 0 {
+		if len(segment) < 17 {
+			return errExtendedTruncated
+		}
+		class, id := segment[0]>>4, segment[0]&0x0f
+		if class > 1 || id > 3 {
+			return errors.New("jpeg: bad Huffman table")
+		}
+		var counts [16]int
+		total := 0
+		for i := range counts {
+			counts[i] = int(segment[1+i])
+			total += counts[i]
+		}
+		if total > 256 || len(segment) < 17+total {
+			return errors.New("jpeg: bad Huffman table")
+		}
+		d.huffman[class][id] = newExtHuffman(counts, segment[17:17+total])
+		segment = segment[17+total:]
+	}
+	return nil
+}
+
+func (d *extJPEG) readDAC(segment []byte) error {
+	for ; len(segment) >= 2; segment = segment[2:] {
+		class, id, value := segment[0]>>4, segment[0]&0x0f, int(segment[1])
+		if id > 3 {
+			return errors.New("jpeg: bad DAC table")
+		}
+		switch class {
+		case 0:
+			d.dcL[id], d.dcU[id] = value&0x0f, value>>4
+			if d.dcL[id] > d.dcU[id] {
+				return errors.New("jpeg: bad DAC value")
+			}
+		case 1:
+			if value < 1 || value > 63 {
+				return errors.New("jpeg: bad DAC value")
+			}
+			d.acK[id] = value
+		default:
+			return errors.New("jpeg: bad DAC table")
+		}
+	}
+	return nil
+}
+
+func (d *extJPEG) readDQT(segment []byte) error {
+	for len(segment) > 0 {
+		precision, id := segment[0]>>4, segment[0]&0x0f
+		if id > 3 || precision > 1 {
+			return errors.New("jpeg: bad quantization table")
+		}
+		size := 64 << precision
+		if len(segment) < 1+size {
+			return errExtendedTruncated
+		}
+		for k := 0; k < 64; k++ {
+			q := int32(segment[1+k])
+			if precision == 1 {
+				q = int32(segment[1+2*k])<<8 | int32(segment[2+2*k])
+			}
+			d.quant[id][zigzag[k]] = q
+		}
+		segment = segment[1+size:]
+	}
+	return nil
+}
+
+// extScan is a scan whose entropy-coded data is being decoded, a row at a
+// time: a row of MCUs, or of blocks for a scan of one component.
+type extScan struct {
+	d     *extJPEG
+	s     *extSegment
+	comps []*extComponent
+	// rows counts the scan's rows
+	rows int
+	// decodeBlock decodes the scan's part of a block's coefficients
+	decodeBlock func(c *extComponent, block []int32) error
+	dec         extEntropy
+	mcu         int
+}
+
+// readScanHeader reads the header of a scan, segment, whose data follows it
+// in s.
+func (d *extJPEG) readScanHeader(s *extSegment, segment []byte) (*extScan, error) {
+	if len(segment) < 1 {
+		return nil, errExtendedTruncated
+	}
+	n := int(segment[0])
+	if n < 1 || n > 4 || len(segment) != 4+2*n {
+		return nil, errors.New("jpeg: bad SOS length")
+	}
+	comps := make([]*extComponent, n)
+	for i := range comps {
+		id := segment[1+2*i]
+		for _, c := range d.comps {
+			if c.id == id {
+				comps[i] = c
+			}
+		}
+		if comps[i] == nil {
+			return nil, errors.New("jpeg: scan of an unknown component")
+		}
+		comps[i].td, comps[i].ta = int(segment[2+2*i]>>4), int(segment[2+2*i]&0x0f)
+		if comps[i].td > 3 || comps[i].ta > 3 {
+			return nil, errors.New("jpeg: bad table selector")
+		}
+	}
+	ss, se := int(segment[1+2*n]), int(segment[2+2*n])
+	ah, al := int(segment[3+2*n]>>4), int(segment[3+2*n]&0x0f)
+	if !d.progressive {
+		ss, ah, al = 0, 0, 0
+		if se == 0 || se > 63 {
+			se = 63
+		}
+	}
+	if ss > se || se > 63 || ss == 0 && se != 0 && d.progressive || ss > 0 && n != 1 || al > 13 {
+		return nil, errors.New("jpeg: bad spectral selection")
+	}
+
+	var dec extEntropy
+	if d.arithmetic {
+		dec = &extArithmetic{s: s, d: d}
+	} else {
+		for _, c := range comps {
+			if ss == 0 && ah == 0 && d.huffman[0][c.td] == nil || se > 0 && d.huffman[1][c.ta] == nil {
+				return nil, errors.New("jpeg: missing Huffman table")
+			}
+		}
+		dec = &extHuffmanDecoder{s: s, d: d}
+	}
+	scan := &extScan{d: d, s: s, comps: comps, dec: dec, rows: d.mcusY}
+	if n == 1 {
+		// A scan of one component codes its blocks in raster order, only
+		// those covering the image
+		scan.rows = (ceilDiv(d.height*comps[0].v, d.vmax) + 7) / 8
+	}
+	scan.decodeBlock = func(c *extComponent, block []int32) error {
+		switch {
+		case ss == 0 && ah == 0:
+			if err := dec.dcFirst(c, block, al); err != nil {
+				return err
+			}
+			if se > 0 {
+				return dec.acFirst(c, block, 1, se, al)
+			}
+			return nil
+		case ss == 0:
+			return dec.dcRefine(block, al)
+		case ah == 0:
+			return dec.acFirst(c, block, ss, se, al)
+		default:
+			return dec.acRefine(c, block, ss, se, al)
+		}
+	}
+	scan.reset()
+	return scan, nil
+}
+
+func (sc *extScan) reset() {
+	for _, c := range sc.comps {
+		c.dcPred, c.dcContext = 0, 0
+	}
+	sc.dec.reset()
+}
+
+func (sc *extScan) nextMCU() {
+	sc.mcu++
+	if sc.d.restart > 0 && sc.mcu%sc.d.restart == 0 {
+		sc.s.nextRestart()
+		sc.reset()
+	}
+}
+
+// decodeRow decodes the next row of the scan, row, into the coefficients
+// of its components.
+func (sc *extScan) decodeRow(row int) error {
+	if len(sc.comps) == 1 {
+		c := sc.comps[0]
+		w := (ceilDiv(sc.d.width*c.h, sc.d.hmax) + 7) / 8
+		for bx := 0; bx < w; bx++ {
+			if err := sc.decodeBlock(c, c.block(bx, row)); err != nil {
+				return err
+			}
+			sc.nextMCU()
+		}
+		return nil
+	}
+	for mx := 0; mx < sc.d.mcusX; mx++ {
+		for _, c := range sc.comps {
+			for y := 0; y < c.v; y++ {
+				for x := 0; x < c.h; x++ {
+					if err := sc.decodeBlock(c, c.block(mx*c.h+x, row*c.v+y)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		sc.nextMCU()
+	}
+	return nil
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
+
+// extSegment reads entropy-coded data, undoing byte stuffing. Reaching a
+// marker, which ends the data, yields zeros: arithmetic decoders read past
+// the end by design, and Huffman ones do on damaged files.
+type extSegment struct {
+	data []byte
+	pos  int
+	// atMarker is set once a marker was reached; pos is at its 0xff
+	atMarker bool
+	// bits and nbits buffer what Huffman decoding hasn't consumed
+	bits  uint64
+	nbits int
+}
+
+func (s *extSegment) readByte() int {
+	if s.atMarker || s.pos >= len(s.data) {
+		s.atMarker = true
+		return 0
+	}
+	b := s.data[s.pos]
+	s.pos++
+	if b != 0xff {
+		return int(b)
+	}
+	for s.pos < len(s.data) && s.data[s.pos] == 0xff {
+		s.pos++
+	}
+	if s.pos < len(s.data) && s.data[s.pos] == 0 {
+		s.pos++
+		return 0xff
+	}
+	s.pos--
+	s.atMarker = true
+	return 0
+}
+
+// seekMarker moves to the next marker, skipping what is left of the data.
+func (s *extSegment) seekMarker() {
+	for s.pos+1 < len(s.data) && (s.data[s.pos] != 0xff || s.data[s.pos+1] == 0 || s.data[s.pos+1] == 0xff) {
+		s.pos++
+	}
+	if s.pos+1 >= len(s.data) {
+		s.pos = len(s.data)
+	}
+	s.atMarker, s.bits, s.nbits = false, 0, 0
+}
+
+// nextRestart moves past the restart marker ending an interval. A missing
+// one is tolerated, as libjpeg does, by carrying on from the next marker.
+func (s *extSegment) nextRestart() {
+	s.seekMarker()
+	if s.pos+1 < len(s.data) && s.data[s.pos+1] >= markerRST0 && s.data[s.pos+1] <= markerRST7 {
+		s.pos += 2
+	}
+}
+
+func (s *extSegment) readBits(n int) int32 {
+	for s.nbits < n {
+		s.bits = s.bits<<8 | uint64(s.readByte())
+		s.nbits += 8
+	}
+	s.nbits -= n
+	return int32(s.bits>>s.nbits) & (1<<n - 1)
+}
+
+// extend turns the n bits v of a coded value into the value, per F.2.2.1.
+func extend(v int32, n int) int32 {
+	if n > 0 && v < 1<<(n-1) {
+		v += -1<<n + 1
+	}
+	return v
+}
+
+// extEntropy decodes coefficients for one block at a time. Progressive
+// scans code the DC and AC coefficients separately, and each in a first
+// pass and refinements adding a bit at a time.
+type extEntropy interface {
+	reset()
+	dcFirst(c *extComponent, block []int32, al int) error
+	dcRefine(block []int32, al int) error
+	acFirst(c *extComponent, block []int32, ss, se, al int) error
+	acRefine(c *extComponent, block []int32, ss, se, al int) error
+}
+
+// extHuffman is a Huffman table, decoded a bit at a time per F.2.2.3. The
+// files that need the extended decoder are rare enough not to need lookup
+// tables.
+type extHuffman struct {
+	maxcode [17]int32
+	mincode [17]int32
+	valptr  [17]int32
+	vals    []byte
+}
+
+func newExtHuffman(counts [16]int, vals []byte) *extHuffman {
+	t := &extHuffman{vals: vals}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		t.valptr[l], t.mincode[l] = k, code
+		code += int32(counts[l-1])
+		k += int32(counts[l-1])
+		t.maxcode[l] = -1
+		if counts[l-1] > 0 {
+			t.maxcode[l] = code - 1
+		}
+		code <<= 1
+	}
+	return t
+}
+
+type extHuffmanDecoder struct {
+	s      *extSegment
+	d      *extJPEG
+	eobrun int32
+}
+
+func (h *extHuffmanDecoder) reset() {
+	h.eobrun = 0
+}
+
+func (h *extHuffmanDecoder) decode(t *extHuffman) (int, error) {
+	code := int32(0)
+	for l := 1; l <= 16; l++ {
+		code = code<<1 | h.s.readBits(1)
+		if code <= t.maxcode[l] {
+			i := t.valptr[l] + code - t.mincode[l]
+			if int(i) >= len(t.vals) {
+				break
+			}
+			return int(t.vals[i]), nil
+		}
+	}
+	return 0, errors.New("jpeg: bad Huffman code")
+}
+
+func (h *extHuffmanDecoder) dcFirst(c *extComponent, block []int32, al int) error {
+	t, err := h.decode(h.d.huffman[0][c.td])
+	if err != nil {
+		return err
+	}
+	if t > 15 {
+		return errors.New("jpeg: bad DC difference")
+	}
+	c.dcPred += extend(h.s.readBits(t), t)
+	block[0] = c.dcPred << al
+	return nil
+}
+
+func (h *extHuffmanDecoder) dcRefine(block []int32, al int) error {
+	if h.s.readBits(1) != 0 {
+		block[0] |= 1 << al
+	}
+	return nil
+}
+
+func (h *extHuffmanDecoder) acFirst(c *extComponent, block []int32, ss, se, al int) error {
+	if h.eobrun > 0 {
+		h.eobrun--
+		return nil
+	}
+	for k := ss; k <= se; k++ {
+		rs, err := h.decode(h.d.huffman[1][c.ta])
+		if err != nil {
+			return err
+		}
+		r, s := rs>>4, rs&0x0f
+		if s == 0 {
+			if r < 15 {
+				h.eobrun = 1<<r - 1
+				if r > 0 {
+					h.eobrun += h.s.readBits(r)
+				}
+				break
+			}
+			k += 15
+			continue
+		}
+		k += r
+		if k > 63 {
+			return errors.New("jpeg: coefficient past the end of a block")
+		}
+		block[zigzag[k]] = extend(h.s.readBits(s), s) << al
+	}
+	return nil
+}
+
+// acRefine follows G.1.2.3 as libjpeg implements it.
+func (h *extHuffmanDecoder) acRefine(c *extComponent, block []int32, ss, se, al int) error {
+	p1, m1 := int32(1)<<al, int32(-1)<<al
+	refine := func(coef *int32) {
+		if h.s.readBits(1) != 0 && *coef&p1 == 0 {
+			if *coef >= 0 {
+				*coef += p1
+			} else {
+				*coef += m1
+			}
+		}
+	}
+	k := ss
+	if h.eobrun == 0 {
+		for ; k <= se; k++ {
+			rs, err := h.decode(h.d.huffman[1][c.ta])
+			if err != nil {
+				return err
+			}
+			r, s := rs>>4, rs&0x0f
+			var value int32
+			if s != 0 {
+				value = m1
+				if h.s.readBits(1) != 0 {
+					value = p1
+				}
+			} else if r != 15 {
+				h.eobrun = 1 << r
+				if r > 0 {
+					h.eobrun += h.s.readBits(r)
+				}
+				break
+			}
+			// Skip r zero coefficients, refining the nonzero ones on the way
+			for ; k <= se; k++ {
+				coef := &block[zigzag[k]]
+				if *coef != 0 {
+					refine(coef)
+				} else {
+					if r == 0 {
+						break
+					}
+					r--
+				}
+			}
+			if value != 0 && k <= se {
+				block[zigzag[k]] = value
+			}
+		}
+	}
+	if h.eobrun > 0 {
+		for ; k <= se; k++ {
+			if coef := &block[zigzag[k]]; *coef != 0 {
+				refine(coef)
+			}
+		}
+		h.eobrun--
+	}
+	return nil
+}
+
+// arithmeticStates is Table D.2 of ITU T.81, the probability estimation
+// state machine of the QM coder: Qe, the next state after an MPS and after
+// an LPS, and whether an LPS swaps the MPS. The last entry is a fixed 0.5
+// estimate used for sign and refinement bits.
+var arithmeticStates = [114]struct {
+	qe         int64
+	nmps, nlps byte
+	swap       bool
+}{
+	{0x5a1d, 1, 1, true}, {0x2586, 2, 14, false}, {0x1114, 3, 16, false}, {0x080b, 4, 18, false},
+	{0x03d8, 5, 20, false}, {0x01da, 6, 23, false}, {0x00e5, 7, 25, false}, {0x006f, 8, 28, false},
+	{0x0036, 9, 30, false}, {0x001a, 10, 33, false}, {0x000d, 11, 35, false}, {0x0006, 12, 9, false},
+	{0x0003, 13, 10, false}, {0x0001, 13, 12, false}, {0x5a7f, 15, 15, true}, {0x3f25, 16, 36, false},
+	{0x2cf2, 17, 38, false}, {0x207c, 18, 39, false}, {0x17b9, 19, 40, false}, {0x1182, 20, 42, false},
+	{0x0cef, 21, 43, false}, {0x09a1, 22, 45, false}, {0x072f, 23, 46, false}, {0x055c, 24, 48, false},
+	{0x0406, 25, 49, false}, {0x0303, 26, 51, false}, {0x0240, 27, 52, false}, {0x01b1, 28, 54, false},
+	{0x0144, 29, 56, false}, {0x00f5, 30, 57, false}, {0x00b7, 31, 59, false}, {0x008a, 32, 60, false},
+	{0x0068, 33, 62, false}, {0x004e, 34, 63, false}, {0x003b, 35, 32, false}, {0x002c, 9, 33, false},
+	{0x5ae1, 37, 37, true}, {0x484c, 38, 64, false}, {0x3a0d, 39, 65, false}, {0x2ef1, 40, 67, false},
+	{0x261f, 41, 68, false}, {0x1f33, 42, 69, false}, {0x19a8, 43, 70, false}, {0x1518, 44, 72, false},
+	{0x1177, 45, 73, false}, {0x0e74, 46, 74, false}, {0x0bfb, 47, 75, false}, {0x09f8, 48, 77, false},
+	{0x0861, 49, 78, false}, {0x0706, 50, 79, false}, {0x05cd, 51, 48, false}, {0x04de, 52, 50, false},
+	{0x040f, 53, 50, false}, {0x0363, 54, 51, false}, {0x02d4, 55, 52, false}, {0x025c, 56, 53, false},
+	{0x01f8, 57, 54, false}, {0x01a4, 58, 55, false}, {0x0160, 59, 56, false}, {0x0125, 60, 57, false},
+	{0x00f6, 61, 58, false}, {0x00cb, 62, 59, false}, {0x00ab, 63, 61, false}, {0x008f, 32, 61, false},
+	{0x5b12, 65, 65, true}, {0x4d04, 66, 80, false}, {0x412c, 67, 81, false}, {0x37d8, 68, 82, false},
+	{0x2fe8, 69, 83, false}, {0x293c, 70, 84, false}, {0x2379, 71, 86, false}, {0x1edf, 72, 87, false},
+	{0x1aa9, 73, 87, false}, {0x174e, 74, 72, false}, {0x1424, 75, 72, false}, {0x119c, 76, 74, false},
+	{0x0f6b, 77, 74, false}, {0x0d51, 78, 75, false}, {0x0bb6, 79, 77, false}, {0x0a40, 48, 77, false},
+	{0x5832, 81, 80, true}, {0x4d1c, 82, 88, false}, {0x438e, 83, 89, false}, {0x3bdd, 84, 90, false},
+	{0x34ee, 85, 91, false}, {0x2eae, 86, 92, false}, {0x299a, 87, 93, false}, {0x2516, 71, 86, false},
+	{0x5570, 89, 88, true}, {0x4ca9, 90, 95, false}, {0x44d9, 91, 96, false}, {0x3e22, 92, 97, false},
+	{0x3824, 93, 99, false}, {0x32b4, 94, 99, false}, {0x2e17, 86, 93, false}, {0x56a8, 96, 95, true},
+	{0x4f46, 97, 101, false}, {0x47e5, 98, 102, false}, {0x41cf, 99, 103, false}, {0x3c3d, 100, 104, false},
+	{0x375e, 93, 99, false}, {0x5231, 102, 105, false}, {0x4c0f, 103, 106, false}, {0x4639, 104, 107, false},
+	{0x415e, 99, 103, false}, {0x5627, 106, 105, true}, {0x50e7, 107, 108, false}, {0x4b85, 103, 109, false},
+	{0x5597, 109, 110, false}, {0x504f, 107, 111, false}, {0x5a10, 111, 110, true}, {0x5522, 109, 112, false},
+	{0x59eb, 111, 112, true}, {0x5a1d, 113, 113, false},
+}
+
+// fixedState is the index of the fixed 0.5 estimate in arithmeticStates.
+const fixedState = 113
+
+// extArithmetic decodes arithmetic-coded data, porting libjpeg's jdarith.c.
+// A statistics bin holds a state index with the MPS in its top bit.
+type extArithmetic struct {
+	s       *extSegment
+	d       *extJPEG
+	c, a    int64
+	ct      int
+	dcStats [4][64]byte
+	acStats [4][256]byte
+	fixed   byte
+}
+
+func (e *extArithmetic) reset() {
+	e.c, e.a, e.ct = 0, 0, -16
+	e.dcStats = [4][64]byte{}
+	e.acStats = [4][256]byte{}
+	e.fixed = fixedState
+}
+
+// decode returns the next binary decision coded with the statistics bin
+// st, per D.2.
+func (e *extArithmetic) decode(st *byte) int {
+	for e.a < 0x8000 {
+		e.ct--
+		if e.ct < 0 {
+			e.c = e.c<<8 | int64(e.s.readByte())
+			e.ct += 8
+			if e.ct < 0 {
+				// Still reading the first two bytes
+				e.ct++
+				if e.ct == 0 {
+					e.a = 0x8000
+				}
+			}
+		}
+		e.a <<= 1
+	}
+	sv := *st
+	state := arithmeticStates[sv&0x7f]
+	qe := state.qe
+	nextLPS := state.nlps
+	if state.swap {
+		nextLPS |= 0x80
+	}
+	temp := e.a - qe
+	e.a = temp
+	temp <<= e.ct
+	if e.c >= temp {
+		e.c -= temp
+		if e.a < qe {
+			e.a = qe
+			*st = sv&0x80 ^ state.nmps
+		} else {
+			e.a = qe
+			*st = sv&0x80 ^ nextLPS
+			sv ^= 0x80
+		}
+	} else if e.a < 0x8000 {
+		if e.a < qe {
+			*st = sv&0x80 ^ nextLPS
+			sv ^= 0x80
+		} else {
+			*st = sv&0x80 ^ state.nmps
+		}
+	}
+	return int(sv >> 7)
+}
+
+var errArithmeticOverflow = errors.New("jpeg: bad arithmetic-coded data")
+
+// magnitude decodes the magnitude category and bits of a nonzero value
+// whose category is coded starting at bin st of stats, after first, its
+// first category decision, and whose bits are coded from bin st+14 on; per
+// F.1.4.4.1.3 and F.1.4.4.2.
+func (e *extArithmetic) magnitude(stats []byte, st int, m int32) (int32, error) {
+	for e.decode(&stats[st]) != 0 {
+		if m <<= 1; m == 0x8000 {
+			return 0, errArithmeticOverflow
+		}
+		st++
+	}
+	v := m
+	st += 14
+	for m >>= 1; m != 0; m >>= 1 {
+		if e.decode(&stats[st]) != 0 {
+			v |= m
+		}
+	}
+	return v, nil
+}
+
+func (e *extArithmetic) dcFirst(c *extComponent, block []int32, al int) error {
+	stats := e.dcStats[c.td][:]
+	st := c.dcContext
+	if e.decode(&stats[st]) == 0 {
+		c.dcContext = 0
+	} else {
+		sign := e.decode(&stats[st+1])
+		st += 2 + sign
+		var v int32
+		var err error
+		if e.decode(&stats[st]) == 0 {
+			v = 0
+		} else {
+			// X1 is bin 20
+			if v, err = e.magnitude(stats, 20, 1); err != nil {
+				return err
+			}
+		}
+		// Conditioning category for the next difference, F.1.4.4.1.2,
+		// from the magnitude category
+		m := int32(0)
+		if v > 0 {
+			m = 1 << (bits.Len32(uint32(v)) - 1)
+		}
+		l, u := e.d.dcL[c.td], e.d.dcU[c.td]
+		switch {
+		case m < int32(1<<l>>1):
+			c.dcContext = 0
+		case m > int32(1<<u>>1):
+			c.dcContext = 12 + sign*4
+		default:
+			c.dcContext = 4 + sign*4
+		}
+		v++
+		if sign != 0 {
+			v = -v
+		}
+		c.dcPred += v
+	}
+	block[0] = c.dcPred << al
+	return nil
+}
+
+func (e *extArithmetic) dcRefine(block []int32, al int) error {
+	if e.decode(&e.fixed) != 0 {
+		block[0] |= 1 << al
+	}
+	return nil
+}
+
+func (e *extArithmetic) acFirst(c *extComponent, block []int32, ss, se, al int) error {
+	stats := e.acStats[c.ta][:]
+	for k := ss; k <= se; k++ {
+		st := 3 * (k - 1)
+		if e.decode(&stats[st]) != 0 {
+			// End of block
+			break
+		}
+		for e.decode(&stats[st+1]) == 0 {
+			st += 3
+			k++
+			if k > se {
+				return errArithmeticOverflow
+			}
+		}
+		sign := e.decode(&e.fixed)
+		st += 2
+		var v int32
+		if e.decode(&stats[st]) != 0 {
+			if e.decode(&stats[st]) == 0 {
+				v = 1
+			} else {
+				x := 189
+				if k > e.d.acK[c.ta] {
+					x = 217
+				}
+				var err error
+				if v, err = e.magnitude(stats, x, 2); err != nil {
+					return err
+				}
+			}
+		}
+		v++
+		if sign != 0 {
+			v = -v
+		}
+		block[zigzag[k]] = v << al
+	}
+	return nil
+}
+
+func (e *extArithmetic) acRefine(c *extComponent, block []int32, ss, se, al int) error {
+	stats := e.acStats[c.ta][:]
+	p1, m1 := int32(1)<<al, int32(-1)<<al
+	// The end of block of the previous pass
+	kex := se
+	for ; kex > 0; kex-- {
+		if block[zigzag[kex]] != 0 {
+			break
+		}
+	}
+	for k := ss; k <= se; k++ {
+		st := 3 * (k - 1)
+		if k > kex && e.decode(&stats[st]) != 0 {
+			break
+		}
+		for {
+			coef := &block[zigzag[k]]
+			if *coef != 0 {
+				if e.decode(&stats[st+2]) != 0 {
+					if *coef < 0 {
+						*coef += m1
+					} else {
+						*coef += p1
+					}
+				}
+				break
+			}
+			if e.decode(&stats[st+1]) != 0 {
+				*coef = p1
+				if e.decode(&e.fixed) != 0 {
+					*coef = m1
+				}
+				break
+			}
+			st += 3
+			k++
+			if k > se {
+				return errArithmeticOverflow
+			}
+		}
+	}
+	return nil
+}
+
+// idctCos holds C(u)/2 cos((2x+1)uπ/16) for the inverse DCT, by x then u.
+var idctCos = func() (t [8][8]float64) {
+	for x := 0; x < 8; x++ {
+		for u := 0; u < 8; u++ {
+			c := 0.5
+			if u == 0 {
+				c = 0.5 / math.Sqrt2
+			}
+			t[x][u] = c * math.Cos(float64((2*x+1)*u)*math.Pi/16)
+		}
+	}
+	return t
+}()
+
+// plane dequantizes and inverse transforms a component into samples, one
+// per pixel of its padded blocks, then drops its coefficients.
+func (d *extJPEG) plane(c *extComponent) []uint16 {
+	samples := make([]uint16, c.blocksW*8*c.blocksH*8)
+	d.transform(c, samples)
+	c.coefs = nil
+	return samples
+}
+
+// transform dequantizes and inverse transforms the blocks c holds
+// coefficients for into samples, one per pixel of them.
+func (d *extJPEG) transform(c *extComponent, samples []uint16) {
+	stride := c.blocksW * 8
+	q := &d.quant[c.tq]
+	center := float64(int(1) << (d.precision - 1))
+	maxSample := float64(int(1)<<d.precision - 1)
+	var in, tmp [64]float64
+	for by := 0; by < len(c.coefs)/(c.blocksW*64); by++ {
+		for bx := 0; bx < c.blocksW; bx++ {
+			block := c.block(bx, c.firstRow+by)
+			for i, coef := range block {
+				in[i] = float64(coef) * float64(q[i])
+			}
+			for v := 0; v < 8; v++ {
+				for x := 0; x < 8; x++ {
+					sum := 0.0
+					for u := 0; u < 8; u++ {
+						sum += idctCos[x][u] * in[v*8+u]
+					}
+					tmp[v*8+x] = sum
+				}
+			}
+			for y := 0; y < 8; y++ {
+				row := samples[(by*8+y)*stride+bx*8:]
+				for x := 0; x < 8; x++ {
+					sum := center
+					for v := 0; v < 8; v++ {
+						sum += idctCos[y][v] * tmp[v*8+x]
+					}
+					row[x] = uint16(math.Round(min(max(sum, 0), maxSample)))
+				}
+			}
+		}
+	}
+}
+
+// image converts the decoded components to pixels, upsampling subsampled
+// ones by repetition as image/jpeg does.
+func (d *extJPEG) image() image.Image {
+	planes := make([][]uint16, len(d.comps))
+	for i, c := range d.comps {
+		planes[i] = d.plane(c)
+	}
+	maxSample := int32(1)<<d.precision - 1
+	rect := image.Rect(0, 0, d.width, d.height)
+
+	if len(d.comps) == 1 {
+		if d.precision == 8 {
+			img := image.NewGray(rect)
+			for y := 0; y < d.height; y++ {
+				for x := 0; x < d.width; x++ {
+					img.Pix[y*img.Stride+x] = uint8(d.sample(planes, 0, x, y))
+				}
+			}
+			return img
+		}
+		img := image.NewGray16(rect)
+		for y := 0; y < d.height; y++ {
+			for x := 0; x < d.width; x++ {
+				img.SetGray16(x, y, color.Gray16{uint16(scaleSample(d.sample(planes, 0, x, y), maxSample))})
+			}
+		}
+		return img
+	}
+
+	var img draw64
+	if d.precision == 8 {
+		img = rgbaImage{image.NewRGBA(rect)}
+	} else {
+		img = rgba64Image{image.NewRGBA64(rect)}
+	}
+	pixel := d.pixels(planes)
+	for y := 0; y < d.height; y++ {
+		for x := 0; x < d.width; x++ {
+			r, g, b := pixel(x, y)
+			img.set(x, y, r, g, b)
+		}
+	}
+	return img.image()
+}
+
+// sample returns the sample of component i at pixel x, y from planes, the
+// transformed components, which hold the rows of blocks from the
+// component's firstRow on.
+func (d *extJPEG) sample(planes [][]uint16, i, x, y int) int32 {
+	c := d.comps[i]
+	return int32(planes[i][(y*c.v/d.vmax-c.firstRow*8)*c.blocksW*8+x*c.h/d.hmax])
+}
+
+// pixels returns a function giving the color at a pixel of planes, the
+// transformed components, as 16-bit RGB.
+func (d *extJPEG) pixels(planes [][]uint16) func(x, y int) (r, g, b int32) {
+	maxSample := int32(1)<<d.precision - 1
+	center := float64(int32(1) << (d.precision - 1))
+	sample := func(i, x, y int) int32 {
+		return d.sample(planes, i, x, y)
+	}
+	clamp := func(v float64) int32 {
+		return int32(min(max(math.Round(v), 0), float64(maxSample)))
+	}
+	// ycc converts a YCbCr sample to RGB per JFIF.
+	ycc := func(y, cb, cr int32) (int32, int32, int32) {
+		fy, fcb, fcr := float64(y), float64(cb)-center, float64(cr)-center
+		return clamp(fy + 1.402*fcr), clamp(fy - 0.344136*fcb - 0.714136*fcr), clamp(fy + 1.772*fcb)
+	}
+	// Components named R, G and B, or marked untransformed by Adobe, are
+	// RGB already, and four components are CMYK unless Adobe marks them
+	// YCCK
+	rgb := d.adobe == 0 || len(d.comps) == 3 && d.comps[0].id == 'R' && d.comps[1].id == 'G' && d.comps[2].id == 'B'
+	if len(d.comps) == 4 {
+		rgb = d.adobe != 2
+	}
+
+	return func(x, y int) (int32, int32, int32) {
+		if len(d.comps) == 1 {
+			v := scaleSample(sample(0, x, y), maxSample)
+			return v, v, v
+		}
+		s0, s1, s2 := sample(0, x, y), sample(1, x, y), sample(2, x, y)
+		var r, g, b int32
+		if rgb {
+			r, g, b = s0, s1, s2
+		} else {
+			r, g, b = ycc(s0, s1, s2)
+		}
+		if len(d.comps) == 4 {
+			// Adobe stores CMYK inverted. YCCK's YCbCr part converts to
+			// inverted CMY, which the RGB inversion cancels, as in
+			// image/jpeg
+			k := sample(3, x, y)
+			if d.adobe == 2 {
+				r, g, b = maxSample-r, maxSample-g, maxSample-b
+			}
+			r, g, b = r*k/maxSample, g*k/maxSample, b*k/maxSample
+		}
+		return scaleSample(r, maxSample), scaleSample(g, maxSample), scaleSample(b, maxSample)
+	}
+}
+
+// scaleSample scales a sample of at most maxSample to 16 bits.
+func scaleSample(v, maxSample int32) int32 {
+	return (v*0xffff + maxSample/2) / maxSample
+}
+
+// draw64 sets opaque pixels from 16-bit values in an image of either depth.
+type draw64 interface {
+	set(x, y int, r, g, b int32)
+	image() image.Image
+}
+
+type rgbaImage struct{ *image.RGBA }
+
+func (m rgbaImage) set(x, y int, r, g, b int32) {
+	i := m.PixOffset(x, y)
+	m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3] = uint8(r>>8), uint8(g>>8), uint8(b>>8), 0xff
+}
+
+func (m rgbaImage) image() image.Image { return m.RGBA }
+
+type rgba64Image struct{ *image.RGBA64 }
+
+func (m rgba64Image) set(x, y int, r, g, b int32) {
+	m.SetRGBA64(x, y, color.RGBA64{uint16(r), uint16(g), uint16(b), 0xffff})
+}
+
+func (m rgba64Image) image() image.Image { return m.RGBA64 }
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The samples in testdata/jpegext are small.jpg re-encoded by libjpeg.
+var jpegExtSamples = []struct {
+	file       string
+	model      color.Model
+	sequential bool
+}{
+	{file: "arithmetic.jpg", model: color.RGBAModel, sequential: true},
+	{file: "arithmetic-progressive.jpg", model: color.RGBAModel},
+	{file: "12bit.jpg", model: color.RGBA64Model, sequential: true},
+	{file: "12bit-gray.jpg", model: color.Gray16Model, sequential: true},
+	{file: "12bit-progressive.jpg", model: color.RGBA64Model},
+	{file: "restart.jpg", model: color.RGBAModel, sequential: true},
+}
+
+func readJPEGExtSample(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "jpegext", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// meanDifference returns the mean absolute difference of the 8-bit samples
+// of a and b, compared in gray if gray is set.
+func meanDifference(a, b image.Image, gray bool) float64 {
+	bounds := a.Bounds()
+	total := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ca, cb := a.At(x, y), b.At(x, y)
+			if gray {
+				ca, cb = color.GrayModel.Convert(ca), color.GrayModel.Convert(cb)
+			}
+			r1, g1, b1, _ := ca.RGBA()
+			r2, g2, b2, _ := cb.RGBA()
+			for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8)} {
+				total += max(d, -d)
+			}
+		}
+	}
+	return float64(total) / float64(3*bounds.Dx()*bounds.Dy())
+}
+
+func TestDecodeExtendedJPEG(t *testing.T) {
+	refData, err := os.ReadFile(filepath.Join("testdata", "small.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := jpeg.Decode(bytes.NewReader(refData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range jpegExtSamples {
+		t.Run(tt.file, func(t *testing.T) {
+			data := readJPEGExtSample(t, tt.file)
+			cfg, err := decodeExtendedJPEGConfig(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := decodeExtendedJPEG(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// decodeImage leaves what image/jpeg reads, restart.jpg here, to it
+			if viaFormat, format, err := decodeImage(bytes.NewReader(data)); err != nil || format != "jpeg" || viaFormat.Bounds() != img.Bounds() {
+				t.Errorf("decodeImage: %v, format %q", err, format)
+			}
+			if img.Bounds() != ref.Bounds() || cfg.Width != 160 || cfg.Height != 120 {
+				t.Fatalf("decoded %v, config %dx%d, want %v", img.Bounds(), cfg.Width, cfg.Height, ref.Bounds())
+			}
+			if img.ColorModel() != tt.model || cfg.ColorModel != tt.model {
+				t.Errorf("color model %v, config %v", img.ColorModel(), cfg.ColorModel)
+			}
+			// Re-encoding loses a little, and 12 bits keep more than the
+			// 8-bit reference
+			if d := meanDifference(img, ref, tt.model == color.Gray16Model); d > 3 {
+				t.Errorf("mean difference from small.jpg is %.2f", d)
+			}
+		})
+	}
+}
+
+// TestJPEGStrips checks that decoding a row of MCUs at a time gives the
+// same pixels as decoding the whole image.
+func TestJPEGStrips(t *testing.T) {
+	for _, tt := range jpegExtSamples {
+		t.Run(tt.file, func(t *testing.T) {
+			data := readJPEGExtSample(t, tt.file)
+			strips, err := openJPEGStrips(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.sequential {
+				if strips != nil {
+					t.Error("progressive JPEG opened for strips")
+				}
+				return
+			}
+			whole, err := decodeExtendedJPEG(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strips.bounds() != whole.Bounds() {
+				t.Fatalf("strips are %v, image %v", strips.bounds(), whole.Bounds())
+			}
+			rows := 0
+			for {
+				band, err := strips.next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if band.Rect.Min.Y != rows {
+					t.Fatalf("band starts at row %d, want %d", band.Rect.Min.Y, rows)
+				}
+				for y := band.Rect.Min.Y; y < band.Rect.Max.Y; y++ {
+					for x := 0; x < band.Rect.Dx(); x++ {
+						want := color.RGBAModel.Convert(whole.At(x, y))
+						if got := band.RGBAAt(x, y); got != want {
+							t.Fatalf("pixel %d,%d is %v in its strip, %v decoded whole", x, y, got, want)
+						}
+					}
+				}
+				rows = band.Rect.Max.Y
+			}
+			if rows != whole.Bounds().Dy() {
+				t.Errorf("strips cover %d rows, want %d", rows, whole.Bounds().Dy())
+			}
+		})
+	}
+}
+
+// segmentAt returns the offset of the first marker segment of type marker
+// before the first scan's data, at its 0xff.
+func segmentAt(t *testing.T, data []byte, marker byte) int {
+	t.Helper()
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		if data[i+1] == marker {
+			return i
+		}
+		if data[i+1] == markerSOS {
+			break
+		}
+		i += 2 + (int(data[i+2])<<8 | int(data[i+3]))
+	}
+	t.Fatalf("no %#x segment", marker)
+	return 0
+}
+
+func TestDecodeExtendedJPEGTruncated(t *testing.T) {
+	for _, tt := range jpegExtSamples {
+		t.Run(tt.file, func(t *testing.T) {
+			data := readJPEGExtSample(t, tt.file)
+			whole, err := decodeExtendedJPEG(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Cut anywhere in the headers, there is nothing to show
+			sos := segmentAt(t, data, markerSOS)
+			for _, n := range []int{0, 1, 2, 3, 20, sos / 2, sos, sos + 4} {
+				if _, err := decodeExtendedJPEG(bytes.NewReader(data[:n])); err == nil {
+					t.Errorf("cut to %d bytes of headers: no error", n)
+				}
+				if _, err := decodeExtendedJPEGConfig(bytes.NewReader(data[:min(n, segmentAt(t, data, markerSOF(data)))])); err == nil {
+					t.Errorf("cut to %d bytes before the frame header: config has no error", n)
+				}
+			}
+
+			// Cut anywhere after the first scan's header, what was decoded
+			// is kept and the rest is filled in, as libjpeg does
+			for fifths := 1; fifths < 5; fifths++ {
+				img, err := decodeExtendedJPEG(bytes.NewReader(data[:sos+(len(data)-sos)*fifths/5]))
+				if err != nil {
+					t.Fatalf("cut at %d/5 of the scans: %v", fifths, err)
+				}
+				if img.Bounds() != whole.Bounds() {
+					t.Fatalf("cut at %d/5 of the scans: %v, want %v", fifths, img.Bounds(), whole.Bounds())
+				}
+				if !tt.sequential {
+					continue
+				}
+				for y := 0; y < 8; y++ {
+					for x := 0; x < whole.Bounds().Dx(); x++ {
+						if img.At(x, y) != whole.At(x, y) {
+							t.Fatalf("cut at %d/5 of the scans: pixel %d,%d of the first rows is %v, want %v", fifths, x, y, img.At(x, y), whole.At(x, y))
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+// markerSOF returns the frame marker of data.
+func markerSOF(data []byte) byte {
+	for _, m := range []byte{markerSOF0, markerSOF1, markerSOF2, markerSOF9, markerSOF10} {
+		if bytes.Contains(data, []byte{0xff, m}) {
+			return m
+		}
+	}
+	return 0
+}
+
+func TestDecodeExtendedJPEGMalformed(t *testing.T) {
+	arith := readJPEGExtSample(t, "arithmetic.jpg")
+	huffman := readJPEGExtSample(t, "12bit.jpg")
+	sof := segmentAt(t, arith, markerSOF9)
+	tests := []struct {
+		name   string
+		data   []byte
+		change func(data []byte)
+		err    string
+	}{
+		{"no SOI", arith, func(d []byte) { d[1] = 0 }, "missing SOI"},
+		{"16-bit", arith, func(d []byte) { d[sof+4] = 16 }, "16-bit samples not supported"},
+		{"zero width", arith, func(d []byte) { d[sof+7], d[sof+8] = 0, 0 }, "zero width"},
+		{"zero height", arith, func(d []byte) { d[sof+5], d[sof+6] = 0, 0 }, "DNL-defined height"},
+		{"two components", arith, func(d []byte) { d[sof+9] = 2 }, "2 components not supported"},
+		{"bad sampling", arith, func(d []byte) { d[sof+11] = 0x51 }, "bad component parameters"},
+		{"lossless", arith, func(d []byte) { d[sof+1] = 0xc3 }, "unsupported frame type 0xc3"},
+		{"bad quantization table", arith, func(d []byte) { d[segmentAt(t, arith, markerDQT)+4] = 0x04 }, "bad quantization table"},
+		{"bad Huffman table", huffman, func(d []byte) {
+			i := segmentAt(t, huffman, markerDHT)
+			d[i+5], d[i+6] = 0xff, 0xff
+		}, "bad Huffman table"},
+		{"unknown scan component", arith, func(d []byte) { d[segmentAt(t, arith, markerSOS)+5] = 0x7f }, "unknown component"},
+		{"bad scan length", arith, func(d []byte) { d[segmentAt(t, arith, markerSOS)+4] = 2 }, "bad SOS length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Clone(tt.data)
+			tt.change(data)
+			_, err := decodeExtendedJPEG(bytes.NewReader(data))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+
+	t.Run("bad DAC", func(t *testing.T) {
+		// AC conditioning for table 5, which doesn't exist
+		data := append([]byte{0xff, markerSOI, 0xff, markerDAC, 0, 4, 0x15, 0}, arith[2:]...)
+		if _, err := decodeExtendedJPEG(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "bad DAC") {
+			t.Errorf("got %v", err)
+		}
+	})
+	t.Run("no scans", func(t *testing.T) {
+		data := append(bytes.Clone(arith[:segmentAt(t, arith, markerSOS)]), 0xff, markerEOI)
+		if _, err := decodeExtendedJPEG(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "no image data") {
+			t.Errorf("got %v", err)
+		}
+	})
+}
+
+// TestDecodeExtendedJPEGCorruptData damages the entropy-coded data of each
+// sample, which must decode to an image of the right size or fail, never
+// panic.
+func TestDecodeExtendedJPEGCorruptData(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, tt := range jpegExtSamples {
+		t.Run(tt.file, func(t *testing.T) {
+			data := readJPEGExtSample(t, tt.file)
+			start := segmentAt(t, data, markerSOS) + 2
+			start += int(data[start])<<8 | int(data[start+1])
+			for i := 0; i < 50; i++ {
+				damaged := bytes.Clone(data)
+				for j := 0; j < 1+i%8; j++ {
+					damaged[start+rng.Intn(len(damaged)-start-2)] = byte(rng.Intn(256))
+				}
+				img, err := decodeExtendedJPEG(bytes.NewReader(damaged))
+				if err == nil && img.Bounds() != image.Rect(0, 0, 160, 120) {
+					t.Fatalf("damaged data decoded to %v", img.Bounds())
+				}
+				if err != nil && errors.Is(err, io.EOF) {
+					t.Fatalf("damaged data: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+	"os"
+)
+
+// lowQualityThreshold is the estimated source quality at or below which a
+// JPEG counts as already heavily compressed. Lowering the quality of such
+// files further mostly adds banding, so they are shrunk instead.
+const lowQualityThreshold = 60
+
+// qualityBelowSource lowers the quality ceiling of JPEG sources further,
+// to this many steps under their estimated quality. Their artifacts and
+// noise then aren't reproduced at more fidelity than the source had.
+var qualityBelowSource int
+
+// minShrinkEdge stops dimension reduction before images become useless.
+const minShrinkEdge = 16
+
+// standardLuminanceTable is the IJG baseline luminance quantization table
+// that libjpeg (and Go's encoder) scale by quality.
+var standardLuminanceTable = [64]int{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+// estimateJPEGQuality estimates the IJG quality setting a JPEG was saved
+// with from its luminance quantization table. It returns 0 if the data has
+// no readable table.
+func estimateJPEGQuality(r io.Reader) int {
+	table, ok := readLuminanceTable(bufio.NewReader(r))
+	if !ok {
+		return 0
+	}
+	sum, std := 0, 0
+	for i, v := range table {
+		sum += v
+		std += standardLuminanceTable[i]
+	}
+	// Invert libjpeg's quality scaling: scale = 5000/q below 50, 200-2q above
+	scale := float64(sum) * 100 / float64(std)
+	var quality float64
+	if scale <= 100 {
+		quality = (200 - scale) / 2
+	} else {
+		quality = 5000 / scale
+	}
+	return min(max(int(math.Round(quality)), 1), 100)
+}
+
+// estimateJPEGQualityFile is estimateJPEGQuality for the file at path.
+func estimateJPEGQualityFile(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	return estimateJPEGQuality(file)
+}
+
+// readLuminanceTable walks the JPEG markers up to the first scan and returns
+// quantization table 0, which baseline encoders use for luminance. Tables of
+// 12-bit JPEGs are scaled to their 8-bit equivalent.
+func readLuminanceTable(r *bufio.Reader) ([64]int, bool) {
+	var table [64]int
+	found := false
+	samplePrecision := 8
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return table, false
+	}
+	for {
+		marker, err := r.ReadByte()
+		if err != nil {
+			return table, false
+		}
+		if marker != 0xff {
+			continue
+		}
+		kind, err := r.ReadByte()
+		if err != nil {
+			return table, false
+		}
+		switch {
+		case kind == 0xff || kind == 0x00 || kind == 0x01 || kind >= 0xd0 && kind <= 0xd7:
+			// Fill byte or marker without a payload
+			continue
+		case kind == 0xda || kind == 0xd9:
+			// Start of scan or end of image: no more tables before the data
+			if found && samplePrecision == 12 {
+				for i := range table {
+					table[i] = max(table[i]/16, 1)
+				}
+			}
+			return table, found
+		}
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return table, false
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return table, false
+		}
+		if kind >= 0xc0 && kind <= 0xcf && kind != 0xc4 && kind != 0xc8 && kind != 0xcc && len(segment) > 0 {
+			// Start of frame, whose first byte is the sample precision
+			samplePrecision = int(segment[0])
+		}
+		if kind != 0xdb || found {
+			continue
+		}
+		// A DQT segment may hold several tables
+		for len(segment) > 0 {
+			precision, id := segment[0]>>4, segment[0]&0x0f
+			size := 64
+			if precision == 1 {
+				size = 128
+			}
+			if len(segment) < 1+size {
+				return table, false
+			}
+			if id == 0 {
+				for i := range table {
+					if precision == 1 {
+						table[i] = int(binary.BigEndian.Uint16(segment[1+2*i:]))
+					} else {
+						table[i] = int(segment[1+i])
+					}
+				}
+				found = true
+				break
+			}
+			segment = segment[1+size:]
+		}
+	}
+}
+
+// compressJPEGSource compresses a decoded JPEG without searching above the
+// quality the source was saved at, since that only spends bytes on the
+// source's own artifacts, less qualityBelowSource. Sources that were already
+// heavily compressed keep their quality and are shrunk in size instead.
+func compressJPEGSource(log *fileLog, srcPath, dstPath string, img image.Image) error {
+	// Kept metadata counts against the target, so the image gets the rest
+	meta := outputMetadata(srcPath, img)
+	limit := targetSize - len(meta)
+
+	quality := estimateJPEGQualityFile(srcPath)
+	var data []byte
+	var err error
+	switch {
+	case quality == 0:
+		data, err = encodeJPEGWithin(log, img, limit, startQuality())
+	case quality > lowQualityThreshold || canvasWidth > 0:
+		// With -canvas the dimensions are fixed, so only quality can give
+		ceiling := max(min(quality-qualityBelowSource, startQuality()), 1)
+		if qualityBelowSource > 0 || qualityCap > 0 {
+			log.Printf("(quality at most %d) ", ceiling)
+		}
+		data, err = encodeJPEGWithin(log, img, limit, ceiling)
+	default:
+		log.Printf("(source already q%d, reducing dimensions) ", quality)
+		data, err = shrinkJPEGToFit(log, img, max(min(quality-qualityBelowSource, startQuality()), 1), limit)
+	}
+	// An oversized result is still written; processFile then tries harder
+	// or fails the file
+	if err != nil && !errors.Is(err, errCannotMeetTarget) {
+		return err
+	}
+	// shrinkJPEGToFit may have made the image smaller than img
+	if config, err := jpeg.DecodeConfig(bytes.NewReader(data)); err == nil {
+		setMetadataDimensions(meta, config.Width, config.Height)
+	}
+	return writeOutput(dstPath, insertJPEGSegments(data, meta))
+}
+
+// shrinkJPEGToFit encodes img at a fixed quality, scaling it down until the
+// result fits in limit bytes or the image gets too small to shrink further.
+func shrinkJPEGToFit(log *fileLog, img image.Image, quality, limit int) ([]byte, error) {
+	bounds := img.Bounds()
+	current := img
+	for {
+		var buffer bytes.Buffer
+		if err := jpeg.Encode(&buffer, current, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+		w, h := current.Bounds().Dx(), current.Bounds().Dy()
+		fits := buffer.Len() <= limit
+		if traceSearch {
+			decision := "shrinking"
+			if fits {
+				decision = "fits"
+			} else if min(w, h) <= minShrinkEdge {
+				decision = "over target, stopping"
+			}
+			log.Line("  q%d at %dx%d: %s, %s", quality, w, h, formatSize(buffer.Len()), decision)
+		}
+		if fits || min(w, h) <= minShrinkEdge {
+			return buffer.Bytes(), nil
+		}
+
+		// Bytes scale roughly with pixel count; aim slightly under
+		scale := math.Sqrt(float64(limit)/float64(buffer.Len())) * 0.95
+		w = max(int(float64(w)*scale), 1)
+		h = max(int(float64(h)*scale), 1)
+		// Always resample from the original to avoid compounding blur
+		current = resizeImage(img, min(w, bounds.Dx()), min(h, bounds.Dy()))
+	}
+}
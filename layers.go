@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// hiddenLayers and layerNames pick the layers of PSD, XCF and OpenRaster
+// documents that are flattened. By default those are the visible ones, and
+// PSD and OpenRaster files are read from the composite their editor saved.
+// hiddenLayers adds the hidden layers; layerNames flattens only the layers
+// and groups of those names, whether they are hidden or not.
+var (
+	hiddenLayers bool
+	layerNames   []string
+)
+
+// parseLayerNames sets layerNames from a comma-separated list, or clears it
+// for "".
+func parseLayerNames(s string) error {
+	layerNames = splitLayerNames(s)
+	return nil
+}
+
+// splitLayerNames splits a comma-separated list of layer names.
+func splitLayerNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// flattensLayers reports whether documents have to be flattened from their
+// layers rather than read from a saved composite.
+func flattensLayers() bool {
+	return hiddenLayers || len(layerNames) > 0
+}
+
+// docLayer is a layer or group of a layered document.
+type docLayer struct {
+	name     string
+	visible  bool
+	opacity  float64
+	group    bool
+	children []*docLayer // top first
+	// load reads what the layer draws; a group's pixels are its children
+	load func() (layerPixels, error)
+}
+
+// layerPixels are what a layer draws: img with its top left corner at
+// offset on the canvas, through mask if it isn't nil, whose corner is at
+// maskOffset. Outside the mask nothing is drawn.
+type layerPixels struct {
+	img        image.Image
+	offset     image.Point
+	mask       *image.Alpha16
+	maskOffset image.Point
+}
+
+// flattenLayers composites layers, listed top first, onto a transparent
+// canvas of width x height, picking them as hiddenLayers and layerNames
+// say. Every layer is composited as Normal; blend modes and clipping are
+// not applied.
+func flattenLayers(width, height int, layers []*docLayer) (*image.RGBA64, error) {
+	if len(layerNames) > 0 && !anyLayerNamed(layers) {
+		return nil, fmt.Errorf("no layer named %s", strings.Join(layerNames, ", "))
+	}
+	canvas := image.NewRGBA64(image.Rect(0, 0, width, height))
+	return canvas, drawLayers(canvas, layers, len(layerNames) == 0)
+}
+
+// drawLayers draws layers over dst bottom first. selected is set when
+// every layer is picked, as inside a group picked by name.
+func drawLayers(dst *image.RGBA64, layers []*docLayer, selected bool) error {
+	for i := len(layers) - 1; i >= 0; i-- {
+		layer := layers[i]
+		named := layerNamed(layer.name)
+		picked := selected || named
+		if !picked && !(layer.group && anyLayerNamed(layer.children)) ||
+			!layer.visible && !hiddenLayers && !named || layer.opacity <= 0 {
+			continue
+		}
+		pixels, err := layer.load()
+		if err != nil {
+			return err
+		}
+		if layer.group {
+			group := image.NewRGBA64(dst.Bounds())
+			if err := drawLayers(group, layer.children, picked); err != nil {
+				return err
+			}
+			pixels.img, pixels.offset = group, image.Point{}
+		}
+		if pixels.img == nil {
+			continue
+		}
+		r := pixels.img.Bounds().Sub(pixels.img.Bounds().Min).Add(pixels.offset)
+		draw.DrawMask(dst, r, pixels.img, pixels.img.Bounds().Min, layerMask(pixels, layer.opacity), r.Min.Sub(pixels.maskOffset), draw.Over)
+	}
+	return nil
+}
+
+// layerMask returns the mask a layer is drawn through: its own mask scaled
+// by opacity, or opacity alone.
+func layerMask(pixels layerPixels, opacity float64) image.Image {
+	opacity = min(opacity, 1)
+	if pixels.mask == nil {
+		return image.NewUniform(color.Alpha16{A: uint16(math.Round(opacity * 0xffff))})
+	}
+	if opacity < 1 {
+		for i := 0; i < len(pixels.mask.Pix); i += 2 {
+			v := math.Round(float64(uint16(pixels.mask.Pix[i])<<8|uint16(pixels.mask.Pix[i+1])) * opacity)
+			pixels.mask.Pix[i], pixels.mask.Pix[i+1] = uint8(uint16(v)>>8), uint8(v)
+		}
+	}
+	return pixels.mask
+}
+
+// layerNamed reports whether name is one of layerNames, ignoring case.
+func layerNamed(name string) bool {
+	for _, n := range layerNames {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyLayerNamed reports whether any of layers, or of their members, is
+// named in layerNames.
+func anyLayerNamed(layers []*docLayer) bool {
+	for _, layer := range layers {
+		if layerNamed(layer.name) || anyLayerNamed(layer.children) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const lockUsage = "what to do when another run is writing to the same output directory: fail, wait or skip (default fail)"
+
+// lockPoll is how often -if-locked wait checks the lock again.
+const lockPoll = 2 * time.Second
+
+// errOutputLocked is what lockOutput fails with when another run holds the
+// lock and -if-locked is fail or skip.
+var errOutputLocked = errors.New("output directory is in use")
+
+// lockOwner is the content of a lock file.
+type lockOwner struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+func (o lockOwner) String() string {
+	return fmt.Sprintf("pid %d on %s since %s", o.PID, o.Host, o.Started.Local().Format(time.DateTime))
+}
+
+// outputLock is held by a run for as long as it writes to an output
+// directory. The operating system holds the lock on the open file, so it
+// is released when the run ends, however it ends.
+type outputLock struct {
+	path string
+	file *os.File
+}
+
+// lockPath is the lock file guarding out. It sits next to out rather than
+// in it, so -atomic can swap out while the lock is held.
+func lockPath(out string) string {
+	return filepath.Clean(out) + ".lock"
+}
+
+// registerIfLocked registers -if-locked, storing its value in ifLocked.
+func registerIfLocked(fs *flag.FlagSet, ifLocked *string) {
+	*ifLocked = "fail"
+	fs.Func("if-locked", lockUsage, func(s string) error {
+		switch s {
+		case "fail", "wait", "skip":
+			*ifLocked = s
+			return nil
+		}
+		return fmt.Errorf("must be fail, wait or skip, got %q", s)
+	})
+}
+
+// skipLocked reports whether err means the run should end quietly because
+// another one holds the lock and ifLocked is skip, saying so if it does.
+func skipLocked(err error, ifLocked string) bool {
+	if ifLocked != "skip" || !errors.Is(err, errOutputLocked) {
+		return false
+	}
+	fmt.Printf("Skipping: %v\n", err)
+	return true
+}
+
+// lockOutput takes the lock on the output directory out. If another run
+// holds it, it waits for that run with ifLocked "wait", or fails with
+// errOutputLocked.
+//
+// The lock is an operating system lock on the lock file, so taking it is
+// atomic and a run that died leaves nothing to take over. The file only
+// names the holder, for the message other runs print.
+func lockOutput(out, ifLocked string) (*outputLock, error) {
+	path := lockPath(out)
+	host, _ := os.Hostname()
+	owner := lockOwner{PID: os.Getpid(), Host: host, Started: time.Now()}
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return nil, err
+	}
+	if err := guardWrite(path); err != nil {
+		return nil, err
+	}
+	waiting := false
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		locked, err := lockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if locked && !namesFile(path, file) {
+			// The run that held it removed it on release; lock the file
+			// that is there now
+			unlockFile(file)
+			continue
+		}
+		if locked {
+			l := &outputLock{path: path, file: file}
+			if err := file.Truncate(0); err == nil {
+				_, err = file.WriteAt(data, 0)
+			}
+			if err != nil {
+				l.release()
+				return nil, err
+			}
+			return l, nil
+		}
+		file.Close()
+
+		holder := readLock(path)
+		if ifLocked != "wait" {
+			return nil, fmt.Errorf("%w by %s", errOutputLocked, holder)
+		}
+		if !waiting {
+			fmt.Printf("Waiting for the run holding %s (%s)...\n", path, holder)
+			waiting = true
+		}
+		time.Sleep(lockPoll)
+	}
+}
+
+// namesFile reports whether path still names the open file.
+func namesFile(path string, file *os.File) bool {
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	fileInfo, err := file.Stat()
+	return err == nil && os.SameFile(pathInfo, fileInfo)
+}
+
+// readLock describes the holder of the lock file at path, or returns
+// "another run" if it hasn't written itself there yet.
+func readLock(path string) string {
+	var owner lockOwner
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &owner)
+	}
+	if owner.PID == 0 {
+		return "another run"
+	}
+	return owner.String()
+}
+
+// release gives up the lock and removes the lock file. It is removed
+// while still locked, so that a run that opened it in the meantime sees it
+// is no longer the lock file once it gets the lock. Windows can't remove a
+// file that is open, so there it is removed once unlocked, unless a
+// waiting run has opened it by then and takes the lock on it.
+func (l *outputLock) release() {
+	err := os.Remove(l.path)
+	unlockFile(l.file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		os.Remove(l.path)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build (!unix && !windows) || aix
+
+package main
+
+import "os"
+
+// lockFile can't lock files on this platform, so every run gets the lock
+// and runs sharing an output directory aren't kept apart.
+func lockFile(f *os.File) (bool, error) {
+	return true, nil
+}
+
+func unlockFile(f *os.File) {
+	f.Close()
+}
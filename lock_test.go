@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockOutputExcludesOtherRuns(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	lock, err := lockOutput(out, "fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockOutput(out, "fail"); !errors.Is(err, errOutputLocked) {
+		t.Fatalf("second lock: %v, want errOutputLocked", err)
+	}
+	lock.release()
+	if _, err := os.Stat(lockPath(out)); !os.IsNotExist(err) {
+		t.Errorf("lock file left after release: %v", err)
+	}
+	lock, err = lockOutput(out, "fail")
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	lock.release()
+}
+
+// TestLockOutputLeftover takes the lock over a lock file that no run
+// holds, as a run that crashed leaves it.
+func TestLockOutputLeftover(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	if err := os.WriteFile(lockPath(out), []byte(`{"pid":1,"host":"elsewhere"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := lockOutput(out, "fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.release()
+}
+
+// TestLockOutputRace takes the lock from many goroutines at once, over a
+// leftover lock file and while the holder releases and retakes it, and
+// checks that no two ever hold it together.
+func TestLockOutputRace(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	if err := os.WriteFile(lockPath(out), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var holders atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				lock, err := lockOutput(out, "fail")
+				if errors.Is(err, errOutputLocked) {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if holders.Add(1) > 1 {
+					t.Error("two holders at once")
+				}
+				time.Sleep(100 * time.Microsecond)
+				holders.Add(-1)
+				lock.release()
+			}
+		}()
+	}
+	wg.Wait()
+}
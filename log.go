@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// logOutput is where progress messages go. Writes to it are serialized by
+// logMu so messages from concurrent work never interleave mid-line.
+var (
+	logOutput io.Writer = os.Stdout
+	logMu     sync.Mutex
+)
+
+// logf writes a complete message to logOutput.
+func logf(format string, args ...any) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	fmt.Fprintf(logOutput, format, args...)
+}
+
+// fileLog collects the messages about one file while it is processed and
+// writes them to logOutput as one block, so the lines of files processed
+// at the same time stay together. If processBatch holds the output of the
+// source file, the block goes there instead.
+type fileLog struct {
+	buf    bytes.Buffer
+	source string
+}
+
+func (l *fileLog) Printf(format string, args ...any) {
+	fmt.Fprintf(&l.buf, format, args...)
+}
+
+// Line writes a message on a line of its own, ending the current line
+// first if one is open.
+func (l *fileLog) Line(format string, args ...any) {
+	if b := l.buf.Bytes(); len(b) > 0 && b[len(b)-1] != '\n' {
+		l.buf.WriteByte('\n')
+	}
+	fmt.Fprintf(&l.buf, format, args...)
+	l.buf.WriteByte('\n')
+}
+
+// flush writes the collected messages as one block and starts a new one.
+func (l *fileLog) flush() {
+	if held, ok := heldOutput.Load(l.source); ok {
+		held.(*bytes.Buffer).Write(l.buf.Bytes())
+		l.buf.Reset()
+		return
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	logOutput.Write(l.buf.Bytes())
+	l.buf.Reset()
+}
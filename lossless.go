@@ -0,0 +1,59 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// encodeLosslessWithin encodes img with encode, a PNG or GIF encoder, at
+// the largest size whose encoding fits in limit bytes. With no quality to
+// give, it binary searches the long edge instead, starting from where the
+// byte count scaling with pixel count suggests. If even minShrinkEdge
+// pixels on the short side don't fit, it returns errCannotMeetTarget. With
+// -trace, attempts are written to log.
+func encodeLosslessWithin(log *fileLog, img image.Image, limit int, encode func(image.Image) ([]byte, error)) ([]byte, error) {
+	data, err := encode(img)
+	if err != nil || len(data) <= limit {
+		return data, err
+	}
+	bounds := img.Bounds()
+	longEdge := max(bounds.Dx(), bounds.Dy())
+	// The smallest long edge that keeps the short side at minShrinkEdge
+	lo := min(longEdge, max(1, minShrinkEdge*longEdge/max(min(bounds.Dx(), bounds.Dy()), 1)))
+	hi := longEdge - 1
+	guess := int(float64(longEdge) * math.Sqrt(float64(limit)/float64(len(data))))
+
+	var best []byte
+	var size image.Point
+	// Once something fits, a long edge within half a percent of the best
+	// possible one isn't worth more encodes
+	for lo <= hi && (best == nil || hi-lo > longEdge/200) {
+		edge := (lo + hi) / 2
+		if guess >= lo && guess <= hi {
+			edge, guess = guess, 0
+		}
+		small := fitLongEdge(img, edge)
+		encoded, err := encode(small)
+		if err != nil {
+			return nil, err
+		}
+		fits := len(encoded) <= limit
+		if traceSearch {
+			decision := "too large, smaller"
+			if fits {
+				decision = "fits, larger"
+			}
+			log.Line("  %dx%d: %s, %s", small.Bounds().Dx(), small.Bounds().Dy(), formatSize(len(encoded)), decision)
+		}
+		if fits {
+			best, size, lo = encoded, small.Bounds().Size(), edge+1
+		} else {
+			hi = edge - 1
+		}
+	}
+	if best == nil {
+		return nil, errCannotMeetTarget
+	}
+	log.Printf("(downscaled to %dx%d to keep the format) ", size.X, size.Y)
+	return best, nil
+}
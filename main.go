@@ -1,301 +1,899 @@
 package main
 
 import (
-	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"image"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
+	"image/color"
+	_ "image/png"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"image-compressor/pkg/compressor"
 )
 
-const targetSize = 990 * 1000 // 990KB for safety margin
+var targetSize = compressor.DefaultTargetSize
+
+// noConvert keeps every output in its source format, failing images that
+// would otherwise be converted to JPEG to meet the target.
+var noConvert bool
+
+// convertAll converts every compressed image to JPEG, even when its own
+// format would meet the target.
+var convertAll bool
+
+// keepBoth writes the best-effort original-format output next to the JPEG
+// whenever an image is converted, even though it misses the target.
+var keepBoth bool
+
+// errCannotMeetTarget is the failure of an image that ends up over the
+// target size however hard it is compressed. No output is left behind for
+// it.
+var errCannotMeetTarget = compressor.ErrCannotMeetTarget
+
+// errNeedsConversion is the failure noConvert reports.
+var errNeedsConversion = errors.New("cannot meet target without conversion")
+
+// errNeedsFlattening is the failure of an image that can't meet the target
+// without losing its transparency.
+var errNeedsFlattening = errors.New("cannot meet target without flattening transparency (see -flatten-background)")
+
+// maxJPEGQuality is where the JPEG quality search starts.
+const maxJPEGQuality = compressor.DefaultMaxQuality
+
+// qualityCap lowers where the JPEG quality search starts; 0 leaves it at
+// maxJPEGQuality. It is only set per file by filename directives.
+var qualityCap int
+
+// startQuality is where the JPEG quality search starts for this file.
+func startQuality() int {
+	if qualityCap > 0 {
+		return qualityCap
+	}
+	return maxJPEGQuality
+}
+
+// command is a subcommand. summary is its one-line description in help;
+// flags returns its flag set without parsing anything, so help and
+// completion scripts can list the flags; words are the fixed values its
+// first positional argument accepts.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+	flags   func() *flag.FlagSet
+	words   []string
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "compress", summary: "compress the images in a directory once", run: runCompress, flags: func() *flag.FlagSet { return compressFlagSet(new(compressOptions)) }},
+		{name: "watch", summary: "keep compressing images as they appear in a directory", run: runWatch, flags: func() *flag.FlagSet { return watchFlagSet("watch", new(watchOptions)) }},
+		{name: "service", summary: "install or manage watch as a system service", run: runService, flags: func() *flag.FlagSet { return watchFlagSet("service", new(watchOptions)) }, words: serviceActions},
+		{name: "tray", summary: "run watch from a system tray icon", run: runTray, flags: func() *flag.FlagSet { return watchFlagSet("tray", new(watchOptions)) }},
+		{name: "serve", summary: "compress images uploaded over HTTP", run: runServe, flags: func() *flag.FlagSet { return serveFlagSet(new(serveOptions)) }},
+		{name: "dicom", summary: "extract size-capped JPEG or PNG previews from DICOM files, with window/level applied", run: runDICOM, flags: func() *flag.FlagSet { return dicomFlagSet(new(dicomOptions)) }},
+		{name: "convert", summary: "convert images to another format at a fixed quality, without a target size", run: runConvert, flags: func() *flag.FlagSet { return convertFlagSet(new(convertOptions)) }},
+		{name: "rpc", summary: "speak JSON-RPC over stdin and stdout, for wrappers in other languages", run: runRPC, flags: func() *flag.FlagSet { return rpcFlagSet(new(rpcOptions)) }},
+		{name: "analyze", summary: "print statistics about images: resolution, quality, entropy, sharpness", run: runAnalyze, flags: func() *flag.FlagSet { return analyzeFlagSet(new(analyzeOptions)) }},
+		{name: "compare", summary: "report how one image differs from another: SSIM, pixel error, dimensions and metadata", run: runCompare, flags: func() *flag.FlagSet { return compareFlagSet(new(compareOptions)) }},
+		{name: "report", summary: "summarize a report written with -report", run: runReport, flags: func() *flag.FlagSet { return reportFlagSet(new(reportOptions)) }},
+		{name: "tiles", summary: "cut images into DZI or IIIF tile pyramids", run: runTiles, flags: func() *flag.FlagSet { return new(tilesOptions).flagSet() }},
+		{name: "send", summary: "compress images and email them within a provider's attachment limit", run: runSend, flags: func() *flag.FlagSet { return sendFlagSet(new(sendOptions)) }},
+		{name: "site", summary: "compress a Hugo or Jekyll site's images in place", run: runSite, flags: func() *flag.FlagSet { return siteFlagSet(new(siteOptions)) }},
+		{name: "upload", summary: "compress images and upload them to WordPress or Ghost", run: runUpload, flags: func() *flag.FlagSet { return uploadFlagSet(new(uploadOptions)) }, words: uploadTargets},
+		{name: "destinations", summary: "list the upload limits -destination knows, or update them", run: runDestinations, flags: func() *flag.FlagSet { return destinationsFlagSet(new(destinationsOptions)) }},
+		{name: "update", summary: "update the binary to the latest release", run: runUpdate, flags: func() *flag.FlagSet { return updateFlagSet(new(updateOptions)) }},
+		{name: "config", summary: "show the effective settings and where each one comes from", run: runConfig, flags: func() *flag.FlagSet { return configFlagSet(new(configOptions)) }, words: configActions},
+		{name: "version", summary: "print the version and, with -features, the codecs compiled in", run: runVersion, flags: func() *flag.FlagSet { return versionFlagSet(new(versionOptions)) }},
+		{name: "completion", summary: "print a shell completion script", run: runCompletion, words: completionShells},
+		{name: "help", summary: "show help for a command", run: runHelp},
+	}
+}
 
 func main() {
-	fmt.Println("Image Compressor - Starting...")
-	fmt.Printf("Target size: %d KB (%.2f MB)\n", targetSize/1000, float64(targetSize)/(1000*1000))
-	
-	// Get the directory where the binary is located
-	execPath, err := os.Executable()
+	if len(os.Args) > 1 {
+		for _, cmd := range commands {
+			if os.Args[1] == cmd.name {
+				runSubcommand(cmd.run)
+				return
+			}
+		}
+	}
+
+	registerCompressionFlags(flag.CommandLine)
+	var input, output string
+	registerInputOutput(flag.CommandLine, &input, &output)
+	jobsPath := flag.String("jobs", "", jobsUsage)
+	lowPriority := flag.Bool("low-priority", false, lowPriorityUsage)
+	atomic := flag.Bool("atomic", false, atomicUsage)
+	var splitSize int
+	registerSplitOutput(flag.CommandLine, &splitSize)
+	var checkpointPath string
+	registerCheckpoint(flag.CommandLine, &checkpointPath)
+	var recursive bool
+	registerRecursive(flag.CommandLine, &recursive)
+	var workers int
+	registerWorkers(flag.CommandLine, &workers)
+	registerFilenameDirectives(flag.CommandLine)
+	registerBrackets(flag.CommandLine)
+	registerBursts(flag.CommandLine)
+	registerDedupe(flag.CommandLine)
+	var ifLocked string
+	registerIfLocked(flag.CommandLine, &ifLocked)
+	assertReadonly := flag.Bool("assert-readonly", false, readonlyUsage)
+	web := flag.Bool("web", false, webUsage)
+	var configPath string
+	registerConfigFlag(flag.CommandLine, &configPath)
+	flag.CommandLine.Usage = printUsage
+	_, err := parseLayered(flag.CommandLine, os.Args[1:], &configPath)
+
+	printBanner("Starting")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		waitForExit()
+		return
+	}
+	applyLowPriority(*lowPriority)
+	printSettings()
+	if *web {
+		if err := runWebUI(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			waitForExit()
+		}
+		return
+	}
+	var jobs []*jobEntry
+	if *jobsPath != "" {
+		var err error
+		if jobs, err = loadJobs(*jobsPath, currentSettings()); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			waitForExit()
+			return
+		}
+	}
+
+	// Without inputs, the images are the ones next to the binary
+	inputs, compressedDir, err := batchInputs(input, output, flag.Args())
 	if err != nil {
-		fmt.Printf("Error getting executable path: %v\n", err)
-		fmt.Println("Press Enter to exit...")
-		fmt.Scanln()
+		fmt.Printf("Error %v\n", err)
+		waitForExit()
+		return
+	}
+
+	if err := protectSources(*assertReadonly, inputs, batchWrites(compressedDir, checkpointPath)...); err != nil {
+		fmt.Printf("Error: %v (use -output)\n", err)
+		waitForExit()
 		return
 	}
-	
-	dir := filepath.Dir(execPath)
-	fmt.Printf("Processing images in: %s\n", dir)
-	
-	// Create compressed directory
-	compressedDir := filepath.Join(dir, "compressed")
-	if err := os.MkdirAll(compressedDir, 0755); err != nil {
-		fmt.Printf("Error creating compressed directory: %v\n", err)
-		fmt.Println("Press Enter to exit...")
-		fmt.Scanln()
+	lock, err := lockOutput(compressedDir, ifLocked)
+	if skipLocked(err, ifLocked) {
 		return
 	}
-	fmt.Printf("Output directory: %s\n\n", compressedDir)
-	
-	files, err := os.ReadDir(dir)
 	if err != nil {
-		fmt.Printf("Error reading directory: %v\n", err)
-		fmt.Println("Press Enter to exit...")
-		fmt.Scanln()
+		fmt.Printf("Error: %v\n", err)
+		waitForExit()
 		return
 	}
-	
-	processedCount := 0
-	skippedCount := 0
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	valid, err := compressBatch(inputs, compressedDir, jobs, *atomic, splitSize, checkpointPath, recursive, workers)
+	lock.release()
+	if err != nil {
+		fmt.Printf("Error %v\n", err)
+		waitForExit()
+		return
+	}
+	waitForExit()
+	if !valid {
+		os.Exit(1)
+	}
+}
+
+// runSubcommand runs a subcommand with the remaining arguments and exits
+// non-zero if it fails.
+func runSubcommand(run func(args []string) error) {
+	if err := run(os.Args[2:]); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// registerCompressionFlags adds the flags shared by every mode that
+// compresses images to fs.
+func registerCompressionFlags(fs *flag.FlagSet) {
+	fs.Func("target", "upload limit of the destination, e.g. 1MB, 500KB or 1MiB (default 1MB)", func(s string) error {
+		limit, err := parseSize(s)
+		uploadLimit = limit
+		updateTarget()
+		return err
+	})
+	fs.Func("target-size", "exact size outputs may reach, e.g. 500KB or 2MB: a -target with no -margin taken off", func(s string) error {
+		size, err := parseSize(s)
+		uploadLimit, sizeMargin = size, margin{}
+		updateTarget()
+		return err
+	})
+	fs.Func("margin", "how far under -target to aim, as a percentage (2%) or a size (10KB) (default 1%)", func(s string) error {
+		m, err := parseMargin(s)
+		sizeMargin = m
+		updateTarget()
+		return err
+	})
+	fs.Func("intent", "what outputs are for: web (8-bit sRGB within the target) or print (source color space and bit depth, lossless, no target) (default web)", parseIntent)
+	fs.IntVar(&effort, "effort", defaultEffort, "encode effort from 1 (fastest) to 9 (smallest output)")
+	fs.IntVar(&qualityBelowSource, "quality-below-source", 0, "cap JPEG output quality this many steps under the estimated source quality")
+	fs.IntVar(&tileThreshold, "tile-threshold", tileThreshold, "pixel count above which images are decoded and reduced in strips")
+	fs.BoolVar(&traceSearch, "trace", false, "print every encode the quality search tries per file: quality, size and what it does next")
+	fs.BoolVar(&skipReview, "skip-review", false, "don't flag images that look blurry or were already heavily compressed for review")
+	fs.BoolVar(&skipUpscaleCheck, "skip-upscale-check", false, "don't detect images enlarged from a smaller original and scale them back down")
+	fs.BoolVar(&linearResize, "linear-resize", false, "resize in linear light for more faithful downscaled photos (slower)")
+	fs.Func("resize-filter", "how images are resampled when scaled down: box averages the pixels each output pixel covers, catmull-rom and lanczos keep more fine detail sharp at the cost of faint halos along hard edges (default box)", parseResizeFilter)
+	fs.BoolVar(&noConvert, "no-convert", false, "never convert PNG, GIF or other formats to JPEG; fail images that can't meet the target in their own format")
+	fs.BoolVar(&convertAll, "convert", false, "convert every compressed image to JPEG, even when its own format would meet the target")
+	fs.Func("policy", policyUsage, parsePolicy)
+	fs.Func("fallback", fallbackUsage, parseFallback)
+	fs.BoolVar(&heicOutput, "heic", false, "write outputs as HEIC (needs a build with -tags heif and libheif)")
+	fs.Func("layers", "comma-separated names of the layers and groups to flatten PSD, XCF and OpenRaster files from, hidden or not, instead of the visible ones", parseLayerNames)
+	fs.BoolVar(&hiddenLayers, "hidden-layers", false, "flatten the hidden layers of PSD, XCF and OpenRaster files too")
+	fs.Func("flatten-color", "background that transparent areas are composited onto when converting to JPEG: white, black, #rrggbb or #rgb (default white)", parseFlattenColor)
+	fs.Func("flatten-background", "convert PNGs and GIFs with transparency that can't meet the target to JPEG, composited onto this color (white, black, #rrggbb or #rgb), instead of reducing them to a palette and scaling them down to keep transparency", parseFlattenBackground)
+	fs.BoolVar(&keepBoth, "keep-both", false, "when an image is converted to JPEG, also keep its best-effort original-format output")
+	fs.BoolVar(&strictExt, "strict-ext", false, "only process files with an image extension, never sniff extensionless files")
+	fs.BoolVar(&stripCopies, "strip-copies", false, "strip metadata from JPEGs copied as-is too, keeping only what -keep-metadata keeps in compressed outputs")
+	fs.BoolVar(&keepMetadata, "keep-metadata", false, "carry JPEG metadata (color profile, EXIF, IPTC, XMP) over to outputs")
+	fs.DurationVar(&timeShift, "shift-time", 0, "shift the EXIF dates and times of outputs that carry metadata, e.g. -7h or 30m, to correct a camera clock")
+	fs.Func("set-offset", "set the EXIF time zone offsets of outputs that carry metadata, as +HH:MM or -HH:MM, where the camera recorded them", parseTimeOffset)
+	fs.Func("gps-precision", gpsPrecisionUsage, parseGPSPrecision)
+	fs.StringVar(&creditArtist, "set-artist", "", "write this artist into the EXIF and XMP of JPEG outputs, kept metadata or not, e.g. \"Jane Doe\"")
+	fs.StringVar(&creditCopyright, "set-copyright", "", "write this copyright notice into the EXIF and XMP of JPEG outputs, kept metadata or not, e.g. \"© 2025 Jane Doe\"")
+	fs.IntVar(&metadataBudget, "metadata-budget", defaultMetadataBudget, "maximum bytes of metadata kept per image; large blocks are trimmed or dropped to fit")
+	fs.Func("tag", tagUsage, parseTag)
+	fs.Func("name", "how outputs are named: original, or hash8 to add a content fingerprint (photo.a1b2c3d4.jpg) and list the names in "+manifestName+" (default original)", parseNaming)
+	fs.IntVar(&ioRetries, "io-retries", ioRetries, "times to retry a file that failed with a transient I/O error, e.g. from a network share")
+	fs.DurationVar(&ioRetryDelay, "io-retry-delay", ioRetryDelay, "wait before the first I/O retry, doubled for each one after it")
+	fs.StringVar(&reportPath, "report", "", "write a per-file report to this path (.csv for CSV, otherwise JSON)")
+	fs.Func("validate-sample", "after the batch, compare this share of outputs with their originals, e.g. 5%", func(s string) error {
+		v, err := parsePercent(s)
+		validateSample = v
+		return err
+	})
+	fs.Float64Var(&validateMinSSIM, "validate-min-ssim", defaultValidateMinSSIM, "fail the run if sampled outputs average a lower SSIM than this")
+	fs.Func("destination", destinationUsage, applyDestination)
+	fs.Func("preset", "apply a messaging app's size and dimension limits: "+strings.Join(presetNames(), ", ")+" (flags after it override it)", applyPreset)
+	fs.IntVar(&maxDimension, "max-dimension", 0, "scale images down so their longer side is at most this many pixels")
+	fs.Float64Var(&panoramaRatio, "panorama-ratio", defaultPanoramaRatio, "aspect ratio from which images are panoramas, whose short side alone -max-dimension and -display-size cap; 0 caps them like any image")
+	fs.IntVar(&panoramaMaxDimension, "panorama-max-dimension", 0, "scale panoramas down so their longer side is at most this many pixels")
+	fs.BoolVar(&panoramaTiles, "panorama-tiles", false, "also cut panoramas into a DZI tile pyramid next to their output, for pan-and-zoom viewers")
+	fs.Func("display-size", "scale images down to what a display of WIDTHxHEIGHT CSS pixels, e.g. 1920x1080, shows at -dpr, keeping their aspect ratio", parseDisplaySize)
+	fs.Float64Var(&displayDPR, "dpr", 1, "device pixel ratio of the screens -display-size is for, e.g. 2 for most phones")
+	fs.Func("canvas", "make every output exactly WIDTHxHEIGHT, e.g. 1200x1200, by scaling the image to fit and padding the rest with -pad-color", parseCanvas)
+	fs.Func("redact", redactUsage, parseRedactFile)
+	fs.Func("redact-detector", redactDetectorUsage, parseRedactDetector)
+	fs.Func("redact-style", "how -redact obscures regions: pixelate, blur, or fill with black, the only style that leaves nothing of them (default pixelate)", parseRedactStyle)
+	fs.Func("pad-color", "color of the padding added by -canvas: white, black, #rrggbb or #rgb (default white)", parsePadColor)
+	fs.Func("sizes", "comma-separated long-edge sizes in pixels to emit per image, e.g. 2048,1024,512, or favicon for a .ico of 16, 32 and 48 px icons plus 16, 32, 180, 192 and 512 px PNGs", func(s string) error {
+		faviconProfile = strings.EqualFold(strings.TrimSpace(s), "favicon")
+		if faviconProfile {
+			profileSizes = faviconSizes
+			return nil
 		}
-		
-		ext := strings.ToLower(filepath.Ext(file.Name()))
-		if ext != ".jpg" && ext != ".jpeg" && ext != ".png" && ext != ".gif" && ext != ".webp" && ext != ".heic" && ext != ".heif" {
-			continue
+		sizes, err := parseSizes(s)
+		profileSizes = sizes
+		return err
+	})
+}
+
+// checkCompressionFlags validates the values set by registerCompressionFlags.
+func checkCompressionFlags() error {
+	if targetSize <= 0 {
+		return fmt.Errorf("-margin %s leaves nothing of the %s -target", sizeMargin, formatSize(uploadLimit))
+	}
+	if noConvert && keepBoth {
+		return fmt.Errorf("-no-convert and -keep-both can't be used together")
+	}
+	if noConvert && convertAll {
+		return fmt.Errorf("-no-convert and -convert can't be used together")
+	}
+	if effort < minEffort || effort > maxEffort {
+		return fmt.Errorf("-effort must be between %d and %d, got %d", minEffort, maxEffort, effort)
+	}
+	if maxDimension < 0 {
+		return fmt.Errorf("-max-dimension must not be negative")
+	}
+	if panoramaMaxDimension < 0 {
+		return fmt.Errorf("-panorama-max-dimension must not be negative")
+	}
+	if panoramaRatio != 0 && panoramaRatio <= 1 {
+		return fmt.Errorf("-panorama-ratio must be above 1, or 0 to turn panoramas off")
+	}
+	if displayDPR <= 0 {
+		return fmt.Errorf("-dpr must be positive")
+	}
+	if ioRetries < 0 || ioRetryDelay < 0 {
+		return fmt.Errorf("-io-retries and -io-retry-delay must not be negative")
+	}
+	if qualityBelowSource < 0 || qualityBelowSource > 99 {
+		return fmt.Errorf("-quality-below-source must be between 0 and 99")
+	}
+	if intent == intentPrint && len(profileSizes) > 0 {
+		return fmt.Errorf("-sizes is not supported with -intent print")
+	}
+	if canvasWidth > 0 && (len(profileSizes) > 0 || intent == intentPrint) {
+		return fmt.Errorf("-canvas can't be combined with -sizes or -intent print")
+	}
+	if heicOutput && !heifSupported {
+		return fmt.Errorf("-heic: %w", errHEICUnsupported)
+	}
+	if heicOutput && (convertAll || intent == intentPrint) {
+		return fmt.Errorf("-heic can't be combined with -convert or -intent print")
+	}
+	if intent == intentPrint && convertAll {
+		return fmt.Errorf("-convert is not supported with -intent print")
+	}
+	return nil
+}
+
+func printSettings() {
+	if intent == intentPrint {
+		fmt.Println("Intent: print (lossless, source color space and bit depth, no target size)")
+		if maxDimension > 0 {
+			fmt.Printf("Max dimension: %d px\n", maxDimension)
+		}
+		return
+	}
+	fmt.Printf("Target size: %s (%s)", formatUnits(targetSize, 1000, "KB"), formatBinarySize(targetSize))
+	if targetSize == sizeMargin.below(uploadLimit) && sizeMargin != (margin{}) {
+		fmt.Printf(", %s under the %s limit", sizeMargin, formatSize(uploadLimit))
+	}
+	fmt.Println()
+	fmt.Printf("Effort: %d\n", effort)
+	if destinationName != "" {
+		fmt.Printf("Destination: %s", destinationName)
+		if destinationBatchLimit > 0 {
+			fmt.Printf(", outputs split into batches of %s", formatSize(destinationBatchLimit))
+		}
+		fmt.Println()
+	}
+	if maxDimension > 0 {
+		fmt.Printf("Max dimension: %d px\n", maxDimension)
+	}
+	if displayWidth > 0 {
+		boxWidth, boxHeight := displayBox()
+		fmt.Printf("Display size: %dx%d at %gx, images fit within %dx%d px\n", displayWidth, displayHeight, displayDPR, boxWidth, boxHeight)
+	}
+	if resizeFilter != compressor.Box {
+		fmt.Printf("Resize filter: %s\n", resizeFilter)
+	}
+	if panoramas := formatPanoramas(); panoramas != "" {
+		fmt.Printf("Panoramas: %s\n", panoramas)
+	}
+	if faviconProfile {
+		fmt.Printf("Profiles: favicon (.ico of %v px, PNGs of %v px)\n", faviconICOSizes, faviconSizes)
+	} else if len(profileSizes) > 0 {
+		fmt.Printf("Profiles: %v px\n", profileSizes)
+	}
+	if len(layerNames) > 0 {
+		fmt.Printf("Layers: %s\n", strings.Join(layerNames, ", "))
+	}
+	if hiddenLayers {
+		fmt.Println("Hidden layers: flattened")
+	}
+	if canvasWidth > 0 {
+		fmt.Printf("Canvas: %dx%d px, padded with %s\n", canvasWidth, canvasHeight, formatColor(padColor))
+	}
+	if redactRegions != nil || redactDetector != nil {
+		fmt.Printf("Redaction: %s\n", formatRedaction())
+	}
+	if flattenTransparent {
+		fmt.Printf("Flatten background: %s, transparent PNGs and GIFs over the target are converted to JPEG\n", formatColor(flattenColor))
+	} else if formatColor(flattenColor) != formatColor(color.White) {
+		fmt.Printf("Flatten color: %s\n", formatColor(flattenColor))
+	}
+	if table := formatPolicyTable(formatPolicies); table != formatPolicyTable(defaultPolicies) {
+		fmt.Printf("Policies: %s\n", table)
+	}
+	if chain := strings.Join(fallbackChain, ","); chain != strings.Join(defaultFallbacks, ",") {
+		if chain == "" {
+			chain = "none"
 		}
-		
-		filePath := filepath.Join(dir, file.Name())
-		info, err := os.Stat(filePath)
+		fmt.Printf("Fallbacks: %s\n", chain)
+	}
+	if gpsPrecision >= 0 {
+		fmt.Printf("GPS precision: %d decimal place(s)\n", gpsPrecision)
+	}
+	if credit := formatCredit(); credit != "" {
+		fmt.Printf("Credit: %s\n", credit)
+	}
+	if fixes := formatTimeFixes(); fixes != "" {
+		fmt.Printf("EXIF times: %s\n", fixes)
+	}
+	if tagMode != tagNone {
+		fmt.Printf("Tagging: %s\n", tagMode)
+	}
+	if outputNaming != "original" {
+		fmt.Printf("Naming: %s (see %s)\n", outputNaming, manifestName)
+	}
+}
+
+// programName is the name the binary was invoked as, without a Windows
+// .exe suffix, or commandName in a branded build that sets it.
+func programName() string {
+	if commandName != "" {
+		return commandName
+	}
+	return strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+}
+
+// executableDir returns the directory containing the running binary, which
+// is where the tool looks for images by default.
+func executableDir() (string, error) {
+	execPath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return longPath(filepath.Dir(execPath)), nil
+}
+
+type fileOutcome int
+
+const (
+	outcomeFailed fileOutcome = iota
+	outcomeCompressed
+	outcomeCopied
+	// outcomeSkipped is a source -tag marks as processed already, or a
+	// bracketed exposure, burst frame or near-duplicate -brackets, -bursts
+	// or -dedupe-similar leaves out
+	outcomeSkipped
+)
+
+func (o fileOutcome) String() string {
+	switch o {
+	case outcomeCompressed:
+		return "compressed"
+	case outcomeCopied:
+		return "copied"
+	case outcomeSkipped:
+		return "skipped"
+	default:
+		return "failed"
+	}
+}
+
+// processFile compresses (or copies) the image at filePath into
+// compressedDir, printing one status line for it.
+func processFile(filePath, compressedDir string) (result fileResult) {
+	name := filepath.Base(filePath)
+	end := startSpan("process file", "file", name)
+	defer func() { end(result.err()) }()
+	log := &fileLog{source: filePath}
+	defer log.flush()
+	// A malformed file must fail only itself, not a whole batch or server
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("internal error: %v", r)
+			log.Printf("ERROR: %v\n", err)
+			result = result.failed(err)
+		}
+	}()
+
+	result = fileResult{Source: filePath, Outcome: outcomeFailed}
+	defer func() {
+		if result.Review = reviewReasons(result); result.Review != "" {
+			log.Line("  review: %s", result.Review)
+		}
+	}()
+	// Renaming by -name comes last, once nothing else touches the outputs
+	defer func() {
+		if result.Outcome == outcomeFailed || result.Outcome == outcomeSkipped || outputNaming == "original" {
+			return
+		}
+		named, err := result.nameOutputs()
 		if err != nil {
-			fmt.Printf("Error getting file info for %s: %v\n", file.Name(), err)
-			continue
+			log.Printf("ERROR naming output: %v\n", err)
+			result = result.failed(err)
+			return
 		}
-		
-		fmt.Printf("Processing %s (%.2f MB)... ", file.Name(), float64(info.Size())/(1000*1000))
-		
-		outputPath := filepath.Join(compressedDir, file.Name())
-		
-		if info.Size() <= targetSize {
-			// Copy file as-is if already under target size
-			if err := copyFile(filePath, outputPath); err != nil {
-				fmt.Printf("ERROR copying: %v\n", err)
-			} else {
-				fmt.Printf("COPIED (already under target)\n")
-				skippedCount++
+		result = named
+	}()
+	info, err := os.Stat(filePath)
+	if err != nil {
+		log.Printf("Error getting file info for %s: %v\n", name, err)
+		return result.failed(err)
+	}
+	result.InputBytes = info.Size()
+	result.SourceQuality = estimateJPEGQualityFile(filePath)
+
+	log.Printf("Processing %s (%.2f MB", name, float64(info.Size())/(1000*1000))
+	if result.SourceQuality > 0 {
+		log.Printf(", q%d", result.SourceQuality)
+	}
+	log.Printf(")... ")
+
+	if tagMode != tagNone {
+		sourceHash, err := fileSHA256(filePath)
+		if err != nil {
+			log.Printf("ERROR: %v\n", err)
+			return result.failed(err)
+		}
+		if output, outInfo := taggedOutput(filePath, compressedDir, sourceHash); outInfo != nil {
+			log.Printf("SKIPPED (tagged as processed)\n")
+			return result.done(outcomeSkipped, output, outInfo.Size())
+		}
+		// Deferred before the -name renaming, which the marks survive
+		defer func() {
+			if result.Outcome != outcomeFailed {
+				tagFinished(log, result, sourceHash)
 			}
-			continue
+		}()
+	}
+
+	if intent == intentPrint {
+		outputPath, err := compressPrint(log, filePath, filepath.Join(compressedDir, outputFileName(filePath)))
+		if err != nil {
+			log.Printf("ERROR: %v\n", err)
+			return result.failed(err)
+		}
+		outInfo, err := os.Stat(outputPath)
+		if err != nil {
+			log.Printf("ERROR reading output: %v\n", err)
+			return result.failed(err)
 		}
-		
-		if err := compressImage(filePath, outputPath); err != nil {
-			fmt.Printf("ERROR: %v\n", err)
-		} else {
-			// Verify the compressed file is actually under 1MB
-			newInfo, err := os.Stat(outputPath)
-			if err != nil {
-				fmt.Printf("ERROR reading output: %v\n", err)
-			} else if newInfo.Size() > targetSize {
-				// Still too large, try more aggressive compression
-				fmt.Printf("still %.2f MB, re-compressing... ", float64(newInfo.Size())/(1000*1000))
-				if err := recompressImage(outputPath); err != nil {
-					fmt.Printf("FAILED: %v\n", err)
-					// Remove the failed file
-					os.Remove(outputPath)
-				} else {
-					finalInfo, _ := os.Stat(outputPath)
-					if finalInfo != nil && finalInfo.Size() <= targetSize {
-						fmt.Printf("DONE (%.2f MB)\n", float64(finalInfo.Size())/(1000*1000))
-						processedCount++
-					} else {
-						fmt.Printf("FAILED: Could not compress below 990KB\n")
-						os.Remove(outputPath)
-					}
-				}
-			} else {
-				fmt.Printf("DONE (%.2f MB)\n", float64(newInfo.Size())/(1000*1000))
-				processedCount++
+		log.Printf("DONE (%s)\n", formatMB(outInfo.Size()))
+		return result.done(outcomeCompressed, outputPath, outInfo.Size())
+	}
+
+	if faviconProfile {
+		if err := compressFavicon(log, filePath, compressedDir, outputFileName(filePath)); err != nil {
+			log.Printf("ERROR: %v\n", err)
+			return result.failed(err)
+		}
+		log.Printf("DONE\n")
+		result.Outcome = outcomeCompressed
+		return result
+	}
+
+	if len(profileSizes) > 0 {
+		if err := compressProfiles(log, filePath, compressedDir, outputFileName(filePath), profileSizes); err != nil {
+			log.Printf("ERROR: %v\n", err)
+			return result.failed(err)
+		}
+		log.Printf("DONE\n")
+		result.Outcome = outcomeCompressed
+		return result
+	}
+
+	if panoramaTiles && isPanoramaFile(filePath) {
+		defer func() {
+			if result.Outcome != outcomeFailed {
+				tilePanorama(log, filePath, compressedDir)
 			}
+		}()
+	}
+
+	outputPath := filepath.Join(compressedDir, outputFileName(filePath))
+
+	if originalFits(filePath, info) {
+		// Copy file as-is if already under target size
+		size, err := copyOriginal(filePath, outputPath)
+		if err != nil {
+			log.Printf("ERROR copying: %v\n", err)
+			return result.failed(err)
 		}
+		log.Printf("COPIED (already under target)\n")
+		return result.done(outcomeCopied, outputPath, size)
 	}
-	
-	fmt.Printf("\nCompleted! Compressed %d images, copied %d images.\n", processedCount, skippedCount)
-	fmt.Printf("All output saved to: %s\n", compressedDir)
-	fmt.Println("Press Enter to exit...")
-	fmt.Scanln()
+
+	requestedPath := outputPath
+	outputPath, err = compressImage(log, filePath, outputPath)
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		return result.failed(err)
+	}
+	if keepBoth && outputPath != requestedPath {
+		if _, err := os.Stat(requestedPath); err == nil {
+			result.KeptOutput = requestedPath
+		}
+	}
+
+	// Verify the compressed file is actually under 1MB
+	newInfo, err := os.Stat(outputPath)
+	if err != nil {
+		log.Printf("ERROR reading output: %v\n", err)
+		return result.failed(err)
+	}
+	size := newInfo.Size()
+	if size > info.Size() && originalUsable(filePath) {
+		// Re-encoding made the file larger. The original is over the
+		// target, or it would have been copied already, so the fallbacks
+		// start from it instead
+		data, err := copiedData(filePath)
+		if err != nil {
+			log.Printf("ERROR copying: %v\n", err)
+			return result.failed(err)
+		}
+		if int64(len(data)) < size {
+			if outputPath != requestedPath {
+				os.Remove(outputPath)
+			}
+			if err := writeOutput(requestedPath, data); err != nil {
+				log.Printf("ERROR copying: %v\n", err)
+				return result.failed(err)
+			}
+			log.Printf("original is smaller than re-encoding it, ")
+			outputPath, size = requestedPath, int64(len(data))
+			result.KeptOutput = ""
+		}
+	}
+	if size <= int64(targetSize) {
+		log.Printf("DONE (%s)\n", formatMB(size))
+		return result.done(outcomeCompressed, outputPath, size)
+	}
+
+	// Still too large, try the fallback strategies
+	log.Printf("still %.2f MB, trying fallbacks... ", float64(size)/(1000*1000))
+	finalPath, finalSize, err := runFallbacks(log, outputPath)
+	if errors.Is(err, errCannotMeetTarget) {
+		log.Printf("FAILED: Could not compress below %s\n", formatSize(targetSize))
+		return result.failed(err)
+	}
+	if err != nil {
+		log.Printf("FAILED: %v\n", err)
+		return result.failed(err)
+	}
+	log.Printf("DONE (%s)\n", formatMB(finalSize))
+	return result.done(outcomeCompressed, finalPath, finalSize)
+}
+
+// originalFits reports whether the source file itself meets the target
+// size and can stand in for a compressed output, as originalUsable
+// decides.
+func originalFits(path string, info os.FileInfo) bool {
+	if info.Size() > int64(targetSize) || !originalUsable(path) {
+		return false
+	}
+	if !setsCredit() {
+		return true
+	}
+	// The credit makes copies larger than their source
+	data, err := copiedData(path)
+	return err == nil && len(data) <= targetSize
+}
+
+// originalUsable reports whether the source file, whatever its size, can
+// stand in for a compressed output: it must be within the dimension cap.
+// With convertAll only JPEGs can, web outputs have to be in sRGB, and
+// images with regions to redact have to be re-encoded. Files whose header
+// can't be read as an image never stand in, so a corrupt source fails
+// rather than being passed on.
+func originalUsable(path string) bool {
+	if !readableImage(path) || convertAll && sniffImageExt(path) != ".jpg" || needsWebConversion(path) || isJPEG2000(path) || isEditorDocument(path) || isBracketMerge(path) || redacts(path) {
+		return false
+	}
+	return !exceedsMaxDimension(path) && matchesCanvas(path)
 }
 
-func copyFile(src, dst string) error {
-	input, err := os.ReadFile(src)
+// readableImage reports whether the header of the image at path decodes.
+func readableImage(path string) bool {
+	file, err := os.Open(path)
 	if err != nil {
-		return err
+		return false
+	}
+	defer file.Close()
+	_, _, err = decodeConfig(file)
+	return err == nil
+}
+
+// copyOriginal copies src to dst and returns the size written.
+func copyOriginal(src, dst string) (int64, error) {
+	data, err := copiedData(src)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), writeOutput(dst, data)
+}
+
+// copiedData returns what copyOriginal writes for src. With stripCopies, a
+// JPEG's metadata is reduced to what a compressed output would carry;
+// otherwise it is only fixed by fixMetadata and credited.
+func copiedData(src string) ([]byte, error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+	if stripCopies {
+		return insertJPEGSegments(stripJPEGMetadata(data), sourceMetadata(src)), nil
 	}
-	return os.WriteFile(dst, input, 0644)
+	return fixJPEGMetadata(data), nil
 }
 
-func compressImage(srcPath, dstPath string) error {
+// compressImage compresses srcPath to dstPath and returns the path actually
+// written, which has a .jpg extension instead when the image was converted.
+func compressImage(log *fileLog, srcPath, dstPath string) (string, error) {
 	ext := strings.ToLower(filepath.Ext(srcPath))
-	
+
+	// A merged bracket stands in for its normal exposure
+	if merged, ok := bracketMerges.Load(srcPath); ok {
+		img := merged.(image.Image)
+		recordSharpness(srcPath, img)
+		log.Printf("(merged bracket) ")
+		img, err := redact(log, srcPath, img)
+		if err != nil {
+			return "", err
+		}
+		return encodeDecoded(log, "jpeg", srcPath, dstPath, fitCanvas(log, shrinkUpscaled(log, capDimensions(img))))
+	}
+
 	// Handle HEIC/HEIF files separately
 	if ext == ".heic" || ext == ".heif" {
-		return compressHEIC(srcPath, dstPath)
+		img, err := decodeHEICFile(log, srcPath)
+		if err != nil {
+			return "", err
+		}
+		recordSharpness(srcPath, img)
+		if img, err = redact(log, srcPath, img); err != nil {
+			return "", err
+		}
+		return encodeDecoded(log, "heic", srcPath, dstPath, fitCanvas(log, shrinkUpscaled(log, capDimensions(img))))
 	}
-	
+
 	// Read the original image
 	file, err := os.Open(srcPath)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer file.Close()
-	
-	// Decode the image
-	img, format, err := image.Decode(file)
-	if err != nil {
-		return err
+
+	// Send gigapixel images down the tiled path before decoding them
+	cfg, sourceFormat, err := decodeConfig(file)
+	if err == nil {
+		if err := checkDecodeSize(cfg); err != nil {
+			return "", err
+		}
+		if cfg.Width*cfg.Height > tileThreshold {
+			file.Close()
+			return compressLarge(log, srcPath, dstPath, cfg)
+		}
 	}
-	file.Close()
-	
-	// Compress based on format
-	switch format {
-	case "jpeg":
-		return compressJPEG(dstPath, img)
-	case "png":
-		return compressPNG(srcPath, dstPath, img)
-	case "gif":
-		return compressGIF(srcPath, dstPath, img)
-	default:
-		// For unsupported formats, try to save as JPEG
-		jpegPath := strings.TrimSuffix(dstPath, filepath.Ext(dstPath)) + ".jpg"
-		return compressJPEG(jpegPath, img)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
 	}
-}
 
-func compressJPEG(dstPath string, img image.Image) error {
-	quality := 95
-	
-	// Try different quality levels
-	for quality > 10 {
-		var buffer bytes.Buffer
-		err := jpeg.Encode(&buffer, img, &jpeg.Options{Quality: quality})
+	// Animated GIFs that stay GIFs keep their frames, unless regions of
+	// them are redacted, which only the first frame has
+	if sourceFormat == "gif" && keepsAnimation() && !redacts(srcPath) {
+		anim, err := readAnimation(file)
 		if err != nil {
-			return err
-		}
-		
-		if buffer.Len() <= targetSize {
-			// Found a good quality level
-			return os.WriteFile(dstPath, buffer.Bytes(), 0644)
+			return "", err
 		}
-		
-		// Adjust quality based on how far we are from target
-		ratio := float64(buffer.Len()) / float64(targetSize)
-		if ratio > 2 {
-			quality -= 20
-		} else if ratio > 1.5 {
-			quality -= 10
-		} else {
-			quality -= 5
+		if anim != nil {
+			path, err := compressAnimation(log, anim, dstPath)
+			if !errors.Is(err, errCannotMeetTarget) {
+				return path, err
+			}
+			log.Printf("(animation can't meet the target; keeping the first frame) ")
 		}
-		
-		if quality < 10 {
-			quality = 10
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", err
 		}
 	}
-	
-	// If we can't get it small enough, use quality 10
-	var buffer bytes.Buffer
-	err := jpeg.Encode(&buffer, img, &jpeg.Options{Quality: 10})
+
+	// Decode the image
+	endDecode := startSpan("decode")
+	img, format, err := decodeImage(file)
+	endDecode(err)
 	if err != nil {
-		return err
+		return "", err
+	}
+	file.Close()
+	recordSharpness(srcPath, img)
+	if img, err = redact(log, srcPath, prepareForWeb(log, srcPath, img)); err != nil {
+		return "", err
 	}
-	return os.WriteFile(dstPath, buffer.Bytes(), 0644)
+
+	return encodeDecoded(log, format, srcPath, dstPath, fitCanvas(log, shrinkUpscaled(log, capDimensions(img))))
 }
 
-func compressPNG(srcPath, dstPath string, img image.Image) error {
-	// First try PNG with best compression
-	var buffer bytes.Buffer
-	encoder := png.Encoder{CompressionLevel: png.BestCompression}
-	err := encoder.Encode(&buffer, img)
-	if err != nil {
-		return err
+// encodeDecoded compresses an already decoded image of the given source
+// format to dstPath and returns the path actually written.
+func encodeDecoded(log *fileLog, format, srcPath, dstPath string, img image.Image) (path string, err error) {
+	end := startSpan("encode", "format", format, "width", img.Bounds().Dx(), "height", img.Bounds().Dy())
+	defer func() { end(err) }()
+
+	if convertAll && format != "jpeg" {
+		jpegPath := jpegOutputPath(dstPath)
+		log.Printf("(converting to JPEG) ")
+		return jpegPath, compressJPEG(log, jpegPath, img)
 	}
-	
-	if buffer.Len() <= targetSize {
-		return os.WriteFile(dstPath, buffer.Bytes(), 0644)
+
+	if heicOutput {
+		return compressHEICOutput(log, dstPath, img)
 	}
-	
-	// If PNG is still too large, convert to JPEG
-	jpegPath := strings.TrimSuffix(dstPath, filepath.Ext(dstPath)) + ".jpg"
-	fmt.Printf("(converting to JPEG) ")
-	return compressJPEG(jpegPath, img)
+
+	return compressWithPolicy(log, format, srcPath, dstPath, img)
 }
 
-func compressGIF(srcPath, dstPath string, img image.Image) error {
-	// For GIF, try to re-encode with default settings
-	var buffer bytes.Buffer
-	err := gif.Encode(&buffer, img, nil)
-	if err != nil {
+// jpegOutputPath is where an output is written when it's converted to JPEG.
+func jpegOutputPath(dstPath string) string {
+	return strings.TrimSuffix(dstPath, filepath.Ext(dstPath)) + ".jpg"
+}
+
+// pngOutputPath is where an output is written when it's converted to PNG.
+func pngOutputPath(dstPath string) string {
+	return strings.TrimSuffix(dstPath, filepath.Ext(dstPath)) + ".png"
+}
+
+// compressJPEG writes img as a JPEG within targetSize, or its smallest
+// encoding if none fits; processFile then tries harder or fails the file.
+func compressJPEG(log *fileLog, dstPath string, img image.Image) error {
+	meta := creditSegments()
+	data, err := encodeJPEGWithin(log, img, targetSize-len(meta), startQuality())
+	if err != nil && !errors.Is(err, errCannotMeetTarget) {
 		return err
 	}
-	
-	if buffer.Len() <= targetSize {
-		return os.WriteFile(dstPath, buffer.Bytes(), 0644)
-	}
-	
-	// If GIF is still too large, convert to JPEG
-	jpegPath := strings.TrimSuffix(dstPath, filepath.Ext(dstPath)) + ".jpg"
-	fmt.Printf("(converting to JPEG) ")
-	return compressJPEG(jpegPath, img)
+	return writeOutput(dstPath, insertJPEGSegments(data, meta))
 }
 
-func compressHEIC(srcPath, dstPath string) error {
-	// Since Go doesn't have native HEIC support, we'll show a message
-	// In a production app, you'd use a tool like ImageMagick or libheif
-	fmt.Printf("\nNote: HEIC format requires external tools for conversion.\n")
-	fmt.Printf("To compress HEIC files, please convert them to JPEG first using:\n")
-	fmt.Printf("  - macOS: Preview app or Photos app\n")
-	fmt.Printf("  - Windows: HEIF Image Extensions from Microsoft Store\n")
-	fmt.Printf("  - Command line: ImageMagick or libheif tools\n")
-	return fmt.Errorf("HEIC compression not supported without external tools")
+// encodeJPEGWithin searches down from startQuality for a JPEG quality whose
+// encoding of img fits in limit bytes. If none does, it returns the quality
+// 10 encoding with errCannotMeetTarget. With -trace, attempts are written to
+// log if it isn't nil.
+func encodeJPEGWithin(log *fileLog, img image.Image, limit, startQuality int) ([]byte, error) {
+	return compressor.CompressImage(img, compressor.Options{TargetSize: limit, MaxQuality: startQuality, Effort: effort, Background: flattenColor, Trace: searchTracer(log)})
 }
 
-func recompressImage(filePath string) error {
-	// Read the file to determine its format
-	file, err := os.Open(filePath)
-	if err != nil {
-		return err
+func compressPNG(log *fileLog, srcPath, dstPath string, img image.Image) (string, error) {
+	// First try PNG at the compression level chosen by effort
+	data, _, err := compressor.CompressPNG(img, keepFormatOptions())
+	return writeOrConvert(log, "png", dstPath, img, data, err)
+}
+
+// keepFormatOptions are the options compressPNG and compressGIF encode
+// with: the library's conversion to JPEG is left to writeOrConvert.
+func keepFormatOptions() compressor.Options {
+	return compressor.Options{TargetSize: targetSize, Effort: effort, KeepFormat: true}
+}
+
+// writeOrConvert writes data, the encoding of img in format, PNG or GIF,
+// if err doesn't say it is over the target. Otherwise it converts img to
+// JPEG, unless -no-convert rules that out, and with -keep-both writes data
+// too. Images with transparency are only converted with
+// -flatten-background; otherwise keepTransparency has them keep format.
+func writeOrConvert(log *fileLog, format, dstPath string, img image.Image, data []byte, err error) (string, error) {
+	if err == nil {
+		return dstPath, writeOutput(dstPath, data)
 	}
-	defer file.Close()
-	
-	// Decode the image
-	img, _, err := image.Decode(file)
-	if err != nil {
-		return err
+	if !errors.Is(err, errCannotMeetTarget) {
+		return "", err
 	}
-	file.Close()
-	
-	// Force JPEG compression with very low quality
-	var buffer bytes.Buffer
-	err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: 5})
-	if err != nil {
-		return err
+	if noConvert {
+		return "", errNeedsConversion
 	}
-	
-	// If still too large, try scaling down the image
-	if buffer.Len() > targetSize {
-		// Scale down by 50%
-		bounds := img.Bounds()
-		newWidth := bounds.Dx() / 2
-		newHeight := bounds.Dy() / 2
-		
-		// Create a scaled version (simple nearest neighbor for now)
-		scaled := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
-		for y := 0; y < newHeight; y++ {
-			for x := 0; x < newWidth; x++ {
-				scaled.Set(x, y, img.At(x*2, y*2))
-			}
-		}
-		
-		// Try encoding the scaled image
-		buffer.Reset()
-		err = jpeg.Encode(&buffer, scaled, &jpeg.Options{Quality: 10})
-		if err != nil {
-			return err
+	if !flattenTransparent && !isOpaque(img) {
+		return keepTransparency(log, format, dstPath, img)
+	}
+	if keepBoth {
+		if err := keepOriginalFormat(log, dstPath, data); err != nil {
+			return "", err
 		}
 	}
-	
-	return os.WriteFile(filePath, buffer.Bytes(), 0644)
-}
\ No newline at end of file
+	jpegPath := jpegOutputPath(dstPath)
+	log.Printf("(converting to JPEG) ")
+	return jpegPath, compressJPEG(log, jpegPath, img)
+}
+
+// keepOriginalFormat writes the over-target original-format encoding for
+// -keep-both.
+func keepOriginalFormat(log *fileLog, dstPath string, data []byte) error {
+	log.Printf("(keeping %s at %s) ", filepath.Base(dstPath), formatSize(len(data)))
+	return writeOutput(dstPath, data)
+}
+
+func compressGIF(log *fileLog, srcPath, dstPath string, img image.Image) (string, error) {
+	// For GIF, try to re-encode with default settings
+	data, _, err := compressor.CompressGIF(img, keepFormatOptions())
+	return writeOrConvert(log, "gif", dstPath, img, data, err)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// runBatch runs the compress subcommand with args, restoring the settings
+// its flags change once the test is done.
+func runBatch(t *testing.T, args ...string) error {
+	t.Helper()
+	saved, roots := currentSettings(), readOnlyRoots
+	t.Cleanup(func() {
+		saved.apply()
+		readOnlyRoots = roots
+	})
+	return runCompress(args)
+}
+
+// testImage returns a w x h image of smooth gradients with noise of the
+// given amplitude on top, so that the noise sets how well it compresses.
+func testImage(w, h, noise int, seed int64) *image.RGBA {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			n := 0
+			if noise > 0 {
+				n = rng.Intn(2*noise+1) - noise
+			}
+			img.SetRGBA(x, y, color.RGBA{
+				clampByte(x*255/max(w-1, 1) + n),
+				clampByte(y*255/max(h-1, 1) + n),
+				clampByte((x+y)*255/max(w+h-2, 1) - n),
+				255,
+			})
+		}
+	}
+	return img
+}
+
+func clampByte(v int) uint8 {
+	return uint8(min(max(v, 0), 255))
+}
+
+// writeTestImage encodes img to path in the format its extension names.
+func writeTestImage(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		err = png.Encode(file, img)
+	default:
+		err = jpeg.Encode(file, img, &jpeg.Options{Quality: 95})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// decodeTestImage decodes the image at path.
+func decodeTestImage(t *testing.T, path string) (image.Image, string) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, format, err := image.Decode(file)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", path, err)
+	}
+	return img, format
+}
+
+// TestReencodingLarger compresses a PNG of black and white noise, which
+// takes far more bytes as a JPEG, so the fallbacks have to start from the
+// smaller original rather than the re-encoding.
+func TestReencodingLarger(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 400, 300), color.Palette{color.Black, color.White})
+	rng := rand.New(rand.NewSource(1))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.Intn(2))
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "noise.png")
+	writeTestImage(t, src, img)
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := info.Size() * 2 / 3
+
+	var log bytes.Buffer
+	saved := logOutput
+	logOutput = &log
+	defer func() { logOutput = saved }()
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	result := compressFile(t, src, out, "-target", strconv.FormatInt(target, 10))
+	if result.Outcome != outcomeCompressed {
+		t.Fatalf("outcome %v (%s), want compressed; log:\n%s", result.Outcome, result.Error, log.String())
+	}
+	if !strings.Contains(log.String(), "original is smaller") {
+		t.Errorf("the original wasn't kept over the larger re-encoding; log:\n%s", log.String())
+	}
+	if result.OutputBytes > target {
+		t.Errorf("output is %d bytes, over the %d byte target", result.OutputBytes, target)
+	}
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "noise.jpg" {
+		t.Errorf("outputs %v, want only noise.jpg", entries)
+	}
+}
+
+// TestTargetSizeProperty checks, over random images and flags, that
+// processFile never writes an output over the target, through the quality
+// search and the -fallback chain, and that only an image nothing fits
+// fails, leaving no output behind.
+func TestTargetSizeProperty(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	runs := 40
+	if testing.Short() {
+		runs = 10
+	}
+	fallbacks := []string{"none", "lowq", "downscale", "lowq,downscale"}
+	for i := 0; i < runs; i++ {
+		dir := t.TempDir()
+		ext := ".jpg"
+		if rng.Intn(2) == 0 {
+			ext = ".png"
+		}
+		src := filepath.Join(dir, "image"+ext)
+		w, h := 16+rng.Intn(400), 16+rng.Intn(400)
+		writeTestImage(t, src, testImage(w, h, rng.Intn(60), rng.Int63()))
+		out := filepath.Join(dir, "out")
+		if err := os.Mkdir(out, 0755); err != nil {
+			t.Fatal(err)
+		}
+		// Anywhere from far below quality 10 to above the source
+		target := int(200 * math.Pow(2, 8*rng.Float64()))
+		args := []string{
+			"-target", strconv.Itoa(target),
+			"-margin", "0",
+			"-effort", strconv.Itoa(1 + rng.Intn(9)),
+			"-fallback", fallbacks[rng.Intn(len(fallbacks))],
+		}
+		if rng.Intn(2) == 0 {
+			args = append(args, "-max-dimension", strconv.Itoa(16+rng.Intn(300)))
+		}
+
+		result := compressFile(t, src, out, args...)
+		entries, err := os.ReadDir(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Outcome == outcomeFailed {
+			if !strings.Contains(result.Error, errCannotMeetTarget.Error()) || len(entries) > 0 {
+				t.Fatalf("run %d, %dx%d%s with %v: failed with %q, leaving %d files", i, w, h, ext, args, result.Error, len(entries))
+			}
+			continue
+		}
+		info, err := os.Stat(result.Output)
+		if err != nil {
+			t.Fatalf("run %d, %dx%d%s with %v: %v", i, w, h, ext, args, err)
+		}
+		if info.Size() > int64(target) || info.Size() != result.OutputBytes || len(entries) != 1 {
+			t.Fatalf("run %d, %dx%d%s with %v: %d byte output (reported %d) of %d files", i, w, h, ext, args, info.Size(), result.OutputBytes, len(entries))
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"sort"
+)
+
+const defaultMetadataBudget = 64 * 1000
+
+// keepMetadata copies metadata from JPEG sources into their outputs, within
+// metadataBudget bytes. Otherwise outputs carry no metadata at all.
+// stripCopies applies the same to JPEGs that are copied rather than
+// compressed, which otherwise keep everything.
+var (
+	keepMetadata   bool
+	metadataBudget = defaultMetadataBudget
+	stripCopies    bool
+)
+
+// jpegSegment is a marker segment; data is the payload after the length.
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+// encoded returns the segment as it appears in a file.
+func (s jpegSegment) encoded() []byte {
+	out := make([]byte, 4, 4+len(s.data))
+	out[0], out[1] = 0xff, s.marker
+	binary.BigEndian.PutUint16(out[2:], uint16(len(s.data)+2))
+	return append(out, s.data...)
+}
+
+// Metadata kinds, in the order they are kept when the budget is tight.
+const (
+	metaICC = iota
+	metaEXIF
+	metaIPTC
+	metaXMP
+	metaExtendedXMP
+	metaOther
+)
+
+// xmpHeader starts the APP1 payload of an XMP segment.
+var xmpHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+func metadataKind(s jpegSegment) int {
+	switch {
+	case s.marker == 0xe2 && bytes.HasPrefix(s.data, []byte("ICC_PROFILE\x00")):
+		return metaICC
+	case s.marker == 0xe1 && bytes.HasPrefix(s.data, exifHeader):
+		return metaEXIF
+	case s.marker == 0xed && bytes.HasPrefix(s.data, []byte("Photoshop 3.0\x00")):
+		return metaIPTC
+	case s.marker == 0xe1 && bytes.HasPrefix(s.data, xmpHeader):
+		return metaXMP
+	case s.marker == 0xe1 && bytes.HasPrefix(s.data, []byte("http://ns.adobe.com/xmp/extension/\x00")):
+		return metaExtendedXMP
+	default:
+		return metaOther
+	}
+}
+
+// readJPEGMetadata returns the APP1-APP15 and COM segments that precede the
+// image data of the JPEG at path. APP0 (JFIF) is left out because the
+// encoder writes its own headers.
+func readJPEGMetadata(path string) ([]jpegSegment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readJPEGMetadataFrom(file)
+}
+
+// readJPEGMetadataFrom is readJPEGMetadata for JPEG data read from src.
+func readJPEGMetadataFrom(src io.Reader) ([]jpegSegment, error) {
+	r := bufio.NewReader(src)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, nil
+	}
+	var segments []jpegSegment
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return segments, nil
+		}
+		if b != 0xff {
+			continue
+		}
+		marker, err := r.ReadByte()
+		if err != nil {
+			return segments, nil
+		}
+		if marker == 0xff || marker == 0x00 || marker == 0x01 || marker >= 0xd0 && marker <= 0xd7 {
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			return segments, nil
+		}
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return segments, nil
+		}
+		data := make([]byte, length-2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return segments, nil
+		}
+		if marker >= 0xe1 && marker <= 0xef || marker == 0xfe {
+			segments = append(segments, jpegSegment{marker: marker, data: data})
+		}
+	}
+}
+
+// fitMetadata picks which segments to keep within budget bytes. Segments
+// are considered in priority order (color profile first, then EXIF, IPTC,
+// XMP); an EXIF block that doesn't fit is retried without its thumbnail, and
+// anything still too large is dropped. Multi-segment ICC profiles and
+// extended XMP are kept or dropped as a whole.
+func fitMetadata(segments []jpegSegment, budget int) []jpegSegment {
+	groups := make(map[int][]jpegSegment)
+	for _, s := range segments {
+		kind := metadataKind(s)
+		groups[kind] = append(groups[kind], s)
+	}
+	kinds := make([]int, 0, len(groups))
+	for kind := range groups {
+		kinds = append(kinds, kind)
+	}
+	sort.Ints(kinds)
+
+	var kept []jpegSegment
+	used := 0
+	for _, kind := range kinds {
+		group := groups[kind]
+		if kind == metaEXIF && encodedSize(group) > budget-used {
+			for i := range group {
+				group[i].data = stripEXIFThumbnail(group[i].data)
+			}
+		}
+		if kind == metaICC || kind == metaExtendedXMP {
+			if size := encodedSize(group); size <= budget-used {
+				kept = append(kept, group...)
+				used += size
+			}
+			continue
+		}
+		for _, s := range group {
+			if size := len(s.data) + 4; size <= budget-used {
+				kept = append(kept, s)
+				used += size
+			}
+		}
+	}
+	return kept
+}
+
+func encodedSize(segments []jpegSegment) int {
+	size := 0
+	for _, s := range segments {
+		size += len(s.data) + 4
+	}
+	return size
+}
+
+// sourceMetadata returns the encoded metadata segments to carry over from
+// the JPEG at srcPath, with the credit of -set-artist and -set-copyright,
+// or nil when metadata isn't being kept and no credit is set.
+func sourceMetadata(srcPath string) []byte {
+	return encodeSegments(creditMetadata(fitMetadata(sourceSegments(srcPath), metadataBudget)))
+}
+
+// outputMetadata is sourceMetadata for an output re-encoded from img. The
+// EXIF thumbnail is regenerated from img, since the source's would show the
+// image before it was resized or cropped, or be missing altogether.
+func outputMetadata(srcPath string, img image.Image) []byte {
+	segments := sourceSegments(srcPath)
+	var thumb []byte
+	for i, s := range segments {
+		if metadataKind(s) != metaEXIF {
+			continue
+		}
+		if thumb == nil {
+			var buffer bytes.Buffer
+			small := fitLongEdge(img, exifThumbnailEdge)
+			if err := jpeg.Encode(&buffer, small, &jpeg.Options{Quality: exifThumbnailQuality}); err != nil {
+				break
+			}
+			thumb = buffer.Bytes()
+		}
+		segments[i].data = replaceEXIFThumbnail(s.data, thumb)
+	}
+	return encodeSegments(creditMetadata(fitMetadata(segments, metadataBudget)))
+}
+
+// sourceSegments returns the metadata segments of the JPEG at srcPath that
+// may be kept, fixed by fixMetadata, or nil when metadata isn't being kept.
+func sourceSegments(srcPath string) []jpegSegment {
+	if !keepMetadata {
+		return nil
+	}
+	segments, err := readJPEGMetadata(srcPath)
+	if err != nil {
+		return nil
+	}
+	segments = fixMetadata(segments)
+	if dropsICCProfile(srcPath) {
+		kept := segments[:0]
+		for _, s := range segments {
+			if metadataKind(s) != metaICC {
+				kept = append(kept, s)
+			}
+		}
+		segments = kept
+	}
+	return segments
+}
+
+// fixesMetadata reports whether fixMetadata changes anything.
+func fixesMetadata() bool {
+	return fixesTimes() || gpsPrecision >= 0
+}
+
+// fixMetadata applies -shift-time, -set-offset and -gps-precision to
+// segments.
+func fixMetadata(segments []jpegSegment) []jpegSegment {
+	for i, s := range segments {
+		switch metadataKind(s) {
+		case metaEXIF:
+			fixEXIFTimes(s.data)
+			roundEXIFGPS(s.data)
+		case metaXMP:
+			segments[i].data = roundXMPGPS(s.data)
+		}
+	}
+	return segments
+}
+
+// fixJPEGMetadata returns the JPEG data with fixMetadata applied to its
+// metadata and the credit set in it. Anything it can't parse is returned
+// unchanged.
+func fixJPEGMetadata(data []byte) []byte {
+	if !fixesMetadata() && !setsCredit() {
+		return data
+	}
+	segments, err := readJPEGMetadataFrom(bytes.NewReader(data))
+	if err != nil {
+		return data
+	}
+	return insertJPEGSegments(stripJPEGMetadata(data), encodeSegments(creditMetadata(fixMetadata(segments))))
+}
+
+func encodeSegments(segments []jpegSegment) []byte {
+	var out []byte
+	for _, s := range segments {
+		out = append(out, s.encoded()...)
+	}
+	return out
+}
+
+// setMetadataDimensions records the output's size in the EXIF segments among
+// encoded, in place.
+func setMetadataDimensions(encoded []byte, width, height int) {
+	for i := 0; i+4 <= len(encoded); {
+		length := int(binary.BigEndian.Uint16(encoded[i+2:]))
+		if length < 2 || i+2+length > len(encoded) {
+			return
+		}
+		s := jpegSegment{marker: encoded[i+1], data: encoded[i+4 : i+2+length]}
+		if metadataKind(s) == metaEXIF {
+			setEXIFDimensions(s.data, width, height)
+		}
+		i += 2 + length
+	}
+}
+
+// stripJPEGMetadata returns the JPEG data without the APP1-APP15 and COM
+// segments before its image data. Anything it can't parse is returned
+// unchanged.
+func stripJPEGMetadata(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return data
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			// Fill byte
+			i++
+			continue
+		}
+		if marker == 0xda {
+			// Image data follows; nothing after it is metadata
+			return append(out, data[i:]...)
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return data
+		}
+		if !(marker >= 0xe1 && marker <= 0xef || marker == 0xfe) {
+			out = append(out, data[i:i+2+length]...)
+		}
+		i += 2 + length
+	}
+	return data
+}
+
+// insertJPEGSegments returns the JPEG data with encoded segments placed
+// right after its SOI marker. Data that isn't a JPEG is returned unchanged.
+func insertJPEGSegments(data, segments []byte) []byte {
+	if len(segments) == 0 || len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return data
+	}
+	out := make([]byte, 0, len(data)+len(segments))
+	out = append(out, data[:2]...)
+	out = append(out, segments...)
+	return append(out, data[2:]...)
+}
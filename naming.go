@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// manifestName is the file in the output directory mapping each output's
+// plain name to the name it was written under, when -name renames outputs.
+const manifestName = "manifest.json"
+
+// namingStrategies turn the path of a finished output into the path it is
+// renamed to. A nil strategy keeps the name.
+var namingStrategies = map[string]func(path string) (string, error){
+	"original": nil,
+	"hash8":    contentHashName,
+}
+
+var outputNaming = "original"
+
+func parseNaming(s string) error {
+	if _, ok := namingStrategies[s]; !ok {
+		return fmt.Errorf("unknown naming %q (available: %s)", s, strings.Join(namingNames(), ", "))
+	}
+	outputNaming = s
+	return nil
+}
+
+func namingNames() []string {
+	names := make([]string, 0, len(namingStrategies))
+	for name := range namingStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// contentHashName fingerprints the output at path with the first 8 hex
+// digits of its SHA-256, e.g. photo.jpg becomes photo.a1b2c3d4.jpg, so it
+// can be served with a far-future cache lifetime.
+func contentHashName(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + hex.EncodeToString(sum[:4]) + ext, nil
+}
+
+// nameOutput renames the finished output at path as -name says and returns
+// its new path, recording the new name for the manifest.
+func nameOutput(path string) (string, error) {
+	strategy := namingStrategies[outputNaming]
+	if strategy == nil {
+		return path, nil
+	}
+	named, err := strategy(path)
+	if err != nil {
+		return "", err
+	}
+	if named != path {
+		if err := guardWrite(named); err != nil {
+			return "", err
+		}
+		if err := os.Rename(path, named); err != nil {
+			return "", err
+		}
+	}
+	manifest.add(filepath.Dir(path), filepath.Base(path), filepath.Base(named))
+	return named, nil
+}
+
+// nameOutputs applies nameOutput to the outputs of a finished result.
+func (r fileResult) nameOutputs() (fileResult, error) {
+	var err error
+	if r.Output != "" {
+		if r.Output, err = nameOutput(r.Output); err != nil {
+			return r, err
+		}
+	}
+	if r.KeptOutput != "" {
+		if r.KeptOutput, err = nameOutput(r.KeptOutput); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// nameManifest collects the names given to outputs until they are written
+// to each output directory's manifest.
+type nameManifest struct {
+	mu   sync.Mutex
+	dirs map[string]map[string]string
+}
+
+var manifest nameManifest
+
+func (m *nameManifest) add(dir, plain, named string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dirs == nil {
+		m.dirs = make(map[string]map[string]string)
+	}
+	if m.dirs[dir] == nil {
+		m.dirs[dir] = make(map[string]string)
+	}
+	m.dirs[dir][plain] = named
+}
+
+// flush merges the names collected since the last flush into each output
+// directory's manifest file.
+func (m *nameManifest) flush() error {
+	m.mu.Lock()
+	dirs := m.dirs
+	m.dirs = nil
+	m.mu.Unlock()
+	for dir, names := range dirs {
+		path := filepath.Join(dir, manifestName)
+		merged, err := readManifest(dir)
+		if err != nil {
+			return err
+		}
+		for plain, named := range names {
+			merged[plain] = named
+		}
+		data, err := json.MarshalIndent(merged, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeOutput(path, append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readManifest reads the manifest in dir, which is empty if there is none.
+func readManifest(dir string) (map[string]string, error) {
+	names := make(map[string]string)
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return names, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Join(dir, manifestName), err)
+	}
+	return names, nil
+}
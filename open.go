@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+// openDesktop shows a folder in the platform's file manager, or a URL in
+// its browser.
+func openDesktop(target string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("explorer", target)
+	case "darwin":
+		cmd = exec.Command("open", target)
+	default:
+		cmd = exec.Command("xdg-open", target)
+	}
+	cmd.Start()
+}
@@ -0,0 +1,285 @@
+//go:build (jp2 || full) && cgo
+
+package main
+
+/*
+#cgo pkg-config: libopenjp2
+#include <stdlib.h>
+#include <string.h>
+#include <openjpeg.h>
+
+// jp2_buffer is the codestream libopenjp2 reads through the callbacks
+// below, in C memory.
+typedef struct {
+	const OPJ_BYTE *data;
+	OPJ_SIZE_T len, pos;
+} jp2_buffer;
+
+static OPJ_SIZE_T jp2_read(void *dst, OPJ_SIZE_T n, void *user) {
+	jp2_buffer *b = user;
+	if (b->pos >= b->len) {
+		return (OPJ_SIZE_T)-1;
+	}
+	if (n > b->len - b->pos) {
+		n = b->len - b->pos;
+	}
+	memcpy(dst, b->data + b->pos, n);
+	b->pos += n;
+	return n;
+}
+
+static OPJ_OFF_T jp2_skip(OPJ_OFF_T n, void *user) {
+	jp2_buffer *b = user;
+	if (n < 0 && (OPJ_SIZE_T)(-n) > b->pos) {
+		n = -(OPJ_OFF_T)b->pos;
+	} else if (n > 0 && (OPJ_SIZE_T)n > b->len - b->pos) {
+		n = (OPJ_OFF_T)(b->len - b->pos);
+	}
+	b->pos += n;
+	return n;
+}
+
+static OPJ_BOOL jp2_seek(OPJ_OFF_T off, void *user) {
+	jp2_buffer *b = user;
+	if (off < 0 || (OPJ_SIZE_T)off > b->len) {
+		return OPJ_FALSE;
+	}
+	b->pos = (OPJ_SIZE_T)off;
+	return OPJ_TRUE;
+}
+
+static void jp2_ignore(const char *msg, void *user) {
+}
+
+// jp2_keep_error keeps the last error message in user, a 256-byte buffer.
+static void jp2_keep_error(const char *msg, void *user) {
+	strncpy(user, msg, 255);
+	((char *)user)[255] = 0;
+}
+
+static opj_stream_t *jp2_stream(jp2_buffer *b) {
+	opj_stream_t *stream = opj_stream_create(OPJ_J2K_STREAM_CHUNK_SIZE, OPJ_TRUE);
+	if (stream == NULL) {
+		return NULL;
+	}
+	opj_stream_set_user_data(stream, b, NULL);
+	opj_stream_set_user_data_length(stream, b->len);
+	opj_stream_set_read_function(stream, jp2_read);
+	opj_stream_set_skip_function(stream, jp2_skip);
+	opj_stream_set_seek_function(stream, jp2_seek);
+	return stream;
+}
+
+static opj_codec_t *jp2_codec(OPJ_CODEC_FORMAT format, char *last_error) {
+	opj_codec_t *codec = opj_create_decompress(format);
+	if (codec == NULL) {
+		return NULL;
+	}
+	opj_set_info_handler(codec, jp2_ignore, NULL);
+	opj_set_warning_handler(codec, jp2_ignore, NULL);
+	opj_set_error_handler(codec, jp2_keep_error, last_error);
+	opj_dparameters_t params;
+	opj_set_default_decoder_parameters(&params);
+	if (!opj_setup_decoder(codec, &params)) {
+		opj_destroy_codec(codec);
+		return NULL;
+	}
+	return codec;
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strings"
+	"unsafe"
+)
+
+const jpeg2000Supported = true
+
+// jp2Plane is one component of a decoded JPEG 2000 image, copied out of
+// libopenjp2's memory.
+type jp2Plane struct {
+	data          []int32
+	width, height int
+	precision     int
+	signed        bool
+}
+
+// value returns the sample at x, y of an image width x height, unsigned and
+// scaled to 16 bits. Subsampled components are upsampled by repeating
+// samples.
+func (p *jp2Plane) value(x, y, width, height int) uint16 {
+	v := p.data[(y*p.height/height)*p.width+x*p.width/width]
+	if p.signed {
+		v += 1 << (p.precision - 1)
+	}
+	maxValue := int32(1)<<p.precision - 1
+	v = min(max(v, 0), maxValue)
+	return uint16(int64(v) * 0xffff / int64(maxValue))
+}
+
+func decodeJPEG2000(r io.Reader) (image.Image, error) {
+	img, _, err := readJPEG2000(r, false)
+	return img, err
+}
+
+func decodeJPEG2000Config(r io.Reader) (image.Config, error) {
+	_, cfg, err := readJPEG2000(r, true)
+	return cfg, err
+}
+
+// readJPEG2000 decodes the JP2 file or codestream in r with libopenjp2, or
+// with configOnly set, only reads its header.
+func readJPEG2000(r io.Reader, configOnly bool) (image.Image, image.Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, image.Config{}, err
+	}
+	format := C.OPJ_CODEC_J2K
+	if bytes.HasPrefix(data, []byte(jpeg2000Signatures[0])) {
+		format = C.OPJ_CODEC_JP2
+	}
+
+	buffer := (*C.jp2_buffer)(C.malloc(C.sizeof_jp2_buffer))
+	defer C.free(unsafe.Pointer(buffer))
+	buffer.data = (*C.OPJ_BYTE)(C.CBytes(data))
+	defer C.free(unsafe.Pointer(buffer.data))
+	buffer.len = C.OPJ_SIZE_T(len(data))
+	buffer.pos = 0
+	lastError := (*C.char)(C.calloc(256, 1))
+	defer C.free(unsafe.Pointer(lastError))
+	openjpegError := func(what string) error {
+		if msg := strings.TrimSpace(C.GoString(lastError)); msg != "" {
+			return errors.New("libopenjp2: " + msg)
+		}
+		return errors.New("libopenjp2: " + what)
+	}
+
+	codec := C.jp2_codec(C.OPJ_CODEC_FORMAT(format), lastError)
+	if codec == nil {
+		return nil, image.Config{}, openjpegError("can't create decoder")
+	}
+	defer C.opj_destroy_codec(codec)
+	stream := C.jp2_stream(buffer)
+	if stream == nil {
+		return nil, image.Config{}, openjpegError("can't create stream")
+	}
+	defer C.opj_stream_destroy(stream)
+
+	var decoded *C.opj_image_t
+	if C.opj_read_header(stream, codec, &decoded) == 0 {
+		return nil, image.Config{}, openjpegError("invalid header")
+	}
+	defer C.opj_image_destroy(decoded)
+
+	comps := unsafe.Slice(decoded.comps, int(decoded.numcomps))
+	width, height := int(decoded.x1-decoded.x0), int(decoded.y1-decoded.y0)
+	highDepth := false
+	for _, c := range comps {
+		highDepth = highDepth || c.prec > 8
+	}
+	gray := len(comps) == 1
+	cfg := image.Config{Width: width, Height: height, ColorModel: color.NRGBAModel}
+	switch {
+	case gray && highDepth:
+		cfg.ColorModel = color.Gray16Model
+	case gray:
+		cfg.ColorModel = color.GrayModel
+	case highDepth:
+		cfg.ColorModel = color.NRGBA64Model
+	}
+	if configOnly {
+		return nil, cfg, nil
+	}
+	if err := checkDecodeSize(cfg); err != nil {
+		return nil, image.Config{}, err
+	}
+
+	if C.opj_decode(codec, stream, decoded) == 0 || C.opj_end_decompress(codec, stream) == 0 {
+		return nil, image.Config{}, openjpegError("decoding failed")
+	}
+	planes := make([]jp2Plane, len(comps))
+	for i, c := range comps {
+		if c.data == nil || c.w == 0 || c.h == 0 || c.prec == 0 || c.prec > 31 {
+			return nil, image.Config{}, errors.New("libopenjp2: component without data")
+		}
+		planes[i] = jp2Plane{
+			data:      append([]int32(nil), unsafe.Slice((*int32)(unsafe.Pointer(c.data)), int(c.w)*int(c.h))...),
+			width:     int(c.w),
+			height:    int(c.h),
+			precision: int(c.prec),
+			signed:    c.sgnd != 0,
+		}
+	}
+	ycc := decoded.color_space == C.OPJ_CLRSPC_SYCC ||
+		// Subsampled chroma means YCC whatever the file says
+		len(comps) >= 3 && decoded.color_space != C.OPJ_CLRSPC_CMYK && (comps[1].dx > comps[0].dx || comps[1].dy > comps[0].dy)
+	return jpeg2000Image(planes, width, height, ycc, decoded.color_space == C.OPJ_CLRSPC_CMYK, highDepth), cfg, nil
+}
+
+// jpeg2000Image assembles decoded components into an image: gray for one
+// component, gray and alpha for two, RGB or YCC with optional alpha for
+// three or four, or CMYK. highDepth keeps 16 bits per sample instead of 8.
+func jpeg2000Image(planes []jp2Plane, width, height int, ycc, cmyk, highDepth bool) image.Image {
+	rect := image.Rect(0, 0, width, height)
+	switch {
+	case len(planes) == 1 && highDepth:
+		img := image.NewGray16(rect)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.SetGray16(x, y, color.Gray16{planes[0].value(x, y, width, height)})
+			}
+		}
+		return img
+	case len(planes) == 1:
+		img := image.NewGray(rect)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.Pix[y*img.Stride+x] = uint8(planes[0].value(x, y, width, height) >> 8)
+			}
+		}
+		return img
+	case len(planes) == 2:
+		planes = []jp2Plane{planes[0], planes[0], planes[0], planes[1]}
+	}
+
+	img := image.NewNRGBA64(rect)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA64{A: 0xffff}
+			a, b, d := planes[0].value(x, y, width, height), planes[1].value(x, y, width, height), planes[2].value(x, y, width, height)
+			switch {
+			case cmyk && len(planes) >= 4:
+				k := 0xffff - uint32(planes[3].value(x, y, width, height))
+				c.R = uint16((0xffff - uint32(a)) * k / 0xffff)
+				c.G = uint16((0xffff - uint32(b)) * k / 0xffff)
+				c.B = uint16((0xffff - uint32(d)) * k / 0xffff)
+			case ycc:
+				luma, cb, cr := float64(a), float64(b)-0x8000, float64(d)-0x8000
+				c.R = clampUint16(luma + 1.402*cr)
+				c.G = clampUint16(luma - 0.344136*cb - 0.714136*cr)
+				c.B = clampUint16(luma + 1.772*cb)
+			default:
+				c.R, c.G, c.B = a, b, d
+			}
+			if len(planes) >= 4 && !cmyk {
+				c.A = planes[3].value(x, y, width, height)
+			}
+			img.SetNRGBA64(x, y, c)
+		}
+	}
+	if highDepth {
+		return img
+	}
+	return toNRGBA(img)
+}
+
+func clampUint16(v float64) uint16 {
+	return uint16(min(max(math.Round(v), 0), 0xffff))
+}
@@ -0,0 +1,18 @@
+//go:build !(jp2 || full) || !cgo
+
+package main
+
+import (
+	"image"
+	"io"
+)
+
+const jpeg2000Supported = false
+
+func decodeJPEG2000(r io.Reader) (image.Image, error) {
+	return nil, errJPEG2000Unsupported
+}
+
+func decodeJPEG2000Config(r io.Reader) (image.Config, error) {
+	return image.Config{}, errJPEG2000Unsupported
+}
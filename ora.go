@@ -0,0 +1,149 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// OpenRaster, the layered format of Krita, MyPaint and other free editors,
+// is a zip of PNG layers described by stack.xml. It is read for the merged
+// image the editor saves beside them, while files without one, and -layers
+// and -hidden-layers, flatten the layers instead.
+func init() {
+	image.RegisterFormat("ora", oraSignature, decodeORA, decodeORAConfig)
+}
+
+// oraSignature starts OpenRaster files: a zip whose first entry, stored
+// uncompressed, is the mimetype.
+const oraSignature = "PK\x03\x04??????????????????????????mimetypeimage/openraster"
+
+// oraImage is the root of stack.xml.
+type oraImage struct {
+	Width  int        `xml:"w,attr"`
+	Height int        `xml:"h,attr"`
+	Stack  oraElement `xml:"stack"`
+}
+
+// oraElement is a layer or a stack, OpenRaster's group, of stack.xml.
+type oraElement struct {
+	XMLName    xml.Name
+	Name       string       `xml:"name,attr"`
+	Src        string       `xml:"src,attr"`
+	Visibility string       `xml:"visibility,attr"`
+	Opacity    string       `xml:"opacity,attr"`
+	X          int          `xml:"x,attr"`
+	Y          int          `xml:"y,attr"`
+	Children   []oraElement `xml:",any"` // top first
+}
+
+// readORA opens the OpenRaster file in r and reads its stack.xml.
+func readORA(r io.Reader) (*zip.Reader, oraImage, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, oraImage{}, err
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, oraImage{}, fmt.Errorf("ora: %w", err)
+	}
+	file, err := archive.Open("stack.xml")
+	if err != nil {
+		return nil, oraImage{}, fmt.Errorf("ora: %w", err)
+	}
+	defer file.Close()
+	var stack oraImage
+	if err := xml.NewDecoder(file).Decode(&stack); err != nil {
+		return nil, oraImage{}, fmt.Errorf("ora: stack.xml: %w", err)
+	}
+	if stack.Width <= 0 || stack.Height <= 0 {
+		return nil, oraImage{}, fmt.Errorf("ora: image is %dx%d", stack.Width, stack.Height)
+	}
+	return archive, stack, nil
+}
+
+func decodeORAConfig(r io.Reader) (image.Config, error) {
+	_, stack, err := readORA(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{Width: stack.Width, Height: stack.Height, ColorModel: color.NRGBAModel}, nil
+}
+
+func decodeORA(r io.Reader) (image.Image, error) {
+	archive, stack, err := readORA(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDecodeSize(image.Config{Width: stack.Width, Height: stack.Height}); err != nil {
+		return nil, err
+	}
+	if !flattensLayers() {
+		img, err := decodeORAFile(archive, "mergedimage.png")
+		if !errors.Is(err, fs.ErrNotExist) {
+			return img, err
+		}
+	}
+	canvas, err := flattenLayers(stack.Width, stack.Height, oraLayers(archive, stack.Stack.Children))
+	if err != nil {
+		return nil, fmt.Errorf("ora: %w", err)
+	}
+	return toNRGBA(canvas), nil
+}
+
+// oraLayers returns the layers and stacks among elements as a tree for
+// flattenLayers.
+func oraLayers(archive *zip.Reader, elements []oraElement) []*docLayer {
+	var layers []*docLayer
+	for _, element := range elements {
+		layer := &docLayer{
+			name:    element.Name,
+			visible: element.Visibility != "hidden",
+			opacity: 1,
+		}
+		if opacity, err := strconv.ParseFloat(strings.TrimSpace(element.Opacity), 64); err == nil {
+			layer.opacity = opacity
+		}
+		switch element.XMLName.Local {
+		case "stack":
+			layer.group = true
+			layer.children = oraLayers(archive, element.Children)
+			layer.load = func() (layerPixels, error) { return layerPixels{}, nil }
+		case "layer":
+			offset, src := image.Pt(element.X, element.Y), element.Src
+			layer.load = func() (layerPixels, error) {
+				img, err := decodeORAFile(archive, src)
+				return layerPixels{img: img, offset: offset}, err
+			}
+		default:
+			// Text and filter elements only hold what editors draw into
+			// their layers
+			continue
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+// decodeORAFile decodes the PNG at name in archive.
+func decodeORAFile(archive *zip.Reader, name string) (image.Image, error) {
+	file, err := archive.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("ora: %w", err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("ora: %s: %w", name, err)
+	}
+	return img, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultPanoramaRatio is how many times longer than its short side an
+// image's long side has to be for it to count as a panorama. Ordinary
+// wide crops such as 16:9 and 21:9 stay below it.
+const defaultPanoramaRatio = 3
+
+// panoramaRatio is the aspect ratio from which images are panoramas, or 0
+// when panoramas are capped like any image. -max-dimension and the
+// -display-size box cap only the short side of a panorama, since holding
+// its long side to them would leave a sliver; panoramaMaxDimension, if
+// set, caps the long side instead. With panoramaTiles, panoramas are also
+// cut into a DZI tile pyramid next to their output, for viewers that pan
+// and zoom.
+var (
+	panoramaRatio        float64 = defaultPanoramaRatio
+	panoramaMaxDimension int
+	panoramaTiles        bool
+)
+
+// Panorama tiles are cut as the tiles subcommand cuts them by default.
+const (
+	panoramaTileSize    = 256
+	panoramaTileOverlap = 1
+	panoramaTileLimit   = 100 * 1000
+)
+
+// isPanorama reports whether a width x height image is a panorama.
+func isPanorama(width, height int) bool {
+	return panoramaRatio > 0 && width > 0 && height > 0 &&
+		float64(max(width, height)) >= panoramaRatio*float64(min(width, height))
+}
+
+// isPanoramaFile reports whether the image at path is a panorama.
+func isPanoramaFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	cfg, _, err := decodeConfig(file)
+	return err == nil && isPanorama(cfg.Width, cfg.Height)
+}
+
+// panoramaScale returns how far cappedSize scales a width x height
+// panorama down: until its short side is within maxDimension and the
+// matching side of the -display-size box, and its long side within
+// panoramaMaxDimension.
+func panoramaScale(width, height int) float64 {
+	long, short := max(width, height), min(width, height)
+	scale := 1.0
+	if maxDimension > 0 && short > maxDimension {
+		scale = float64(maxDimension) / float64(short)
+	}
+	if boxWidth, boxHeight := displayBox(); boxWidth > 0 {
+		boxShort := boxHeight
+		if height > width {
+			boxShort = boxWidth
+		}
+		scale = min(scale, float64(boxShort)/float64(short))
+	}
+	if panoramaMaxDimension > 0 && long > panoramaMaxDimension {
+		scale = min(scale, float64(panoramaMaxDimension)/float64(long))
+	}
+	return scale
+}
+
+// tilePanorama cuts the source at path into a DZI tile pyramid in
+// compressedDir, logging how many tiles it took.
+func tilePanorama(log *fileLog, path, compressedDir string) {
+	count, err := writeDZI(path, compressedDir, panoramaTileSize, panoramaTileOverlap, panoramaTileLimit)
+	if err != nil {
+		log.Line("  panorama tiles: ERROR: %v", err)
+		return
+	}
+	name := outputName(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	log.Line("  panorama tiles: %d in %s", count, name+".dzi")
+}
+
+// formatPanoramas describes how panoramas are treated for printSettings,
+// or returns "" if no differently from other images.
+func formatPanoramas() string {
+	if panoramaRatio == 0 || maxDimension == 0 && displayWidth == 0 && panoramaMaxDimension == 0 && !panoramaTiles {
+		return ""
+	}
+	s := fmt.Sprintf("%g:1 or wider, short side capped", panoramaRatio)
+	if panoramaMaxDimension > 0 {
+		s += fmt.Sprintf(", long side up to %d px", panoramaMaxDimension)
+	}
+	if panoramaTiles {
+		s += ", also tiled as DZI"
+	}
+	return s
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// longPath makes p absolute and, on Windows, gives it the \\?\ prefix that
+// lifts the MAX_PATH limit. Every other path the tool builds is joined onto
+// one of these roots, so the prefix carries through to output files deep
+// inside them. Roots are prefixed however short they are, since it is the
+// names joined onto them that reach MAX_PATH.
+func longPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	if runtime.GOOS != "windows" {
+		return abs
+	}
+	return extendedPath(abs)
+}
+
+// extendedPath returns the absolute Windows path abs with the \\?\ prefix.
+func extendedPath(abs string) string {
+	switch {
+	case strings.HasPrefix(abs, `\\?\`):
+		return abs
+	case strings.HasPrefix(abs, `\\`):
+		// \\server\share\... becomes \\?\UNC\server\share\...
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
+// plainPath removes the prefix extendedPath adds, for comparing p with
+// paths that didn't come through longPath.
+func plainPath(p string) string {
+	if rest, ok := strings.CutPrefix(p, `\\?\UNC\`); ok {
+		return `\\` + rest
+	}
+	return strings.TrimPrefix(p, `\\?\`)
+}
+
+// outputName returns the file name used for an output derived from a source
+// named name. Names are normalized to NFC, so files copied from macOS (which
+// stores decomposed accents) come out the same as ones typed on Windows or
+// Linux and match up when compared later.
+func outputName(name string) string {
+	return norm.NFC.String(name)
+}
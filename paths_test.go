@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestExtendedPath(t *testing.T) {
+	tests := []struct {
+		abs, want string
+	}{
+		{`C:\photos\a.jpg`, `\\?\C:\photos\a.jpg`},
+		{`C:\写真\🌸 spring.jpg`, `\\?\C:\写真\🌸 spring.jpg`},
+		{`\\server\share\사진\a.jpg`, `\\?\UNC\server\share\사진\a.jpg`},
+		{`\\?\C:\photos`, `\\?\C:\photos`},
+		{`\\?\UNC\server\share`, `\\?\UNC\server\share`},
+	}
+	for _, tt := range tests {
+		got := extendedPath(tt.abs)
+		if got != tt.want {
+			t.Errorf("extendedPath(%q) = %q, want %q", tt.abs, got, tt.want)
+		}
+		if plain := plainPath(got); plain != plainPath(tt.abs) {
+			t.Errorf("plainPath(%q) = %q, want %q", got, plain, plainPath(tt.abs))
+		}
+	}
+}
+
+func TestCompressUnicodeNames(t *testing.T) {
+	names := []string{
+		"写真 2024.png",
+		"東京タワー.jpg",
+		"🌸🎉 party.png",
+		"사진.jpg",
+		norm.NFD.String("café crème.png"),
+	}
+	dir := t.TempDir()
+	// Deep enough that the output paths pass MAX_PATH
+	deep := filepath.Join(dir, "アルバム", "🏔️ trip")
+	for len(deep) < 300 {
+		deep = filepath.Join(deep, "サブフォルダ")
+	}
+	for _, src := range []string{dir, deep} {
+		if err := os.MkdirAll(src, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for i, name := range names {
+			writeTestImage(t, filepath.Join(src, name), testImage(400, 300, 60, int64(i)))
+		}
+		out := filepath.Join(src, "出力 📦")
+		if err := runBatch(t, "-target", "60KB", "-input", src, "-output", out); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			// Noisy PNGs can only meet the target converted to JPEG
+			path := jpegOutputPath(filepath.Join(out, outputName(name)))
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Errorf("no output for %q: %v", name, err)
+				continue
+			}
+			if info.Size() > 60000 {
+				t.Errorf("%q: %d bytes, over the 60KB target", name, info.Size())
+			}
+		}
+	}
+}
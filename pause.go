@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// pauser is processing that can be paused and resumed while it runs: a
+// watcher or a batch.
+type pauser interface {
+	isPaused() bool
+	setPaused(paused bool)
+}
+
+// batchPause holds a batch between files while it is paused.
+type batchPause struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+func (p *batchPause) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+func (p *batchPause) setPaused(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if paused == p.paused {
+		return
+	}
+	p.paused = paused
+	if paused {
+		p.resumed = make(chan struct{})
+	} else {
+		close(p.resumed)
+	}
+}
+
+// wait returns once the batch isn't paused.
+func (p *batchPause) wait() {
+	p.mu.Lock()
+	resumed := p.resumed
+	paused := p.paused
+	p.mu.Unlock()
+	if paused {
+		<-resumed
+	}
+}
+
+// switchPause pauses or resumes p and says so. Files already being
+// processed finish either way.
+func switchPause(p pauser, paused bool) {
+	if p.isPaused() == paused {
+		return
+	}
+	p.setPaused(paused)
+	if paused {
+		fmt.Println("Paused; files in progress will finish first.")
+	} else {
+		fmt.Println("Resumed.")
+	}
+}
+
+// controlPause lets p be paused and resumed until stop is called: with
+// pauseSignal and resumeSignal where the system has them, and with keys,
+// by pressing Enter on the terminal.
+func controlPause(p pauser, keys bool) (stop func()) {
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	if pauseSignal != nil {
+		signal.Notify(signals, pauseSignal, resumeSignal)
+	}
+	var lines <-chan string
+	if keys && stdinIsTerminal() {
+		lines = stdinLines()
+		fmt.Println("Press Enter to pause or resume.")
+	}
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-signals:
+				switchPause(p, sig == pauseSignal)
+			case _, ok := <-lines:
+				if !ok {
+					lines = nil
+					continue
+				}
+				switchPause(p, !p.isPaused())
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+var (
+	stdinOnce  sync.Once
+	stdinInput chan string
+)
+
+// stdinLines returns the lines typed on standard input. They are read by a
+// single goroutine, so pause keys and the exit prompt don't race for them.
+// The channel is closed at the end of the input.
+func stdinLines() <-chan string {
+	stdinOnce.Do(func() {
+		stdinInput = make(chan string)
+		go func() {
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				stdinInput <- scanner.Text()
+			}
+			close(stdinInput)
+		}()
+	})
+	return stdinInput
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// There are no spare signals to pause and resume with; the keyboard, the
+// tray menu and the health address still work.
+var (
+	pauseSignal  os.Signal
+	resumeSignal os.Signal
+)
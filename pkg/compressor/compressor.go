@@ -0,0 +1,327 @@
+// Package compressor encodes images to fit a byte budget. It holds the
+// size-targeted encoders behind the image-compressor command, for programs
+// that want to use them on images they already have in memory:
+// CompressImage searches for the JPEG quality that fits, and CompressPNG
+// and CompressGIF keep those formats when they fit, converting to JPEG
+// when they don't:
+//
+//	data, err := compressor.CompressImage(img, compressor.Options{TargetSize: 500 * 1000})
+//	if errors.Is(err, compressor.ErrCannotMeetTarget) {
+//		// data is the quality 10 encoding, still over 500 KB
+//	}
+//
+// Compress does the same from encoded input to a writer, for streams such
+// as HTTP uploads:
+//
+//	result, err := compressor.Compress(req.Body, w, compressor.Options{TargetSize: 500 * 1000})
+//
+// The package works on images, readers and writers only, never files or
+// other operating system facilities, so it also builds for GOOS=js
+// GOARCH=wasm; the wasm directory wraps it for JavaScript.
+package compressor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+)
+
+const (
+	// DefaultTargetSize leaves a safety margin under a 1 MB upload limit.
+	DefaultTargetSize = 990 * 1000
+	// DefaultMaxQuality is where the JPEG quality search starts.
+	DefaultMaxQuality = 95
+	// DefaultMaxPixels is the largest width × height Compress and
+	// CompressBytes decode, as the command does.
+	DefaultMaxPixels = 1 << 30
+
+	MinEffort     = 1
+	MaxEffort     = 9
+	DefaultEffort = 5
+
+	// minQuality is the lowest JPEG quality the search goes down to.
+	minQuality = 10
+)
+
+// ErrCannotMeetTarget is returned when even the lowest quality the search
+// tries encodes to more than the target size.
+var ErrCannotMeetTarget = errors.New("compressor: cannot meet target size")
+
+// ErrTooManyPixels is returned when an encoded image's header claims more
+// than Options.MaxPixels pixels.
+var ErrTooManyPixels = errors.New("compressor: image has too many pixels")
+
+// Options controls CompressImage. Zero values select the defaults.
+type Options struct {
+	// TargetSize is the maximum output size in bytes.
+	TargetSize int
+	// MaxQuality is the highest JPEG quality tried, from 1 to 100.
+	MaxQuality int
+	// Effort trades CPU time for output bytes, from MinEffort (fastest) to
+	// MaxEffort. Up to 3 the quality search stops at the first quality that
+	// fits, up to 6 at one within 10% of the target; from 7 up it finds the
+	// highest quality that fits.
+	Effort int
+	// MaxDimension scales images down so their longer side is at most this
+	// many pixels. 0 means no cap.
+	MaxDimension int
+	// LinearResize averages colors in linear light when scaling down.
+	LinearResize bool
+	// Filter is how images are resampled when scaling down. The zero value
+	// is Box.
+	Filter Filter
+	// Background is the opaque color transparent areas are flattened onto,
+	// since JPEG has no alpha. nil means white.
+	Background color.Color
+	// KeepFormat makes CompressPNG and CompressGIF return their encoding
+	// with ErrCannotMeetTarget when it doesn't fit, instead of converting
+	// to JPEG.
+	KeepFormat bool
+	// Trace, if set, is called after every encode the quality search tries.
+	Trace func(Attempt)
+	// MaxPixels is the largest width × height Compress and CompressBytes
+	// decode. They check the header first, so a small upload claiming a
+	// huge image fails before the pixels are allocated. 0 means
+	// DefaultMaxPixels.
+	MaxPixels int
+}
+
+// Attempt describes one encode tried by the quality search.
+type Attempt struct {
+	Quality int
+	Size    int
+	// Fits reports whether Size is within the target size.
+	Fits bool
+	// Next is the quality the search tries after this one, or 0 if it
+	// stops here.
+	Next int
+}
+
+func (o Options) trace(a Attempt) {
+	if o.Trace != nil {
+		o.Trace(a)
+	}
+}
+
+func (o Options) withDefaults() (Options, error) {
+	if o.TargetSize == 0 {
+		o.TargetSize = DefaultTargetSize
+	}
+	if o.MaxQuality == 0 {
+		o.MaxQuality = DefaultMaxQuality
+	}
+	if o.Effort == 0 {
+		o.Effort = DefaultEffort
+	}
+	if o.MaxPixels == 0 {
+		o.MaxPixels = DefaultMaxPixels
+	}
+	if o.Background == nil {
+		o.Background = color.White
+	}
+	switch {
+	case o.TargetSize < 0:
+		return o, fmt.Errorf("compressor: negative target size %d", o.TargetSize)
+	case o.MaxQuality < 1 || o.MaxQuality > 100:
+		return o, fmt.Errorf("compressor: max quality %d outside 1..100", o.MaxQuality)
+	case o.Effort < MinEffort || o.Effort > MaxEffort:
+		return o, fmt.Errorf("compressor: effort %d outside %d..%d", o.Effort, MinEffort, MaxEffort)
+	case o.MaxDimension < 0:
+		return o, fmt.Errorf("compressor: negative max dimension %d", o.MaxDimension)
+	case o.MaxPixels < 0:
+		return o, fmt.Errorf("compressor: negative max pixels %d", o.MaxPixels)
+	}
+	return o, nil
+}
+
+// CompressImage encodes an already decoded image as a JPEG of at most
+// opts.TargetSize bytes, searching down from opts.MaxQuality. Callers that
+// hold a decoded frame, e.g. from a video decoder or a screenshot API, skip
+// the encode and decode round trip of going through a file.
+//
+// If even quality 10 doesn't fit, CompressImage returns ErrCannotMeetTarget
+// together with the quality 10 encoding, for callers that would rather
+// have a best effort than nothing. The output is never larger than the
+// target without that error.
+func CompressImage(img image.Image, opts Options) ([]byte, error) {
+	img, opts, err := prepare(img, opts)
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := searchQuality(img, opts, true)
+	if err == nil && len(data) > opts.TargetSize {
+		err = ErrCannotMeetTarget
+	}
+	return data, err
+}
+
+// prepare applies the defaults to opts, and the dimension cap and
+// background to img.
+func prepare(img image.Image, opts Options) (image.Image, Options, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, opts, err
+	}
+	return Flatten(scale(img, opts), opts.Background), opts, nil
+}
+
+// scale returns img scaled down to opts.MaxDimension, or img itself if it
+// fits.
+func scale(img image.Image, opts Options) image.Image {
+	if opts.MaxDimension == 0 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := LongEdgeSize(bounds.Dx(), bounds.Dy(), opts.MaxDimension)
+	if w == bounds.Dx() && h == bounds.Dy() {
+		return img
+	}
+	return Resample(img, w, h, opts.LinearResize, opts.Filter)
+}
+
+// searchQuality finds the JPEG quality to encode img at, or minQuality if
+// none fits. With keep set it also returns that encoding; otherwise attempts
+// are only measured, so no encoding is held in memory.
+//
+// Rather than stepping the quality down, each attempt is aimed at the
+// target: the second by how far over it the first came, the rest by
+// interpolating between the attempts either side of it, or extrapolating
+// from the two nearest until some quality fits. That takes 3 to 6 encodes
+// for most images, even at the highest efforts.
+func searchQuality(img image.Image, opts Options, keep bool) (int, []byte, error) {
+	quality := max(opts.MaxQuality, minQuality)
+	s := qualitySearch{opts: opts, width: quality - minQuality + 2}
+	for quality != 0 {
+		size, data, err := encodeJPEG(img, quality, keep)
+		if err != nil {
+			return 0, nil, err
+		}
+		a := attempt{quality: quality, size: size, data: data}
+		fits := size <= opts.TargetSize
+		if fits {
+			s.fit = a
+		} else {
+			s.tooLarge, s.prevTooLarge = a, s.tooLarge
+		}
+		quality = s.next()
+		opts.trace(Attempt{Quality: a.quality, Size: size, Fits: fits, Next: quality})
+	}
+	if s.fit.quality == 0 {
+		return minQuality, s.tooLarge.data, nil
+	}
+	return s.fit.quality, s.fit.data, nil
+}
+
+// closeEnough is how near the target an encode has to come for efforts
+// below 7 to settle for it.
+const closeEnough = 0.9
+
+// attempt is one encode searchQuality tried.
+type attempt struct {
+	quality, size int
+	data          []byte
+}
+
+// qualitySearch is what the encodes searchQuality tried tell about an
+// image: the highest quality known to fit, the lowest known not to and the
+// one too large before that. Unknown attempts have quality 0.
+type qualitySearch struct {
+	opts                        Options
+	fit, tooLarge, prevTooLarge attempt
+	// width is how many qualities apart fit and tooLarge were before the
+	// last attempt, counting one past each end while unknown, and slow how
+	// many attempts in a row didn't halve that
+	width, slow int
+}
+
+// next returns the quality to try next, or 0 to stop. Efforts from 7 go on
+// until the highest quality that fits is found; lower ones stop at an
+// encode within closeEnough of the target, and efforts up to 3 at the first
+// one that fits.
+func (s *qualitySearch) next() int {
+	lo, hi := max(s.fit.quality, minQuality-1), s.tooLarge.quality
+	if hi == 0 || hi-lo <= 1 {
+		return 0
+	}
+	target := s.opts.TargetSize
+	if s.fit.quality != 0 && s.opts.Effort < 7 {
+		if s.opts.Effort <= 3 || float64(s.fit.size) >= closeEnough*float64(target) {
+			return 0
+		}
+	}
+	if 2*(hi-lo) > s.width {
+		s.slow++
+	} else {
+		s.slow = 0
+	}
+	var quality int
+	switch {
+	case s.fit.quality != 0 && s.slow >= 2:
+		// Interpolation is crawling along a curve that bends away from
+		// it; bisect instead
+		quality = (lo + hi) / 2
+	case s.fit.quality != 0:
+		quality = interpolateQuality(s.fit, s.tooLarge, target)
+	case s.prevTooLarge.quality != 0:
+		quality = interpolateQuality(s.tooLarge, s.prevTooLarge, target)
+	default:
+		ratio := float64(s.tooLarge.size) / float64(target)
+		quality = scaleQuality(quantScale(hi) * math.Pow(ratio, 1/sizeExponent))
+	}
+	s.width = hi - lo
+	return min(max(quality, lo+1), hi-1)
+}
+
+// sizeExponent is roughly how the size of a JPEG scales with the
+// quantization scale of its quality, for the first attempt to be aimed from.
+const sizeExponent = 0.55
+
+// interpolateQuality returns the quality at which the line through a and b,
+// in the log of the size against the log of the quantization scale, reaches
+// target. Sizes follow that line far more closely than they do the quality
+// itself, which scales the quantization tables unevenly.
+func interpolateQuality(a, b attempt, target int) int {
+	la, lb := math.Log(float64(a.size)), math.Log(float64(b.size))
+	if la == lb {
+		return (a.quality + b.quality) / 2
+	}
+	sa, sb := math.Log(quantScale(a.quality)), math.Log(quantScale(b.quality))
+	return scaleQuality(math.Exp(sa + (math.Log(float64(target))-la)*(sb-sa)/(lb-la)))
+}
+
+// quantScale returns the percentage image/jpeg scales its quantization
+// tables by at quality, as libjpeg does.
+func quantScale(quality int) float64 {
+	if quality < 50 {
+		return 5000 / float64(quality)
+	}
+	return float64(200 - 2*quality)
+}
+
+// scaleQuality is the inverse of quantScale, rounded down to a whole
+// quality.
+func scaleQuality(scale float64) int {
+	if scale > 100 {
+		return int(math.Floor(5000 / scale))
+	}
+	return int(math.Floor((200 - scale) / 2))
+}
+
+// encodeJPEG returns the size of img encoded at quality, and the encoding
+// itself if keep is set.
+func encodeJPEG(img image.Image, quality int, keep bool) (int, []byte, error) {
+	if !keep {
+		var counter countingWriter
+		err := jpeg.Encode(&counter, img, &jpeg.Options{Quality: quality})
+		return int(counter.n), nil, err
+	}
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, img, &jpeg.Options{Quality: quality}); err != nil {
+		return 0, nil, err
+	}
+	return buffer.Len(), buffer.Bytes(), nil
+}
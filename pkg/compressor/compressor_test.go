@@ -0,0 +1,221 @@
+package compressor
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand/v2"
+	"testing"
+)
+
+// randomImage returns an image of random size and content: flat, a
+// gradient, noise, or blocks of each, sometimes with transparency.
+func randomImage(r *rand.Rand) image.Image {
+	w, h := 1+r.IntN(400), 1+r.IntN(400)
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	kind := r.IntN(4)
+	base := color.NRGBA{uint8(r.Uint32()), uint8(r.Uint32()), uint8(r.Uint32()), 255}
+	alpha := r.IntN(3) == 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := base
+			k := kind
+			if k == 3 {
+				// Blocks of 32 pixels, each one of the other kinds
+				k = (x/32 + y/32) % 3
+			}
+			switch k {
+			case 1:
+				c.R = uint8(x * 255 / w)
+				c.G = uint8(y * 255 / h)
+			case 2:
+				c = color.NRGBA{uint8(r.Uint32()), uint8(r.Uint32()), uint8(r.Uint32()), 255}
+			}
+			if alpha {
+				c.A = uint8(r.Uint32())
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// photoImage returns an image of random size with smooth gradients under
+// noise of random amplitude, compressing much as photos do.
+func photoImage(r *rand.Rand) image.Image {
+	w, h := 64+r.IntN(400), 64+r.IntN(400)
+	noise := 2 + r.IntN(30)
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			n := r.IntN(2*noise+1) - noise
+			img.SetRGBA(x, y, color.RGBA{
+				uint8(min(max(x*255/w+n, 0), 255)),
+				uint8(min(max(y*255/h+n, 0), 255)),
+				uint8(min(max((x+y)*255/(w+h)-n, 0), 255)),
+				255,
+			})
+		}
+	}
+	return img
+}
+
+// randomOptions returns valid Options with a target anywhere from far too
+// small for any image to comfortably large.
+func randomOptions(r *rand.Rand) Options {
+	opts := Options{
+		TargetSize:   100 + r.IntN(60000),
+		MaxQuality:   1 + r.IntN(100),
+		Effort:       MinEffort + r.IntN(MaxEffort-MinEffort+1),
+		LinearResize: r.IntN(2) == 0,
+		Filter:       Filter(r.IntN(len(filterNames))),
+	}
+	if r.IntN(2) == 0 {
+		opts.MaxDimension = 1 + r.IntN(300)
+	}
+	if r.IntN(2) == 0 {
+		opts.Background = color.NRGBA{uint8(r.Uint32()), uint8(r.Uint32()), uint8(r.Uint32()), 255}
+	}
+	return opts
+}
+
+// TestTargetSizeProperty checks, over random images and options, that
+// CompressImage, CompressImageTo, CompressPNG, CompressGIF and Compress
+// never return more than the target without ErrCannotMeetTarget, and that
+// CompressImage and CompressImageTo agree on whether it was met.
+func TestTargetSizeProperty(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	runs := 200
+	if testing.Short() {
+		runs = 30
+	}
+	for i := 0; i < runs; i++ {
+		img, opts := randomImage(r), randomOptions(r)
+		b := img.Bounds()
+
+		data, err := CompressImage(img, opts)
+		cannotMeet := errors.Is(err, ErrCannotMeetTarget)
+		if err != nil && !cannotMeet {
+			t.Fatalf("run %d, %dx%d with %+v: CompressImage: %v", i, b.Dx(), b.Dy(), opts, err)
+		}
+		if !cannotMeet && len(data) > opts.TargetSize {
+			t.Fatalf("run %d, %dx%d with %+v: CompressImage returned %d bytes", i, b.Dx(), b.Dy(), opts, len(data))
+		}
+
+		var buf bytes.Buffer
+		n, err := CompressImageTo(&buf, img, opts)
+		switch {
+		case errors.Is(err, ErrCannotMeetTarget):
+			if !cannotMeet {
+				t.Fatalf("run %d, %dx%d with %+v: only CompressImageTo can't meet the target", i, b.Dx(), b.Dy(), opts)
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("run %d, %dx%d with %+v: CompressImageTo wrote %d bytes with ErrCannotMeetTarget", i, b.Dx(), b.Dy(), opts, buf.Len())
+			}
+		case err != nil:
+			t.Fatalf("run %d, %dx%d with %+v: CompressImageTo: %v", i, b.Dx(), b.Dy(), opts, err)
+		case cannotMeet:
+			t.Fatalf("run %d, %dx%d with %+v: only CompressImage can't meet the target", i, b.Dx(), b.Dy(), opts)
+		case n != int64(buf.Len()) || buf.Len() > opts.TargetSize:
+			t.Fatalf("run %d, %dx%d with %+v: CompressImageTo wrote %d bytes, reported %d", i, b.Dx(), b.Dy(), opts, buf.Len(), n)
+		}
+
+		lossless := opts
+		lossless.KeepFormat = r.IntN(2) == 0
+		for _, compress := range []struct {
+			name string
+			f    func(image.Image, Options) ([]byte, string, error)
+		}{{"CompressPNG", CompressPNG}, {"CompressGIF", CompressGIF}} {
+			data, format, err := compress.f(img, lossless)
+			switch {
+			case errors.Is(err, ErrCannotMeetTarget):
+				if !lossless.KeepFormat && format != FormatJPEG {
+					t.Fatalf("run %d, %dx%d with %+v: %s gave up on the %s without converting", i, b.Dx(), b.Dy(), lossless, compress.name, format)
+				}
+			case err != nil:
+				t.Fatalf("run %d, %dx%d with %+v: %s: %v", i, b.Dx(), b.Dy(), lossless, compress.name, err)
+			case len(data) > opts.TargetSize:
+				t.Fatalf("run %d, %dx%d with %+v: %s returned a %d byte %s", i, b.Dx(), b.Dy(), lossless, compress.name, len(data), format)
+			}
+		}
+
+		var in, out bytes.Buffer
+		if err := png.Encode(&in, img); err != nil {
+			t.Fatal(err)
+		}
+		result, err := Compress(&in, &out, opts)
+		switch {
+		case errors.Is(err, ErrCannotMeetTarget):
+			if out.Len() != 0 {
+				t.Fatalf("run %d, %dx%d with %+v: Compress wrote %d bytes with ErrCannotMeetTarget", i, b.Dx(), b.Dy(), opts, out.Len())
+			}
+		case err != nil:
+			t.Fatalf("run %d, %dx%d with %+v: Compress: %v", i, b.Dx(), b.Dy(), opts, err)
+		case result.Size != int64(out.Len()) || out.Len() > opts.TargetSize:
+			t.Fatalf("run %d, %dx%d with %+v: Compress wrote %d bytes, reported %d", i, b.Dx(), b.Dy(), opts, out.Len(), result.Size)
+		}
+	}
+}
+
+// TestSearchQuality checks the quality search against stepping down one
+// quality at a time: from effort 7 it finds the same highest quality that
+// fits, in the few encodes its doc comment promises, and below that it
+// settles for one that fits without going over.
+func TestSearchQuality(t *testing.T) {
+	r := rand.New(rand.NewPCG(7, 8))
+	runs := 40
+	if testing.Short() {
+		runs = 10
+	}
+	searched, within := 0, 0
+	for i := 0; i < runs; i++ {
+		img := photoImage(r)
+		b := img.Bounds()
+		size, _, err := encodeJPEG(img, DefaultMaxQuality, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := size * (15 + r.IntN(70)) / 100
+		highest := 0
+		for quality := DefaultMaxQuality; quality >= minQuality && highest == 0; quality-- {
+			if size, _, err = encodeJPEG(img, quality, false); err != nil {
+				t.Fatal(err)
+			}
+			if size <= target {
+				highest = quality
+			}
+		}
+		if highest == 0 {
+			continue
+		}
+		searched++
+
+		for _, effort := range []int{DefaultEffort, 7, MaxEffort} {
+			opts, err := Options{TargetSize: target, Effort: effort}.withDefaults()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var attempts []Attempt
+			opts.Trace = func(a Attempt) { attempts = append(attempts, a) }
+			quality, _, err := searchQuality(img, opts, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fits := false
+			for _, a := range attempts {
+				fits = fits || a.Quality == quality && a.Fits
+			}
+			if !fits || quality > highest || effort >= 7 && quality != highest {
+				t.Errorf("run %d, %dx%d at effort %d: quality %d, highest that fits is %d; attempts %+v", i, b.Dx(), b.Dy(), effort, quality, highest, attempts)
+			}
+			if effort == MaxEffort && len(attempts) >= 3 && len(attempts) <= 6 {
+				within++
+			}
+		}
+	}
+	if within < searched*3/4 {
+		t.Errorf("only %d of %d searches at effort %d took 3 to 6 encodes", within, searched, MaxEffort)
+	}
+}
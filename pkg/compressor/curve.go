@@ -0,0 +1,119 @@
+package compressor
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// DefaultCurvePoints is how many qualities SizeCurve samples when asked
+// for 0.
+const DefaultCurvePoints = 8
+
+const (
+	// curveSamplePixels bounds how many pixels SizeCurve encodes per
+	// quality; larger images are estimated from a sample this size.
+	curveSamplePixels = 1 << 20
+	// curveTile is the side of the tiles sampled, a multiple of the 16
+	// pixel blocks JPEG encodes with chroma subsampling.
+	curveTile = 64
+)
+
+// SizePoint is the encoded size of an image at one JPEG quality.
+type SizePoint struct {
+	Quality int
+	Size    int
+}
+
+// SizeCurve returns the JPEG size of img, after opts.MaxDimension is
+// applied, at points qualities spread evenly from 10 to opts.MaxQuality,
+// lowest first. It is meant for showing a size next to every position of a
+// quality slider before committing to an encode.
+//
+// Images of up to a megapixel are encoded whole at every quality, so their
+// sizes are exact. Larger ones are estimated from a mosaic of tiles taken
+// evenly across the image, which is usually within a few percent for
+// photos. SizeCurve reports whether the sizes are exact.
+func SizeCurve(img image.Image, opts Options, points int) ([]SizePoint, bool, error) {
+	img, opts, err := prepare(img, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	if points <= 0 {
+		points = DefaultCurvePoints
+	}
+	sample, scale := sampleMosaic(img)
+	exact := sample == img
+
+	var curve []SizePoint
+	for _, quality := range curveQualities(opts.MaxQuality, points) {
+		size, _, err := encodeJPEG(sample, quality, false)
+		if err != nil {
+			return nil, false, err
+		}
+		if !exact {
+			// Headers and tables don't grow with the image
+			overhead, _, err := encodeJPEG(image.NewGray(image.Rect(0, 0, 8, 8)), quality, false)
+			if err != nil {
+				return nil, false, err
+			}
+			size = overhead + int(float64(size-overhead)*scale)
+		}
+		curve = append(curve, SizePoint{Quality: quality, Size: size})
+	}
+	return curve, exact, nil
+}
+
+// curveQualities spreads up to n qualities evenly from minQuality to
+// maxQuality.
+func curveQualities(maxQuality, n int) []int {
+	if n == 1 || maxQuality <= minQuality {
+		return []int{maxQuality}
+	}
+	var qualities []int
+	for i := 0; i < n; i++ {
+		q := minQuality + int(math.Round(float64(i*(maxQuality-minQuality))/float64(n-1)))
+		if len(qualities) == 0 || q != qualities[len(qualities)-1] {
+			qualities = append(qualities, q)
+		}
+	}
+	return qualities
+}
+
+// sampleMosaic returns img itself if it is small enough to encode whole.
+// Otherwise it returns a mosaic of curveTile tiles taken on an even grid
+// across img, about curveSamplePixels in total, and how many times more
+// pixels img has than the mosaic.
+func sampleMosaic(img image.Image) (image.Image, float64) {
+	bounds := img.Bounds()
+	cols, rows := bounds.Dx()/curveTile, bounds.Dy()/curveTile
+	if bounds.Dx()*bounds.Dy() <= curveSamplePixels || cols == 0 || rows == 0 {
+		return img, 1
+	}
+	step := max(int(math.Sqrt(float64(cols*rows)*curveTile*curveTile/curveSamplePixels)), 1)
+	sampleCols, sampleRows := (cols+step-1)/step, (rows+step-1)/step
+	rect := image.Rect(0, 0, sampleCols*curveTile, sampleRows*curveTile)
+
+	// Grayscale sources stay grayscale, since the encoder writes them
+	// with a single channel
+	var mosaic draw.Image
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		mosaic = image.NewGray(rect)
+	default:
+		mosaic = image.NewRGBA(rect)
+	}
+	for r := 0; r < sampleRows; r++ {
+		for c := 0; c < sampleCols; c++ {
+			// Spread the tiles from edge to edge, so no band of the image
+			// is left out
+			src := bounds.Min.Add(image.Pt(
+				c*(bounds.Dx()-curveTile)/max(sampleCols-1, 1),
+				r*(bounds.Dy()-curveTile)/max(sampleRows-1, 1),
+			))
+			dst := image.Rect(c*curveTile, r*curveTile, (c+1)*curveTile, (r+1)*curveTile)
+			draw.Draw(mosaic, dst, img, src, draw.Src)
+		}
+	}
+	return mosaic, float64(bounds.Dx()*bounds.Dy()) / float64(rect.Dx()*rect.Dy())
+}
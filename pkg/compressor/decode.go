@@ -0,0 +1,47 @@
+package compressor
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+// CompressBytes is CompressImage for an encoded JPEG, PNG or GIF, for
+// callers such as language bindings that only pass bytes around.
+func CompressBytes(data []byte, opts Options) ([]byte, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := decode(bytes.NewReader(data), opts.MaxPixels)
+	if err != nil {
+		return nil, err
+	}
+	return CompressImage(img, opts)
+}
+
+// decode decodes the image in r once its header says it has at most
+// maxPixels pixels. The header is read through a buffer and replayed to
+// the decoder, so r needn't seek.
+func decode(r io.Reader, maxPixels int) (image.Image, string, error) {
+	var header bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, "", fmt.Errorf("compressor: %w", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, "", fmt.Errorf("compressor: invalid dimensions %dx%d", cfg.Width, cfg.Height)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > int64(maxPixels) {
+		return nil, "", fmt.Errorf("%w: %dx%d", ErrTooManyPixels, cfg.Width, cfg.Height)
+	}
+	img, format, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, "", fmt.Errorf("compressor: %w", err)
+	}
+	return img, format, nil
+}
@@ -0,0 +1,39 @@
+package compressor
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Flatten composites img over an opaque background color, for encoders such
+// as JPEG that can't store transparency. Pixels are blended from their
+// premultiplied values, so a half-transparent edge ends up halfway between
+// its color and the background instead of turning dark. Opaque images are
+// returned as they are.
+func Flatten(img image.Image, background color.Color) image.Image {
+	if isOpaque(img) {
+		return img
+	}
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Over)
+	return dst
+}
+
+// isOpaque reports whether img has no transparent pixels.
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
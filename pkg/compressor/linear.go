@@ -0,0 +1,91 @@
+package compressor
+
+import (
+	"image"
+	"math"
+)
+
+// srgbToLinear maps an 8-bit sRGB value to linear light in [0, 1].
+var srgbToLinear [256]float32
+
+// linearToSRGB maps linear light quantized to linearSteps+1 levels back to
+// 8-bit sRGB.
+const linearSteps = 4095
+
+var linearToSRGB [linearSteps + 1]uint8
+
+func init() {
+	for i := range srgbToLinear {
+		c := float64(i) / 255
+		if c <= 0.04045 {
+			c /= 12.92
+		} else {
+			c = math.Pow((c+0.055)/1.055, 2.4)
+		}
+		srgbToLinear[i] = float32(c)
+	}
+	for i := range linearToSRGB {
+		l := float64(i) / linearSteps
+		if l <= 0.0031308 {
+			l *= 12.92
+		} else {
+			l = 1.055*math.Pow(l, 1/2.4) - 0.055
+		}
+		linearToSRGB[i] = uint8(math.Round(l * 255))
+	}
+}
+
+// encodeLinear converts an averaged linear value back to 8-bit sRGB.
+func encodeLinear(l float32) uint8 {
+	i := int(l*linearSteps + 0.5)
+	return linearToSRGB[min(max(i, 0), linearSteps)]
+}
+
+// averageLinear averages the premultiplied RGBA pixels of strip in columns
+// x0..x1 and rows 0..rows, converting to linear light first. Sources are
+// assumed to be sRGB, which is what the encoders write.
+func averageLinear(strip *image.RGBA, x0, x1, rows int) (r, g, b, a uint8) {
+	var sumR, sumG, sumB, sumA float32
+	n := 0
+	for sy := 0; sy < rows; sy++ {
+		i := strip.PixOffset(x0, sy)
+		for sx := x0; sx < x1; sx++ {
+			n++
+			alpha := strip.Pix[i+3]
+			if alpha == 0 {
+				i += 4
+				continue
+			}
+			// Undo premultiplication before linearizing, then weight by
+			// alpha so transparent pixels don't pull colors toward black
+			w := float32(alpha)
+			sumR += srgbToLinear[unpremultiply(strip.Pix[i], alpha)] * w
+			sumG += srgbToLinear[unpremultiply(strip.Pix[i+1], alpha)] * w
+			sumB += srgbToLinear[unpremultiply(strip.Pix[i+2], alpha)] * w
+			sumA += w
+			i += 4
+		}
+	}
+	if sumA == 0 {
+		return 0, 0, 0, 0
+	}
+	a = uint8(sumA/float32(n) + 0.5)
+	r = premultiply(encodeLinear(sumR/sumA), a)
+	g = premultiply(encodeLinear(sumG/sumA), a)
+	b = premultiply(encodeLinear(sumB/sumA), a)
+	return r, g, b, a
+}
+
+func unpremultiply(c, a uint8) uint8 {
+	if a == 255 {
+		return c
+	}
+	return uint8(min(int(c)*255/int(a), 255))
+}
+
+func premultiply(c, a uint8) uint8 {
+	if a == 255 {
+		return c
+	}
+	return uint8(int(c) * int(a) / 255)
+}
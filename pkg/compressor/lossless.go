@@ -0,0 +1,142 @@
+package compressor
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+)
+
+// Formats CompressPNG and CompressGIF report, named as image.Decode names
+// them.
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+)
+
+// CompressPNG encodes img as a PNG with EncodePNG and returns it if it fits
+// in opts.TargetSize. Otherwise it converts to a JPEG with CompressImage,
+// or with opts.KeepFormat set, returns the PNG with ErrCannotMeetTarget.
+// Either way it also returns the format of the encoding, FormatPNG or
+// FormatJPEG.
+func CompressPNG(img image.Image, opts Options) ([]byte, string, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := EncodePNG(scale(img, opts), opts.Effort)
+	if err != nil {
+		return nil, "", err
+	}
+	return fitOrConvert(img, opts, data, FormatPNG)
+}
+
+// CompressGIF is CompressPNG for a single-frame GIF encoded by EncodeGIF.
+func CompressGIF(img image.Image, opts Options) ([]byte, string, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := EncodeGIF(scale(img, opts))
+	if err != nil {
+		return nil, "", err
+	}
+	return fitOrConvert(img, opts, data, FormatGIF)
+}
+
+// fitOrConvert returns data, img encoded in format, if it fits the target,
+// and otherwise goes on as CompressPNG describes.
+func fitOrConvert(img image.Image, opts Options, data []byte, format string) ([]byte, string, error) {
+	if len(data) <= opts.TargetSize {
+		return data, format, nil
+	}
+	if opts.KeepFormat {
+		return data, format, ErrCannotMeetTarget
+	}
+	data, err := CompressImage(img, opts)
+	return data, FormatJPEG, err
+}
+
+// pngCompressionLevel is the zlib level EncodePNG uses at effort.
+func pngCompressionLevel(effort int) png.CompressionLevel {
+	switch {
+	case effort <= 2:
+		return png.BestSpeed
+	case effort <= 4:
+		return png.DefaultCompression
+	default:
+		return png.BestCompression
+	}
+}
+
+// EncodePNG encodes img losslessly at the compression level effort picks.
+// From effort 7 up it also tries a paletted encoding when the image has at
+// most 256 colors, keeping whichever is smaller.
+func EncodePNG(img image.Image, effort int) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: pngCompressionLevel(effort)}
+	if err := encoder.Encode(&buffer, img); err != nil {
+		return nil, err
+	}
+	if effort < 7 {
+		return buffer.Bytes(), nil
+	}
+	if _, ok := img.(*image.Paletted); ok {
+		return buffer.Bytes(), nil
+	}
+
+	paletted := PalettedLossless(img)
+	if paletted == nil {
+		return buffer.Bytes(), nil
+	}
+	var alt bytes.Buffer
+	if err := encoder.Encode(&alt, paletted); err != nil {
+		return nil, err
+	}
+	if alt.Len() < buffer.Len() {
+		return alt.Bytes(), nil
+	}
+	return buffer.Bytes(), nil
+}
+
+// EncodeGIF encodes img as a single-frame GIF. Images with more than 256
+// colors are reduced to the standard library's Plan 9 palette.
+func EncodeGIF(img image.Image) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gif.Encode(&buffer, img, nil); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// PalettedLossless returns a paletted copy of img, or nil if img uses more
+// than 256 distinct colors or any color that does not fit in 8 bits.
+func PalettedLossless(img image.Image) *image.Paletted {
+	bounds := img.Bounds()
+	index := make(map[color.NRGBA]uint8)
+	var palette color.Palette
+	paletted := image.NewPaletted(bounds, nil)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			wide := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			if wide.R%257 != 0 || wide.G%257 != 0 || wide.B%257 != 0 || wide.A%257 != 0 {
+				return nil
+			}
+			c := color.NRGBA{uint8(wide.R >> 8), uint8(wide.G >> 8), uint8(wide.B >> 8), uint8(wide.A >> 8)}
+			i, ok := index[c]
+			if !ok {
+				if len(palette) == 256 {
+					return nil
+				}
+				i = uint8(len(palette))
+				index[c] = i
+				palette = append(palette, c)
+			}
+			paletted.Pix[paletted.PixOffset(x, y)] = i
+		}
+	}
+	paletted.Palette = palette
+	return paletted
+}
@@ -0,0 +1,230 @@
+package compressor
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// Filter selects how images are resampled when they are scaled.
+type Filter int
+
+const (
+	// Box averages the source pixels covered by each destination pixel.
+	// It is the fastest and never rings, but leaves downscaled detail a
+	// little soft.
+	Box Filter = iota
+	// CatmullRom is a cubic filter: sharper than Box, with faint halos
+	// along hard edges.
+	CatmullRom
+	// Lanczos is a windowed sinc over three lobes: the sharpest, with the
+	// most ringing.
+	Lanczos
+)
+
+var filterNames = [...]string{Box: "box", CatmullRom: "catmull-rom", Lanczos: "lanczos"}
+
+func (f Filter) String() string {
+	if f < 0 || int(f) >= len(filterNames) {
+		return fmt.Sprintf("Filter(%d)", int(f))
+	}
+	return filterNames[f]
+}
+
+// ParseFilter returns the filter named s: box, catmull-rom or lanczos.
+func ParseFilter(s string) (Filter, error) {
+	for f, name := range filterNames {
+		if s == name {
+			return Filter(f), nil
+		}
+	}
+	return Box, fmt.Errorf("compressor: unknown resize filter %q (want box, catmull-rom or lanczos)", s)
+}
+
+// kernel returns how far from its center, in pixels, the kernel of f
+// reaches, and the kernel itself.
+func (f Filter) kernel() (float64, func(x float64) float64) {
+	switch f {
+	case CatmullRom:
+		return 2, catmullRom
+	case Lanczos:
+		return 3, lanczos3
+	}
+	return 0, nil
+}
+
+func catmullRom(x float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x < 1:
+		return (3*x-5)*x*x/2 + 1
+	case x < 2:
+		return ((5-x)*x-8)*x/2 + 2
+	}
+	return 0
+}
+
+func lanczos3(x float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x == 0:
+		return 1
+	case x < 3:
+		px := math.Pi * x
+		return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+	}
+	return 0
+}
+
+// Resample scales img to width x height with filter. Box is Resize; the
+// other filters weigh the source pixels around each destination pixel by
+// their kernel, stretched by the scale factor when shrinking so every
+// source pixel counts. Colors are weighed in premultiplied form, in linear
+// light with linear set, as Resize does.
+//
+// Each source row is read and resampled horizontally once, and only as
+// many of them as one destination row needs are held at a time, so
+// resampling a huge decoded frame never materializes a full-size copy.
+func Resample(img image.Image, width, height int, linear bool, filter Filter) *image.RGBA {
+	support, kernel := filter.kernel()
+	if kernel == nil {
+		return Resize(img, width, height, linear)
+	}
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	xs := resampleWeights(srcW, width, support, kernel)
+	ys := resampleWeights(srcH, height, support, kernel)
+
+	// Horizontally resampled rows are kept in a ring indexed by source row,
+	// as large as the widest window a destination row reads
+	ringRows := 0
+	for _, c := range ys {
+		ringRows = max(ringRows, len(c.weights))
+	}
+	ring := make([][]float32, ringRows)
+	for i := range ring {
+		ring[i] = make([]float32, width*4)
+	}
+	row := image.NewRGBA(image.Rect(0, 0, srcW, 1))
+	src := make([]float32, srcW*4)
+	next := 0
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	sum := make([]float32, width*4)
+	for y, cy := range ys {
+		for ; next < cy.start+len(cy.weights); next++ {
+			drawRows(row, row.Rect, img, image.Pt(bounds.Min.X, bounds.Min.Y+next))
+			loadRow(src, row.Pix, linear)
+			resampleRow(ring[next%ringRows], src, xs)
+		}
+		clear(sum)
+		for k, w := range cy.weights {
+			line := ring[(cy.start+k)%ringRows]
+			for i, v := range line {
+				sum[i] += w * v
+			}
+		}
+		storeRow(dst.Pix[y*dst.Stride:y*dst.Stride+width*4], sum, linear)
+	}
+	return dst
+}
+
+// contribution is the run of source pixels, from start, that make up one
+// destination pixel and how much each counts.
+type contribution struct {
+	start   int
+	weights []float32
+}
+
+// resampleWeights works out the contributions to each of dst pixels from
+// src pixels under kernel. Pixels past the edges are left out, and the
+// weights of the rest normalized to sum to 1.
+func resampleWeights(src, dst int, support float64, kernel func(float64) float64) []contribution {
+	scale := float64(src) / float64(dst)
+	stretch := max(scale, 1)
+	reach := support * stretch
+	out := make([]contribution, dst)
+	for i := range out {
+		center := (float64(i) + 0.5) * scale
+		start := max(int(math.Floor(center-reach)), 0)
+		end := min(int(math.Ceil(center+reach)), src)
+		weights := make([]float32, 0, end-start)
+		var total float64
+		for j := start; j < end; j++ {
+			w := kernel((float64(j) + 0.5 - center) / stretch)
+			weights = append(weights, float32(w))
+			total += w
+		}
+		if total != 0 {
+			for k := range weights {
+				weights[k] = float32(float64(weights[k]) / total)
+			}
+		}
+		out[i] = contribution{start: start, weights: weights}
+	}
+	return out
+}
+
+// loadRow converts a row of premultiplied RGBA pixels to premultiplied
+// floats in [0, 1], linearizing the colors with linear set.
+func loadRow(dst []float32, pix []uint8, linear bool) {
+	for i := 0; i < len(pix); i += 4 {
+		alpha := pix[i+3]
+		a := float32(alpha) / 255
+		if linear {
+			if alpha == 0 {
+				dst[i], dst[i+1], dst[i+2] = 0, 0, 0
+			} else {
+				dst[i] = srgbToLinear[unpremultiply(pix[i], alpha)] * a
+				dst[i+1] = srgbToLinear[unpremultiply(pix[i+1], alpha)] * a
+				dst[i+2] = srgbToLinear[unpremultiply(pix[i+2], alpha)] * a
+			}
+		} else {
+			dst[i] = float32(pix[i]) / 255
+			dst[i+1] = float32(pix[i+1]) / 255
+			dst[i+2] = float32(pix[i+2]) / 255
+		}
+		dst[i+3] = a
+	}
+}
+
+// resampleRow resamples the pixels of src, as loadRow left them, into dst
+// by the contributions xs.
+func resampleRow(dst, src []float32, xs []contribution) {
+	for x, c := range xs {
+		var r, g, b, a float32
+		j := c.start * 4
+		for _, w := range c.weights {
+			r += w * src[j]
+			g += w * src[j+1]
+			b += w * src[j+2]
+			a += w * src[j+3]
+			j += 4
+		}
+		i := x * 4
+		dst[i], dst[i+1], dst[i+2], dst[i+3] = r, g, b, a
+	}
+}
+
+// storeRow converts a resampled row back to 8-bit premultiplied RGBA.
+// Kernels with negative lobes overshoot near edges, so values are clamped,
+// colors to no more than their alpha.
+func storeRow(pix []uint8, row []float32, linear bool) {
+	for i := 0; i < len(pix); i += 4 {
+		a := min(max(row[i+3], 0), 1)
+		alpha := uint8(a*255 + 0.5)
+		pix[i+3] = alpha
+		if alpha == 0 {
+			pix[i], pix[i+1], pix[i+2] = 0, 0, 0
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			v := min(max(row[i+c], 0), a)
+			if linear {
+				pix[i+c] = premultiply(encodeLinear(v/a), alpha)
+			} else {
+				pix[i+c] = uint8(v*255 + 0.5)
+			}
+		}
+	}
+}
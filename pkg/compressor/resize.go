@@ -0,0 +1,92 @@
+package compressor
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Resize scales img to width x height by averaging the source pixels covered
+// by each destination pixel. It is meant for downscaling; colors are
+// averaged in premultiplied form so transparent edges don't bleed dark. With
+// linear set, colors are averaged in linear light instead of gamma-encoded
+// sRGB, which otherwise darkens fine detail such as foliage, text and thin
+// highlights.
+//
+// The source is converted to RGBA one strip of rows at a time, so resizing a
+// huge decoded frame never materializes a full-size RGBA copy of it.
+func Resize(img image.Image, width, height int, linear bool) *image.RGBA {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	stripRows := max((srcH+height-1)/height, 1)
+	strip := image.NewRGBA(image.Rect(0, 0, srcW, stripRows))
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * srcH / height
+		y1 := max((y+1)*srcH/height, y0+1)
+		drawRows(strip, image.Rect(0, 0, srcW, y1-y0), img, image.Pt(bounds.Min.X, bounds.Min.Y+y0))
+
+		for x := 0; x < width; x++ {
+			x0 := x * srcW / width
+			x1 := max((x+1)*srcW/width, x0+1)
+
+			j := dst.PixOffset(x, y)
+			if linear {
+				dst.Pix[j], dst.Pix[j+1], dst.Pix[j+2], dst.Pix[j+3] = averageLinear(strip, x0, x1, y1-y0)
+				continue
+			}
+
+			var r, g, b, a, n int
+			for sy := 0; sy < y1-y0; sy++ {
+				i := strip.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(strip.Pix[i])
+					g += int(strip.Pix[i+1])
+					b += int(strip.Pix[i+2])
+					a += int(strip.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// RowDrawer is an image that copies its rows into an RGBA image itself,
+// such as one decoded a band of rows at a time as they are asked for.
+// Resize and Resample read rows top to bottom and never go back to a row
+// before the last one read, so such an image need only hold the band being
+// read.
+type RowDrawer interface {
+	image.Image
+	// DrawRows copies the pixels of the image from sp into r of dst.
+	DrawRows(dst *image.RGBA, r image.Rectangle, sp image.Point)
+}
+
+// drawRows copies the pixels of img from sp into r of dst, through
+// DrawRows if img is a RowDrawer.
+func drawRows(dst *image.RGBA, r image.Rectangle, img image.Image, sp image.Point) {
+	if rows, ok := img.(RowDrawer); ok {
+		rows.DrawRows(dst, r, sp)
+		return
+	}
+	draw.Draw(dst, r, img, sp, draw.Src)
+}
+
+// LongEdgeSize returns the dimensions of a width x height image scaled down
+// so that its longer side is at most size pixels.
+func LongEdgeSize(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		return size, max(height*size/width, 1)
+	}
+	return max(width*size/height, 1), size
+}
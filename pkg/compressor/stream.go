@@ -0,0 +1,218 @@
+package compressor
+
+import (
+	"image"
+	"image/jpeg"
+	"io"
+	"sync"
+)
+
+// Result describes the output Compress wrote.
+type Result struct {
+	// SourceFormat is the format the input was decoded as, e.g. FormatPNG.
+	SourceFormat string
+	// Format is the format of the output, FormatJPEG unless a PNG or GIF
+	// kept its own.
+	Format string
+	// Size is the number of bytes written.
+	Size int64
+	// Width and Height are the output's dimensions, after
+	// opts.MaxDimension.
+	Width, Height int
+}
+
+// Compress decodes a JPEG, PNG or GIF from r and writes it to w compressed
+// within opts.TargetSize, for servers that handle uploads without touching
+// disk. JPEGs are compressed as by CompressImageTo, streaming the chosen
+// encoding into w; PNGs and GIFs go through CompressPNG and CompressGIF,
+// keeping their format if it fits.
+//
+// Images whose header claims more than opts.MaxPixels pixels fail with
+// ErrTooManyPixels before they are decoded.
+//
+// If nothing fits, Compress returns ErrCannotMeetTarget without writing
+// anything; the Result still says what the output would have been.
+func Compress(r io.Reader, w io.Writer, opts Options) (Result, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return Result{}, err
+	}
+	img, format, err := decode(r, opts.MaxPixels)
+	if err != nil {
+		return Result{}, err
+	}
+	bounds := img.Bounds()
+	result := Result{SourceFormat: format, Format: FormatJPEG, Width: bounds.Dx(), Height: bounds.Dy()}
+	if opts.MaxDimension > 0 {
+		result.Width, result.Height = LongEdgeSize(result.Width, result.Height, opts.MaxDimension)
+	}
+
+	var data []byte
+	switch format {
+	case FormatPNG:
+		data, result.Format, err = CompressPNG(img, opts)
+	case FormatGIF:
+		data, result.Format, err = CompressGIF(img, opts)
+	default:
+		result.Size, err = CompressImageTo(w, img, opts)
+		return result, err
+	}
+	if err != nil {
+		return result, err
+	}
+	n, err := w.Write(data)
+	result.Size = int64(n)
+	return result, err
+}
+
+// DefaultPartSize is the part size CompressImageToWriterAt uses when given
+// 0. It is the smallest part S3 multipart uploads accept.
+const DefaultPartSize = 5 * 1024 * 1024
+
+// CompressImageTo is CompressImage writing to w instead of returning a
+// buffer. The quality search only measures its attempts, and the chosen
+// quality is encoded once more straight into w, so no whole encoding is
+// held in memory. It returns the number of bytes written.
+//
+// If no quality fits, it returns ErrCannotMeetTarget without writing
+// anything.
+func CompressImageTo(w io.Writer, img image.Image, opts Options) (int64, error) {
+	img, opts, err := prepare(img, opts)
+	if err != nil {
+		return 0, err
+	}
+	quality, _, err := searchQuality(img, opts, false)
+	if err != nil {
+		return 0, err
+	}
+	if quality == minQuality {
+		// The search stops at minQuality whether or not it fits
+		var counter countingWriter
+		if err := jpeg.Encode(&counter, img, &jpeg.Options{Quality: quality}); err != nil {
+			return 0, err
+		}
+		if counter.n > int64(opts.TargetSize) {
+			return 0, ErrCannotMeetTarget
+		}
+	}
+	counter := countingWriter{w: w}
+	err = jpeg.Encode(&counter, img, &jpeg.Options{Quality: quality})
+	return counter.n, err
+}
+
+// CompressImageToWriterAt is CompressImageTo for destinations written by
+// offset, such as a multipart upload where every part is sent separately.
+// The output is cut into partSize chunks (the last one shorter) and each is
+// passed to w.WriteAt as soon as it is complete, with up to concurrency
+// calls in flight while encoding continues. Memory use is bounded by
+// (concurrency+1) * partSize. It returns the total size written.
+func CompressImageToWriterAt(w io.WriterAt, img image.Image, opts Options, partSize, concurrency int) (int64, error) {
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+	concurrency = max(concurrency, 1)
+	parts := &partWriter{
+		w:    w,
+		size: partSize,
+		sem:  make(chan struct{}, concurrency),
+	}
+	n, err := CompressImageTo(parts, img, opts)
+	if closeErr := parts.close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// partWriter collects sequential writes into fixed-size parts and writes
+// each full part to an io.WriterAt from its own goroutine.
+type partWriter struct {
+	w    io.WriterAt
+	size int
+	sem  chan struct{}
+	wg   sync.WaitGroup
+	pool sync.Pool
+
+	buf []byte
+	off int64
+
+	mu  sync.Mutex
+	err error
+}
+
+func (p *partWriter) Write(data []byte) (int, error) {
+	if err := p.firstErr(); err != nil {
+		return 0, err
+	}
+	written := len(data)
+	for len(data) > 0 {
+		if p.buf == nil {
+			if b, ok := p.pool.Get().([]byte); ok {
+				p.buf = b[:0]
+			} else {
+				p.buf = make([]byte, 0, p.size)
+			}
+		}
+		n := min(len(data), p.size-len(p.buf))
+		p.buf = append(p.buf, data[:n]...)
+		data = data[n:]
+		if len(p.buf) == p.size {
+			p.flush()
+		}
+	}
+	return written, nil
+}
+
+// flush hands the current part to a goroutine, waiting for a free slot.
+func (p *partWriter) flush() {
+	part, off := p.buf, p.off
+	p.buf = nil
+	p.off += int64(len(part))
+	p.sem <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			p.pool.Put(part)
+			<-p.sem
+			p.wg.Done()
+		}()
+		if _, err := p.w.WriteAt(part, off); err != nil {
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = err
+			}
+			p.mu.Unlock()
+		}
+	}()
+}
+
+// close writes the final partial part and waits for every write to finish.
+func (p *partWriter) close() error {
+	if len(p.buf) > 0 {
+		p.flush()
+	}
+	p.wg.Wait()
+	return p.firstErr()
+}
+
+func (p *partWriter) firstErr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// countingWriter counts the bytes written through it to w, or discards them
+// if w is nil.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	if c.w == nil {
+		c.n += int64(len(data))
+		return len(data), nil
+	}
+	n, err := c.w.Write(data)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,164 @@
+package compressor
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math/rand/v2"
+	"sync"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	img := randomImage(rand.New(rand.NewPCG(3, 4)))
+	b := img.Bounds()
+	opts := Options{TargetSize: 20000, MaxDimension: 100}
+	w, h := LongEdgeSize(b.Dx(), b.Dy(), opts.MaxDimension)
+	for _, format := range []string{FormatJPEG, FormatPNG} {
+		var in bytes.Buffer
+		var err error
+		if format == FormatPNG {
+			err = png.Encode(&in, img)
+		} else {
+			err = jpeg.Encode(&in, img, &jpeg.Options{Quality: 95})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, _, err := image.Decode(bytes.NewReader(in.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want bytes.Buffer
+		if format == FormatPNG {
+			data, _, err := CompressPNG(decoded, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want.Write(data)
+		} else if _, err := CompressImageTo(&want, decoded, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		result, err := Compress(&in, &out, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if result.SourceFormat != format || result.Size != int64(out.Len()) || result.Width != w || result.Height != h {
+			t.Errorf("%s: result %+v for %d bytes, want %dx%d", format, result, out.Len(), w, h)
+		}
+		if !bytes.Equal(out.Bytes(), want.Bytes()) {
+			t.Errorf("%s: Compress wrote %d bytes unlike decoding first, %d", format, out.Len(), want.Len())
+		}
+	}
+}
+
+func TestCompressMaxPixels(t *testing.T) {
+	var small bytes.Buffer
+	if err := png.Encode(&small, image.NewGray(image.Rect(0, 0, 64, 48))); err != nil {
+		t.Fatal(err)
+	}
+	// A GIF header claiming 65535x65535 pixels and nothing else, which
+	// the default limit rejects before decoding
+	huge := []byte("GIF89a\xff\xff\xff\xff\x00\x00\x00")
+	tests := []struct {
+		name      string
+		in        []byte
+		maxPixels int
+	}{
+		{"over MaxPixels", small.Bytes(), 64*48 - 1},
+		{"over the default", huge, 0},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		_, err := Compress(bytes.NewReader(tt.in), &out, Options{MaxPixels: tt.maxPixels})
+		if !errors.Is(err, ErrTooManyPixels) || out.Len() != 0 {
+			t.Errorf("%s: wrote %d bytes, %v", tt.name, out.Len(), err)
+		}
+		if _, err := CompressBytes(tt.in, Options{MaxPixels: tt.maxPixels}); !errors.Is(err, ErrTooManyPixels) {
+			t.Errorf("%s: CompressBytes returned %v", tt.name, err)
+		}
+	}
+	var out bytes.Buffer
+	if _, err := Compress(bytes.NewReader(small.Bytes()), &out, Options{MaxPixels: 64 * 48}); err != nil {
+		t.Errorf("at MaxPixels: %v", err)
+	}
+}
+
+// partsWriter records the parts written to it by offset, and how many
+// WriteAt calls were in flight at most. With failAt > 0, that call fails.
+type partsWriter struct {
+	mu       sync.Mutex
+	parts    map[int64][]byte
+	calls    int
+	failAt   int
+	inFlight int
+	maxIn    int
+}
+
+var errPartFailed = errors.New("part upload failed")
+
+func (w *partsWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	w.calls++
+	call := w.calls
+	w.inFlight++
+	w.maxIn = max(w.maxIn, w.inFlight)
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		w.inFlight--
+		w.mu.Unlock()
+	}()
+	if call == w.failAt {
+		return 0, errPartFailed
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.parts[off] = bytes.Clone(p)
+	return len(p), nil
+}
+
+func TestCompressImageToWriterAt(t *testing.T) {
+	img := randomImage(rand.New(rand.NewPCG(5, 6)))
+	opts := Options{TargetSize: 30000}
+	var want bytes.Buffer
+	if _, err := CompressImageTo(&want, img, opts); err != nil {
+		t.Fatal(err)
+	}
+	const partSize, concurrency = 1000, 3
+	if want.Len() < 5*partSize {
+		t.Fatalf("encoding is only %d bytes, too few parts to test", want.Len())
+	}
+
+	w := &partsWriter{parts: make(map[int64][]byte)}
+	n, err := CompressImageToWriterAt(w, img, opts, partSize, concurrency)
+	if err != nil || n != int64(want.Len()) {
+		t.Fatalf("wrote %d bytes, %v; want %d", n, err, want.Len())
+	}
+	var got []byte
+	for off := int64(0); off < n; off += partSize {
+		part, ok := w.parts[off]
+		if !ok {
+			t.Fatalf("no part at %d", off)
+		}
+		if len(part) != partSize && off+int64(len(part)) != n {
+			t.Errorf("part at %d is %d bytes", off, len(part))
+		}
+		got = append(got, part...)
+	}
+	if len(w.parts) != (want.Len()+partSize-1)/partSize || !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("%d parts differ from CompressImageTo", len(w.parts))
+	}
+	if w.maxIn > concurrency {
+		t.Errorf("%d writes in flight, want at most %d", w.maxIn, concurrency)
+	}
+
+	failing := &partsWriter{parts: make(map[int64][]byte), failAt: 2}
+	if _, err := CompressImageToWriterAt(failing, img, opts, partSize, concurrency); !errors.Is(err, errPartFailed) {
+		t.Errorf("failing part returned %v", err)
+	}
+}
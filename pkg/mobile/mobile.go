@@ -0,0 +1,78 @@
+// Package mobile binds the compressor package for iOS and Android apps with
+// gomobile, so they compress uploads exactly as the command line does:
+//
+//	gomobile bind -target=android -o dist/mobile/compressor.aar ./pkg/mobile
+//	gomobile bind -target=ios -o dist/mobile/Compressor.xcframework ./pkg/mobile
+//
+// gomobile only passes basic types across, so images go in and out as
+// encoded bytes.
+package mobile
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+
+	"image-compressor/pkg/compressor"
+)
+
+// Options mirrors compressor.Options with the types gomobile can bind.
+// Start from NewOptions; zero values also select the defaults.
+type Options struct {
+	// TargetSize is the maximum output size in bytes.
+	TargetSize int
+	// MaxQuality is the highest JPEG quality tried, from 1 to 100.
+	MaxQuality int
+	// Effort trades CPU time for output bytes, from 1 to 9.
+	Effort int
+	// MaxDimension caps the longer side in pixels; 0 means no cap.
+	MaxDimension int
+	// LinearResize averages colors in linear light when scaling down.
+	LinearResize bool
+	// Background is the color transparent areas are flattened onto, as
+	// #rrggbb; "" means white.
+	Background string
+}
+
+// NewOptions returns the default options.
+func NewOptions() *Options {
+	return &Options{
+		TargetSize: compressor.DefaultTargetSize,
+		MaxQuality: compressor.DefaultMaxQuality,
+		Effort:     compressor.DefaultEffort,
+	}
+}
+
+// Compress re-encodes a JPEG, PNG or GIF as a JPEG of at most
+// opts.TargetSize bytes. It fails if even the lowest quality is too large;
+// IsCannotMeetTarget tells that failure apart. opts may be nil.
+func Compress(data []byte, opts *Options) ([]byte, error) {
+	if opts == nil {
+		opts = NewOptions()
+	}
+	o := compressor.Options{
+		TargetSize:   opts.TargetSize,
+		MaxQuality:   opts.MaxQuality,
+		Effort:       opts.Effort,
+		MaxDimension: opts.MaxDimension,
+		LinearResize: opts.LinearResize,
+	}
+	if opts.Background != "" {
+		var r, g, b uint8
+		if _, err := fmt.Sscanf(opts.Background, "#%02x%02x%02x", &r, &g, &b); err != nil {
+			return nil, fmt.Errorf("background %q is not #rrggbb", opts.Background)
+		}
+		o.Background = color.RGBA{R: r, G: g, B: b, A: 0xff}
+	}
+	out, err := compressor.CompressBytes(data, o)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// IsCannotMeetTarget reports whether err is Compress failing because the
+// image doesn't fit in the target size at any quality.
+func IsCannotMeetTarget(err error) bool {
+	return errors.Is(err, compressor.ErrCannotMeetTarget)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"sort"
+	"strings"
+)
+
+// Pipelines an image can be compressed with, picked per source format by
+// the policy table.
+const (
+	// pipelineRequantize searches JPEG qualities down from the source's
+	pipelineRequantize = "requantize"
+	// pipelineReencode keeps the source format, converting to JPEG only if
+	// that can't meet the target
+	pipelineReencode = "reencode"
+	// pipelineQuantize reduces PNG and GIF images to a palette first, then
+	// goes on as pipelineReencode
+	pipelineQuantize = "quantize"
+	// pipelineDownscale keeps PNG and GIF images lossless, reducing their
+	// dimensions until they meet the target
+	pipelineDownscale = "downscale"
+	// pipelineJPEG converts to JPEG
+	pipelineJPEG = "jpeg"
+	// pipelinePNG converts to PNG, then to JPEG if that can't meet the
+	// target
+	pipelinePNG = "png"
+	// pipelineHEIC encodes HEIC, in builds with libheif
+	pipelineHEIC = "heic"
+)
+
+// otherFormats is the policy key for formats without an entry of their own.
+const otherFormats = "*"
+
+// defaultPolicies is the pipeline each source format goes through unless
+// -policy says otherwise. Formats there is no encoder for are converted.
+var defaultPolicies = map[string]string{
+	"jpeg":       pipelineRequantize,
+	"png":        pipelineReencode,
+	"gif":        pipelineReencode,
+	"heic":       pipelineJPEG,
+	otherFormats: pipelineJPEG,
+}
+
+// formatPolicies is the policy table in effect.
+var formatPolicies = defaultPolicies
+
+// formatEncoders compress an image in its own format, for pipelineReencode.
+var formatEncoders = map[string]func(log *fileLog, srcPath, dstPath string, img image.Image) (string, error){
+	"jpeg": func(log *fileLog, srcPath, dstPath string, img image.Image) (string, error) {
+		return dstPath, compressJPEGSource(log, srcPath, dstPath, img)
+	},
+	"png": compressPNG,
+	"gif": compressGIF,
+	"heic": func(log *fileLog, srcPath, dstPath string, img image.Image) (string, error) {
+		return compressHEICOutput(log, dstPath, img)
+	},
+}
+
+// policyFormats maps what -policy accepts for a format, such as an
+// extension or content type, to the format name image.Decode reports.
+var policyFormats = map[string]string{
+	"jpg": "jpeg", "jpe": "jpeg", "jfif": "jpeg", "heif": "heic", "tif": "tiff",
+}
+
+// policyUsage is the usage of the -policy flag.
+var policyUsage = "comma-separated format=pipeline entries overriding the default per-format pipelines, e.g. png=quantize,gif=jpeg,psd=png; formats may be given as extensions or content types, * is every other format, and pipelines are requantize, reencode, quantize, downscale, jpeg, png or heic (default " + formatPolicyTable(defaultPolicies) + ")"
+
+// parsePolicy applies -policy entries on top of the current table.
+func parsePolicy(s string) error {
+	policies := make(map[string]string, len(formatPolicies))
+	for format, pipeline := range formatPolicies {
+		policies[format] = pipeline
+	}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, pipeline, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("%q is not format=pipeline", entry)
+		}
+		format := policyFormat(key)
+		pipeline = strings.ToLower(strings.TrimSpace(pipeline))
+		if err := checkPolicy(format, pipeline); err != nil {
+			return err
+		}
+		policies[format] = pipeline
+	}
+	formatPolicies = policies
+	return nil
+}
+
+// policyFormat normalizes a format given as a name, an extension (.png)
+// or a content type (image/png).
+func policyFormat(key string) string {
+	key = strings.ToLower(strings.TrimSpace(key))
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "image/"), ".")
+	key = strings.TrimPrefix(key, "x-")
+	if format, ok := policyFormats[key]; ok {
+		return format
+	}
+	return key
+}
+
+// checkPolicy reports whether format can go through pipeline.
+func checkPolicy(format, pipeline string) error {
+	switch pipeline {
+	case pipelineJPEG, pipelinePNG, pipelineReencode:
+	case pipelineRequantize:
+		if format != "jpeg" {
+			return fmt.Errorf("%s=%s: only JPEG sources can be requantized", format, pipeline)
+		}
+	case pipelineQuantize, pipelineDownscale:
+		if format != "png" && format != "gif" {
+			return fmt.Errorf("%s=%s: only PNG and GIF outputs have palettes", format, pipeline)
+		}
+	case pipelineHEIC:
+		if !heifSupported {
+			return fmt.Errorf("%s=%s: %w", format, pipeline, errHEICUnsupported)
+		}
+	default:
+		return fmt.Errorf("%s: unknown pipeline %q (want requantize, reencode, quantize, downscale, jpeg, png or heic)", format, pipeline)
+	}
+	return nil
+}
+
+// pipelineFor returns the pipeline for images of format.
+func pipelineFor(format string) string {
+	if pipeline, ok := formatPolicies[format]; ok {
+		return pipeline
+	}
+	return formatPolicies[otherFormats]
+}
+
+// formatPolicyTable lists policies as -policy would take them, sorted by
+// format with * last.
+func formatPolicyTable(policies map[string]string) string {
+	formats := make([]string, 0, len(policies))
+	for format := range policies {
+		formats = append(formats, format)
+	}
+	sort.Slice(formats, func(i, j int) bool {
+		if formats[i] == otherFormats || formats[j] == otherFormats {
+			return formats[j] == otherFormats && formats[i] != otherFormats
+		}
+		return formats[i] < formats[j]
+	})
+	entries := make([]string, len(formats))
+	for i, format := range formats {
+		entries[i] = format + "=" + policies[format]
+	}
+	return strings.Join(entries, ",")
+}
+
+// compressWithPolicy compresses img, decoded from a source of the given
+// format, through the pipeline the policy table picks for it.
+func compressWithPolicy(log *fileLog, format, srcPath, dstPath string, img image.Image) (string, error) {
+	encode, hasEncoder := formatEncoders[format]
+	switch pipelineFor(format) {
+	case pipelineHEIC:
+		return compressHEICOutput(log, dstPath, img)
+	case pipelinePNG:
+		return compressPNG(log, srcPath, pngOutputPath(dstPath), img)
+	case pipelineRequantize:
+		return dstPath, compressJPEGSource(log, srcPath, dstPath, img)
+	case pipelineQuantize:
+		log.Printf("(quantizing) ")
+		data, err := encodeLossless(format, quantize(img))
+		if err != nil {
+			return "", err
+		}
+		if len(data) <= targetSize {
+			return dstPath, writeOutput(dstPath, data)
+		}
+		// Too large even with a palette; carry on from the full colors, so a
+		// conversion to JPEG isn't dithered
+		return encode(log, srcPath, dstPath, img)
+	case pipelineDownscale:
+		data, err := encodeLosslessWithin(log, img, targetSize, func(img image.Image) ([]byte, error) {
+			return encodeLossless(format, img)
+		})
+		if err == nil {
+			return dstPath, writeOutput(dstPath, data)
+		}
+		if !errors.Is(err, errCannotMeetTarget) {
+			return "", err
+		}
+	case pipelineReencode:
+		if hasEncoder {
+			return encode(log, srcPath, dstPath, img)
+		}
+	default:
+		// Converting is ruled out, but the format may have an encoder
+		if noConvert && hasEncoder {
+			return encode(log, srcPath, dstPath, img)
+		}
+	}
+	if noConvert {
+		return "", errNeedsConversion
+	}
+	jpegPath := jpegOutputPath(dstPath)
+	log.Printf("(converting to JPEG) ")
+	return jpegPath, compressJPEG(log, jpegPath, img)
+}
+
+// encodeLossless encodes img as a PNG, or as a GIF with a palette chosen
+// by quantize if it doesn't have one.
+func encodeLossless(format string, img image.Image) ([]byte, error) {
+	if format == "gif" {
+		var buffer bytes.Buffer
+		err := gif.Encode(&buffer, quantize(img), nil)
+		return buffer.Bytes(), err
+	}
+	return encodePNG(img)
+}
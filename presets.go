@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// maxDimension caps the longer side of every output in pixels; 0 means no
+// cap. maxWidth and maxHeight cap one side each, and are only set per file
+// by filename directives.
+var (
+	maxDimension int
+	maxWidth     int
+	maxHeight    int
+)
+
+// displayWidth and displayHeight, when set by -display-size, are the size
+// in CSS pixels outputs are shown at, and displayDPR the device pixel ratio
+// of the screens showing them. Pixels beyond what the screen shows are
+// never seen, so images are scaled down to fit the box in device pixels
+// before the search for the target size.
+var (
+	displayWidth, displayHeight int
+	displayDPR                  float64 = 1
+)
+
+// parseDisplaySize sets the display size from WIDTHxHEIGHT, or clears it
+// for "".
+func parseDisplaySize(s string) error {
+	if s == "" {
+		displayWidth, displayHeight = 0, 0
+		return nil
+	}
+	width, height, ok := parseWxH(s)
+	if !ok {
+		return fmt.Errorf("invalid display size %q, expected WIDTHxHEIGHT such as 1920x1080", s)
+	}
+	displayWidth, displayHeight = width, height
+	return nil
+}
+
+// displayBox returns the size in device pixels images must fit for
+// -display-size, or 0, 0 if it isn't set.
+func displayBox() (int, int) {
+	if displayWidth == 0 {
+		return 0, 0
+	}
+	return int(math.Ceil(float64(displayWidth) * displayDPR)), int(math.Ceil(float64(displayHeight) * displayDPR))
+}
+
+// preset bundles an upload limit with a dimension cap.
+type preset struct {
+	limit        int
+	maxDimension int
+}
+
+// presets match the limits messaging apps apply to photos sent as photos
+// (not as files). Staying inside them means the app delivers the image as
+// is instead of recompressing it a second time.
+var presets = map[string]preset{
+	"whatsapp": {limit: 1000 * 1000, maxDimension: 1600},
+	"telegram": {limit: 5000 * 1000, maxDimension: 2560},
+	"signal":   {limit: 3000 * 1000, maxDimension: 2048},
+}
+
+// applyPreset sets uploadLimit, and so targetSize, and maxDimension from
+// the named preset.
+func applyPreset(name string) error {
+	p, ok := presets[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(presetNames(), ", "))
+	}
+	uploadLimit = p.limit
+	updateTarget()
+	maxDimension = p.maxDimension
+	return nil
+}
+
+func presetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// exceedsMaxDimension reports whether the image at path is larger than
+// maxDimension, maxWidth, maxHeight or -display-size allow, reading only
+// its header.
+func exceedsMaxDimension(path string) bool {
+	if maxDimension <= 0 && maxWidth <= 0 && maxHeight <= 0 && displayWidth == 0 && panoramaMaxDimension <= 0 {
+		return false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	cfg, _, err := decodeConfig(file)
+	if err != nil {
+		return false
+	}
+	width, height := cappedSize(cfg.Width, cfg.Height)
+	return width != cfg.Width || height != cfg.Height
+}
+
+// cappedSize scales width x height down, keeping its aspect ratio, until it
+// is within maxDimension, maxWidth, maxHeight and the -display-size box.
+// Panoramas are capped by panoramaScale instead, then maxWidth and
+// maxHeight.
+func cappedSize(width, height int) (int, int) {
+	scale := 1.0
+	if isPanorama(width, height) {
+		scale = panoramaScale(width, height)
+	} else {
+		if maxDimension > 0 && max(width, height) > maxDimension {
+			scale = float64(maxDimension) / float64(max(width, height))
+		}
+		if boxWidth, boxHeight := displayBox(); boxWidth > 0 {
+			scale = min(scale, float64(boxWidth)/float64(width), float64(boxHeight)/float64(height))
+		}
+	}
+	if maxWidth > 0 && width > maxWidth {
+		scale = min(scale, float64(maxWidth)/float64(width))
+	}
+	if maxHeight > 0 && height > maxHeight {
+		scale = min(scale, float64(maxHeight)/float64(height))
+	}
+	if scale == 1 {
+		return width, height
+	}
+	return max(int(float64(width)*scale), 1), max(int(float64(height)*scale), 1)
+}
+
+// capDimensions scales img down to maxDimension, maxWidth, maxHeight and the
+// -display-size box if they are set, as cappedSize does.
+func capDimensions(img image.Image) image.Image {
+	bounds := img.Bounds()
+	if maxWidth <= 0 && maxHeight <= 0 && displayWidth == 0 && !isPanorama(bounds.Dx(), bounds.Dy()) {
+		if maxDimension <= 0 {
+			return img
+		}
+		return fitLongEdge(img, maxDimension)
+	}
+	width, height := cappedSize(bounds.Dx(), bounds.Dy())
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return img
+	}
+	return resizeImage(img, width, height)
+}
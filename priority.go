@@ -0,0 +1,18 @@
+package main
+
+import "fmt"
+
+const lowPriorityUsage = "run at low CPU and disk priority so big batches don't slow down the rest of the machine"
+
+// applyLowPriority lowers the process's priority if low is set. Failing to
+// is only a warning: the images still get compressed, just not as politely.
+func applyLowPriority(low bool) {
+	if !low {
+		return
+	}
+	if err := lowerPriority(); err != nil {
+		fmt.Printf("Warning: couldn't lower priority: %v\n", err)
+		return
+	}
+	fmt.Println("Priority: low")
+}
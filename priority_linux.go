@@ -0,0 +1,40 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	lowNice = 10
+	// Best-effort class, lowest level: disk access still gets through when
+	// the machine is busy, unlike the idle class
+	ioprioWhoProcess = 1
+	lowIOPriority    = 2<<13 | 7
+)
+
+// lowerPriority sets the nice value and I/O priority of every thread of the
+// process. Linux keeps both per thread; threads started afterwards inherit
+// them from the thread that starts them.
+func lowerPriority() error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, lowNice); err != nil {
+			return err
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), lowIOPriority); errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
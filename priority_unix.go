@@ -0,0 +1,13 @@
+//go:build unix && !linux
+
+package main
+
+import "syscall"
+
+const lowNice = 10
+
+// lowerPriority raises the process's nice value. There's no portable way
+// to lower its I/O priority, so disk access is left as it is.
+func lowerPriority() error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, lowNice)
+}
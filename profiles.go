@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// profileSizes lists the long-edge pixel sizes to emit for every image. When
+// empty, each image produces a single output at its original dimensions.
+var profileSizes []int
+
+// parseSizes parses a comma-separated list of positive pixel sizes.
+func parseSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		size, err := strconv.Atoi(field)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid size %q", field)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// profilePath returns the output path for outName at the given profile size,
+// e.g. photo.jpg at 1024 becomes photo_1024.jpg.
+func profilePath(dstDir, outName string, size int) string {
+	ext := filepath.Ext(outName)
+	return filepath.Join(dstDir, fmt.Sprintf("%s_%d%s", strings.TrimSuffix(outName, ext), size, ext))
+}
+
+// decodeProfileSource decodes srcPath for compressProfiles and
+// compressFavicon, converted for the web and redacted, and returns it with
+// its format.
+func decodeProfileSource(log *fileLog, srcPath string) (image.Image, string, error) {
+	if ext := strings.ToLower(filepath.Ext(srcPath)); ext == ".heic" || ext == ".heif" {
+		img, err := decodeHEICFile(log, srcPath)
+		if err != nil {
+			return nil, "", err
+		}
+		recordSharpness(srcPath, img)
+		img, err = redact(log, srcPath, prepareForWeb(log, srcPath, img))
+		return img, "heic", err
+	}
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	endDecode := startSpan("decode")
+	img, format, err := decodeLimited(file)
+	endDecode(err)
+	if err != nil {
+		return nil, "", err
+	}
+	recordSharpness(srcPath, img)
+	img, err = redact(log, srcPath, prepareForWeb(log, srcPath, img))
+	return img, format, err
+}
+
+// compressProfiles decodes srcPath once and writes one output per profile
+// size into dstDir, named after outName. Sizes are handled largest first so every resize starts
+// from the previous intermediate instead of the full-resolution frame.
+func compressProfiles(log *fileLog, srcPath, dstDir, outName string, sizes []int) error {
+	srcInfo, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	img, format, err := decodeProfileSource(log, srcPath)
+	if err != nil {
+		return err
+	}
+
+	sizes = append([]int(nil), sizes...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+
+	current := img
+	for _, size := range sizes {
+		current = fitLongEdge(current, size)
+		dstPath := profilePath(dstDir, outName, size)
+		written, err := encodeDecoded(log, format, srcPath, dstPath, current)
+		if err != nil {
+			return fmt.Errorf("%dpx: %w", size, err)
+		}
+		info, err := os.Stat(written)
+		if err != nil {
+			return fmt.Errorf("%dpx: %w", size, err)
+		}
+		// A profile at least as large as the source only re-encodes it;
+		// the source itself is the better output if it qualifies
+		if current == img && info.Size() >= srcInfo.Size() && originalFits(srcPath, srcInfo) {
+			if written != dstPath {
+				os.Remove(written)
+			}
+			if _, err := copyOriginal(srcPath, dstPath); err != nil {
+				return fmt.Errorf("%dpx: %w", size, err)
+			}
+			if _, err := nameOutput(dstPath); err != nil {
+				return fmt.Errorf("%dpx: %w", size, err)
+			}
+			log.Printf("%dpx (original) ", size)
+			continue
+		}
+		// Profiles don't get processFile's second pass, so an oversized
+		// output is a failure right away
+		if info.Size() > int64(targetSize) {
+			os.Remove(written)
+			return fmt.Errorf("%dpx: %w", size, errCannotMeetTarget)
+		}
+		if _, err := nameOutput(written); err != nil {
+			return fmt.Errorf("%dpx: %w", size, err)
+		}
+		log.Printf("%dpx ", size)
+	}
+	return nil
+}
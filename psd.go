@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// Photoshop documents, PSD and the large-document PSB, are read for their
+// composite: the flattened image Photoshop stores after the layers unless
+// "Maximize Compatibility" was turned off. Files saved without one, and
+// -layers and -hidden-layers, flatten the layers instead.
+func init() {
+	image.RegisterFormat("psd", "8BPS", decodePSD, decodePSDConfig)
+}
+
+// isEditorDocument reports whether the file at path is a Photoshop, GIMP or
+// OpenRaster document. Only editors open those, so they are always converted.
+func isEditorDocument(path string) bool {
+	switch sniffImageExt(path) {
+	case ".psd", ".psb", ".xcf", ".ora":
+		return true
+	}
+	return false
+}
+
+// Photoshop color modes.
+const (
+	psdBitmap    = 0
+	psdGrayscale = 1
+	psdIndexed   = 2
+	psdRGB       = 3
+	psdCMYK      = 4
+	psdDuotone   = 8
+	psdLab       = 9
+)
+
+// psdVersionInfo is the image resource saying whether the file has a real
+// composite.
+const psdVersionInfo = 1057
+
+var errPSDNoComposite = errors.New("psd: saved without a composite or layers")
+
+// psdHeader is the fixed start of a PSD file.
+type psdHeader struct {
+	large         bool
+	channels      int
+	width, height int
+	depth         int
+	mode          int
+}
+
+// colorChannels is how many of the composite's channels hold color.
+func (h psdHeader) colorChannels() (int, error) {
+	switch h.mode {
+	case psdBitmap, psdGrayscale, psdIndexed, psdDuotone:
+		return 1, nil
+	case psdRGB, psdLab:
+		return 3, nil
+	case psdCMYK:
+		return 4, nil
+	}
+	return 0, fmt.Errorf("psd: color mode %d isn't supported", h.mode)
+}
+
+// psdReader reads big-endian values, keeping the first error.
+type psdReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+// psdChunk is the largest read allocated in one go. Lengths come from the
+// file, so longer reads grow only as far as the data really goes.
+const psdChunk = 64 << 10
+
+// read reads n bytes. After an error, reads of fixed-size fields return
+// zeros and longer ones nothing.
+func (p *psdReader) read(n int) []byte {
+	if n < 0 && p.err == nil {
+		p.err = fmt.Errorf("invalid length %d", n)
+	}
+	if p.err != nil {
+		if n > 8 {
+			return nil
+		}
+		return make([]byte, max(n, 0))
+	}
+	if n <= psdChunk {
+		b := make([]byte, n)
+		_, p.err = io.ReadFull(p.r, b)
+		return b
+	}
+	var b bytes.Buffer
+	read, err := io.CopyN(&b, p.r, int64(n))
+	if err == io.EOF && read > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	p.err = err
+	return b.Bytes()
+}
+
+func (p *psdReader) u16() int { return int(binary.BigEndian.Uint16(p.read(2))) }
+func (p *psdReader) u32() int { return int(binary.BigEndian.Uint32(p.read(4))) }
+
+// length reads a section length, 8 bytes long in PSB files where large is
+// set.
+func (p *psdReader) length(large bool) int64 {
+	if large {
+		return int64(binary.BigEndian.Uint64(p.read(8)))
+	}
+	return int64(binary.BigEndian.Uint32(p.read(4)))
+}
+
+func (p *psdReader) skip(n int64) {
+	if p.err == nil {
+		_, p.err = io.CopyN(io.Discard, p.r, n)
+	}
+}
+
+func readPSDHeader(p *psdReader) (psdHeader, error) {
+	b := p.read(26)
+	if p.err != nil {
+		return psdHeader{}, p.err
+	}
+	if string(b[:4]) != "8BPS" {
+		return psdHeader{}, errors.New("psd: invalid signature")
+	}
+	version := binary.BigEndian.Uint16(b[4:])
+	if version != 1 && version != 2 {
+		return psdHeader{}, fmt.Errorf("psd: unknown version %d", version)
+	}
+	h := psdHeader{
+		large:    version == 2,
+		channels: int(binary.BigEndian.Uint16(b[12:])),
+		height:   int(binary.BigEndian.Uint32(b[14:])),
+		width:    int(binary.BigEndian.Uint32(b[18:])),
+		depth:    int(binary.BigEndian.Uint16(b[22:])),
+		mode:     int(binary.BigEndian.Uint16(b[24:])),
+	}
+	switch h.depth {
+	case 1, 8, 16, 32:
+	default:
+		return psdHeader{}, fmt.Errorf("psd: %d bits per channel isn't supported", h.depth)
+	}
+	if h.depth == 1 && h.mode != psdBitmap {
+		return psdHeader{}, errors.New("psd: 1-bit image that isn't a bitmap")
+	}
+	return h, nil
+}
+
+func decodePSDConfig(r io.Reader) (image.Config, error) {
+	h, err := readPSDHeader(&psdReader{r: bufio.NewReader(r)})
+	if err != nil {
+		return image.Config{}, err
+	}
+	cfg := image.Config{Width: h.width, Height: h.height, ColorModel: color.NRGBAModel}
+	gray := h.mode == psdBitmap || h.mode == psdGrayscale || h.mode == psdDuotone
+	switch {
+	case gray && h.depth > 8:
+		cfg.ColorModel = color.Gray16Model
+	case gray:
+		cfg.ColorModel = color.GrayModel
+	case h.depth > 8:
+		cfg.ColorModel = color.NRGBA64Model
+	}
+	return cfg, nil
+}
+
+func decodePSD(r io.Reader) (image.Image, error) {
+	p := &psdReader{r: bufio.NewReader(r)}
+	h, err := readPSDHeader(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDecodeSize(image.Config{Width: h.width, Height: h.height}); err != nil {
+		return nil, err
+	}
+	colorChannels, err := h.colorChannels()
+	if err != nil {
+		return nil, err
+	}
+	if h.channels < colorChannels {
+		return nil, fmt.Errorf("psd: %d channels for color mode %d", h.channels, h.mode)
+	}
+
+	// Color mode data: the palette of indexed images
+	var palette []byte
+	if n := int64(p.u32()); h.mode == psdIndexed && n >= 768 {
+		palette = p.read(768)
+		p.skip(n - 768)
+	} else {
+		p.skip(n)
+	}
+
+	// Image resources, of which only the version info matters
+	hasComposite := true
+	resources := p.read(p.u32())
+	for len(resources) >= 12 && string(resources[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(resources[4:])
+		nameLength := (int(resources[6]) + 2) &^ 1
+		if len(resources) < 6+nameLength+4 {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(resources[6+nameLength:]))
+		data := resources[6+nameLength+4:]
+		if size > len(data) {
+			break
+		}
+		if id == psdVersionInfo && size >= 5 {
+			hasComposite = data[4] != 0
+		}
+		resources = data[min((size+1)&^1, len(data)):]
+	}
+	if p.err != nil {
+		return nil, fmt.Errorf("psd: %w", p.err)
+	}
+
+	// Layer and mask information: a negative layer count means the first
+	// extra channel is the composite's transparency
+	alpha := false
+	var layers []*docLayer
+	if n := p.length(h.large); n > 0 && (flattensLayers() || !hasComposite) {
+		section := p.read(int(n))
+		if p.err != nil {
+			return nil, fmt.Errorf("psd: %w", p.err)
+		}
+		if layers, alpha, err = readPSDLayers(section, h, palette); err != nil {
+			return nil, err
+		}
+	} else if n > 0 {
+		layersLength := p.length(h.large)
+		read := int64(4)
+		if h.large {
+			read = 8
+		}
+		if layersLength >= 2 {
+			alpha = int16(p.u16()) < 0
+			read += 2
+		}
+		p.skip(n - read)
+	}
+	if !hasComposite && len(layers) == 0 {
+		return nil, errPSDNoComposite
+	}
+	if !hasComposite || flattensLayers() && (len(layers) > 0 || len(layerNames) > 0) {
+		canvas, err := flattenLayers(h.width, h.height, layers)
+		if err != nil {
+			return nil, fmt.Errorf("psd: %w", err)
+		}
+		if h.depth <= 8 {
+			return toNRGBA(canvas), nil
+		}
+		return canvas, nil
+	}
+
+	channels := colorChannels
+	if alpha && h.channels > colorChannels {
+		channels++
+	}
+	planes, err := readPSDChannels(p, h, channels)
+	if err != nil {
+		return nil, err
+	}
+	return psdImage(h, planes, palette, alpha && channels > colorChannels, true), nil
+}
+
+// readPSDChannels reads the first n channels of the composite, each a plane
+// of rows of h.depth bits per sample.
+func readPSDChannels(p *psdReader, h psdHeader, n int) ([][]byte, error) {
+	rowBytes := (h.width*h.depth + 7) / 8
+	compression := p.u16()
+	if p.err != nil {
+		return nil, fmt.Errorf("psd: %w", p.err)
+	}
+	planes := make([][]byte, n)
+	switch compression {
+	case 0:
+		for i := range planes {
+			planes[i] = p.read(rowBytes * h.height)
+		}
+	case 1:
+		// PackBits rows, after the compressed length of every row of every
+		// channel
+		counts := make([]int, h.channels*h.height)
+		for i := range counts {
+			if h.large {
+				counts[i] = p.u32()
+			} else {
+				counts[i] = p.u16()
+			}
+		}
+		for i := range planes {
+			plane := make([]byte, 0, rowBytes*h.height)
+			for y := 0; y < h.height && p.err == nil; y++ {
+				row, err := unpackBits(p.read(counts[i*h.height+y]), rowBytes)
+				if err != nil {
+					return nil, fmt.Errorf("psd: %w", err)
+				}
+				plane = append(plane, row...)
+			}
+			planes[i] = plane
+		}
+	case 2, 3:
+		// Deflate, of every channel in one stream; 3 stores differences
+		// between neighboring samples
+		z, err := zlib.NewReader(p.r)
+		if err != nil {
+			return nil, fmt.Errorf("psd: %w", err)
+		}
+		for i := range planes {
+			planes[i] = make([]byte, rowBytes*h.height)
+			if _, err := io.ReadFull(z, planes[i]); err != nil {
+				return nil, fmt.Errorf("psd: %w", err)
+			}
+			if compression == 3 {
+				undoPSDPrediction(planes[i], h.width, h.height, h.depth)
+			}
+		}
+		// Reading to the end of the stream checks it wasn't cut short
+		if _, err := io.Copy(io.Discard, z); err != nil {
+			return nil, fmt.Errorf("psd: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("psd: unknown compression %d", compression)
+	}
+	if p.err != nil {
+		return nil, fmt.Errorf("psd: %w", p.err)
+	}
+	return planes, nil
+}
+
+// unpackBits decodes a PackBits row of n bytes.
+func unpackBits(src []byte, n int) ([]byte, error) {
+	dst := make([]byte, 0, n)
+	for len(src) > 0 && len(dst) < n {
+		count := int(int8(src[0]))
+		src = src[1:]
+		switch {
+		case count >= 0:
+			if len(src) < count+1 {
+				return nil, errors.New("truncated PackBits literal")
+			}
+			dst = append(dst, src[:count+1]...)
+			src = src[count+1:]
+		case count > -128:
+			if len(src) < 1 {
+				return nil, errors.New("truncated PackBits run")
+			}
+			dst = append(dst, bytes.Repeat(src[:1], 1-count)...)
+			src = src[1:]
+		}
+	}
+	if len(dst) < n {
+		return nil, errors.New("short PackBits row")
+	}
+	return dst[:n], nil
+}
+
+// undoPSDPrediction turns the differences ZIP-with-prediction stores back
+// into samples: per byte at 8 bits, per big-endian value at 16, and at 32
+// per byte of rows whose values' bytes are stored in planes.
+func undoPSDPrediction(plane []byte, width, height, depth int) {
+	switch depth {
+	case 8:
+		for y := 0; y < height; y++ {
+			row := plane[y*width : (y+1)*width]
+			for x := 1; x < width; x++ {
+				row[x] += row[x-1]
+			}
+		}
+	case 16:
+		for y := 0; y < height; y++ {
+			row := plane[y*width*2 : (y+1)*width*2]
+			for x := 2; x < len(row); x += 2 {
+				v := binary.BigEndian.Uint16(row[x:]) + binary.BigEndian.Uint16(row[x-2:])
+				binary.BigEndian.PutUint16(row[x:], v)
+			}
+		}
+	case 32:
+		shuffled := make([]byte, width*4)
+		for y := 0; y < height; y++ {
+			row := plane[y*width*4 : (y+1)*width*4]
+			for x := 1; x < len(row); x++ {
+				row[x] += row[x-1]
+			}
+			for x := 0; x < width; x++ {
+				for b := 0; b < 4; b++ {
+					shuffled[x*4+b] = row[b*width+x]
+				}
+			}
+			copy(row, shuffled)
+		}
+	}
+}
+
+// psdImage assembles the planes of the composite, or of a layer h has the
+// size of, into an image, 16 bits per sample if the document has more than
+// 8. With alpha the last plane is the transparency, and with matted the
+// colors have been blended with white, as the composite's are.
+func psdImage(h psdHeader, planes [][]byte, palette []byte, alpha, matted bool) image.Image {
+	// sample returns sample i of plane c scaled to 0-1
+	sample := func(c, i int) float64 {
+		plane := planes[c]
+		switch h.depth {
+		case 1:
+			// Bitmap ones are black
+			return float64(1 - plane[i/h.width*((h.width+7)/8)+i%h.width/8]>>(7-i%h.width%8)&1)
+		case 8:
+			return float64(plane[i]) / 0xff
+		case 16:
+			return float64(binary.BigEndian.Uint16(plane[2*i:])) / 0xffff
+		}
+		// 32-bit documents are linear light
+		v := math.Float32frombits(binary.BigEndian.Uint32(plane[4*i:]))
+		return linearToSRGB(min(max(float64(v), 0), 1))
+	}
+
+	rect := image.Rect(0, 0, h.width, h.height)
+	deep := h.depth > 8
+	if colorChannels, _ := h.colorChannels(); colorChannels == 1 && h.mode != psdIndexed && !alpha {
+		if deep {
+			img := image.NewGray16(rect)
+			for i := 0; i < h.width*h.height; i++ {
+				binary.BigEndian.PutUint16(img.Pix[2*i:], uint16(math.Round(sample(0, i)*0xffff)))
+			}
+			return img
+		}
+		img := image.NewGray(rect)
+		for i := range img.Pix {
+			img.Pix[i] = uint8(math.Round(sample(0, i) * 0xff))
+		}
+		return img
+	}
+
+	img := image.NewNRGBA64(rect)
+	for i := 0; i < h.width*h.height; i++ {
+		var r, g, b float64
+		a := 1.0
+		switch h.mode {
+		case psdIndexed:
+			index := int(planes[0][i])
+			r, g, b = float64(palette[index])/0xff, float64(palette[256+index])/0xff, float64(palette[512+index])/0xff
+		case psdRGB:
+			r, g, b = sample(0, i), sample(1, i), sample(2, i)
+		case psdCMYK:
+			// Stored inverted, so 1 is no ink
+			k := sample(3, i)
+			r, g, b = sample(0, i)*k, sample(1, i)*k, sample(2, i)*k
+		case psdLab:
+			r, g, b = labToSRGB(sample(0, i)*100, sample(1, i)*255-128, sample(2, i)*255-128)
+		default:
+			r = sample(0, i)
+			g, b = r, r
+		}
+		if alpha {
+			// The composite is matted against white; take the matte out
+			if a = sample(len(planes)-1, i); a > 0 && matted {
+				r, g, b = (r-1+a)/a, (g-1+a)/a, (b-1+a)/a
+			}
+		}
+		img.SetNRGBA64(i%h.width, i/h.width, color.NRGBA64{
+			R: unitUint16(r), G: unitUint16(g), B: unitUint16(b), A: unitUint16(a),
+		})
+	}
+	if deep {
+		return img
+	}
+	return toNRGBA(img)
+}
+
+// unitUint16 scales v from 0-1 to 16 bits, clamping it.
+func unitUint16(v float64) uint16 {
+	return uint16(math.Round(min(max(v, 0), 1) * 0xffff))
+}
+
+// labToSRGB converts CIE L*a*b*, relative to D50 as Photoshop uses it, to
+// sRGB from 0 to 1.
+func labToSRGB(l, a, b float64) (float64, float64, float64) {
+	fy := (l + 16) / 116
+	fx, fz := fy+a/500, fy-b/200
+	inverse := func(f float64) float64 {
+		if f > 6.0/29 {
+			return f * f * f
+		}
+		return 3 * (6.0 / 29) * (6.0 / 29) * (f - 4.0/29)
+	}
+	// D50 white
+	xyz := [3]float64{0.96422 * inverse(fx), inverse(fy), 0.82521 * inverse(fz)}
+	var rgb [3]float64
+	for i := range rgb {
+		linear := srgbFromXYZ[i][0]*xyz[0] + srgbFromXYZ[i][1]*xyz[1] + srgbFromXYZ[i][2]*xyz[2]
+		rgb[i] = linearToSRGB(min(max(linear, 0), 1))
+	}
+	return rgb[0], rgb[1], rgb[2]
+}
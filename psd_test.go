@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readDocSample(t *testing.T, dir, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// pickLayers sets hiddenLayers and layerNames until the test ends.
+func pickLayers(t *testing.T, hidden bool, names ...string) {
+	hiddenBefore, namesBefore := hiddenLayers, layerNames
+	hiddenLayers, layerNames = hidden, names
+	t.Cleanup(func() { hiddenLayers, layerNames = hiddenBefore, namesBefore })
+}
+
+// nearColor reports whether every channel of a and b, in 8-bit NRGBA,
+// differs by at most 1.
+func nearColor(a, b color.Color) bool {
+	x, y := color.NRGBAModel.Convert(a).(color.NRGBA), color.NRGBAModel.Convert(b).(color.NRGBA)
+	near := func(p, q uint8) bool { d := int(p) - int(q); return max(d, -d) <= 1 }
+	return near(x.R, y.R) && near(x.G, y.G) && near(x.B, y.B) && near(x.A, y.A)
+}
+
+// TestDecodePSD checks every pixel of the composites against what they
+// were written with.
+func TestDecodePSD(t *testing.T) {
+	tests := []struct {
+		file  string
+		model color.Model
+		want  func(x, y int) color.Color
+	}{
+		{"rgb-rle.psd", color.NRGBAModel, func(x, y int) color.Color { return color.NRGBA{uint8(4 * x), uint8(5 * y), 128, 255} }},
+		// Deflate with prediction
+		{"rgb-zip.psd", color.NRGBAModel, func(x, y int) color.Color { return color.NRGBA{uint8(4 * x), uint8(5 * y), 128, 255} }},
+		{"rgb16.psb", color.NRGBA64Model, func(x, y int) color.Color { return color.NRGBA64{uint16(1000 * x), 0, 0xffff, 0xffff} }},
+		// Left half transparent, right half red at 50% matted with white
+		{"rgba.psd", color.NRGBAModel, func(x, y int) color.Color {
+			if x < 32 {
+				return color.NRGBA{}
+			}
+			return color.NRGBA{255, 0, 0, 128}
+		}},
+		// Full cyan ink, stored inverted
+		{"cmyk.psd", color.NRGBAModel, func(x, y int) color.Color { return color.NRGBA{0, 255, 255, 255} }},
+		{"gray.psd", color.GrayModel, func(x, y int) color.Color { return color.Gray{uint8(4 * x)} }},
+		{"indexed.psd", color.NRGBAModel, func(x, y int) color.Color { return color.NRGBA{uint8(4 * x), uint8(255 - 4*x), 0, 255} }},
+		// L* 50, a* and b* 0, a middle gray
+		{"lab.psd", color.NRGBAModel, func(x, y int) color.Color { return color.NRGBA{119, 119, 119, 255} }},
+		// The upper half is 4 black pixels then 4 white, the lower white
+		{"bitmap.psd", color.GrayModel, func(x, y int) color.Color {
+			if y < 24 && x%8 < 4 {
+				return color.Gray{0}
+			}
+			return color.Gray{255}
+		}},
+		// The composite of the layered document is yellow
+		{"layers.psd", color.NRGBAModel, func(x, y int) color.Color { return color.NRGBA{255, 255, 0, 255} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data := readDocSample(t, "psd", tt.file)
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil || format != "psd" {
+				t.Fatalf("config: %v, format %q", err, format)
+			}
+			img, err := decodePSD(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := img.Bounds()
+			if cfg.Width != b.Dx() || cfg.Height != b.Dy() || img.ColorModel() != tt.model || cfg.ColorModel != tt.model {
+				t.Fatalf("decoded %v in %v, config %dx%d in %v", b, img.ColorModel(), cfg.Width, cfg.Height, cfg.ColorModel)
+			}
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if want := tt.want(x, y); !nearColor(img.At(x, y), want) {
+						t.Fatalf("pixel %d,%d is %v, want %v", x, y, img.At(x, y), want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// docLayerTests flatten the layers of layers.psd and the XCF samples, which
+// hold the same document, top first: a hidden red layer over the whole
+// canvas, "top", green at 50% opacity at 10,10-40,30, the group "grp" with
+// "child", blue at 70,50-90,70, and "bg", gray masked out left of x=50.
+var docLayerTests = []struct {
+	name   string
+	hidden bool
+	names  []string
+	pixels map[image.Point]color.NRGBA
+}{
+	{
+		name:   "every layer",
+		hidden: true,
+		pixels: map[image.Point]color.NRGBA{
+			{5, 5}: {255, 0, 0, 255}, {20, 20}: {255, 0, 0, 255}, {80, 60}: {255, 0, 0, 255},
+		},
+	},
+	{
+		name:  "picked by name",
+		names: []string{"bg", "TOP", "grp"},
+		pixels: map[image.Point]color.NRGBA{
+			{5, 5}: {}, {60, 5}: {128, 128, 128, 255}, {20, 20}: {0, 255, 0, 128},
+			{80, 60}: {0, 0, 255, 255}, {45, 60}: {},
+		},
+	},
+	{
+		name:  "a group",
+		names: []string{"grp"},
+		pixels: map[image.Point]color.NRGBA{
+			{60, 5}: {}, {80, 60}: {0, 0, 255, 255}, {69, 50}: {}, {89, 69}: {0, 0, 255, 255},
+		},
+	},
+}
+
+func TestDecodePSDLayers(t *testing.T) {
+	data := readDocSample(t, "psd", "layers.psd")
+	for _, tt := range docLayerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			pickLayers(t, tt.hidden, tt.names...)
+			img, err := decodePSD(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for p, want := range tt.pixels {
+				if got := img.At(p.X, p.Y); !nearColor(got, want) {
+					t.Errorf("pixel %v is %v, want %v", p, got, want)
+				}
+			}
+		})
+	}
+	t.Run("unknown name", func(t *testing.T) {
+		pickLayers(t, false, "nowhere")
+		if _, err := decodePSD(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "no layer named nowhere") {
+			t.Errorf("got %v", err)
+		}
+	})
+}
+
+// psdLayerInfo returns the offset of the layer count in a PSD document
+// with a layer info section.
+func psdLayerInfo(data []byte) int {
+	pos := 26
+	pos += 4 + int(binary.BigEndian.Uint32(data[pos:])) // color mode data
+	pos += 4 + int(binary.BigEndian.Uint32(data[pos:])) // image resources
+	return pos + 8                                      // section and layer info lengths
+}
+
+func TestDecodePSDCorrupt(t *testing.T) {
+	rgb := readDocSample(t, "psd", "rgb-rle.psd")
+	layers := readDocSample(t, "psd", "layers.psd")
+	info := psdLayerInfo(layers)
+	// The RLE channels of "child", 20x20: compression, row lengths and the
+	// first row
+	child := bytes.Index(layers, append(append([]byte{0, 1}, bytes.Repeat([]byte{0, 2}, 20)...), 256-19, 0xff))
+	if child < 0 {
+		t.Fatal("no RLE channel in layers.psd")
+	}
+	tests := []struct {
+		name   string
+		data   []byte
+		change func(d []byte)
+		err    string
+	}{
+		{"signature", rgb, func(d []byte) { d[0] = 'x' }, "invalid signature"},
+		{"version", rgb, func(d []byte) { d[5] = 3 }, "unknown version 3"},
+		{"depth", rgb, func(d []byte) { d[23] = 7 }, "7 bits per channel"},
+		{"1-bit RGB", rgb, func(d []byte) { d[23] = 1 }, "1-bit image that isn't a bitmap"},
+		{"color mode", rgb, func(d []byte) { d[25] = 5 }, "color mode 5"},
+		{"too few channels", rgb, func(d []byte) { d[13] = 2 }, "2 channels for color mode 3"},
+		{"too large", rgb, func(d []byte) { binary.BigEndian.PutUint32(d[18:], 1<<30) }, "too large"},
+		{"color mode data past the end", rgb, func(d []byte) { binary.BigEndian.PutUint32(d[26:], 0xfffffff0) }, "psd:"},
+		{"compression", rgb, func(d []byte) { d[psdLayerInfo(rgb)-3] = 9 }, "unknown compression 9"},
+		{"PackBits row", rgb, func(d []byte) { binary.BigEndian.PutUint16(d[psdLayerInfo(rgb)-2:], 1) }, "PackBits"},
+
+		// The layer table, read when layers are flattened
+		{"layer count", layers, func(d []byte) { binary.BigEndian.PutUint16(d[info:], 0x7fff) }, "psd: layers:"},
+		{"channel length", layers, func(d []byte) { binary.BigEndian.PutUint32(d[info+2+16+2+2:], 0x7ffffff0) }, "psd: layers:"},
+		{"layer compression", layers, func(d []byte) { d[child+1] = 7 }, `layer "child": unknown compression 7`},
+		{"layer row length", layers, func(d []byte) { binary.BigEndian.PutUint16(d[child+2:], 0xffff) }, `layer "child": short channel`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pickLayers(t, true)
+			data := bytes.Clone(tt.data)
+			tt.change(data)
+			if _, err := decodePSD(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// TestDecodeDocTruncated cuts every PSD and XCF sample short, which must
+// fail to decode, with layers flattened or not, and never panic.
+func TestDecodeDocTruncated(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "psd", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	xcf, err := filepath.Glob(filepath.Join("testdata", "xcf", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range append(paths, xcf...) {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decode := decodePSD
+			if filepath.Ext(path) == ".xcf" {
+				decode = decodeXCF
+			}
+			step := max(len(data)/2000, 1)
+			if testing.Short() {
+				step *= 17
+			}
+			for _, hidden := range []bool{false, true} {
+				pickLayers(t, hidden)
+				end := len(data)
+				if hidden && filepath.Base(path) == "layers.psd" {
+					// Flattened from its layers, the composite after them
+					// isn't read
+					end = psdLayerInfo(data) - 4 + int(binary.BigEndian.Uint32(data[psdLayerInfo(data)-8:]))
+				}
+				for n := 0; n < end; n += step {
+					if _, err := decode(bytes.NewReader(data[:n])); err == nil {
+						t.Fatalf("cut to %d of %d bytes, it still decodes", n, len(data))
+					}
+				}
+			}
+		})
+	}
+}
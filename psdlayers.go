@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"unicode/utf16"
+)
+
+// Photoshop channel IDs beside the color channels, which count from 0.
+const (
+	psdTransparency = -1
+	psdUserMask     = -2
+)
+
+// Photoshop section divider types, which mark the layers that open and
+// close a group.
+const (
+	psdOpenFolder   = 1
+	psdClosedFolder = 2
+	psdGroupEnd     = 3
+)
+
+// psdLongBlocks are the tagged blocks whose length is 8 bytes long in PSB
+// files.
+var psdLongBlocks = map[string]bool{
+	"LMsk": true, "Lr16": true, "Lr32": true, "Layr": true, "Mt16": true, "Mt32": true,
+	"Mtrn": true, "Alph": true, "FMsk": true, "lnk2": true, "FEid": true, "FXid": true, "PxSD": true,
+}
+
+// psdLayerRecord is a layer as the layer info stores it.
+type psdLayerRecord struct {
+	rect     image.Rectangle
+	channels map[int][]byte // compressed image data by channel ID
+	opacity  uint8
+	flags    uint8
+	name     string
+	section  int
+	// The user mask, unless it is disabled
+	maskRect  image.Rectangle
+	maskColor uint8
+}
+
+// readPSDLayers reads the layers in section, the layer and mask
+// information of a document with header h, as a tree for flattenLayers. It
+// also reports whether the composite has transparency.
+func readPSDLayers(section []byte, h psdHeader, palette []byte) ([]*docLayer, bool, error) {
+	p := &psdReader{r: bufio.NewReader(bytes.NewReader(section))}
+	info := p.read(int(p.length(h.large)))
+	if p.err == nil && len(info) == 0 {
+		// Documents deeper than 8 bits keep their layers in a tagged block
+		// after the global layer mask
+		p.skip(int64(p.u32()))
+		readPSDBlocks(p, h.large, func(key string, data []byte) {
+			if key == "Lr16" || key == "Lr32" || key == "Layr" {
+				info = data
+			}
+		})
+	}
+	if p.err != nil && p.err != io.EOF {
+		return nil, false, fmt.Errorf("psd: layers: %w", p.err)
+	}
+	if len(info) < 2 {
+		return nil, false, nil
+	}
+
+	p = &psdReader{r: bufio.NewReader(bytes.NewReader(info))}
+	count := int(int16(p.u16()))
+	alpha := count < 0
+	count = max(count, -count)
+	records := make([]*psdLayerRecord, count)
+	lengths := make([][][2]int64, count)
+	for i := range records {
+		records[i], lengths[i] = readPSDLayerRecord(p, h.large)
+	}
+	// The channels' image data follows the records in the same order
+	for i, record := range records {
+		for _, channel := range lengths[i] {
+			record.channels[int(channel[0])] = p.read(int(channel[1]))
+		}
+	}
+	if p.err != nil {
+		return nil, false, fmt.Errorf("psd: layers: %w", p.err)
+	}
+
+	// Records are listed bottom first, a group's after its members, between
+	// a record closing the group below them and the group's own above
+	var top []*docLayer
+	var groups []*docLayer
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		if record.section == psdGroupEnd {
+			if len(groups) > 0 {
+				groups = groups[:len(groups)-1]
+			}
+			continue
+		}
+		layer := &docLayer{
+			name:    record.name,
+			visible: record.flags&2 == 0,
+			opacity: float64(record.opacity) / 0xff,
+			group:   record.section == psdOpenFolder || record.section == psdClosedFolder,
+		}
+		layer.load = func() (layerPixels, error) {
+			return psdLayerPixels(record, h, palette, layer.group)
+		}
+		if len(groups) > 0 {
+			parent := groups[len(groups)-1]
+			parent.children = append(parent.children, layer)
+		} else {
+			top = append(top, layer)
+		}
+		if layer.group {
+			groups = append(groups, layer)
+		}
+	}
+	return top, alpha, nil
+}
+
+// readPSDLayerRecord reads one layer record and the ID and data length of
+// each of its channels.
+func readPSDLayerRecord(p *psdReader, large bool) (*psdLayerRecord, [][2]int64) {
+	record := &psdLayerRecord{channels: make(map[int][]byte)}
+	top, left := int(int32(p.u32())), int(int32(p.u32()))
+	bottom, right := int(int32(p.u32())), int(int32(p.u32()))
+	record.rect = image.Rect(left, top, right, bottom)
+	lengths := make([][2]int64, p.u16())
+	for i := range lengths {
+		lengths[i] = [2]int64{int64(int16(p.u16())), p.length(large)}
+	}
+	p.read(8) // blend mode signature and key
+	b := p.read(4)
+	record.opacity, record.flags = b[0], b[2]
+
+	extra := &psdReader{r: bufio.NewReader(bytes.NewReader(p.read(p.u32())))}
+	if mask := extra.read(extra.u32()); len(mask) >= 18 && mask[17]&2 == 0 {
+		top, left := int(int32(binary.BigEndian.Uint32(mask))), int(int32(binary.BigEndian.Uint32(mask[4:])))
+		bottom, right := int(int32(binary.BigEndian.Uint32(mask[8:]))), int(int32(binary.BigEndian.Uint32(mask[12:])))
+		record.maskRect = image.Rect(left, top, right, bottom)
+		record.maskColor = mask[16]
+	}
+	extra.skip(int64(extra.u32())) // blending ranges
+	// A Pascal name padded to 4 bytes, or the Unicode one of a tagged block
+	nameLength := int(extra.read(1)[0])
+	record.name = string(extra.read(nameLength))
+	extra.skip(int64((nameLength+4)&^3 - nameLength - 1))
+	readPSDBlocks(extra, large, func(key string, data []byte) {
+		switch {
+		case key == "luni" && len(data) >= 4:
+			n := min(int(binary.BigEndian.Uint32(data)), (len(data)-4)/2)
+			units := make([]uint16, n)
+			for i := range units {
+				units[i] = binary.BigEndian.Uint16(data[4+2*i:])
+			}
+			record.name = string(utf16.Decode(units))
+		case (key == "lsct" || key == "lsdk") && len(data) >= 4:
+			record.section = int(binary.BigEndian.Uint32(data))
+		}
+	})
+	return record, lengths
+}
+
+// readPSDBlocks calls f with the key and data of each tagged block up to
+// the end of p.
+func readPSDBlocks(p *psdReader, large bool, f func(key string, data []byte)) {
+	for p.err == nil {
+		signature := p.read(4)
+		if p.err != nil || string(signature) != "8BIM" && string(signature) != "8B64" {
+			return
+		}
+		key := string(p.read(4))
+		var length int64
+		if large && psdLongBlocks[key] {
+			length = p.length(true)
+		} else {
+			length = p.length(false)
+		}
+		data := p.read(int(length))
+		if p.err == nil {
+			f(key, data)
+		}
+	}
+}
+
+// psdLayerPixels decodes the pixels and mask of a layer of a document with
+// header h; groups have only a mask.
+func psdLayerPixels(record *psdLayerRecord, h psdHeader, palette []byte, group bool) (layerPixels, error) {
+	pixels := layerPixels{offset: record.rect.Min}
+	colorChannels, err := h.colorChannels()
+	if err != nil {
+		return layerPixels{}, err
+	}
+	if !group && !record.rect.Empty() {
+		layer := h
+		layer.width, layer.height = record.rect.Dx(), record.rect.Dy()
+		ids := make([]int, colorChannels)
+		for i := range ids {
+			ids[i] = i
+		}
+		_, alpha := record.channels[psdTransparency]
+		if alpha {
+			ids = append(ids, psdTransparency)
+		}
+		planes := make([][]byte, len(ids))
+		for i, id := range ids {
+			if planes[i], err = decodePSDChannel(record.channels[id], layer); err != nil {
+				return layerPixels{}, fmt.Errorf("psd: layer %q: %w", record.name, err)
+			}
+		}
+		pixels.img = psdImage(layer, planes, palette, alpha, false)
+	}
+
+	data, hasMask := record.channels[psdUserMask]
+	if !hasMask || record.maskRect.Empty() {
+		return pixels, nil
+	}
+	// Outside its rectangle the mask has its default color, so it is
+	// extended to cover the layer, or the whole document for a group
+	area := record.rect
+	if group || area.Empty() {
+		area = image.Rect(0, 0, h.width, h.height)
+	}
+	mask := image.NewAlpha16(image.Rect(0, 0, area.Dx(), area.Dy()))
+	draw.Draw(mask, mask.Bounds(), image.NewUniform(color.Alpha{A: record.maskColor}), image.Point{}, draw.Src)
+	maskHeader := h
+	maskHeader.width, maskHeader.height = record.maskRect.Dx(), record.maskRect.Dy()
+	plane, err := decodePSDChannel(data, maskHeader)
+	if err != nil {
+		return layerPixels{}, fmt.Errorf("psd: layer %q mask: %w", record.name, err)
+	}
+	values := psdImage(psdHeader{width: maskHeader.width, height: maskHeader.height, depth: h.depth, mode: psdGrayscale}, [][]byte{plane}, nil, false, false)
+	draw.Draw(mask, record.maskRect.Sub(area.Min), grayAsAlpha{values}, image.Point{}, draw.Src)
+	pixels.mask, pixels.maskOffset = mask, area.Min
+	return pixels, nil
+}
+
+// grayAsAlpha reads a gray image as an alpha mask.
+type grayAsAlpha struct {
+	image.Image
+}
+
+func (g grayAsAlpha) ColorModel() color.Model { return color.Alpha16Model }
+
+func (g grayAsAlpha) At(x, y int) color.Color {
+	v, _, _, _ := g.Image.At(x, y).RGBA()
+	return color.Alpha16{A: uint16(v)}
+}
+
+// decodePSDChannel decodes the image data of one layer channel, its
+// compression followed by the samples of a plane of h's size.
+func decodePSDChannel(data []byte, h psdHeader) ([]byte, error) {
+	rowBytes := (h.width*h.depth + 7) / 8
+	size := rowBytes * h.height
+	if len(data) < 2 {
+		// Layers without a channel, such as color channels left out of a
+		// layer that is all transparent, read as zeros
+		return make([]byte, size), nil
+	}
+	compression := binary.BigEndian.Uint16(data)
+	data = data[2:]
+	switch compression {
+	case 0:
+		if len(data) < size {
+			return nil, fmt.Errorf("short channel")
+		}
+		return data[:size], nil
+	case 1:
+		countSize := 2
+		if h.large {
+			countSize = 4
+		}
+		if len(data) < h.height*countSize {
+			return nil, fmt.Errorf("short channel")
+		}
+		rows := data[h.height*countSize:]
+		plane := make([]byte, 0, size)
+		for y := 0; y < h.height; y++ {
+			n := int(binary.BigEndian.Uint16(data[y*countSize:]))
+			if h.large {
+				n = int(binary.BigEndian.Uint32(data[y*countSize:]))
+			}
+			if n > len(rows) {
+				return nil, fmt.Errorf("short channel")
+			}
+			row, err := unpackBits(rows[:n], rowBytes)
+			if err != nil {
+				return nil, err
+			}
+			plane = append(plane, row...)
+			rows = rows[n:]
+		}
+		return plane, nil
+	case 2, 3:
+		z, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		plane := make([]byte, size)
+		if _, err := io.ReadFull(z, plane); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(io.Discard, z); err != nil {
+			return nil, err
+		}
+		if compression == 3 {
+			undoPSDPrediction(plane, h.width, h.height, h.depth)
+		}
+		return plane, nil
+	}
+	return nil, fmt.Errorf("unknown compression %d", compression)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pyramidLevel is one resolution of a tile pyramid. scale is how many source
+// pixels each level pixel covers along one axis.
+type pyramidLevel struct {
+	img   image.Image
+	scale int
+}
+
+// tilesOptions holds the flags of the tiles subcommand.
+type tilesOptions struct {
+	layout   string
+	tileSize int
+	overlap  int
+	tileKB   int
+	baseURL  string
+	outDir   string
+}
+
+func (o *tilesOptions) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("tiles", flag.ExitOnError)
+	fs.StringVar(&o.layout, "layout", "dzi", "pyramid layout: dzi or iiif")
+	fs.IntVar(&o.tileSize, "tile-size", 256, "tile edge length in pixels")
+	fs.IntVar(&o.overlap, "overlap", 1, "pixels of overlap between neighboring DZI tiles")
+	fs.IntVar(&o.tileKB, "tile-target-kb", 100, "maximum size of each tile in KB")
+	fs.StringVar(&o.baseURL, "base-url", "", "IIIF service base URL written to info.json")
+	fs.StringVar(&o.outDir, "out", "tiles", "output directory")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s tiles [flags] image...\n", programName())
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// runTiles implements the tiles subcommand, which cuts each input image into
+// a Deep Zoom (DZI) or static IIIF Image API tile pyramid.
+func runTiles(args []string) error {
+	var opts tilesOptions
+	fs := opts.flagSet()
+	fs.Parse(args)
+
+	if opts.layout != "dzi" && opts.layout != "iiif" {
+		return fmt.Errorf("unknown layout %q", opts.layout)
+	}
+	if opts.tileSize <= 0 || opts.overlap < 0 || opts.tileKB <= 0 {
+		return fmt.Errorf("tile size, overlap and tile target must be positive")
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no input images")
+	}
+	opts.outDir = longPath(opts.outDir)
+	if err := os.MkdirAll(opts.outDir, 0755); err != nil {
+		return err
+	}
+
+	tileLimit := opts.tileKB * 1000
+	for _, srcPath := range fs.Args() {
+		fmt.Printf("Tiling %s... ", filepath.Base(srcPath))
+		var err error
+		var count int
+		if opts.layout == "dzi" {
+			count, err = writeDZI(longPath(srcPath), opts.outDir, opts.tileSize, opts.overlap, tileLimit)
+		} else {
+			count, err = writeIIIF(longPath(srcPath), opts.outDir, opts.baseURL, opts.tileSize, tileLimit)
+		}
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			continue
+		}
+		fmt.Printf("DONE (%d tiles)\n", count)
+	}
+	return nil
+}
+
+// buildPyramid decodes and redacts srcPath and returns its levels from full resolution
+// down to a single pixel, each half the size of the one before it.
+func buildPyramid(srcPath string) ([]pyramidLevel, error) {
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := decodeLimited(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	if img, err = redact(new(fileLog), srcPath, img); err != nil {
+		return nil, err
+	}
+
+	levels := []pyramidLevel{{img: img, scale: 1}}
+	for {
+		last := levels[len(levels)-1]
+		w, h := last.img.Bounds().Dx(), last.img.Bounds().Dy()
+		if w == 1 && h == 1 {
+			return levels, nil
+		}
+		half := resizeImage(last.img, (w+1)/2, (h+1)/2)
+		levels = append(levels, pyramidLevel{img: half, scale: last.scale * 2})
+	}
+}
+
+// writeTile crops rect out of img and writes it as a JPEG of at most limit
+// bytes.
+func writeTile(path string, img image.Image, rect image.Rectangle, limit int) error {
+	tile := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(tile, tile.Bounds(), img, rect.Min, draw.Src)
+	data, err := encodeJPEGWithin(nil, tile, limit, maxJPEGQuality)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeOutput(path, data)
+}
+
+// writeDZI writes name.dzi and name_files/<level>/<col>_<row>.jpg, where
+// level 0 is the 1x1 image and the highest level is full resolution.
+func writeDZI(srcPath, outDir string, tileSize, overlap, limit int) (int, error) {
+	levels, err := buildPyramid(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	name := outputName(strings.TrimSuffix(filepath.Base(srcPath), filepath.Ext(srcPath)))
+	full := levels[0].img.Bounds()
+
+	count := 0
+	for i, level := range levels {
+		dziLevel := len(levels) - 1 - i
+		bounds := level.img.Bounds()
+		for row := 0; row*tileSize < bounds.Dy(); row++ {
+			for col := 0; col*tileSize < bounds.Dx(); col++ {
+				rect := image.Rect(col*tileSize-overlap, row*tileSize-overlap, (col+1)*tileSize+overlap, (row+1)*tileSize+overlap)
+				rect = rect.Add(bounds.Min).Intersect(bounds)
+				path := filepath.Join(outDir, name+"_files", fmt.Sprint(dziLevel), fmt.Sprintf("%d_%d.jpg", col, row))
+				if err := writeTile(path, level.img, rect, limit); err != nil {
+					return count, err
+				}
+				count++
+			}
+		}
+	}
+
+	descriptor := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" TileSize="%d" Overlap="%d" Format="jpg">
+  <Size Width="%d" Height="%d"/>
+</Image>
+`, tileSize, overlap, full.Dx(), full.Dy())
+	return count, writeOutput(filepath.Join(outDir, name+".dzi"), []byte(descriptor))
+}
+
+// iiifInfo is the info.json document of a level 0 IIIF Image API 3.0
+// service.
+type iiifInfo struct {
+	Context  string     `json:"@context"`
+	ID       string     `json:"id"`
+	Type     string     `json:"type"`
+	Protocol string     `json:"protocol"`
+	Profile  string     `json:"profile"`
+	Width    int        `json:"width"`
+	Height   int        `json:"height"`
+	Tiles    []iiifTile `json:"tiles"`
+}
+
+type iiifTile struct {
+	Width        int   `json:"width"`
+	ScaleFactors []int `json:"scaleFactors"`
+}
+
+// writeIIIF writes a static IIIF tile tree under outDir/name, with tiles at
+// {x},{y},{w},{h}/{tw},{th}/0/default.jpg in full-resolution coordinates.
+func writeIIIF(srcPath, outDir, baseURL string, tileSize, limit int) (int, error) {
+	levels, err := buildPyramid(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	name := outputName(strings.TrimSuffix(filepath.Base(srcPath), filepath.Ext(srcPath)))
+	root := filepath.Join(outDir, name)
+	full := levels[0].img.Bounds()
+
+	count := 0
+	var scaleFactors []int
+	for _, level := range levels {
+		scaleFactors = append(scaleFactors, level.scale)
+		bounds := level.img.Bounds()
+		for row := 0; row*tileSize < bounds.Dy(); row++ {
+			for col := 0; col*tileSize < bounds.Dx(); col++ {
+				rect := image.Rect(col*tileSize, row*tileSize, (col+1)*tileSize, (row+1)*tileSize)
+				rect = rect.Add(bounds.Min).Intersect(bounds)
+
+				// Region in full-resolution pixels
+				x, y := col*tileSize*level.scale, row*tileSize*level.scale
+				w := min(tileSize*level.scale, full.Dx()-x)
+				h := min(tileSize*level.scale, full.Dy()-y)
+				region := fmt.Sprintf("%d,%d,%d,%d", x, y, w, h)
+				size := fmt.Sprintf("%d,%d", rect.Dx(), rect.Dy())
+				path := filepath.Join(root, region, size, "0", "default.jpg")
+				if err := writeTile(path, level.img, rect, limit); err != nil {
+					return count, err
+				}
+				count++
+			}
+		}
+		// Smaller levels would only repeat the single tile at lower scales
+		if bounds.Dx() <= tileSize && bounds.Dy() <= tileSize {
+			break
+		}
+	}
+
+	id := name
+	if baseURL != "" {
+		id = strings.TrimSuffix(baseURL, "/") + "/" + name
+	}
+	info := iiifInfo{
+		Context:  "http://iiif.io/api/image/3/context.json",
+		ID:       id,
+		Type:     "ImageService3",
+		Protocol: "http://iiif.io/api/image",
+		Profile:  "level0",
+		Width:    full.Dx(),
+		Height:   full.Dy(),
+		Tiles:    []iiifTile{{Width: tileSize, ScaleFactors: scaleFactors}},
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return count, err
+	}
+	return count, writeOutput(filepath.Join(root, "info.json"), data)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+
+	"image-compressor/pkg/compressor"
+)
+
+// maxPaletteColors is the most colors a PNG or GIF palette holds.
+const maxPaletteColors = 256
+
+// quantize reduces img to at most maxPaletteColors colors, which suits
+// screenshots and diagrams with large flat areas. Images with few enough
+// colors are converted exactly; others get a median cut palette and
+// Floyd-Steinberg dithering.
+func quantize(img image.Image) *image.Paletted {
+	if paletted, ok := img.(*image.Paletted); ok {
+		return paletted
+	}
+	if paletted := compressor.PalettedLossless(img); paletted != nil {
+		return paletted
+	}
+	bounds := img.Bounds()
+	counts := make(map[color.NRGBA]int)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			counts[color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)]++
+		}
+	}
+	colors := make([]colorCount, 0, len(counts))
+	for c, n := range counts {
+		colors = append(colors, colorCount{c, n})
+	}
+	paletted := image.NewPaletted(bounds, medianCut(colors, maxPaletteColors))
+	draw.FloydSteinberg.Draw(paletted, bounds, img, bounds.Min)
+	return paletted
+}
+
+type colorCount struct {
+	color color.NRGBA
+	count int
+}
+
+// colorBox is a set of colors and the channel along which they vary most.
+type colorBox struct {
+	colors  []colorCount
+	channel int
+	spread  int
+}
+
+func newColorBox(colors []colorCount) colorBox {
+	box := colorBox{colors: colors}
+	for channel := 0; channel < 4; channel++ {
+		lo, hi := uint8(255), uint8(0)
+		for _, c := range colors {
+			v := channelValue(c.color, channel)
+			lo, hi = min(lo, v), max(hi, v)
+		}
+		if spread := int(hi) - int(lo); spread > box.spread {
+			box.channel, box.spread = channel, spread
+		}
+	}
+	return box
+}
+
+// medianCut splits colors into at most n boxes, each time halving the box
+// with the widest channel range at its pixel-weighted median, and returns
+// the weighted average color of each box.
+func medianCut(colors []colorCount, n int) color.Palette {
+	boxes := []colorBox{newColorBox(colors)}
+	for len(boxes) < n {
+		widest := -1
+		for i, box := range boxes {
+			if len(box.colors) > 1 && box.spread > 0 && (widest < 0 || box.spread > boxes[widest].spread) {
+				widest = i
+			}
+		}
+		if widest < 0 {
+			break
+		}
+		box := boxes[widest]
+		sort.Slice(box.colors, func(i, j int) bool {
+			return channelValue(box.colors[i].color, box.channel) < channelValue(box.colors[j].color, box.channel)
+		})
+		total := 0
+		for _, c := range box.colors {
+			total += c.count
+		}
+		split, seen := 1, 0
+		for i, c := range box.colors[:len(box.colors)-1] {
+			if seen += c.count; seen*2 >= total {
+				split = i + 1
+				break
+			}
+		}
+		boxes[widest] = newColorBox(box.colors[:split])
+		boxes = append(boxes, newColorBox(box.colors[split:]))
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		var r, g, b, a, total int
+		for _, c := range box.colors {
+			r += int(c.color.R) * c.count
+			g += int(c.color.G) * c.count
+			b += int(c.color.B) * c.count
+			a += int(c.color.A) * c.count
+			total += c.count
+		}
+		palette[i] = color.NRGBA{uint8(r / total), uint8(g / total), uint8(b / total), uint8(a / total)}
+	}
+	return palette
+}
+
+func channelValue(c color.NRGBA, channel int) uint8 {
+	return [4]uint8{c.R, c.G, c.B, c.A}[channel]
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const readonlyUsage = "guarantee nothing is written inside the source directory: outputs, temp files, locks and reports must all go elsewhere"
+
+// readOnlyRoots are the source directories -assert-readonly protects, with
+// symlinks resolved. Every write checks against them, so a path that slips
+// past the checks at startup still can't reach a source tree.
+var readOnlyRoots []string
+
+// protectSource makes dir read-only for the rest of the run if assert is
+// set, after checking that writes, the paths the run will write to, and the
+// temp directory are outside it.
+func protectSource(assert bool, dir string, writes ...string) error {
+	if !assert {
+		return nil
+	}
+	root, err := resolvePath(dir)
+	if err != nil {
+		return err
+	}
+	readOnlyRoots = append(readOnlyRoots, root)
+	for _, path := range append(writes, os.TempDir()) {
+		if err := guardWrite(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// guardWrite fails if path is inside a directory protected by
+// -assert-readonly.
+func guardWrite(path string) error {
+	if len(readOnlyRoots) == 0 {
+		return nil
+	}
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+	for _, root := range readOnlyRoots {
+		if rel, err := filepath.Rel(root, resolved); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("-assert-readonly: refusing to write %s inside the source directory %s", path, root)
+		}
+	}
+	return nil
+}
+
+// resolvePath returns path made absolute, without the \\?\ prefix, and
+// with symlinks resolved in the longest part of it that exists, so paths
+// not created yet resolve to where they will be.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(plainPath(path))
+	if err != nil {
+		return "", err
+	}
+	var missing []string
+	for p := abs; ; p = filepath.Dir(p) {
+		if resolved, err := filepath.EvalSymlinks(p); err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+		if filepath.Dir(p) == p {
+			return abs, nil
+		}
+		missing = append([]string{filepath.Base(p)}, missing...)
+	}
+}
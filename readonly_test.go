@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readonlySource builds a source tree of testdata images, one of them
+// corrupt and one in a subdirectory, and makes it read-only until the test
+// ends.
+func readonlySource(t *testing.T) string {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), "src")
+	files := map[string]string{
+		"photo.jpg":     "photo.jpg",
+		"small.jpg":     "small.jpg",
+		"rgb.png":       "rgb.png",
+		"truncated.jpg": "corrupt/truncated.jpg",
+		"sub/gray.jpg":  "gray.jpg",
+	}
+	for name, sample := range files {
+		data, err := os.ReadFile(filepath.Join("testdata", sample))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0444); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setTreeMode(t, src, 0555)
+	t.Cleanup(func() { setTreeMode(t, src, 0755) })
+	return src
+}
+
+// setTreeMode sets the mode of every directory under root.
+func setTreeMode(t *testing.T, root string, mode os.FileMode) {
+	t.Helper()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return os.Chmod(path, mode)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// treeState describes every entry under root by its size, mode and
+// modification time, and by its -tag mark where there can be one.
+func treeState(t *testing.T, root string) map[string]string {
+	t.Helper()
+	state := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		desc := fmt.Sprintf("%d %v %v", info.Size(), info.Mode(), info.ModTime())
+		if tagSupported && !d.IsDir() {
+			tag, _ := readTag(path)
+			desc += " " + tag
+		}
+		state[path] = desc
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// assertUnchanged fails t if root doesn't match before.
+func assertUnchanged(t *testing.T, root string, before map[string]string) {
+	t.Helper()
+	after := treeState(t, root)
+	for path, desc := range after {
+		if was, ok := before[path]; !ok {
+			t.Errorf("%s was written inside the source tree", path)
+		} else if was != desc {
+			t.Errorf("%s changed: %s, was %s", path, desc, was)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			t.Errorf("%s was removed from the source tree", path)
+		}
+	}
+}
+
+func TestAssertReadonlyBatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra []string
+		// failed is set when the corrupt source fails the whole batch
+		failed bool
+	}{
+		{name: "checkpoint", extra: []string{"-recursive", "-checkpoint", "checkpoint.json"}},
+		{name: "atomic", extra: []string{"-atomic", "-keep-both"}, failed: true},
+		{name: "split", extra: []string{"-split-output", "100KB"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := readonlySource(t)
+			before := treeState(t, src)
+			dir := t.TempDir()
+			out := filepath.Join(dir, "out")
+			args := []string{"-input", src, "-output", out, "-assert-readonly", "-target", "40KB", "-report", filepath.Join(dir, "report.json")}
+			if tagSupported {
+				args = append(args, "-tag", "both")
+			}
+			for _, arg := range tt.extra {
+				if strings.HasSuffix(arg, ".json") {
+					arg = filepath.Join(dir, arg)
+				}
+				args = append(args, arg)
+			}
+			if err := runBatch(t, args...); (err != nil) != tt.failed {
+				t.Fatalf("batch returned %v", err)
+			}
+			assertUnchanged(t, src, before)
+			if _, err := os.Stat(filepath.Join(dir, "report.json")); err != nil {
+				t.Errorf("report wasn't written outside the source: %v", err)
+			}
+			// Outputs land in out, or its staging directory if the
+			// atomic batch failed
+			outputs := 0
+			filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() && isSupportedImage(path) {
+					outputs++
+				}
+				return nil
+			})
+			if outputs == 0 {
+				t.Error("the batch wrote no outputs")
+			}
+		})
+	}
+}
+
+// TestAssertReadonlyRefuses checks that a batch which would write inside
+// the source tree fails before writing anything.
+func TestAssertReadonlyRefuses(t *testing.T) {
+	tests := map[string]func(src string) []string{
+		"default output": func(src string) []string { return nil },
+		"output inside":  func(src string) []string { return []string{"-output", filepath.Join(src, "sub", "out")} },
+		"report inside": func(src string) []string {
+			return []string{"-output", filepath.Join(t.TempDir(), "out"), "-report", filepath.Join(src, "report.json")}
+		},
+		"checkpoint inside": func(src string) []string {
+			return []string{"-output", filepath.Join(t.TempDir(), "out"), "-checkpoint", filepath.Join(src, "checkpoint.json")}
+		},
+	}
+	for name, extra := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := readonlySource(t)
+			before := treeState(t, src)
+			args := append([]string{"-input", src, "-assert-readonly", "-target", "40KB"}, extra(src)...)
+			err := runBatch(t, args...)
+			if err == nil || !strings.Contains(err.Error(), "-assert-readonly") {
+				t.Errorf("batch returned %v, want an -assert-readonly error", err)
+			}
+			assertUnchanged(t, src, before)
+		})
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redactUsage = "obscure regions of images before they are compressed, such as faces and license plates, listed in this file one image per line: its file name, then x,y,w,h rectangles in its pixels, e.g. IMG_0042.jpg 812,340,96,120 1410,900,220,48. Use -redact-detector to find them automatically"
+
+const redactDetectorUsage = "find regions of each image to redact, such as faces and license plates, by running this command with the image's path added as its last argument; it prints the x,y,w,h rectangles it finds in the image's pixels, separated by spaces or lines, and they are obscured along with any -redact lists"
+
+// Redaction styles, set by -redact-style.
+const (
+	// redactPixelate replaces each region with a few large blocks of its
+	// average colors
+	redactPixelate = "pixelate"
+	// redactBlur blurs each region heavily, keeping its colors
+	redactBlur = "blur"
+	// redactFill paints each region solid black, leaving nothing to recover
+	redactFill = "fill"
+)
+
+// redactRegions maps file names, as listed in the -redact file at
+// redactPath, to the rectangles obscured in each in redactStyle before it
+// is compressed. Redacted images are never copied as they are, and fail
+// rather than pass through a path that can't redact them.
+var (
+	redactPath    string
+	redactRegions map[string][]image.Rectangle
+	redactStyle   = redactPixelate
+)
+
+// regionDetector finds the regions of the image file at path to redact,
+// in its pixels.
+type regionDetector interface {
+	detect(path string) ([]image.Rectangle, error)
+}
+
+// redactDetector, set by -redact-detector, finds regions of every image
+// to redact on top of those listed in the -redact file. nil finds none.
+var redactDetector regionDetector
+
+// detectorTimeout is how long -redact-detector may take over one image.
+const detectorTimeout = 2 * time.Minute
+
+// commandDetector runs an external program over each image, args followed
+// by its path, and reads the regions it prints. A file is checked several
+// times on its way through, so what the program found is kept by path,
+// size and modification time and it runs once per version of a file.
+type commandDetector struct {
+	args []string
+
+	mu    sync.Mutex
+	found map[detectionKey]detection
+}
+
+type detectionKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+type detection struct {
+	regions []image.Rectangle
+	err     error
+}
+
+func (d *commandDetector) String() string {
+	return strings.Join(d.args, " ")
+}
+
+func (d *commandDetector) detect(path string) ([]image.Rectangle, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	key := detectionKey{path, info.Size(), info.ModTime()}
+	d.mu.Lock()
+	found, ok := d.found[key]
+	d.mu.Unlock()
+	if ok {
+		return found.regions, found.err
+	}
+	found.regions, found.err = d.run(path)
+	d.mu.Lock()
+	d.found[key] = found
+	d.mu.Unlock()
+	return found.regions, found.err
+}
+
+// run runs the program over path and parses what it prints.
+func (d *commandDetector) run(path string) ([]image.Rectangle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), detectorTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, d.args[0], append(d.args[1:], path)...).Output()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && len(exit.Stderr) > 0 {
+			return nil, fmt.Errorf("%v: %s", err, bytes.TrimSpace(exit.Stderr))
+		}
+		return nil, err
+	}
+	var regions []image.Rectangle
+	for _, field := range strings.Fields(string(out)) {
+		r, ok := parseRegion(field)
+		if !ok {
+			return nil, fmt.Errorf("printed %q, which isn't an x,y,w,h region", field)
+		}
+		regions = append(regions, r)
+	}
+	return regions, nil
+}
+
+// parseRedactDetector sets redactDetector to run the command line s, or
+// clears it for "".
+func parseRedactDetector(s string) error {
+	args := strings.Fields(s)
+	if len(args) == 0 {
+		redactDetector = nil
+		return nil
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return err
+	}
+	redactDetector = &commandDetector{args: args, found: make(map[detectionKey]detection)}
+	return nil
+}
+
+// pixelateBlocks is how many blocks pixelation leaves across the shorter
+// side of a region, and minPixelateBlock the smallest block in pixels, so
+// that small faces and plates still lose their features.
+const (
+	pixelateBlocks   = 5
+	minPixelateBlock = 8
+)
+
+// blurPasses box blurs of a quarter of a region's shorter side make up
+// redactBlur, close to a Gaussian.
+const blurPasses = 3
+
+// parseRedactStyle sets redactStyle.
+func parseRedactStyle(s string) error {
+	switch s {
+	case redactPixelate, redactBlur, redactFill:
+		redactStyle = s
+		return nil
+	}
+	return fmt.Errorf("unknown redaction style %q (want pixelate, blur or fill)", s)
+}
+
+// parseRedactFile reads the regions to redact from the file at path, or
+// clears them for "". Blank lines and lines starting with # are skipped.
+func parseRedactFile(path string) error {
+	if path == "" {
+		redactPath, redactRegions = "", nil
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	regions := make(map[string][]image.Rectangle)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// File names may contain spaces, so regions are read from the end
+		fields := strings.Fields(line)
+		var rects []image.Rectangle
+		for len(fields) > 1 {
+			r, ok := parseRegion(fields[len(fields)-1])
+			if !ok {
+				break
+			}
+			rects = append(rects, r)
+			fields = fields[:len(fields)-1]
+		}
+		if len(rects) == 0 {
+			return fmt.Errorf("%s:%d: expected a file name followed by x,y,w,h regions", path, n)
+		}
+		name := strings.Join(fields, " ")
+		regions[name] = append(regions[name], rects...)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	redactPath, redactRegions = path, regions
+	return nil
+}
+
+// parseRegion parses a rectangle written x,y,w,h.
+func parseRegion(s string) (image.Rectangle, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, false
+	}
+	var v [4]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return image.Rectangle{}, false
+		}
+		v[i] = n
+	}
+	if v[2] == 0 || v[3] == 0 {
+		return image.Rectangle{}, false
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), true
+}
+
+// formatRedaction describes -redact, -redact-detector and -redact-style
+// for printSettings.
+func formatRedaction() string {
+	var sources []string
+	if redactRegions != nil {
+		regions := 0
+		for _, rects := range redactRegions {
+			regions += len(rects)
+		}
+		sources = append(sources, fmt.Sprintf("%d region(s) in %d image(s) from %s", regions, len(redactRegions), redactPath))
+	}
+	if redactDetector != nil {
+		sources = append(sources, fmt.Sprintf("regions found by %v", redactDetector))
+	}
+	return strings.Join(sources, " and ") + ", " + redactStyle
+}
+
+// regionsFor returns the regions to redact in the image at path: those
+// the -redact file lists and those redactDetector finds.
+func regionsFor(path string) ([]image.Rectangle, error) {
+	regions := redactRegions[filepath.Base(path)]
+	if redactDetector == nil {
+		return regions, nil
+	}
+	found, err := redactDetector.detect(path)
+	if err != nil {
+		return nil, fmt.Errorf("redaction detector: %w", err)
+	}
+	return append(slices.Clip(regions), found...), nil
+}
+
+// redacts reports whether the image at path has regions to redact. An
+// image the detector fails on counts as having some, so that it goes on
+// to redact and fails there rather than being passed on.
+func redacts(path string) bool {
+	regions, err := regionsFor(path)
+	return err != nil || len(regions) > 0
+}
+
+// redact returns img with the regions listed or detected for srcPath
+// obscured, or img itself if there are none.
+func redact(log *fileLog, srcPath string, img image.Image) (image.Image, error) {
+	bounds := img.Bounds()
+	return redactScaled(log, srcPath, img, bounds.Dx(), bounds.Dy())
+}
+
+// redactScaled is redact for img scaled from a sourceWidth x sourceHeight
+// source, which the regions are given in. Regions are widened to whole
+// pixels of img, never narrowed. A region wholly outside the source fails
+// the image, since its coordinates are probably wrong.
+func redactScaled(log *fileLog, srcPath string, img image.Image, sourceWidth, sourceHeight int) (image.Image, error) {
+	regions, err := regionsFor(srcPath)
+	if err != nil || len(regions) == 0 {
+		return img, err
+	}
+	source := image.Rect(0, 0, sourceWidth, sourceHeight)
+	bounds := img.Bounds()
+	scaleX := float64(bounds.Dx()) / float64(sourceWidth)
+	scaleY := float64(bounds.Dy()) / float64(sourceHeight)
+
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Rect, img, bounds.Min, draw.Src)
+	for _, r := range regions {
+		if r.Intersect(source).Empty() {
+			return nil, fmt.Errorf("redaction region %d,%d,%d,%d is outside the %dx%d image", r.Min.X, r.Min.Y, r.Dx(), r.Dy(), sourceWidth, sourceHeight)
+		}
+		r = image.Rect(
+			int(math.Floor(float64(r.Min.X)*scaleX)),
+			int(math.Floor(float64(r.Min.Y)*scaleY)),
+			int(math.Ceil(float64(r.Max.X)*scaleX)),
+			int(math.Ceil(float64(r.Max.Y)*scaleY)),
+		).Intersect(out.Rect)
+		switch redactStyle {
+		case redactBlur:
+			blurRegion(out, r)
+		case redactFill:
+			draw.Draw(out, r, image.NewUniform(color.Black), image.Point{}, draw.Src)
+		default:
+			pixelateRegion(out, r)
+		}
+	}
+	log.Printf("(%d region(s) redacted) ", len(regions))
+	return out, nil
+}
+
+// pixelateRegion replaces r of img with blocks of its average colors. The
+// blocks are spread evenly over r, so none at its edges is left thin
+// enough to show the pixels under it.
+func pixelateRegion(img *image.RGBA, r image.Rectangle) {
+	block := max(min(r.Dx(), r.Dy())/pixelateBlocks, minPixelateBlock)
+	cols := max(r.Dx()/block, 1)
+	rows := max(r.Dy()/block, 1)
+	for j := 0; j < rows; j++ {
+		y0, y1 := r.Min.Y+j*r.Dy()/rows, r.Min.Y+(j+1)*r.Dy()/rows
+		for i := 0; i < cols; i++ {
+			x0, x1 := r.Min.X+i*r.Dx()/cols, r.Min.X+(i+1)*r.Dx()/cols
+			var sum [4]int
+			for y := y0; y < y1; y++ {
+				row := img.Pix[img.PixOffset(x0, y):img.PixOffset(x1, y)]
+				for k := 0; k < len(row); k++ {
+					sum[k%4] += int(row[k])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			average := color.RGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), uint8(sum[3] / n)}
+			draw.Draw(img, image.Rect(x0, y0, x1, y1), image.NewUniform(average), image.Point{}, draw.Src)
+		}
+	}
+}
+
+// blurRegion blurs r of img by blurPasses box blurs along its rows and
+// columns. Only pixels inside r are read, so nothing around it is smeared
+// in and the blur can't be undone from its surroundings.
+func blurRegion(img *image.RGBA, r image.Rectangle) {
+	w, h := r.Dx(), r.Dy()
+	radius := max(min(w, h)/4, 1)
+	values := make([]float32, w*h*4)
+	for y := 0; y < h; y++ {
+		row := img.Pix[img.PixOffset(r.Min.X, r.Min.Y+y):img.PixOffset(r.Max.X, r.Min.Y+y)]
+		for k, v := range row {
+			values[y*w*4+k] = float32(v)
+		}
+	}
+	line := make([]float32, max(w, h)*4)
+	for pass := 0; pass < blurPasses; pass++ {
+		for y := 0; y < h; y++ {
+			blurLine(values[y*w*4:], 4, w, radius, line)
+		}
+		for x := 0; x < w; x++ {
+			blurLine(values[x*4:], w*4, h, radius, line)
+		}
+	}
+	for y := 0; y < h; y++ {
+		row := img.Pix[img.PixOffset(r.Min.X, r.Min.Y+y):img.PixOffset(r.Max.X, r.Min.Y+y)]
+		for k := range row {
+			row[k] = uint8(values[y*w*4+k] + 0.5)
+		}
+	}
+}
+
+// blurLine averages each of n RGBA pixels of values, stride floats apart,
+// with those within radius of it, repeating the end pixels past the ends.
+// line is scratch space for at least n pixels.
+func blurLine(values []float32, stride, n, radius int, line []float32) {
+	for i := 0; i < n; i++ {
+		copy(line[i*4:i*4+4], values[i*stride:i*stride+4])
+	}
+	at := func(i, c int) float32 { return line[min(max(i, 0), n-1)*4+c] }
+	span := float32(2*radius + 1)
+	for c := 0; c < 4; c++ {
+		var sum float32
+		for i := -radius; i <= radius; i++ {
+			sum += at(i, c)
+		}
+		for i := 0; i < n; i++ {
+			values[i*stride+c] = sum / span
+			sum += at(i+radius+1, c) - at(i-radius, c)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// detectorFunc is a regionDetector that calls itself.
+type detectorFunc func(path string) ([]image.Rectangle, error)
+
+func (f detectorFunc) detect(path string) ([]image.Rectangle, error) { return f(path) }
+
+// redactWith sets the redaction settings until the test ends.
+func redactWith(t *testing.T, regions map[string][]image.Rectangle, detector regionDetector, style string) {
+	saved := currentSettings()
+	t.Cleanup(saved.apply)
+	redactRegions, redactDetector, redactStyle = regions, detector, style
+}
+
+func TestRedactDetected(t *testing.T) {
+	listed, detected := image.Rect(0, 0, 4, 4), image.Rect(10, 10, 20, 15)
+	redactWith(t, map[string][]image.Rectangle{"street.png": {listed}}, detectorFunc(func(path string) ([]image.Rectangle, error) {
+		if path != filepath.Join("in", "street.png") {
+			t.Errorf("detector ran over %s", path)
+		}
+		return []image.Rectangle{detected}, nil
+	}), redactFill)
+
+	src := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	for i := range src.Pix {
+		src.Pix[i] = 200
+	}
+	if !redacts(filepath.Join("in", "street.png")) {
+		t.Fatal("redacts is false")
+	}
+	out, err := redact(new(fileLog), filepath.Join("in", "street.png"), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			p := image.Pt(x, y)
+			want := color.Color(color.RGBA{200, 200, 200, 200})
+			if p.In(listed) || p.In(detected) {
+				want = color.Black
+			}
+			if got := out.At(x, y); color.RGBAModel.Convert(got) != color.RGBAModel.Convert(want) {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestRedactDetectorFails(t *testing.T) {
+	redactWith(t, nil, detectorFunc(func(string) ([]image.Rectangle, error) {
+		return nil, errors.New("no model")
+	}), redactPixelate)
+	if !redacts("street.png") {
+		t.Error("an image the detector fails on would be copied as it is")
+	}
+	if _, err := redact(new(fileLog), "street.png", image.NewRGBA(image.Rect(0, 0, 8, 8))); err == nil || !strings.Contains(err.Error(), "redaction detector: no model") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCommandDetector(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the detectors are shell scripts")
+	}
+	redactWith(t, nil, nil, redactPixelate)
+	dir := t.TempDir()
+	script := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	photo := filepath.Join(dir, "street.jpg")
+	if err := os.WriteFile(photo, []byte("jpeg"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runs := filepath.Join(dir, "runs")
+
+	found := script("found", `echo "$@" >> `+runs+`; printf '1,2,3,4\n5,6,7,8 9,10,11,12\n'`)
+	if err := parseRedactDetector(found + " --faces"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		regions, err := redactDetector.detect(photo)
+		want := []image.Rectangle{image.Rect(1, 2, 4, 6), image.Rect(5, 6, 12, 14), image.Rect(9, 10, 20, 22)}
+		if err != nil || len(regions) != len(want) || regions[0] != want[0] || regions[1] != want[1] || regions[2] != want[2] {
+			t.Fatalf("found %v, %v, want %v", regions, err, want)
+		}
+	}
+	if data, _ := os.ReadFile(runs); string(data) != "--faces "+photo+"\n" {
+		t.Errorf("the detector ran with %q, want once with the image last", data)
+	}
+
+	for _, tt := range []struct{ name, body, err string }{
+		{"fails", "echo no model >&2; exit 3", "exit status 3: no model"},
+		{"garbage", "echo 1,2,3", `printed "1,2,3"`},
+		{"empty-region", "echo 1,2,0,4", `printed "1,2,0,4"`},
+	} {
+		if err := parseRedactDetector(script(tt.name, tt.body)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := redactDetector.detect(photo); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.err)
+		}
+	}
+
+	if err := parseRedactDetector(filepath.Join(dir, "missing")); err == nil {
+		t.Error("a missing detector was accepted")
+	}
+}
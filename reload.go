@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"image-compressor/pkg/compressor"
+)
+
+// compressionSettings is a snapshot of everything registerCompressionFlags
+// can change, so a reload can start again from the command line's values.
+type compressionSettings struct {
+	targetSize            int
+	uploadLimit           int
+	sizeMargin            margin
+	effort                int
+	qualityBelowSource    int
+	intent                string
+	tileThreshold         int
+	skipUpscaleCheck      bool
+	skipReview            bool
+	traceSearch           bool
+	linearResize          bool
+	resizeFilter          compressor.Filter
+	strictExt             bool
+	noConvert             bool
+	heicOutput            bool
+	convertAll            bool
+	keepBoth              bool
+	flattenColor          color.Color
+	flattenTransparent    bool
+	redactPath            string
+	redactRegions         map[string][]image.Rectangle
+	redactDetector        regionDetector
+	redactStyle           string
+	formatPolicies        map[string]string
+	fallbackChain         []string
+	keepMetadata          bool
+	metadataBudget        int
+	timeShift             time.Duration
+	timeOffset            string
+	gpsPrecision          int
+	creditArtist          string
+	creditCopyright       string
+	stripCopies           bool
+	reportPath            string
+	ioRetries             int
+	ioRetryDelay          time.Duration
+	outputNaming          string
+	tagMode               string
+	validateSample        float64
+	validateMinSSIM       float64
+	maxDimension          int
+	panoramaRatio         float64
+	panoramaMaxDimension  int
+	panoramaTiles         bool
+	destinationName       string
+	destinationBatchLimit int
+	maxWidth              int
+	maxHeight             int
+	displayWidth          int
+	displayHeight         int
+	displayDPR            float64
+	qualityCap            int
+	canvasWidth           int
+	canvasHeight          int
+	padColor              color.Color
+	profileSizes          []int
+	faviconProfile        bool
+	hiddenLayers          bool
+	layerNames            []string
+}
+
+func currentSettings() compressionSettings {
+	return compressionSettings{
+		targetSize:            targetSize,
+		uploadLimit:           uploadLimit,
+		sizeMargin:            sizeMargin,
+		effort:                effort,
+		qualityBelowSource:    qualityBelowSource,
+		intent:                intent,
+		tileThreshold:         tileThreshold,
+		skipUpscaleCheck:      skipUpscaleCheck,
+		skipReview:            skipReview,
+		traceSearch:           traceSearch,
+		linearResize:          linearResize,
+		resizeFilter:          resizeFilter,
+		strictExt:             strictExt,
+		noConvert:             noConvert,
+		heicOutput:            heicOutput,
+		convertAll:            convertAll,
+		keepBoth:              keepBoth,
+		flattenColor:          flattenColor,
+		flattenTransparent:    flattenTransparent,
+		redactPath:            redactPath,
+		redactRegions:         redactRegions,
+		redactDetector:        redactDetector,
+		redactStyle:           redactStyle,
+		formatPolicies:        formatPolicies,
+		fallbackChain:         fallbackChain,
+		keepMetadata:          keepMetadata,
+		metadataBudget:        metadataBudget,
+		timeShift:             timeShift,
+		timeOffset:            timeOffset,
+		gpsPrecision:          gpsPrecision,
+		creditArtist:          creditArtist,
+		creditCopyright:       creditCopyright,
+		stripCopies:           stripCopies,
+		reportPath:            reportPath,
+		ioRetries:             ioRetries,
+		ioRetryDelay:          ioRetryDelay,
+		outputNaming:          outputNaming,
+		tagMode:               tagMode,
+		validateSample:        validateSample,
+		validateMinSSIM:       validateMinSSIM,
+		maxDimension:          maxDimension,
+		panoramaRatio:         panoramaRatio,
+		panoramaMaxDimension:  panoramaMaxDimension,
+		panoramaTiles:         panoramaTiles,
+		destinationName:       destinationName,
+		destinationBatchLimit: destinationBatchLimit,
+		maxWidth:              maxWidth,
+		maxHeight:             maxHeight,
+		displayWidth:          displayWidth,
+		displayHeight:         displayHeight,
+		displayDPR:            displayDPR,
+		qualityCap:            qualityCap,
+		canvasWidth:           canvasWidth,
+		canvasHeight:          canvasHeight,
+		padColor:              padColor,
+		profileSizes:          profileSizes,
+		faviconProfile:        faviconProfile,
+		hiddenLayers:          hiddenLayers,
+		layerNames:            layerNames,
+	}
+}
+
+func (s compressionSettings) apply() {
+	targetSize = s.targetSize
+	uploadLimit = s.uploadLimit
+	sizeMargin = s.sizeMargin
+	effort = s.effort
+	qualityBelowSource = s.qualityBelowSource
+	intent = s.intent
+	tileThreshold = s.tileThreshold
+	skipUpscaleCheck = s.skipUpscaleCheck
+	skipReview = s.skipReview
+	traceSearch = s.traceSearch
+	linearResize = s.linearResize
+	resizeFilter = s.resizeFilter
+	strictExt = s.strictExt
+	noConvert = s.noConvert
+	heicOutput = s.heicOutput
+	convertAll = s.convertAll
+	keepBoth = s.keepBoth
+	flattenColor = s.flattenColor
+	flattenTransparent = s.flattenTransparent
+	redactPath = s.redactPath
+	redactRegions = s.redactRegions
+	redactDetector = s.redactDetector
+	redactStyle = s.redactStyle
+	formatPolicies = s.formatPolicies
+	fallbackChain = s.fallbackChain
+	keepMetadata = s.keepMetadata
+	metadataBudget = s.metadataBudget
+	timeShift = s.timeShift
+	timeOffset = s.timeOffset
+	gpsPrecision = s.gpsPrecision
+	creditArtist = s.creditArtist
+	creditCopyright = s.creditCopyright
+	stripCopies = s.stripCopies
+	reportPath = s.reportPath
+	ioRetries = s.ioRetries
+	ioRetryDelay = s.ioRetryDelay
+	outputNaming = s.outputNaming
+	tagMode = s.tagMode
+	validateSample = s.validateSample
+	validateMinSSIM = s.validateMinSSIM
+	maxDimension = s.maxDimension
+	panoramaRatio = s.panoramaRatio
+	panoramaMaxDimension = s.panoramaMaxDimension
+	panoramaTiles = s.panoramaTiles
+	destinationName = s.destinationName
+	destinationBatchLimit = s.destinationBatchLimit
+	maxWidth = s.maxWidth
+	maxHeight = s.maxHeight
+	displayWidth = s.displayWidth
+	displayHeight = s.displayHeight
+	displayDPR = s.displayDPR
+	qualityCap = s.qualityCap
+	canvasWidth = s.canvasWidth
+	canvasHeight = s.canvasHeight
+	padColor = s.padColor
+	profileSizes = s.profileSizes
+	faviconProfile = s.faviconProfile
+	hiddenLayers = s.hiddenLayers
+	layerNames = s.layerNames
+}
+
+// configLayers resolves the compression settings from their sources. From
+// lowest to highest precedence these are the defaults, a config file,
+// environment variables and the command line, so a flag always wins and the
+// file holds what's shared. The config file is re-read when it changes or
+// on SIGHUP, and everything is applied again on top of the defaults.
+//
+// Each line of the config file is one flag with or without its leading dash,
+// e.g. "preset=whatsapp" or "-effort 7"; blank lines and lines starting with
+// # are ignored.
+type configLayers struct {
+	path     string
+	defaults compressionSettings
+	modTime  time.Time
+	// args are the compression flags given on the command line, in order
+	args []configValue
+	// values lists every value given for each flag, lowest precedence first
+	values map[string][]configValue
+}
+
+// configValue is a flag value and where it came from.
+type configValue struct {
+	name   string
+	value  string
+	source string
+}
+
+// recordedFlag stands in for a flag to note the values the command line
+// gives it, in order.
+type recordedFlag struct {
+	name   string
+	isBool bool
+	values *[]configValue
+}
+
+func (f *recordedFlag) String() string { return "" }
+
+func (f *recordedFlag) Set(s string) error {
+	*f.values = append(*f.values, configValue{name: f.name, value: s, source: "command line"})
+	return nil
+}
+
+func (f *recordedFlag) IsBoolFlag() bool { return f.isBool }
+
+// parseLayered parses args with fs, which has the compression flags
+// registered, and applies the settings of every layer. The config file is
+// *configPath if that is set, and otherwise found by defaultConfigPath.
+func parseLayered(fs *flag.FlagSet, args []string, configPath *string) (*configLayers, error) {
+	c := &configLayers{defaults: currentSettings()}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	c.args = commandLineValues(fs, args)
+	if configPath != nil && *configPath != "" {
+		c.path = longPath(*configPath)
+	} else {
+		c.path = defaultConfigPath()
+	}
+	return c, c.load()
+}
+
+// commandLineValues returns the compression flags in args, which fs parsed
+// successfully, in the order given so later ones still override earlier
+// ones such as -preset.
+func commandLineValues(fs *flag.FlagSet, args []string) []configValue {
+	names := compressionFlagNames()
+	var values, ignored []configValue
+	recorder := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	recorder.SetOutput(io.Discard)
+	fs.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flag := &recordedFlag{name: f.Name, isBool: ok && b.IsBoolFlag(), values: &ignored}
+		if names[f.Name] {
+			flag.values = &values
+		}
+		recorder.Var(flag, f.Name, f.Usage)
+	})
+	recorder.Parse(args)
+	return values
+}
+
+// compressionFlagNames returns the names of the flags
+// registerCompressionFlags adds.
+func compressionFlagNames() map[string]bool {
+	// Registering resets the settings to their defaults
+	defer currentSettings().apply()
+	names := make(map[string]bool)
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	registerCompressionFlags(fs)
+	fs.VisitAll(func(f *flag.Flag) { names[f.Name] = true })
+	return names
+}
+
+// load applies every layer on top of the defaults. If any of them is
+// invalid the settings in effect before the call are kept.
+func (c *configLayers) load() error {
+	previous := currentSettings()
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	registerCompressionFlags(fs)
+	c.defaults.apply()
+
+	values := make(map[string][]configValue)
+	set := func(v configValue) error {
+		if err := fs.Set(v.name, v.value); err != nil {
+			return fmt.Errorf("%s: -%s: %w", v.source, v.name, err)
+		}
+		values[v.name] = append(values[v.name], v)
+		return nil
+	}
+	fileValues, err := c.readFile(fs)
+	var layered []configValue
+	layered = append(layered, fileValues...)
+	layered = append(layered, envValues(fs)...)
+	layered = append(layered, c.args...)
+	for _, v := range layered {
+		if err != nil {
+			break
+		}
+		err = set(v)
+	}
+	if err == nil {
+		err = checkCompressionFlags()
+	}
+	if err != nil {
+		previous.apply()
+		return err
+	}
+	c.values = values
+	return nil
+}
+
+// readFile returns the flags in the config file, or none if there is no
+// file. Values of boolean flags may be left out.
+func (c *configLayers) readFile(fs *flag.FlagSet) ([]configValue, error) {
+	if c.path == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	// Recorded even if the file turns out invalid, so it is reported once
+	// rather than on every scan until fixed
+	c.modTime = info.ModTime()
+
+	var values []configValue
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", c.path, line)
+		name, value, ok := strings.Cut(strings.TrimLeft(text, "-"), "=")
+		if !ok {
+			name, value, ok = strings.Cut(name, " ")
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		f := fs.Lookup(name)
+		if f == nil {
+			return nil, fmt.Errorf("%s: unknown flag -%s", source, name)
+		}
+		if !ok {
+			if b, isBool := f.Value.(interface{ IsBoolFlag() bool }); !isBool || !b.IsBoolFlag() {
+				return nil, fmt.Errorf("%s: -%s needs a value", source, name)
+			}
+			value = "true"
+		}
+		values = append(values, configValue{name: name, value: value, source: source})
+	}
+	return values, nil
+}
+
+// changed reports whether the config file was modified since it was last
+// loaded.
+func (c *configLayers) changed() bool {
+	if c.path == "" {
+		return false
+	}
+	info, err := os.Stat(c.path)
+	return err == nil && !info.ModTime().Equal(c.modTime)
+}
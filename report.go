@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// reportPath is where the per-file batch report is written, if anywhere.
+var reportPath string
+
+// fileResult describes what happened to one input file.
+type fileResult struct {
+	Source      string      `json:"source"`
+	Output      string      `json:"output,omitempty"`
+	Outcome     fileOutcome `json:"outcome"`
+	InputBytes  int64       `json:"input_bytes"`
+	OutputBytes int64       `json:"output_bytes,omitempty"`
+	// SourceQuality is the estimated JPEG quality of the input, or 0 for
+	// other formats.
+	SourceQuality int `json:"source_quality,omitempty"`
+	// KeptOutput is the original-format output written next to a converted
+	// one with -keep-both.
+	KeptOutput string `json:"kept_output,omitempty"`
+	// URL is where the output was uploaded to, if it was.
+	URL   string `json:"url,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Transient is set when the file failed with an I/O error that may go
+	// away, such as a network share dropping, rather than because of its
+	// content. Running again may well succeed.
+	Transient bool `json:"transient,omitempty"`
+	// Review says why the source looks degraded, e.g. blurry, and its
+	// output deserves a look before it's published.
+	Review string `json:"review,omitempty"`
+	// KeptInstead is the source compressed in place of a skipped burst
+	// frame or near-duplicate.
+	KeptInstead string `json:"kept_instead,omitempty"`
+}
+
+func (r fileResult) failed(err error) fileResult {
+	r.Outcome = outcomeFailed
+	r.Error = err.Error()
+	r.Transient = isTransientIOError(err)
+	return r
+}
+
+// err returns the result's error, or nil if it didn't fail.
+func (r fileResult) err() error {
+	if r.Outcome != outcomeFailed {
+		return nil
+	}
+	return errors.New(r.Error)
+}
+
+func (r fileResult) done(outcome fileOutcome, output string, size int64) fileResult {
+	r.Outcome = outcome
+	r.Output = output
+	r.OutputBytes = size
+	return r
+}
+
+func (o fileOutcome) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+func (o *fileOutcome) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "compressed":
+		*o = outcomeCompressed
+	case "copied":
+		*o = outcomeCopied
+	case "skipped":
+		*o = outcomeSkipped
+	case "failed":
+		*o = outcomeFailed
+	default:
+		return fmt.Errorf("unknown outcome %q", text)
+	}
+	return nil
+}
+
+// reportColumns are the CSV report's columns, in order.
+var reportColumns = []string{"source", "output", "outcome", "input_bytes", "output_bytes", "source_quality", "kept_output", "url", "error", "transient", "review", "kept_instead"}
+
+// writeReport writes results to path as CSV if it ends in .csv, or as a
+// JSON array otherwise.
+func writeReport(path string, results []fileResult) error {
+	if results == nil {
+		results = []fileResult{}
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		var b strings.Builder
+		w := csv.NewWriter(&b)
+		w.Write(reportColumns)
+		for _, r := range results {
+			w.Write([]string{
+				r.Source,
+				r.Output,
+				r.Outcome.String(),
+				strconv.FormatInt(r.InputBytes, 10),
+				strconv.FormatInt(r.OutputBytes, 10),
+				strconv.Itoa(r.SourceQuality),
+				r.KeptOutput,
+				r.URL,
+				r.Error,
+				strconv.FormatBool(r.Transient),
+				r.Review,
+				r.KeptInstead,
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+		return writeOutput(path, []byte(b.String()))
+	}
+
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeOutput(path, append(data, '\n'))
+}
+
+// readReport reads a report written by writeReport. CSV columns are matched
+// by name, so reports from older versions with fewer columns still load.
+func readReport(path string) ([]fileResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(filepath.Ext(path), ".csv") {
+		var results []fileResult
+		if err := json.Unmarshal(data, &results); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return results, nil
+	}
+
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	var results []fileResult
+	for line, record := range records[1:] {
+		var r fileResult
+		if err := r.Outcome.UnmarshalText([]byte(field(record, "outcome"))); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line+2, err)
+		}
+		r.Source = field(record, "source")
+		r.Output = field(record, "output")
+		r.InputBytes, _ = strconv.ParseInt(field(record, "input_bytes"), 10, 64)
+		r.OutputBytes, _ = strconv.ParseInt(field(record, "output_bytes"), 10, 64)
+		r.SourceQuality, _ = strconv.Atoi(field(record, "source_quality"))
+		r.KeptOutput = field(record, "kept_output")
+		r.URL = field(record, "url")
+		r.Error = field(record, "error")
+		r.Transient, _ = strconv.ParseBool(field(record, "transient"))
+		r.Review = field(record, "review")
+		r.KeptInstead = field(record, "kept_instead")
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// reportOptions holds the flags of the report subcommand.
+type reportOptions struct {
+	failed bool
+}
+
+func reportFlagSet(o *reportOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	fs.BoolVar(&o.failed, "failed", false, "only list the files that failed")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s report [-failed] report.json|report.csv\n", programName())
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// runReport implements the report subcommand, which summarizes a report
+// written with -report: how many files had each outcome, how many bytes
+// were saved, and why files failed.
+func runReport(args []string) error {
+	var opts reportOptions
+	fs := reportFlagSet(&opts)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one report file")
+	}
+	results, err := readReport(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var counts [outcomeSkipped + 1]int
+	var input, output int64
+	transient := 0
+	for _, r := range results {
+		counts[r.Outcome]++
+		if r.Transient {
+			transient++
+		}
+		// Profile outputs have no single size to compare
+		if r.Outcome != outcomeFailed && r.OutputBytes > 0 {
+			input += r.InputBytes
+			output += r.OutputBytes
+		}
+		if r.Transient {
+			fmt.Printf("%s: %s (transient I/O error)\n", r.Source, r.Error)
+		} else if r.Outcome == outcomeFailed {
+			fmt.Printf("%s: %s\n", r.Source, r.Error)
+		} else if r.KeptInstead != "" && !opts.failed {
+			fmt.Printf("%s: %s, %s kept instead\n", r.Source, r.Outcome, r.KeptInstead)
+		} else if !opts.failed {
+			fmt.Printf("%s: %s, %s -> %s\n", r.Source, r.Outcome, formatSize(int(r.InputBytes)), formatSize(int(r.OutputBytes)))
+		}
+	}
+	fmt.Printf("\n%d files: %d compressed, %d copied, %d skipped, %d failed\n",
+		len(results), counts[outcomeCompressed], counts[outcomeCopied], counts[outcomeSkipped], counts[outcomeFailed])
+	if transient > 0 {
+		fmt.Printf("%d of the failures were transient I/O errors; running again may fix them\n", transient)
+	}
+	printReview(results)
+	if input > 0 {
+		fmt.Printf("Input %s, output %s (%.1f%% smaller)\n",
+			formatSize(int(input)), formatSize(int(output)), 100*float64(input-output)/float64(input))
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"image-compressor/pkg/compressor"
+)
+
+// linearResize makes resizing average colors in linear light instead of in
+// gamma-encoded sRGB, which otherwise darkens fine detail such as foliage,
+// text and thin highlights.
+var linearResize bool
+
+// resizeFilter, set by -resize-filter, is how images are resampled when
+// they are scaled down.
+var resizeFilter compressor.Filter
+
+// parseResizeFilter sets resizeFilter from the name of a filter.
+func parseResizeFilter(s string) error {
+	f, err := compressor.ParseFilter(s)
+	if err != nil {
+		return fmt.Errorf("unknown resize filter %q (want box, catmull-rom or lanczos)", s)
+	}
+	resizeFilter = f
+	return nil
+}
+
+// resizeImage scales img down to width x height; see compressor.Resample.
+func resizeImage(img image.Image, width, height int) *image.RGBA {
+	defer startSpan("resize", "width", width, "height", height, "filter", resizeFilter.String())(nil)
+	return compressor.Resample(img, width, height, linearResize, resizeFilter)
+}
+
+// fitLongEdge returns img scaled down so that its longer side is at most
+// size pixels, or img itself if it already fits.
+func fitLongEdge(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := compressor.LongEdgeSize(bounds.Dx(), bounds.Dy(), size)
+	if w == bounds.Dx() && h == bounds.Dy() {
+		return img
+	}
+	return resizeImage(img, w, h)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"strings"
+	"sync"
+
+	"image-compressor/pkg/compressor"
+)
+
+// skipReview turns off flagging images that look blurry or were already
+// badly compressed.
+var skipReview bool
+
+// sourceSharpness holds the sharpness of each source measured while it was
+// decoded for compression, so processFile can flag blurry images without
+// decoding them again.
+var sourceSharpness sync.Map
+
+// recordSharpness measures the decoded source img of srcPath for review.
+func recordSharpness(srcPath string, img image.Image) {
+	if skipReview {
+		return
+	}
+	sourceSharpness.Store(srcPath, measureSharpness(img))
+}
+
+// measureSharpness is the sharpness analyze reports for img.
+func measureSharpness(img image.Image) float64 {
+	return sharpness(luminance(compressor.Flatten(fitLongEdge(img, analyzeEdge), flattenColor)))
+}
+
+// reviewReasons returns why the source of result should be looked at by
+// someone before its output is published, or "" if nothing stands out:
+// it looks blurry, or its JPEG quality was already low. Sources that were
+// copied rather than decoded are decoded here to measure them.
+func reviewReasons(result fileResult) string {
+	value, measured := sourceSharpness.LoadAndDelete(result.Source)
+	if skipReview || result.Outcome == outcomeFailed || result.Outcome == outcomeSkipped {
+		return ""
+	}
+	if !measured {
+		file, err := os.Open(result.Source)
+		if err != nil {
+			return ""
+		}
+		img, _, err := decodeLimited(file)
+		file.Close()
+		if err != nil {
+			return ""
+		}
+		value = measureSharpness(img)
+	}
+
+	var reasons []string
+	if s := value.(float64); s < blurThreshold {
+		reasons = append(reasons, fmt.Sprintf("looks blurry (sharpness %.0f)", s))
+	}
+	if result.SourceQuality > 0 && result.SourceQuality <= lowQualityThreshold {
+		reasons = append(reasons, fmt.Sprintf("source already q%d", result.SourceQuality))
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// printReview lists the results flagged for review, if any.
+func printReview(results []fileResult) {
+	var flagged []fileResult
+	for _, r := range results {
+		if r.Review != "" {
+			flagged = append(flagged, r)
+		}
+	}
+	if len(flagged) == 0 {
+		return
+	}
+	fmt.Printf("\n%d image(s) to review before publishing:\n", len(flagged))
+	for _, r := range flagged {
+		fmt.Printf("  %s: %s\n", r.Source, r.Review)
+	}
+}
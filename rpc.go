@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// rpcProtocolVersion is bumped whenever the rpc schema changes in a way
+// wrappers have to know about.
+const rpcProtocolVersion = 1
+
+// rpcSchema documents the rpc subcommand for wrapper authors; help rpc
+// prints it.
+const rpcSchema = `The rpc command speaks JSON-RPC 2.0 over stdin and stdout, one message
+per line. Requests are handled one at a time, in order. Anything else the
+program prints goes to stderr.
+
+Methods:
+  capabilities
+    params: none
+    result: {"protocol": 1, "version", "go", "platform",
+             "features": [{"name", "enabled", "detail"}],
+             "methods": [...], "notifications": [...],
+             "flags": [{"name", "usage", "default"}]}
+  compress
+    params: {"paths": [file or directory, ...], "out": directory,
+             "flags": {"target": "500KB", "effort": 7, ...}}
+      flags are the compression flags of the command line, by name without
+      the dash, applied on top of the ones rpc was started with for this
+      request only.
+    result: {"results": [{"source", "output", "outcome", "input_bytes",
+             "output_bytes", "error", ...}], "compressed", "copied", "skipped", "failed"}
+  shutdown
+    params: none
+    result: null, after which the program exits
+
+Notifications sent while compress runs, carrying the id of its request:
+  progress  {"request", "file", "index", "total", "state": "started"}
+            {"request", "file", "index", "total", "state": "finished",
+             "result": {...}}
+  log       {"request", "text"}: the lines the command line would print
+
+Errors use the JSON-RPC codes: -32700 parse error, -32600 invalid request,
+-32601 unknown method, -32602 invalid params. Images that fail don't fail
+the request; they are reported in its results.`
+
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcUnknownMethod  = -32601
+	rpcInvalidParams  = -32602
+)
+
+// rpcMethods are the methods the rpc command answers.
+var rpcMethods = []string{"capabilities", "compress", "shutdown"}
+
+// rpcOptions holds the flags of the rpc subcommand.
+type rpcOptions struct {
+	config string
+}
+
+func rpcFlagSet(o *rpcOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("rpc", flag.ExitOnError)
+	registerConfigFlag(fs, &o.config)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rpc [flags]\n\n%s\n\nFlags, the defaults of every request:\n", programName(), rpcSchema)
+		fs.PrintDefaults()
+	}
+	registerCompressionFlags(fs)
+	return fs
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  any             `json:"params,omitempty"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+// rpcConn writes messages to the client. request is the id of the request
+// being handled, which notifications carry.
+type rpcConn struct {
+	mu      sync.Mutex
+	out     *json.Encoder
+	request json.RawMessage
+}
+
+func (c *rpcConn) send(m rpcMessage) {
+	m.JSONRPC = "2.0"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.out.Encode(m)
+}
+
+func (c *rpcConn) notify(method string, params map[string]any) {
+	params["request"] = c.request
+	c.send(rpcMessage{Method: method, Params: params})
+}
+
+// Write makes the connection the log output: every block of progress
+// lines becomes a log notification.
+func (c *rpcConn) Write(p []byte) (int, error) {
+	if len(bytes.TrimSpace(p)) > 0 {
+		c.notify("log", map[string]any{"text": string(p)})
+	}
+	return len(p), nil
+}
+
+// runRPC implements the rpc subcommand.
+func runRPC(args []string) error {
+	var opts rpcOptions
+	fs := rpcFlagSet(&opts)
+	if _, err := parseLayered(fs, args, &opts.config); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected %q", fs.Arg(0))
+	}
+
+	// Stdout carries only protocol messages; stray output goes to stderr
+	conn := &rpcConn{out: json.NewEncoder(os.Stdout)}
+	os.Stdout = os.Stderr
+	logOutput = conn
+	base := currentSettings()
+
+	in := json.NewDecoder(os.Stdin)
+	for {
+		var raw json.RawMessage
+		if err := in.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			conn.send(rpcMessage{ID: json.RawMessage("null"), Error: &rpcError{rpcParseError, err.Error()}})
+			return err
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+			conn.send(rpcMessage{ID: json.RawMessage("null"), Error: &rpcError{rpcInvalidRequest, "not a JSON-RPC 2.0 request object"}})
+			continue
+		}
+		conn.request = req.ID
+		result, err := handleRPC(conn, req)
+		base.apply()
+		switch {
+		case req.ID == nil:
+			// Notifications get no response
+		case err != nil:
+			var rerr *rpcError
+			if !errors.As(err, &rerr) {
+				rerr = &rpcError{rpcInvalidParams, err.Error()}
+			}
+			conn.send(rpcMessage{ID: req.ID, Error: rerr})
+		case result == nil:
+			conn.send(rpcMessage{ID: req.ID, Result: json.RawMessage("null")})
+		default:
+			conn.send(rpcMessage{ID: req.ID, Result: result})
+		}
+		if req.Method == "shutdown" {
+			return nil
+		}
+	}
+}
+
+func handleRPC(conn *rpcConn, req rpcRequest) (any, error) {
+	switch req.Method {
+	case "capabilities":
+		return rpcCapabilities(), nil
+	case "compress":
+		var params struct {
+			Paths []string       `json:"paths"`
+			Out   string         `json:"out"`
+			Flags map[string]any `json:"flags"`
+		}
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return nil, err
+			}
+		}
+		if len(params.Paths) == 0 || params.Out == "" {
+			return nil, errors.New("compress needs paths and out")
+		}
+		if err := applyFlagValues(params.Flags); err != nil {
+			return nil, err
+		}
+		return rpcCompress(conn, params.Paths, longPath(params.Out))
+	case "shutdown":
+		return nil, nil
+	}
+	return nil, &rpcError{rpcUnknownMethod, "unknown method " + req.Method}
+}
+
+// rpcCapabilities describes what this build can do, for wrappers to check
+// before relying on it.
+func rpcCapabilities() map[string]any {
+	build := currentBuild(true)
+	// Registering resets the settings to their defaults
+	defer currentSettings().apply()
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	registerCompressionFlags(fs)
+	var flags []map[string]string
+	fs.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, map[string]string{"name": f.Name, "usage": f.Usage, "default": flagDefault(f)})
+	})
+	return map[string]any{
+		"protocol":      rpcProtocolVersion,
+		"version":       build.Version,
+		"go":            build.Go,
+		"platform":      build.Platform,
+		"features":      build.Features,
+		"methods":       rpcMethods,
+		"notifications": []string{"progress", "log"},
+		"flags":         flags,
+	}
+}
+
+// applyFlagValues sets compression flags by name on top of the current
+// settings, as if they were given on the command line.
+func applyFlagValues(values map[string]any) error {
+	current := currentSettings()
+	fs := flag.NewFlagSet("rpc", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	registerCompressionFlags(fs)
+	current.apply()
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+		if err := fs.Set(name, fmt.Sprint(values[name])); err != nil {
+			return fmt.Errorf("-%s: %w", name, err)
+		}
+	}
+	return checkCompressionFlags()
+}
+
+// rpcCompress compresses the images at paths into out, notifying the
+// client as each one starts and finishes.
+func rpcCompress(conn *rpcConn, paths []string, out string) (any, error) {
+	files, err := imagePaths(paths)
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, err.Error()}
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return nil, &rpcError{rpcInvalidParams, err.Error()}
+	}
+	results := make([]fileResult, 0, len(files))
+	counts := make(map[fileOutcome]int)
+	for i, path := range files {
+		conn.notify("progress", map[string]any{"file": path, "index": i, "total": len(files), "state": "started"})
+		result := processFileRetrying(path, out)
+		conn.notify("progress", map[string]any{"file": path, "index": i, "total": len(files), "state": "finished", "result": result})
+		results = append(results, result)
+		counts[result.Outcome]++
+	}
+	return map[string]any{
+		"results":    results,
+		"compressed": counts[outcomeCompressed],
+		"copied":     counts[outcomeCopied],
+		"skipped":    counts[outcomeSkipped],
+		"failed":     counts[outcomeFailed],
+	}, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+)
+
+// scanBatchSize is how many directory entries a dirScanner reads at a
+// time, so listing a directory of millions of files takes bounded memory.
+const scanBatchSize = 1000
+
+// dirScanner lists the images directly in a directory a batch at a time.
+// Batches come in the order the file system returns entries, sorted by name
+// within each batch; a directory of up to scanBatchSize entries comes out
+// fully sorted, as os.ReadDir would list it.
+type dirScanner struct {
+	dir  string
+	file *os.File
+}
+
+func openScanner(dir string) (*dirScanner, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &dirScanner{dir: dir, file: file}, nil
+}
+
+// next returns the paths of the images in the next batch of entries, which
+// may be none, or io.EOF after the last batch.
+func (s *dirScanner) next() ([]string, error) {
+	entries, err := s.file.ReadDir(scanBatchSize)
+	if len(entries) == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	var paths []string
+	for _, e := range entries {
+		path := filepath.Join(s.dir, e.Name())
+		if !e.IsDir() && isSupportedImage(path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+func (s *dirScanner) close() error {
+	return s.file.Close()
+}
+
+const recursiveUsage = "also compress the images in every subdirectory of the input directories, recreating the folders under the output directory"
+
+// registerRecursive registers -recursive, storing its value in recursive.
+func registerRecursive(fs *flag.FlagSet, recursive *bool) {
+	fs.BoolVar(recursive, "recursive", false, recursiveUsage)
+}
+
+// sourceScanner lists the images of a batch's inputs a batch at a time:
+// the image files given directly first, as one batch, then the images in
+// each directory as a dirScanner lists them.
+type sourceScanner struct {
+	files []string
+	dirs  []sourceDir
+	dir   *dirScanner
+	root  string
+}
+
+// sourceDir is a directory to scan, and the input directory it was found
+// under.
+type sourceDir struct {
+	root, dir string
+}
+
+// sourceBatch is a batch of images a sourceScanner lists: the files given
+// directly, with root "", or images directly in dir, a directory under the
+// input directory root.
+type sourceBatch struct {
+	root, dir string
+	paths     []string
+}
+
+// rel returns the directory of the batch's images relative to their input
+// directory, which outputs mirror, or "." for the files given directly.
+func (b sourceBatch) rel() string {
+	if b.root == "" {
+		return "."
+	}
+	rel, err := filepath.Rel(b.root, b.dir)
+	if err != nil {
+		return "."
+	}
+	return rel
+}
+
+// openSources sorts inputs, paths of images and directories, into the
+// files and directories to scan. With recursive, the directories under
+// every input directory are scanned too, except exclude and what is under
+// them.
+func openSources(inputs []string, recursive bool, exclude ...string) (*sourceScanner, error) {
+	s := new(sourceScanner)
+	for _, input := range inputs {
+		info, err := os.Stat(input)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case info.IsDir() && recursive:
+			err := filepath.WalkDir(input, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || !d.IsDir() {
+					return err
+				}
+				if slices.Contains(exclude, path) {
+					return filepath.SkipDir
+				}
+				s.dirs = append(s.dirs, sourceDir{root: input, dir: path})
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		case info.IsDir():
+			s.dirs = append(s.dirs, sourceDir{root: input, dir: input})
+		case slices.Contains(s.files, input):
+			// processBatch tells files apart by path
+		case isSupportedImage(input):
+			s.files = append(s.files, input)
+		default:
+			return nil, fmt.Errorf("%s is not a supported image", input)
+		}
+	}
+	return s, nil
+}
+
+// next returns the next batch, or io.EOF after the last one.
+func (s *sourceScanner) next() (sourceBatch, error) {
+	if len(s.files) > 0 {
+		files := s.files
+		s.files = nil
+		return sourceBatch{paths: files}, nil
+	}
+	for {
+		if s.dir == nil {
+			if len(s.dirs) == 0 {
+				return sourceBatch{}, io.EOF
+			}
+			dir, err := openScanner(s.dirs[0].dir)
+			if err != nil {
+				return sourceBatch{}, err
+			}
+			s.dir, s.root, s.dirs = dir, s.dirs[0].root, s.dirs[1:]
+		}
+		paths, err := s.dir.next()
+		if err != io.EOF {
+			return sourceBatch{root: s.root, dir: s.dir.dir, paths: paths}, err
+		}
+		s.dir.close()
+		s.dir = nil
+	}
+}
+
+func (s *sourceScanner) close() error {
+	if s.dir == nil {
+		return nil
+	}
+	return s.dir.close()
+}
+
+const checkpointUsage = "record finished files in this file after every batch of directory entries, and skip the files it lists when a batch is run again, so an interrupted run over a huge directory resumes where it stopped; removed once the batch completes"
+
+// registerCheckpoint registers -checkpoint, storing its value in path.
+func registerCheckpoint(fs *flag.FlagSet, path *string) {
+	fs.StringVar(path, "checkpoint", "", checkpointUsage)
+}
+
+// checkpoint records the files a batch has finished, one path per line,
+// so a rerun can skip them. Checkpoints of older versions list names.
+type checkpoint struct {
+	path string
+	file *os.File
+	out  *bufio.Writer
+	// done holds the paths finished by earlier runs
+	done map[string]bool
+}
+
+// openCheckpoint reads the checkpoint at path, if there is one, and opens
+// it to record more. A nil checkpoint records nothing.
+func openCheckpoint(path string) (*checkpoint, error) {
+	if path == "" {
+		return nil, nil
+	}
+	c := &checkpoint{path: path, done: make(map[string]bool)}
+	if file, err := os.Open(path); err == nil {
+		lines := bufio.NewScanner(file)
+		for lines.Scan() {
+			c.done[lines.Text()] = true
+		}
+		file.Close()
+		if err := lines.Err(); err != nil {
+			return nil, fmt.Errorf("reading checkpoint: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c.file, c.out = file, bufio.NewWriter(file)
+	return c, nil
+}
+
+// resumed returns how many files earlier runs finished.
+func (c *checkpoint) resumed() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.done)
+}
+
+// finished reports whether an earlier run finished the file at path.
+func (c *checkpoint) finished(path string) bool {
+	return c != nil && (c.done[path] || c.done[filepath.Base(path)])
+}
+
+// record marks the file at path finished, once the next save has run.
+func (c *checkpoint) record(path string) {
+	if c != nil {
+		fmt.Fprintln(c.out, path)
+	}
+}
+
+// save writes what has been recorded to disk.
+func (c *checkpoint) save() error {
+	if c == nil {
+		return nil
+	}
+	if err := c.out.Flush(); err != nil {
+		return err
+	}
+	return c.file.Sync()
+}
+
+// close saves the checkpoint, and removes it if the batch completed.
+func (c *checkpoint) close(completed bool) error {
+	if c == nil {
+		return nil
+	}
+	err := c.save()
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && completed {
+		err = os.Remove(c.path)
+	}
+	return err
+}
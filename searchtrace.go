@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"image-compressor/pkg/compressor"
+)
+
+// traceSearch prints every encode the size searches try, with its quality,
+// size and what the search does next.
+var traceSearch bool
+
+// searchTracer returns a compressor.Options.Trace function writing attempts
+// to log, or nil without -trace or a log to write to.
+func searchTracer(log *fileLog) func(compressor.Attempt) {
+	if !traceSearch || log == nil {
+		return nil
+	}
+	return func(a compressor.Attempt) {
+		log.Line("  q%d: %s, %s", a.Quality, formatSize(a.Size), attemptDecision(a))
+	}
+}
+
+// attemptDecision describes what a quality search did after an attempt.
+func attemptDecision(a compressor.Attempt) string {
+	switch {
+	case a.Fits && a.Next == 0:
+		return "fits"
+	case a.Fits:
+		return fmt.Sprintf("fits, trying higher q%d", a.Next)
+	case a.Next == 0:
+		return "over target, stopping"
+	}
+	return fmt.Sprintf("over target, trying q%d", a.Next)
+}
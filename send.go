@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smtpPasswordEnv overrides the password in the SMTP config, so it can be
+// kept out of the file.
+const smtpPasswordEnv = "IMAGE_COMPRESSOR_SMTP_PASSWORD"
+
+// attachmentBudgets is the total attachment size each mail provider accepts.
+var attachmentBudgets = map[string]int{
+	"gmail":   25 * 1000 * 1000,
+	"outlook": 20 * 1000 * 1000,
+	"yahoo":   25 * 1000 * 1000,
+	"icloud":  20 * 1000 * 1000,
+	"generic": 10 * 1000 * 1000,
+}
+
+// smtpConfig is the JSON file describing how to send mail.
+type smtpConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+	Provider string `json:"provider"`
+}
+
+// sendOptions holds the flags of the send subcommand.
+type sendOptions struct {
+	config   string
+	to       string
+	subject  string
+	body     string
+	provider string
+	// settings is the file of compression flags; config is the SMTP one
+	settings string
+}
+
+func sendFlagSet(o *sendOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	fs.StringVar(&o.config, "smtp-config", "smtp.json", "SMTP settings file (JSON with host, port, username, password, from, provider)")
+	fs.StringVar(&o.to, "to", "", "comma-separated recipients")
+	fs.StringVar(&o.subject, "subject", "Photos", "message subject")
+	fs.StringVar(&o.body, "body", "", "message text")
+	fs.StringVar(&o.provider, "provider", "", "attachment budget to fit: gmail, outlook, yahoo, icloud or generic (default: from config)")
+	registerConfigFlag(fs, &o.settings)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s send -to addr [flags] image...\n", programName())
+		fs.PrintDefaults()
+	}
+	registerCompressionFlags(fs)
+	return fs
+}
+
+// runSend implements the send subcommand, which compresses images to fit a
+// mail provider's attachment limit and mails them in one message.
+func runSend(args []string) error {
+	var opts sendOptions
+	fs := sendFlagSet(&opts)
+	if _, err := parseLayered(fs, args, &opts.settings); err != nil {
+		return err
+	}
+	if opts.to == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("need -to and at least one image")
+	}
+
+	cfg, err := loadSMTPConfig(opts.config)
+	if err != nil {
+		return err
+	}
+	provider := opts.provider
+	if provider == "" {
+		provider = cfg.Provider
+	}
+	if provider == "" {
+		provider = "generic"
+	}
+	budget, ok := attachmentBudgets[provider]
+	if !ok {
+		return fmt.Errorf("unknown provider %q", provider)
+	}
+
+	// Attachments grow by a third when base64 encoded; keep some room for
+	// headers and the body too
+	rawBudget := budget*3/4 - 64*1000
+	perFile := rawBudget / fs.NArg()
+	targetSize = min(targetSize, perFile)
+	fmt.Printf("Fitting %d image(s) into %s's %d MB limit (%d KB each)\n", fs.NArg(), provider, budget/(1000*1000), targetSize/1000)
+
+	tmpDir, err := os.MkdirTemp("", shortName+"-send-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var attachments []string
+	for _, path := range fs.Args() {
+		result := processFileRetrying(longPath(path), tmpDir)
+		if result.Outcome == outcomeFailed {
+			return fmt.Errorf("%s: %s", path, result.Error)
+		}
+		attachments = append(attachments, result.Output)
+	}
+
+	recipients, err := mail.ParseAddressList(opts.to)
+	if err != nil {
+		return fmt.Errorf("-to: %w", err)
+	}
+	msg, err := buildMessage(cfg.From, recipients, opts.subject, opts.body, attachments)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sending %.2f MB message to %s... ", float64(len(msg))/(1000*1000), opts.to)
+	if err := sendMail(cfg, recipients, msg); err != nil {
+		fmt.Println("FAILED")
+		return err
+	}
+	fmt.Println("SENT")
+	return nil
+}
+
+func loadSMTPConfig(path string) (*smtpConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading SMTP config: %w", err)
+	}
+	var cfg smtpConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if password := os.Getenv(smtpPasswordEnv); password != "" {
+		cfg.Password = password
+	}
+	if cfg.Host == "" || cfg.From == "" {
+		return nil, fmt.Errorf("%s must set host and from", path)
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 587
+	}
+	return &cfg, nil
+}
+
+// buildMessage assembles a multipart/mixed message with the files attached.
+func buildMessage(from string, to []*mail.Address, subject, body string, files []string) ([]byte, error) {
+	var boundaryBytes [16]byte
+	if _, err := rand.Read(boundaryBytes[:]); err != nil {
+		return nil, err
+	}
+	boundary := hex.EncodeToString(boundaryBytes[:])
+
+	addresses := make([]string, len(to))
+	for i, addr := range to {
+		addresses[i] = addr.String()
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(addresses, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(path)
+		contentType := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: %s\r\n", contentType)
+		b.WriteString("Content-Transfer-Encoding: base64\r\n")
+		fmt.Fprintf(&b, "Content-Disposition: %s\r\n\r\n", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+
+		encoded := base64.StdEncoding.EncodeToString(data)
+		for len(encoded) > 76 {
+			b.WriteString(encoded[:76])
+			b.WriteString("\r\n")
+			encoded = encoded[76:]
+		}
+		b.WriteString(encoded)
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return b.Bytes(), nil
+}
+
+// sendMail delivers msg, using implicit TLS on port 465 and STARTTLS (when
+// offered) on any other port.
+func sendMail(cfg *smtpConfig, to []*mail.Address, msg []byte) error {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return fmt.Errorf("from: %w", err)
+	}
+	recipients := make([]string, len(to))
+	for i, a := range to {
+		recipients[i] = a.Address
+	}
+
+	if cfg.Port != 465 {
+		return smtp.SendMail(addr, auth, from.Address, recipients, msg)
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: cfg.Host})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, r := range recipients {
+		if err := client.Rcpt(r); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxUploadBytes bounds the request bodies the server accepts.
+const maxUploadBytes = 200 * 1000 * 1000
+
+// tenant is one API key's policy in server mode. Zero values fall back to
+// the settings given on the command line.
+type tenant struct {
+	Name          string   `json:"name"`
+	Key           string   `json:"key"`
+	TargetKB      int      `json:"target_kb"`
+	Formats       []string `json:"formats"`
+	MaxDimension  int      `json:"max_dimension"`
+	Effort        int      `json:"effort"`
+	RatePerMinute int      `json:"rate_per_minute"`
+
+	settings compressionSettings
+	limiter  *rateLimiter
+}
+
+// tenantConfig is the JSON file passed to serve -tenants.
+type tenantConfig struct {
+	Tenants []*tenant `json:"tenants"`
+}
+
+// serveOptions holds the flags of the serve subcommand.
+type serveOptions struct {
+	addr     string
+	tenants  string
+	auditLog string
+	config   string
+}
+
+func serveFlagSet(o *serveOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.StringVar(&o.addr, "addr", "127.0.0.1:8080", "address to listen on")
+	fs.StringVar(&o.auditLog, "audit-log", "", "append a JSON line per request to this file (who, when, options, input and output hashes)")
+	fs.StringVar(&o.tenants, "tenants", "", "JSON file of per-API-key policies (default: no authentication)")
+	registerConfigFlag(fs, &o.config)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve [-addr host:port] [-tenants file] [flags]\n", programName())
+		fs.PrintDefaults()
+	}
+	registerCompressionFlags(fs)
+	return fs
+}
+
+// server compresses images POSTed to /compress and estimates their sizes
+// for images POSTed to /estimate. GET /features lists the codecs the build
+// has, so clients can tell what it accepts. Compression reads the
+// package-level settings, so requests are compressed one at a time with the
+// requesting tenant's settings applied.
+type server struct {
+	base    compressionSettings
+	tenants []*tenant
+	audit   *auditLog
+
+	mu sync.Mutex
+}
+
+// runServe implements the serve subcommand, an HTTP service that returns
+// each uploaded image compressed.
+func runServe(args []string) error {
+	var opts serveOptions
+	if _, err := parseLayered(serveFlagSet(&opts), args, &opts.config); err != nil {
+		return err
+	}
+	if len(profileSizes) > 0 {
+		return fmt.Errorf("-sizes is not supported in server mode")
+	}
+	if outputNaming != "original" {
+		return fmt.Errorf("-name is not supported in server mode")
+	}
+	shutdownTracing, err := initTracing()
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing()
+
+	s := &server{base: currentSettings()}
+	if opts.tenants != "" {
+		tenants, err := loadTenants(opts.tenants, s.base)
+		if err != nil {
+			return err
+		}
+		s.tenants = tenants
+	}
+	if opts.auditLog != "" {
+		audit, err := openAuditLog(longPath(opts.auditLog))
+		if err != nil {
+			return err
+		}
+		defer audit.close()
+		s.audit = audit
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/compress", s.handleCompress)
+	mux.HandleFunc("/estimate", s.handleEstimate)
+	mux.HandleFunc("/features", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(currentBuild(true))
+	})
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		writeProbe(rw, encoderSelfCheck(selfCheckTimeout))
+	})
+	mux.HandleFunc("/readyz", func(rw http.ResponseWriter, r *http.Request) {
+		writeProbe(rw, nil)
+	})
+
+	printBanner("Serving")
+	printSettings()
+	if len(s.tenants) > 0 {
+		fmt.Printf("Tenants: %d\n", len(s.tenants))
+	} else {
+		fmt.Println("Tenants: none, requests are not authenticated")
+	}
+	if s.audit != nil {
+		fmt.Printf("Audit log: %s\n", opts.auditLog)
+	}
+	fmt.Printf("Listening on: %s\n\n", opts.addr)
+	return http.ListenAndServe(opts.addr, mux)
+}
+
+// loadTenants reads a tenant file and resolves each tenant's settings on top
+// of base.
+func loadTenants(path string, base compressionSettings) ([]*tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg tenantConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	keys := make(map[string]bool)
+	for i, t := range cfg.Tenants {
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("tenant %d", i+1)
+		}
+		if t.Key == "" || keys[t.Key] {
+			return nil, fmt.Errorf("%s: %s needs a unique key", path, t.Name)
+		}
+		keys[t.Key] = true
+		if t.Effort != 0 && (t.Effort < minEffort || t.Effort > maxEffort) {
+			return nil, fmt.Errorf("%s: %s: effort must be between %d and %d", path, t.Name, minEffort, maxEffort)
+		}
+		if t.TargetKB < 0 || t.MaxDimension < 0 || t.RatePerMinute < 0 {
+			return nil, fmt.Errorf("%s: %s: limits must not be negative", path, t.Name)
+		}
+
+		t.settings = base
+		if t.TargetKB > 0 {
+			// target_kb is the tenant's -target, which outputs stay
+			// -margin under like any other
+			t.settings.uploadLimit = t.TargetKB * 1000
+			t.settings.targetSize = t.settings.sizeMargin.below(t.settings.uploadLimit)
+			if t.settings.targetSize <= 0 {
+				return nil, fmt.Errorf("%s: %s: target_kb %d leaves nothing after the %s margin", path, t.Name, t.TargetKB, t.settings.sizeMargin)
+			}
+		}
+		if t.MaxDimension > 0 {
+			t.settings.maxDimension = t.MaxDimension
+		}
+		if t.Effort > 0 {
+			t.settings.effort = t.Effort
+		}
+		for j, format := range t.Formats {
+			t.Formats[j] = strings.ToLower(format)
+		}
+		if t.RatePerMinute > 0 {
+			t.limiter = newRateLimiter(t.RatePerMinute)
+		}
+	}
+	return cfg.Tenants, nil
+}
+
+// authenticate returns the tenant whose key the request carries, in an
+// Authorization: Bearer or X-API-Key header.
+func (s *server) authenticate(r *http.Request) *tenant {
+	key := r.Header.Get("X-API-Key")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		key = bearer
+	}
+	if key == "" {
+		return nil
+	}
+	for _, t := range s.tenants {
+		if subtle.ConstantTimeCompare([]byte(t.Key), []byte(key)) == 1 {
+			return t
+		}
+	}
+	return nil
+}
+
+// upload is an image POSTed to the server that it has accepted, with the
+// settings it gets.
+type upload struct {
+	body     []byte
+	format   string
+	settings compressionSettings
+}
+
+// request starts answering r: its audit entry is recorded by fail, or by
+// the handler once it has succeeded.
+type request struct {
+	rw    http.ResponseWriter
+	r     *http.Request
+	audit *auditLog
+	entry auditEntry
+}
+
+func (s *server) newRequest(rw http.ResponseWriter, r *http.Request) *request {
+	return &request{
+		rw:    rw,
+		r:     r,
+		audit: s.audit,
+		entry: auditEntry{Time: time.Now().UTC(), Path: r.URL.Path, Remote: r.RemoteAddr, Tenant: "anonymous"},
+	}
+}
+
+func (q *request) fail(msg string, status int) {
+	q.entry.Status, q.entry.Error = status, msg
+	q.audit.record(q.entry)
+	http.Error(q.rw, msg, status)
+}
+
+// accept checks that the request POSTs an image the caller's API key and
+// rate limit allow, and reads it. If not, the request has been failed and
+// accept returns false.
+func (s *server) accept(q *request) (upload, bool) {
+	if q.r.Method != http.MethodPost {
+		q.rw.Header().Set("Allow", http.MethodPost)
+		q.fail("POST an image", http.StatusMethodNotAllowed)
+		return upload{}, false
+	}
+	settings := s.base
+	var formats []string
+	if len(s.tenants) > 0 {
+		t := s.authenticate(q.r)
+		if t == nil {
+			q.entry.Tenant = ""
+			q.fail("missing or unknown API key", http.StatusUnauthorized)
+			return upload{}, false
+		}
+		q.entry.Tenant = t.Name
+		if wait := t.limiter.reserve(time.Now()); wait > 0 {
+			q.rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			q.fail("rate limit exceeded", http.StatusTooManyRequests)
+			return upload{}, false
+		}
+		settings, formats = t.settings, t.Formats
+	}
+	q.entry.Options = auditOptionsOf(settings)
+
+	body, err := io.ReadAll(http.MaxBytesReader(q.rw, q.r.Body, maxUploadBytes))
+	if err != nil {
+		q.fail(err.Error(), http.StatusRequestEntityTooLarge)
+		return upload{}, false
+	}
+	q.entry.InputSHA256, q.entry.InputBytes = sha256Hex(body), len(body)
+	cfg, format, err := decodeConfig(bytes.NewReader(body))
+	if err == nil {
+		err = checkDecodeSize(cfg)
+	}
+	if err != nil {
+		q.fail("unsupported image: "+err.Error(), http.StatusUnsupportedMediaType)
+		return upload{}, false
+	}
+	q.entry.Format = format
+	if len(formats) > 0 && !slices.Contains(formats, format) {
+		q.fail(format+" images are not allowed for this key", http.StatusUnsupportedMediaType)
+		return upload{}, false
+	}
+	return upload{body: body, format: format, settings: settings}, true
+}
+
+func (s *server) handleCompress(rw http.ResponseWriter, r *http.Request) {
+	q := s.newRequest(rw, r)
+	in, ok := s.accept(q)
+	if !ok {
+		return
+	}
+
+	output, err := s.compress(r.Header, in.body, in.format, in.settings)
+	if err != nil {
+		q.fail(err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	q.entry.Status = http.StatusOK
+	q.entry.OutputSHA256, q.entry.OutputBytes = sha256Hex(output.data), len(output.data)
+	s.audit.record(q.entry)
+
+	rw.Header().Set("Content-Type", contentTypeOf(output.name))
+	rw.Header().Set("Content-Length", strconv.Itoa(len(output.data)))
+	rw.Write(output.data)
+}
+
+// serverOutput is a compressed image ready to be sent back.
+type serverOutput struct {
+	name string
+	data []byte
+}
+
+// compress runs one upload through processFile with settings applied.
+func (s *server) compress(header http.Header, body []byte, format string, settings compressionSettings) (serverOutput, error) {
+	tmpDir, err := os.MkdirTemp("", shortName+"-serve-")
+	if err != nil {
+		return serverOutput{}, err
+	}
+	defer os.RemoveAll(tmpDir)
+	inDir := filepath.Join(tmpDir, "in")
+	if err := os.Mkdir(inDir, 0755); err != nil {
+		return serverOutput{}, err
+	}
+	inPath := filepath.Join(inDir, "upload."+format)
+	if err := os.WriteFile(inPath, body, 0644); err != nil {
+		return serverOutput{}, err
+	}
+
+	s.mu.Lock()
+	settings.apply()
+	end := startRequestSpan(header, "compress request", "format", format, "input_bytes", len(body))
+	result := processFile(inPath, tmpDir)
+	end(result.err())
+	s.mu.Unlock()
+	if result.Outcome == outcomeFailed {
+		return serverOutput{}, fmt.Errorf("%s", result.Error)
+	}
+	data, err := os.ReadFile(result.Output)
+	if err != nil {
+		return serverOutput{}, err
+	}
+	return serverOutput{name: result.Output, data: data}, nil
+}
+
+// rateLimiter is a token bucket refilled at a fixed number of requests per
+// minute, allowing bursts of up to that many.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{rate: float64(perMinute) / 60, burst: float64(perMinute), tokens: float64(perMinute)}
+}
+
+// reserve takes a token if one is available and returns 0, or returns how
+// long until one will be. A nil limiter never limits.
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTenantsTarget(t *testing.T) {
+	base := currentSettings()
+	base.uploadLimit, base.sizeMargin = 1000*1000, margin{percent: 2}
+	base.targetSize = base.sizeMargin.below(base.uploadLimit)
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	write := func(config string) {
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"tenants": [{"name": "blog", "key": "a", "target_kb": 500}, {"name": "default", "key": "b"}]}`)
+	tenants, err := loadTenants(path, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := tenants[0].settings; s.uploadLimit != 500*1000 || s.targetSize != 490*1000 {
+		t.Errorf("target_kb 500 with a 2%% margin gives a %d byte limit and %d byte target", s.uploadLimit, s.targetSize)
+	}
+	if s := tenants[1].settings; s.uploadLimit != base.uploadLimit || s.targetSize != base.targetSize {
+		t.Errorf("no target_kb gives a %d byte limit and %d byte target, want the base's", s.uploadLimit, s.targetSize)
+	}
+
+	base.sizeMargin = margin{bytes: 20 * 1000}
+	write(`{"tenants": [{"name": "blog", "key": "a", "target_kb": 500}]}`)
+	if tenants, err := loadTenants(path, base); err != nil || tenants[0].settings.targetSize != 480*1000 {
+		t.Errorf("target_kb 500 with a 20 KB margin: %v", err)
+	}
+	write(`{"tenants": [{"name": "tiny", "key": "a", "target_kb": 10}]}`)
+	if _, err := loadTenants(path, base); err == nil || !strings.Contains(err.Error(), "target_kb 10 leaves nothing after the 20 KB margin") {
+		t.Errorf("target_kb under the margin: got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var serviceActions = []string{"install", "uninstall", "status"}
+
+// runService implements the service subcommand, which registers watch mode
+// to start at boot as a systemd unit or a Windows service.
+//
+//	service install [watch flags]
+//	service uninstall
+//	service status
+func runService(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s service install|uninstall|status [watch flags]", programName())
+	}
+	switch runtime.GOOS {
+	case "linux":
+		return systemdService(args[0], args[1:])
+	case "windows":
+		return windowsService(args[0], args[1:])
+	default:
+		return fmt.Errorf("service management is not supported on %s", runtime.GOOS)
+	}
+}
+
+// serviceCommandLine returns the binary path followed by the watch
+// arguments the service should run with. Relative -input, -output, -dir,
+// -out and -config values are made absolute because services don't start
+// in the caller's directory.
+func serviceCommandLine(watchArgs []string) ([]string, error) {
+	execPath, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	line := []string{execPath, "watch"}
+	for i := 0; i < len(watchArgs); i++ {
+		arg := watchArgs[i]
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		switch name {
+		case "input", "output", "dir", "out", "config":
+			if !hasValue && i+1 < len(watchArgs) {
+				i++
+				value = watchArgs[i]
+			}
+			abs, err := filepath.Abs(value)
+			if err != nil {
+				return nil, err
+			}
+			arg = "-" + name + "=" + abs
+		}
+		line = append(line, arg)
+	}
+	return line, nil
+}
+
+// quoteArgs joins args into a command line the way systemd splits
+// ExecStart: those containing spaces or quotes are double-quoted, and
+// backslashes are escaped since systemd reads C escapes.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		arg = strings.ReplaceAll(arg, `\`, `\\`)
+		if arg == "" || strings.ContainsAny(arg, " \t\"'") {
+			arg = `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+func runCommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// systemdUnitPath returns where the unit file lives and whether it is a
+// user unit. Root installs a system unit; everyone else gets a user unit.
+func systemdUnitPath() (string, bool, error) {
+	if os.Geteuid() == 0 {
+		return filepath.Join("/etc/systemd/system", shortName+".service"), false, nil
+	}
+	config, err := os.UserConfigDir()
+	if err != nil {
+		return "", true, err
+	}
+	return filepath.Join(config, "systemd", "user", shortName+".service"), true, nil
+}
+
+// systemdUnit returns the unit file that runs line, installed for
+// wantedBy. systemd expands % specifiers and $ variables in ExecStart, so
+// both are doubled to reach the command as written.
+func systemdUnit(line []string, wantedBy string) string {
+	execStart := strings.NewReplacer("%", "%%", "$", "$$").Replace(quoteArgs(line))
+	return fmt.Sprintf(`[Unit]
+Description=%s watch mode
+After=local-fs.target
+
+[Service]
+ExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+
+[Install]
+WantedBy=%s
+`, productName, execStart, wantedBy)
+}
+
+func systemdService(action string, watchArgs []string) error {
+	unitPath, user, err := systemdUnitPath()
+	if err != nil {
+		return err
+	}
+	systemctl := func(args ...string) error {
+		if user {
+			args = append([]string{"--user"}, args...)
+		}
+		return runCommand("systemctl", args...)
+	}
+
+	switch action {
+	case "install":
+		line, err := serviceCommandLine(watchArgs)
+		if err != nil {
+			return err
+		}
+		wantedBy := "multi-user.target"
+		if user {
+			wantedBy = "default.target"
+		}
+		unit := systemdUnit(line, wantedBy)
+		if err := os.MkdirAll(filepath.Dir(unitPath), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(unitPath, []byte(unit), 0644); err != nil {
+			return err
+		}
+		if err := systemctl("daemon-reload"); err != nil {
+			return err
+		}
+		if err := systemctl("enable", "--now", shortName); err != nil {
+			return err
+		}
+		fmt.Printf("Installed %s\n", unitPath)
+		return nil
+	case "uninstall":
+		// Keep going if the unit is already stopped or disabled
+		systemctl("disable", "--now", shortName)
+		if err := os.Remove(unitPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := systemctl("daemon-reload"); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s\n", unitPath)
+		return nil
+	case "status":
+		return systemctl("status", "--no-pager", shortName)
+	default:
+		return fmt.Errorf("unknown service action %q", action)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func windowsService(action string, watchArgs []string) error {
+	return errors.New("Windows services can only be managed on Windows")
+}
+
+// serviceContext returns ctx unchanged, since only Windows starts watch
+// mode through a service manager that must be answered.
+func serviceContext(ctx context.Context) (context.Context, func()) {
+	return ctx, func() {}
+}
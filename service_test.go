@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSystemdUnitEscapesExecStart(t *testing.T) {
+	line := []string{"/opt/ic/ic", "watch", "-dir=/srv/100% photos", "-out=/srv/$out", `-config=/srv/a\b.yaml`}
+	unit := systemdUnit(line, "multi-user.target")
+	want := `ExecStart=/opt/ic/ic watch "-dir=/srv/100%% photos" -out=/srv/$$out -config=/srv/a\\b.yaml` + "\n"
+	if !strings.Contains(unit, want) {
+		t.Errorf("unit file:\n%s\nwant line %q", unit, want)
+	}
+	if !strings.Contains(unit, "ExecReload=/bin/kill -HUP $MAINPID\n") {
+		t.Errorf("ExecReload was escaped:\n%s", unit)
+	}
+}
+
+func TestServiceCommandLineAbsolutePaths(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := serviceCommandLine([]string{"-input", "photos", "--output=out", "-dir=in", "-out", "done", "-config", "c.yaml", "-target", "500KB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"watch",
+		"-input=" + filepath.Join(wd, "photos"),
+		"-output=" + filepath.Join(wd, "out"),
+		"-dir=" + filepath.Join(wd, "in"),
+		"-out=" + filepath.Join(wd, "done"),
+		"-config=" + filepath.Join(wd, "c.yaml"),
+		"-target", "500KB",
+	}
+	if !slices.Equal(line[1:], want) {
+		t.Errorf("command line %q, want %q", line[1:], want)
+	}
+}
+
+func TestWatchInputOutput(t *testing.T) {
+	for _, name := range []string{"watch", "service", "tray"} {
+		var opts watchOptions
+		fs := watchFlagSet(name, &opts)
+		if err := fs.Parse([]string{"-input", "in", "-output", "out"}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if opts.dir != "in" || opts.out != "out" {
+			t.Errorf("%s: -input and -output set %q and %q", name, opts.dir, opts.out)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceStopWait is how long uninstall waits for a running service to
+// stop before deleting it.
+const serviceStopWait = 30 * time.Second
+
+// windowsService registers watch mode as a Windows service that starts at
+// boot and is restarted if it fails. It runs as LocalSystem, so the
+// watched and output directories must be local paths or shares the
+// machine account can reach; mapped drives of a user's session aren't.
+func windowsService(action string, watchArgs []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager (run as administrator): %w", err)
+	}
+	defer m.Disconnect()
+
+	switch action {
+	case "install":
+		line, err := serviceCommandLine(watchArgs)
+		if err != nil {
+			return err
+		}
+		s, err := m.OpenService(shortName)
+		if err == nil {
+			s.Close()
+			return fmt.Errorf("service %s is already installed; uninstall it first", shortName)
+		}
+		s, err = m.CreateService(shortName, line[0], mgr.Config{
+			StartType:   mgr.StartAutomatic,
+			DisplayName: productName,
+			Description: productName + " watch mode",
+		}, line[1:]...)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		restart := []mgr.RecoveryAction{
+			{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+			{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+			{Type: mgr.ServiceRestart, Delay: time.Minute},
+		}
+		if err := s.SetRecoveryActions(restart, uint32((24 * time.Hour).Seconds())); err != nil {
+			return err
+		}
+		if err := s.Start(); err != nil {
+			return err
+		}
+		fmt.Printf("Installed service %s\n", shortName)
+		return nil
+	case "uninstall":
+		s, err := m.OpenService(shortName)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		// Keep going if the service is already stopped
+		if status, err := s.Control(svc.Stop); err == nil {
+			deadline := time.Now().Add(serviceStopWait)
+			for status.State != svc.Stopped && time.Now().Before(deadline) {
+				time.Sleep(500 * time.Millisecond)
+				if status, err = s.Query(); err != nil {
+					break
+				}
+			}
+		}
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		fmt.Printf("Removed service %s\n", shortName)
+		return nil
+	case "status":
+		s, err := m.OpenService(shortName)
+		if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+			return fmt.Errorf("service %s is not installed", shortName)
+		}
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		config, err := s.Config()
+		if err != nil {
+			return err
+		}
+		status, err := s.Query()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Service: %s\n", shortName)
+		fmt.Printf("State: %s\n", serviceStateName(status.State))
+		if status.ProcessId != 0 {
+			fmt.Printf("PID: %d\n", status.ProcessId)
+		}
+		fmt.Printf("Command: %s\n", config.BinaryPathName)
+		return nil
+	default:
+		return fmt.Errorf("unknown service action %q", action)
+	}
+}
+
+func serviceStateName(state svc.State) string {
+	switch state {
+	case svc.Stopped:
+		return "stopped"
+	case svc.StartPending:
+		return "starting"
+	case svc.StopPending:
+		return "stopping"
+	case svc.Running:
+		return "running"
+	case svc.Paused:
+		return "paused"
+	default:
+		return fmt.Sprintf("state %d", state)
+	}
+}
+
+// serviceContext returns ctx unchanged unless the process was started by
+// the service manager, in which case it reports watch mode as running and
+// the returned context is also canceled when the service is stopped. The
+// returned function reports the service stopped once watch mode has
+// finished, and must be called before returning.
+func serviceContext(ctx context.Context) (context.Context, func()) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	handler := &watchService{cancel: cancel, done: make(chan struct{})}
+	finished := make(chan struct{})
+	go func() {
+		if err := svc.Run(shortName, handler); err != nil {
+			fmt.Printf("Error running as a service: %v\n", err)
+		}
+		cancel()
+		close(finished)
+	}()
+	return ctx, func() {
+		close(handler.done)
+		<-finished
+	}
+}
+
+// watchService answers the service manager for watch mode. Stop and
+// shutdown requests cancel the watch, and the service is only reported
+// stopped once it has finished.
+type watchService struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (w *watchService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	changes <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case <-w.done:
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending, WaitHint: uint32(serviceStopWait.Milliseconds())}
+				w.cancel()
+				<-w.done
+				return false, 0
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+
+	"image-compressor/pkg/compressor"
+)
+
+// Why a batch leaves a source out in favor of another, as skipShot words
+// it.
+const (
+	leftOutBracket   = "bracketed exposure"
+	leftOutBurst     = "burst frame"
+	leftOutDuplicate = "near-duplicate"
+)
+
+// leftOutSummaries sum up the sources of each kind a batch left out.
+var leftOutSummaries = []struct {
+	what   string
+	format string
+}{
+	{leftOutBracket, "Skipped %d bracketed exposures, keeping one image of each bracket.\n"},
+	{leftOutBurst, "Skipped %d burst frames, keeping the best of each burst.\n"},
+	{leftOutDuplicate, "Skipped %d near-duplicates, keeping the best of each group of similar shots.\n"},
+}
+
+// leftOut is a source that -brackets, -bursts or -dedupe-similar leave out
+// of a batch: what it is, and the source kept in its place.
+type leftOut struct {
+	what string
+	kept string
+}
+
+// leaveOut records in skip that path is left out in favor of kept. Sources
+// left out earlier in favor of path now point at kept instead.
+func leaveOut(skip map[string]leftOut, path, kept, what string) {
+	for source, left := range skip {
+		if left.kept == path {
+			skip[source] = leftOut{what: left.what, kept: kept}
+		}
+	}
+	skip[path] = leftOut{what: what, kept: kept}
+}
+
+// shotScore rates img for picking from shots of the same scene: its
+// sharpness, less the share of its pixels clipped to black or white.
+func shotScore(img image.Image) float64 {
+	luma, w, h := luminance(compressor.Flatten(fitLongEdge(img, analyzeEdge), flattenColor))
+	clipped := 0
+	for _, v := range luma {
+		if v := math.Round(v); v <= 0 || v >= 255 {
+			clipped++
+		}
+	}
+	return sharpness(luma, w, h) * (1 - float64(clipped)/float64(max(len(luma), 1)))
+}
+
+// skipShot reports the source at path as skipped as left says.
+func skipShot(path string, left leftOut) fileResult {
+	result := fileResult{Source: path, Outcome: outcomeSkipped, KeptInstead: left.kept}
+	if info, err := os.Stat(path); err == nil {
+		result.InputBytes = info.Size()
+	}
+	log := &fileLog{source: path}
+	log.Printf("Processing %s... SKIPPED (%s, keeping %s)\n", filepath.Base(path), left.what, filepath.Base(left.kept))
+	log.flush()
+	return result
+}
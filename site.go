@@ -0,0 +1,243 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// siteOptions holds the flags of the site subcommand.
+type siteOptions struct {
+	root   string
+	dirs   string
+	dryRun bool
+	config string
+}
+
+func siteFlagSet(o *siteOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("site", flag.ExitOnError)
+	fs.StringVar(&o.root, "root", ".", "root of the Hugo or Jekyll site")
+	fs.StringVar(&o.dirs, "dirs", "static,assets", "comma-separated image directories under the root")
+	fs.BoolVar(&o.dryRun, "dry-run", false, "report what would change without touching the site")
+	registerConfigFlag(fs, &o.config)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s site [-root dir] [flags]\n", programName())
+		fs.PrintDefaults()
+	}
+	registerCompressionFlags(fs)
+	return fs
+}
+
+// siteSkipDirs are build outputs and dependencies that are never scanned for
+// content.
+var siteSkipDirs = map[string]bool{
+	".git": true, "public": true, "_site": true, "resources": true,
+	"node_modules": true, ".jekyll-cache": true,
+}
+
+var markdownExtensions = map[string]bool{".md": true, ".markdown": true, ".mdown": true}
+
+// imageRefPattern matches anything in Markdown or front matter that looks
+// like a path to an image.
+var imageRefPattern = regexp.MustCompile(`[^\s"'()<>\[\]=]+\.(?i:jpe?g|png|gif|webp|bmp|tiff?|heic|heif)\b`)
+
+// runSite implements the site subcommand. It compresses the images of a Hugo
+// or Jekyll site in place, rewrites Markdown and front matter references to
+// images whose name changed, and reports references that resolve to nothing.
+func runSite(args []string) error {
+	var opts siteOptions
+	flags := siteFlagSet(&opts)
+	if _, err := parseLayered(flags, args, &opts.config); err != nil {
+		return err
+	}
+	if len(profileSizes) > 0 {
+		return fmt.Errorf("-sizes is not supported in site mode")
+	}
+	root := longPath(opts.root)
+	var imageDirs []string
+	for _, dir := range strings.Split(opts.dirs, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			imageDirs = append(imageDirs, filepath.Join(root, dir))
+		}
+	}
+
+	tmpDir, err := os.MkdirTemp("", shortName+"-site-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	renamed := make(map[string]string)
+	var results []fileResult
+	for _, dir := range imageDirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == dir {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			if d.IsDir() || isTempOutput(d.Name()) || !isSupportedImage(path) {
+				return nil
+			}
+			result := processFileRetrying(path, tmpDir)
+			if result.Output != "" {
+				defer os.Remove(result.Output)
+			}
+			if result.Outcome == outcomeCompressed {
+				newPath, err := replaceSiteImage(path, result.Output, opts.dryRun)
+				if err != nil {
+					fmt.Printf("  ERROR replacing %s: %v\n", filepath.Base(path), err)
+					result = result.failed(err)
+				} else {
+					result.Output = newPath
+					if newPath != path {
+						renamed[path] = newPath
+					}
+				}
+			} else {
+				result.Output = ""
+			}
+			results = append(results, result)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	broken, err := rewriteSiteContent(root, imageDirs, renamed, opts.dryRun)
+	if err != nil {
+		return err
+	}
+
+	if reportPath != "" {
+		if err := writeReport(reportPath, results); err != nil {
+			return err
+		}
+		fmt.Printf("Report saved to: %s\n", reportPath)
+	}
+	if len(broken) > 0 {
+		fmt.Println("\nBroken image links:")
+		for _, link := range broken {
+			fmt.Printf("  %s\n", link)
+		}
+		return fmt.Errorf("found %d broken image link(s)", len(broken))
+	}
+	return nil
+}
+
+// replaceSiteImage moves a compressed output over its source. When the
+// output has a different name, e.g. a PNG converted to JPEG, the source is
+// removed and the output takes its new name next to it. It returns the path
+// the image now has.
+func replaceSiteImage(srcPath, outPath string, dryRun bool) (string, error) {
+	newPath := filepath.Join(filepath.Dir(srcPath), filepath.Base(outPath))
+	if newPath != srcPath {
+		if _, err := os.Stat(newPath); err == nil {
+			return "", fmt.Errorf("%s already exists", filepath.Base(newPath))
+		}
+	}
+	if dryRun {
+		return newPath, nil
+	}
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		return "", err
+	}
+	if err := writeOutput(newPath, data); err != nil {
+		return "", err
+	}
+	if newPath != srcPath {
+		if err := os.Remove(srcPath); err != nil {
+			return "", err
+		}
+	}
+	return newPath, nil
+}
+
+// rewriteSiteContent updates image references in the site's Markdown files
+// for the renamed images and returns the references that point at no file,
+// as "file: reference".
+func rewriteSiteContent(root string, imageDirs []string, renamed map[string]string, dryRun bool) ([]string, error) {
+	var broken []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && siteSkipDirs[d.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !markdownExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+
+		changed := false
+		text := imageRefPattern.ReplaceAllStringFunc(string(data), func(ref string) string {
+			if strings.Contains(ref, "://") || strings.HasPrefix(ref, "//") {
+				return ref
+			}
+			target := resolveSiteRef(ref, filepath.Dir(path), root, imageDirs, renamed)
+			if target == "" {
+				broken = append(broken, rel+": "+ref)
+				return ref
+			}
+			newPath, ok := renamed[target]
+			if !ok {
+				return ref
+			}
+			changed = true
+			fmt.Printf("%s: %s -> %s\n", rel, ref, strings.TrimSuffix(ref, filepath.Base(target))+filepath.Base(newPath))
+			return strings.TrimSuffix(ref, filepath.Base(target)) + filepath.Base(newPath)
+		})
+		if changed && !dryRun {
+			return writeOutput(path, []byte(text))
+		}
+		return nil
+	})
+	sort.Strings(broken)
+	return broken, err
+}
+
+// resolveSiteRef returns the file a reference points at, or "" if there is
+// none. Absolute references are looked up under the site root (Jekyll) and
+// the image directories (Hugo's static/); relative ones next to the page
+// (Hugo page bundles) and under the image directories (Hugo's assets/).
+func resolveSiteRef(ref, pageDir, root string, imageDirs []string, renamed map[string]string) string {
+	ref = strings.SplitN(ref, "?", 2)[0]
+	rel := filepath.FromSlash(strings.TrimPrefix(ref, "/"))
+	var candidates []string
+	if strings.HasPrefix(ref, "/") {
+		candidates = append(candidates, filepath.Join(root, rel))
+	} else {
+		candidates = append(candidates, filepath.Join(pageDir, rel))
+	}
+	for _, dir := range imageDirs {
+		candidates = append(candidates, filepath.Join(dir, rel))
+	}
+	for _, candidate := range candidates {
+		// Filenames are matched exactly, since the site is served that way
+		if filepath.Base(candidate) != filepath.Base(rel) {
+			continue
+		}
+		if _, ok := renamed[candidate]; ok {
+			return candidate
+		}
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return ""
+}
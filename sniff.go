@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// strictExt restricts input matching to known extensions, skipping files
+// without one instead of sniffing their contents.
+var strictExt bool
+
+// imageExtensions are the extensions the tool processes, lower case.
+var imageExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+	".webp": true, ".heic": true, ".heif": true,
+	".jp2": true, ".j2k": true, ".j2c": true, ".jpf": true, ".jpx": true,
+	".psd": true, ".psb": true, ".xcf": true, ".ora": true,
+}
+
+// isSupportedImage reports whether the file at path should be processed.
+// Extensions match case-insensitively and only the last one counts, so
+// photo.JPG and photo.jpg.jpg are images while photo.jpeg.bak is not. Files
+// with no extension at all are identified by their contents unless
+// strictExt is set.
+func isSupportedImage(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != "" || strictExt {
+		return imageExtensions[ext]
+	}
+	return sniffImageExt(path) != ""
+}
+
+// sniffImageExt returns the extension matching the image format found at the
+// start of the file at path, or "" if it isn't a recognized image.
+func sniffImageExt(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	header := make([]byte, len(oraSignature))
+	n, _ := io.ReadFull(file, header)
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, []byte{0xff, 0xd8, 0xff}):
+		return ".jpg"
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return ".png"
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return ".gif"
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		return ".webp"
+	case bytes.HasPrefix(header, []byte(jpeg2000Signatures[0])):
+		return ".jp2"
+	case bytes.HasPrefix(header, []byte(jpeg2000Signatures[1])):
+		return ".j2k"
+	case len(header) >= 6 && string(header[:4]) == "8BPS":
+		if header[5] == 2 {
+			return ".psb"
+		}
+		return ".psd"
+	case bytes.HasPrefix(header, []byte(xcfSignature)):
+		return ".xcf"
+	case len(header) == len(oraSignature) && string(header[:4]) == "PK\x03\x04" && string(header[30:]) == oraSignature[30:]:
+		return ".ora"
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		switch string(header[8:12]) {
+		case "heic", "heix", "hevc", "hevx", "heim", "heis":
+			return ".heic"
+		case "mif1", "msf1":
+			return ".heif"
+		}
+	}
+	return ""
+}
+
+// outputFileName returns the name of the output for the source at path. It
+// is the normalized source name, plus the sniffed extension when the source
+// has none, so outputs always open with the right application.
+func outputFileName(path string) string {
+	_, name := splitDirectives(path)
+	name = outputName(name)
+	if filepath.Ext(name) == "" {
+		name += sniffImageExt(path)
+	}
+	return name
+}
@@ -0,0 +1,5 @@
+package main
+
+// spanEnd ends a tracing span opened by startSpan, recording err on it if it
+// isn't nil. Builds without the otel tag make spans no-ops.
+type spanEnd func(err error)
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+const splitUsage = "distribute outputs into numbered subfolders (part-001, part-002, ...) of at most this total size each, e.g. 200MB, for burning to media or services with per-batch limits"
+
+// partDirPattern matches the subfolders splitOutputs creates.
+var partDirPattern = regexp.MustCompile(`^part-\d{3,}$`)
+
+// partDir is the nth subfolder of out, counting from 1.
+func partDir(out string, n int) string {
+	return filepath.Join(out, fmt.Sprintf("part-%03d", n))
+}
+
+// registerSplitOutput registers -split-output, storing its value in bytes in
+// limit.
+func registerSplitOutput(fs *flag.FlagSet, limit *int) {
+	fs.Func("split-output", splitUsage, func(s string) error {
+		size, err := parseSize(s)
+		*limit = size
+		return err
+	})
+}
+
+// splitFile is an output to be placed in a part.
+type splitFile struct {
+	path string
+	size int64
+}
+
+// splitOutputs moves the outputs in out into numbered part subfolders of at
+// most limit bytes each, filled in name order, and returns results with
+// their new paths. Outputs of earlier batches, loose or already in parts,
+// are repacked with the new ones, and a fresh output replaces an older one
+// of the same name. An output larger than limit gets a part to itself.
+// The -name manifest stays at the top and lists the paths within parts.
+func splitOutputs(out string, limit int, results []fileResult) ([]fileResult, error) {
+	byName := make(map[string]splitFile)
+	var parts []string
+	collect := func(dir string, loose bool) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if e.IsDir() {
+				if loose && partDirPattern.MatchString(name) {
+					parts = append(parts, filepath.Join(dir, name))
+				}
+				continue
+			}
+			if isTempOutput(name) || loose && name == manifestName {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				return err
+			}
+			path := filepath.Join(dir, name)
+			if _, ok := byName[name]; ok {
+				// Loose files are collected first and are this batch's
+				// outputs, so an older copy in a part is removed: the
+				// loose output replaces it
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+				continue
+			}
+			byName[name] = splitFile{path: path, size: info.Size()}
+		}
+		return nil
+	}
+	if err := collect(out, true); err != nil {
+		return results, err
+	}
+	for _, part := range parts {
+		if err := collect(part, false); err != nil {
+			return results, err
+		}
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	moved := make(map[string]string)
+	relNames := make(map[string]string)
+	part, used := 1, int64(0)
+	for _, name := range names {
+		file := byName[name]
+		if used > 0 && used+file.size > int64(limit) {
+			part, used = part+1, 0
+		}
+		if file.size > int64(limit) {
+			fmt.Printf("%s alone is larger than -split-output %s\n", name, formatSize(limit))
+		}
+		used += file.size
+		dir := partDir(out, part)
+		dst := filepath.Join(dir, name)
+		relNames[name] = filepath.ToSlash(filepath.Join(filepath.Base(dir), name))
+		if dst == file.path {
+			continue
+		}
+		if err := guardWrite(dst); err != nil {
+			return results, err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return results, err
+		}
+		if err := os.Rename(file.path, dst); err != nil {
+			return results, err
+		}
+		moved[file.path] = dst
+	}
+	// Parts past the last one used are empty now
+	for _, dir := range parts {
+		os.Remove(dir)
+	}
+	fmt.Printf("Split output into %d part(s) of at most %s\n", part, formatSize(limit))
+
+	split := make([]fileResult, len(results))
+	for i, r := range results {
+		if dst, ok := moved[r.Output]; ok {
+			r.Output = dst
+		}
+		if dst, ok := moved[r.KeptOutput]; ok {
+			r.KeptOutput = dst
+		}
+		split[i] = r
+	}
+	return split, splitManifest(out, relNames)
+}
+
+// splitManifest points the -name manifest in out at the outputs' paths
+// within parts, given by relNames for each file name.
+func splitManifest(out string, relNames map[string]string) error {
+	names, err := readManifest(out)
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	for plain, named := range names {
+		if rel, ok := relNames[filepath.Base(named)]; ok {
+			names[plain] = rel
+		}
+	}
+	data, err := json.MarshalIndent(names, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeOutput(filepath.Join(out, manifestName), append(data, '\n'))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeSized writes size bytes to path, creating its directory.
+func writeSized(t *testing.T, path string, size int) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, bytes.Repeat([]byte{'x'}, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// splitLayout returns what is in out as "name:size", with the files in
+// parts prefixed by their part, space-separated in name order.
+func splitLayout(t *testing.T, out string) string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(out, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(out, path)
+		files = append(files, filepath.ToSlash(rel)+":"+strconv.FormatInt(info.Size(), 10))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(files, " ")
+}
+
+func TestSplitOutputs(t *testing.T) {
+	tests := []struct {
+		name string
+		// files are written to the output directory before splitting,
+		// by path and size. The loose ones are this batch's outputs, and
+		// the sizes tell copies of one name apart.
+		files map[string]int
+		want  string
+	}{
+		{
+			name:  "fills parts in name order",
+			files: map[string]int{"a.jpg": 400, "b.jpg": 400, "c.jpg": 300},
+			want:  "part-001/a.jpg:400 part-001/b.jpg:400 part-002/c.jpg:300",
+		},
+		{
+			name: "repacks existing parts",
+			files: map[string]int{
+				"a.jpg": 400, "part-001/old.jpg": 500, "part-002/z.jpg": 300,
+				"part-003/y.jpg": 200,
+			},
+			want: "part-001/a.jpg:400 part-001/old.jpg:500 part-002/y.jpg:200 part-002/z.jpg:300",
+		},
+		{
+			name:  "replaces same-named files",
+			files: map[string]int{"a.jpg": 100, "part-001/a.jpg": 900, "part-002/a.jpg": 800},
+			want:  "part-001/a.jpg:100",
+		},
+		{
+			name:  "a file larger than the limit",
+			files: map[string]int{"a.jpg": 400, "big.jpg": 2500, "c.jpg": 300},
+			want:  "part-001/a.jpg:400 part-002/big.jpg:2500 part-003/c.jpg:300",
+		},
+		{
+			name:  "leaves temp files and other directories",
+			files: map[string]int{"a.jpg": 400, ".b.jpg.123.tmp": 50, "thumbs/a.jpg": 10},
+			want:  ".b.jpg.123.tmp:50 part-001/a.jpg:400 thumbs/a.jpg:10",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := t.TempDir()
+			var results []fileResult
+			for path, size := range tt.files {
+				writeSized(t, filepath.Join(out, path), size)
+				if !strings.Contains(path, "/") && !isTempOutput(path) {
+					results = append(results, fileResult{Source: path, Outcome: outcomeCompressed, Output: filepath.Join(out, path)})
+				}
+			}
+			split, err := splitOutputs(out, 1000, results)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := splitLayout(t, out); got != tt.want {
+				t.Errorf("split into %s, want %s", got, tt.want)
+			}
+			for _, r := range split {
+				if _, err := os.Stat(r.Output); err != nil || filepath.Base(filepath.Dir(r.Output)) == filepath.Base(out) {
+					t.Errorf("result for %s points at %s: %v", r.Source, r.Output, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitOutputsManifest(t *testing.T) {
+	out := t.TempDir()
+	writeSized(t, filepath.Join(out, "a.1a2b3c4d.jpg"), 600)
+	writeSized(t, filepath.Join(out, "part-001", "b.5e6f7a8b.jpg"), 600)
+	manifest := map[string]string{"a.jpg": "a.1a2b3c4d.jpg", "b.jpg": "part-001/b.5e6f7a8b.jpg", "gone.jpg": "gone.00000000.jpg"}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(out, manifestName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := splitOutputs(out, 1000, nil); err != nil {
+		t.Fatal(err)
+	}
+	names, err := readManifest(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a.jpg": "part-001/a.1a2b3c4d.jpg", "b.jpg": "part-002/b.5e6f7a8b.jpg", "gone.jpg": "gone.00000000.jpg"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("manifest is %v, want %v", names, want)
+	}
+	if got := splitLayout(t, out); !strings.HasPrefix(got, manifestName+":") {
+		t.Errorf("manifest moved: %s", got)
+	}
+}
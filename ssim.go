@@ -0,0 +1,95 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"os"
+)
+
+// ssimWindow is the edge of the square blocks SSIM statistics are taken
+// over.
+const ssimWindow = 8
+
+// SSIM stabilizing constants for 8-bit luminance.
+const (
+	ssimC1 = (0.01 * 255) * (0.01 * 255)
+	ssimC2 = (0.03 * 255) * (0.03 * 255)
+)
+
+// luminance returns the Rec. 601 luma of img as a width*height slice.
+func luminance(img image.Image) ([]float64, int, int) {
+	bounds := img.Bounds()
+	rgba, ok := img.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	}
+	w, h := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	luma := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := rgba.PixOffset(x, y)
+			luma[y*w+x] = 0.299*float64(rgba.Pix[i]) + 0.587*float64(rgba.Pix[i+1]) + 0.114*float64(rgba.Pix[i+2])
+		}
+	}
+	return luma, w, h
+}
+
+// ssim computes the mean structural similarity of the luminance of a and b
+// over non-overlapping blocks. b is resampled to a's size first if the two
+// differ, so a downscaled output can be compared with its original.
+func ssim(a, b image.Image) float64 {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Dx() != bb.Dx() || ab.Dy() != bb.Dy() {
+		// Compare at the smaller of the two sizes
+		if ab.Dx()*ab.Dy() > bb.Dx()*bb.Dy() {
+			a = resizeImage(a, bb.Dx(), bb.Dy())
+		} else {
+			b = resizeImage(b, ab.Dx(), ab.Dy())
+		}
+	}
+	la, w, h := luminance(a)
+	lb, _, _ := luminance(b)
+
+	window := min(ssimWindow, w, h)
+	var total float64
+	blocks := 0
+	for by := 0; by+window <= h; by += window {
+		for bx := 0; bx+window <= w; bx += window {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for y := by; y < by+window; y++ {
+				for x := bx; x < bx+window; x++ {
+					va, vb := la[y*w+x], lb[y*w+x]
+					sumA += va
+					sumB += vb
+					sumAA += va * va
+					sumBB += vb * vb
+					sumAB += va * vb
+				}
+			}
+			n := float64(window * window)
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			cov := sumAB/n - meanA*meanB
+			total += ((2*meanA*meanB + ssimC1) * (2*cov + ssimC2)) /
+				((meanA*meanA + meanB*meanB + ssimC1) * (varA + varB + ssimC2))
+			blocks++
+		}
+	}
+	if blocks == 0 {
+		return 1
+	}
+	return total / float64(blocks)
+}
+
+// decodeFile decodes the image at path.
+func decodeFile(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := decodeLimited(file)
+	return img, err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const atomicUsage = "write the batch to a staging directory and replace the output directory with it only if every image succeeds"
+
+// stagingDir is where an atomic batch into out is written. It sits next to
+// out so that swapping it in is a rename on the same filesystem.
+func stagingDir(out string) string {
+	return filepath.Clean(out) + ".staging"
+}
+
+// previousDir is where out is moved while an atomic batch replaces it.
+func previousDir(out string) string {
+	return filepath.Clean(out) + ".previous"
+}
+
+// commitStaging replaces out with staging if every file in results
+// succeeded and valid is set, and returns results with their outputs under
+// out. Otherwise out is left as it was and staging is kept for a look at
+// what went wrong, until the next atomic batch clears it.
+//
+// Swapping takes two renames, so out is briefly missing but never holds a
+// partial batch.
+func commitStaging(staging, out string, results []fileResult, valid bool) ([]fileResult, error) {
+	failed := 0
+	for _, r := range results {
+		if r.Outcome == outcomeFailed {
+			failed++
+		}
+	}
+	switch {
+	case failed > 0:
+		return results, fmt.Errorf("%d image(s) failed; %s is unchanged, this batch's outputs are in %s", failed, out, staging)
+	case !valid:
+		return results, fmt.Errorf("sampled outputs failed validation; %s is unchanged, this batch's outputs are in %s", out, staging)
+	}
+
+	previous := previousDir(out)
+	if err := os.RemoveAll(previous); err != nil {
+		return results, err
+	}
+	if err := os.Rename(out, previous); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return results, fmt.Errorf("moving %s aside: %w", out, err)
+	}
+	if err := os.Rename(staging, out); err != nil {
+		os.Rename(previous, out)
+		return results, fmt.Errorf("moving %s into place: %w", staging, err)
+	}
+	if err := os.RemoveAll(previous); err != nil {
+		fmt.Printf("Error removing the previous outputs in %s: %v\n", previous, err)
+	}
+
+	moved := make([]fileResult, len(results))
+	for i, r := range results {
+		r.Output = movedPath(r.Output, staging, out)
+		r.KeptOutput = movedPath(r.KeptOutput, staging, out)
+		moved[i] = r
+	}
+	return moved, nil
+}
+
+// movedPath returns path with its staging prefix replaced by out.
+func movedPath(path, staging, out string) string {
+	rel, err := filepath.Rel(staging, path)
+	if path == "" || err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return filepath.Join(out, rel)
+}
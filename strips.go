@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+	"os"
+)
+
+// stripDecoder decodes an image a band of rows at a time, top to bottom.
+type stripDecoder interface {
+	bounds() image.Rectangle
+	// next returns the next band, which the call after it may reuse, or
+	// io.EOF after the last.
+	next() (*image.RGBA, error)
+	close()
+}
+
+// stripImage is an image decoded a band at a time as its rows are read,
+// for compressor.Resize and Resample, which read rows top to bottom. Only
+// the band holding the last row read is kept, so a frame far too large to
+// decode whole can be scaled down in little more memory than the result.
+// Rows before that band can't be read again; they, and every row after a
+// decoding error, read as transparent black, and err reports the error.
+type stripImage struct {
+	dec  stripDecoder
+	band *image.RGBA
+	err  error
+}
+
+func (m *stripImage) ColorModel() color.Model { return color.RGBAModel }
+
+func (m *stripImage) Bounds() image.Rectangle { return m.dec.bounds() }
+
+func (m *stripImage) At(x, y int) color.Color {
+	if band := m.rows(y); band != nil {
+		return band.At(x, y)
+	}
+	return color.RGBA{}
+}
+
+// DrawRows implements compressor.RowDrawer.
+func (m *stripImage) DrawRows(dst *image.RGBA, r image.Rectangle, sp image.Point) {
+	for y := 0; y < r.Dy(); y++ {
+		row := dst.Pix[dst.PixOffset(r.Min.X, r.Min.Y+y):dst.PixOffset(r.Max.X, r.Min.Y+y)]
+		band := m.rows(sp.Y + y)
+		if band == nil {
+			clear(row)
+			continue
+		}
+		copy(row, band.Pix[band.PixOffset(sp.X, sp.Y+y):])
+	}
+}
+
+// close releases what the decoder holds open.
+func (m *stripImage) close() { m.dec.close() }
+
+// rows returns the band holding row y, decoding up to it, or nil if it
+// can't be had.
+func (m *stripImage) rows(y int) *image.RGBA {
+	for m.err == nil && (m.band == nil || y >= m.band.Rect.Max.Y) {
+		band, err := m.dec.next()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			m.err = err
+			return nil
+		}
+		m.band = band
+	}
+	if m.err != nil || y < m.band.Rect.Min.Y {
+		return nil
+	}
+	return m.band
+}
+
+// openStrips opens the image at path to be decoded a band at a time, or
+// returns nil if its format can only be decoded whole. Sequential JPEGs
+// and non-interlaced PNGs, the usual formats of huge maps and scans, can
+// be decoded in bands.
+func openStrips(path string) (*stripImage, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	var dec stripDecoder
+	var format string
+	switch sniffImageExt(path) {
+	case ".jpg":
+		j, err := openJPEGStrips(file)
+		if err != nil || j == nil {
+			return nil, "", err
+		}
+		dec, format = j, "jpeg"
+	case ".png":
+		// The PNG is read as it is decoded, so it keeps its own handle
+		p, err := openPNGStrips(path)
+		if err != nil || p == nil {
+			return nil, "", err
+		}
+		dec, format = p, "png"
+	default:
+		return nil, "", nil
+	}
+	return &stripImage{dec: dec}, format, nil
+}
+
+// pngStripRows is how many rows pngStrips decodes at a time.
+const pngStripRows = 16
+
+// pngStrips decodes a non-interlaced PNG a band of rows at a time, reading
+// its image data as it goes.
+type pngStrips struct {
+	file          *os.File
+	width, height int
+	depth         int
+	colorType     byte
+	// palette is premultiplied, with the alpha of tRNS
+	palette []color.RGBA
+	// transparent is the tRNS color of grayscale and truecolor images, in
+	// their sample depth, or nil
+	transparent []uint16
+	zr          io.ReadCloser
+	// bpp is the bytes per pixel filters work with; prev and cur are the
+	// last row read and the one being read, filter byte first
+	bpp       int
+	prev, cur []byte
+	y         int
+	band      *image.RGBA
+}
+
+// PNG color types.
+const (
+	pngGray      = 0
+	pngTrueColor = 2
+	pngPaletted  = 3
+	pngGrayAlpha = 4
+	pngRGBA      = 6
+)
+
+// openPNGStrips reads the header chunks of the PNG at path for pngStrips,
+// up to its image data, or returns nil if it is interlaced.
+func openPNGStrips(path string) (*pngStrips, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &pngStrips{file: file}
+	ok := false
+	defer func() {
+		if !ok {
+			file.Close()
+		}
+	}()
+	r := bufio.NewReader(file)
+	signature := make([]byte, 8)
+	if _, err := io.ReadFull(r, signature); err != nil || string(signature) != "\x89PNG\r\n\x1a\n" {
+		return nil, errors.New("png: bad signature")
+	}
+	interlaced := false
+	for {
+		kind, data, err := readPNGChunk(r)
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case "IHDR":
+			if len(data) != 13 {
+				return nil, errors.New("png: bad IHDR")
+			}
+			p.width = int(binary.BigEndian.Uint32(data))
+			p.height = int(binary.BigEndian.Uint32(data[4:]))
+			p.depth, p.colorType = int(data[8]), data[9]
+			interlaced = data[12] != 0
+			if err := checkDecodeSize(image.Config{Width: p.width, Height: p.height}); err != nil {
+				return nil, err
+			}
+			if err := p.checkFormat(); err != nil {
+				return nil, err
+			}
+		case "PLTE":
+			for i := 0; i+2 < len(data); i += 3 {
+				p.palette = append(p.palette, color.RGBA{data[i], data[i+1], data[i+2], 0xff})
+			}
+		case "tRNS":
+			switch p.colorType {
+			case pngPaletted:
+				for i := 0; i < len(data) && i < len(p.palette); i++ {
+					c := color.NRGBA{p.palette[i].R, p.palette[i].G, p.palette[i].B, data[i]}
+					p.palette[i] = color.RGBAModel.Convert(c).(color.RGBA)
+				}
+			case pngGray, pngTrueColor:
+				for i := 0; i+1 < len(data); i += 2 {
+					p.transparent = append(p.transparent, binary.BigEndian.Uint16(data[i:]))
+				}
+			}
+		case "IDAT":
+			if p.width == 0 {
+				return nil, errors.New("png: image data before IHDR")
+			}
+			if interlaced {
+				return nil, nil
+			}
+			if p.colorType == pngPaletted && len(p.palette) == 0 {
+				return nil, errors.New("png: paletted image without a palette")
+			}
+			zr, err := zlib.NewReader(io.MultiReader(bytes.NewReader(data), &idatReader{r: r}))
+			if err != nil {
+				return nil, err
+			}
+			p.zr = zr
+			channels := map[byte]int{pngGray: 1, pngTrueColor: 3, pngPaletted: 1, pngGrayAlpha: 2, pngRGBA: 4}[p.colorType]
+			rowBytes := (p.width*channels*p.depth + 7) / 8
+			p.bpp = max(channels*p.depth/8, 1)
+			p.prev, p.cur = make([]byte, 1+rowBytes), make([]byte, 1+rowBytes)
+			p.band = image.NewRGBA(image.Rect(0, 0, p.width, min(pngStripRows, p.height)))
+			ok = true
+			return p, nil
+		case "IEND":
+			return nil, errors.New("png: no image data")
+		}
+	}
+}
+
+// checkFormat rejects the color type and depth combinations PNG doesn't
+// allow.
+func (p *pngStrips) checkFormat() error {
+	valid := false
+	switch p.colorType {
+	case pngGray:
+		valid = p.depth == 1 || p.depth == 2 || p.depth == 4 || p.depth == 8 || p.depth == 16
+	case pngPaletted:
+		valid = p.depth == 1 || p.depth == 2 || p.depth == 4 || p.depth == 8
+	case pngTrueColor, pngGrayAlpha, pngRGBA:
+		valid = p.depth == 8 || p.depth == 16
+	}
+	if !valid || p.width <= 0 || p.height <= 0 {
+		return fmt.Errorf("png: unsupported color type %d at depth %d", p.colorType, p.depth)
+	}
+	return nil
+}
+
+// readPNGChunk reads a chunk and checks its CRC.
+func readPNGChunk(r io.Reader) (string, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", nil, fmt.Errorf("png: %w", io.ErrUnexpectedEOF)
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n > 1<<31 {
+		return "", nil, errors.New("png: bad chunk length")
+	}
+	// Read rather than allocated up front, so a corrupt length can't claim
+	// gigabytes the file doesn't have
+	data, err := io.ReadAll(io.LimitReader(r, int64(n)+4))
+	if err != nil || len(data) < int(n)+4 {
+		return "", nil, fmt.Errorf("png: %w", io.ErrUnexpectedEOF)
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data[:n])
+	if crc.Sum32() != binary.BigEndian.Uint32(data[n:]) {
+		return "", nil, errors.New("png: bad chunk checksum")
+	}
+	return string(header[4:]), data[:n], nil
+}
+
+// idatReader reads the data of the IDAT chunks after the first, ending at
+// the first chunk of another kind.
+type idatReader struct {
+	r    io.Reader
+	data []byte
+	done bool
+}
+
+func (ir *idatReader) Read(b []byte) (int, error) {
+	for len(ir.data) == 0 {
+		if ir.done {
+			return 0, io.EOF
+		}
+		kind, data, err := readPNGChunk(ir.r)
+		if err != nil {
+			return 0, err
+		}
+		if kind != "IDAT" {
+			ir.done = true
+			continue
+		}
+		ir.data = data
+	}
+	n := copy(b, ir.data)
+	ir.data = ir.data[n:]
+	return n, nil
+}
+
+func (p *pngStrips) bounds() image.Rectangle {
+	return image.Rect(0, 0, p.width, p.height)
+}
+
+func (p *pngStrips) close() { p.file.Close() }
+
+// next decodes the next pngStripRows rows, or returns io.EOF after the
+// last.
+func (p *pngStrips) next() (*image.RGBA, error) {
+	if p.y == p.height {
+		return nil, io.EOF
+	}
+	p.band.Rect = image.Rect(0, p.y, p.width, min(p.y+pngStripRows, p.height))
+	for ; p.y < p.band.Rect.Max.Y; p.y++ {
+		if _, err := io.ReadFull(p.zr, p.cur); err != nil {
+			return nil, fmt.Errorf("png: %w", io.ErrUnexpectedEOF)
+		}
+		if err := p.unfilter(); err != nil {
+			return nil, err
+		}
+		p.convert(p.band.Pix[p.band.PixOffset(0, p.y):])
+		p.prev, p.cur = p.cur, p.prev
+	}
+	return p.band, nil
+}
+
+// unfilter undoes the filter of the row in cur, given prev, per section 9
+// of the PNG specification.
+func (p *pngStrips) unfilter() error {
+	cur, prev := p.cur[1:], p.prev[1:]
+	bpp := p.bpp
+	switch p.cur[0] {
+	case 0:
+	case 1:
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += cur[i-bpp]
+		}
+	case 2:
+		for i := range cur {
+			cur[i] += prev[i]
+		}
+	case 3:
+		for i := range cur {
+			var left byte
+			if i >= bpp {
+				left = cur[i-bpp]
+			}
+			cur[i] += byte((int(left) + int(prev[i])) / 2)
+		}
+	case 4:
+		for i := range cur {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = cur[i-bpp], prev[i-bpp]
+			}
+			cur[i] += paeth(left, prev[i], upLeft)
+		}
+	default:
+		return errors.New("png: bad filter type")
+	}
+	return nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// convert writes the unfiltered row in cur to pix as premultiplied RGBA.
+func (p *pngStrips) convert(pix []byte) {
+	row := p.cur[1:]
+	maxValue := uint32(1)<<p.depth - 1
+	// sample returns the i-th sample of the row scaled to 16 bits
+	sample := func(i int) uint32 {
+		switch p.depth {
+		case 16:
+			return uint32(binary.BigEndian.Uint16(row[2*i:]))
+		case 8:
+			return uint32(row[i]) * 0x101
+		}
+		perByte := 8 / p.depth
+		shift := uint(8 - p.depth*(i%perByte+1))
+		return uint32(row[i/perByte]>>shift) & maxValue * 0xffff / maxValue
+	}
+	// raw returns the i-th sample as stored, to compare with tRNS
+	raw := func(i int) uint16 {
+		return uint16(sample(i) * maxValue / 0xffff)
+	}
+	for x := 0; x < p.width; x++ {
+		var r, g, b, a uint32
+		switch p.colorType {
+		case pngPaletted:
+			i := sample(x) * maxValue / 0xffff
+			if int(i) < len(p.palette) {
+				c := p.palette[i]
+				pix[4*x], pix[4*x+1], pix[4*x+2], pix[4*x+3] = c.R, c.G, c.B, c.A
+			} else {
+				pix[4*x], pix[4*x+1], pix[4*x+2], pix[4*x+3] = 0, 0, 0, 0xff
+			}
+			continue
+		case pngGray:
+			r, a = sample(x), 0xffff
+			if len(p.transparent) == 1 && raw(x) == p.transparent[0] {
+				a = 0
+			}
+			g, b = r, r
+		case pngGrayAlpha:
+			r, a = sample(2*x), sample(2*x+1)
+			g, b = r, r
+		case pngTrueColor:
+			r, g, b, a = sample(3*x), sample(3*x+1), sample(3*x+2), 0xffff
+			if len(p.transparent) == 3 && raw(3*x) == p.transparent[0] && raw(3*x+1) == p.transparent[1] && raw(3*x+2) == p.transparent[2] {
+				a = 0
+			}
+		case pngRGBA:
+			r, g, b, a = sample(4*x), sample(4*x+1), sample(4*x+2), sample(4*x+3)
+		}
+		pix[4*x] = uint8(r * a / 0xffff >> 8)
+		pix[4*x+1] = uint8(g * a / 0xffff >> 8)
+		pix[4*x+2] = uint8(b * a / 0xffff >> 8)
+		pix[4*x+3] = uint8(a >> 8)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"runtime"
+)
+
+// systemLoad is a snapshot of how busy the machine is. What can't be read
+// on this platform is left unknown and doesn't limit anything.
+type systemLoad struct {
+	load         float64 // 1-minute load average
+	hasLoad      bool
+	memAvailable uint64
+	hasMemory    bool
+	onBattery    bool
+}
+
+// bytesPerPixel roughly estimates the peak memory needed per source pixel
+// while a file is processed: the decoded image, a resized or converted copy
+// and the encoder's buffers.
+const bytesPerPixel = 16
+
+// estimateMemory returns roughly how much memory processing srcPath needs,
+// from the dimensions in its header, or 0 if they can't be read.
+func estimateMemory(srcPath string) uint64 {
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	cfg, _, err := decodeConfig(file)
+	if err != nil {
+		return 0
+	}
+	return uint64(cfg.Width) * uint64(cfg.Height) * bytesPerPixel
+}
+
+// hasRoomFor reports whether the machine can take another file needing
+// memory bytes on top of running ones: a CPU must be left idle, counting
+// the running files in case the load average hasn't caught up with them
+// yet, and the file must fit in half the available memory, leaving the
+// rest for whatever else is running.
+func (s systemLoad) hasRoomFor(running int, memory uint64) bool {
+	if s.hasLoad && max(s.load, float64(running))+1 > float64(runtime.NumCPU()) {
+		return false
+	}
+	if s.hasMemory && memory > s.memAvailable/2 {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// readSystemLoad reads the load average and available memory from /proc
+// and the power supplies from /sys.
+func readSystemLoad() systemLoad {
+	var s systemLoad
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			if load, err := strconv.ParseFloat(fields[0], 64); err == nil {
+				s.load, s.hasLoad = load, true
+			}
+		}
+	}
+	if data, err := os.ReadFile("/proc/meminfo"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+				if kb, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+					s.memAvailable, s.hasMemory = kb<<10, true
+				}
+			}
+		}
+	}
+	s.onBattery = onBattery()
+	return s
+}
+
+// onBattery reports whether a battery is discharging with no mains or USB
+// supply online.
+func onBattery() bool {
+	supplies, _ := filepath.Glob("/sys/class/power_supply/*")
+	discharging := false
+	for _, dir := range supplies {
+		switch readSysfs(dir, "type") {
+		case "Mains", "USB":
+			if readSysfs(dir, "online") == "1" {
+				return false
+			}
+		case "Battery":
+			if readSysfs(dir, "status") == "Discharging" {
+				discharging = true
+			}
+		}
+	}
+	return discharging
+}
+
+func readSysfs(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// readSystemLoad knows nothing about the machine outside Linux, so only
+// -workers limits how many files are processed at once.
+func readSystemLoad() systemLoad {
+	return systemLoad{}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What -tag marks as processed.
+const (
+	tagNone    = "none"
+	tagOutputs = "outputs"
+	tagSources = "sources"
+	tagBoth    = "both"
+)
+
+// tagMode is the -tag setting in effect.
+var tagMode = tagNone
+
+const tagUsage = "mark finished files with an extended attribute (an alternate data stream on Windows) recording the version, the source's SHA-256 and the settings, and skip sources whose marks match on later runs: none, outputs, sources or both (default none)"
+
+var errTagUnsupported = errors.New("-tag: this platform has no extended attributes")
+
+// parseTag sets tagMode from -tag.
+func parseTag(s string) error {
+	switch s {
+	case tagNone, tagOutputs, tagSources, tagBoth:
+	default:
+		return fmt.Errorf("unknown -tag %q (want none, outputs, sources or both)", s)
+	}
+	if s != tagNone && !tagSupported {
+		return errTagUnsupported
+	}
+	tagMode = s
+	return nil
+}
+
+// processedTag is the mark -tag writes for a source with the given hash:
+// the version that processed it, the hash, the target it was processed
+// for and the fingerprint of the other settings.
+func processedTag(sourceHash string) string {
+	return fmt.Sprintf("image-compressor %s sha256:%s target:%d settings:%s", version, sourceHash, targetSize, settingsFingerprint())
+}
+
+// tagMatches reports whether tag marks a source with the given hash as
+// processed for the current target and settings. The version doesn't
+// matter, so an upgrade doesn't redo every file.
+func tagMatches(tag, sourceHash string) bool {
+	fields := strings.Fields(tag)
+	return len(fields) == 5 && fields[0] == "image-compressor" &&
+		fields[2] == "sha256:"+sourceHash && fields[3] == fmt.Sprintf("target:%d", targetSize) &&
+		fields[4] == "settings:"+settingsFingerprint()
+}
+
+// settingsFingerprint returns a short hash of the settings that change
+// what an output looks like, so a mark left by a run with, say, another
+// -max-dimension or -effort doesn't skip the source. Settings that only
+// change where outputs go or what is reported are left out.
+func settingsFingerprint() string {
+	hash := sha256.New()
+	for _, v := range []any{
+		effort, qualityBelowSource, qualityCap, intent, tileThreshold,
+		maxDimension, maxWidth, maxHeight, displayWidth, displayHeight, displayDPR,
+		canvasWidth, canvasHeight, padColor, profileSizes, faviconProfile,
+		panoramaRatio, panoramaMaxDimension, panoramaTiles,
+		linearResize, resizeFilter, flattenColor, flattenTransparent,
+		noConvert, heicOutput, convertAll, formatPolicies, fallbackChain,
+		keepMetadata, metadataBudget, stripCopies, timeShift, timeOffset, gpsPrecision,
+		creditArtist, creditCopyright, redactRegions, redactDetector, redactStyle,
+		hiddenLayers, layerNames,
+	} {
+		fmt.Fprintf(hash, "%v\n", v)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// taggedOutput returns the output in out of the source at srcPath, whose
+// hash is sourceHash, and its info if a -tag mark on either shows it is up
+// to date, or nil info if the source needs processing.
+func taggedOutput(srcPath, out, sourceHash string) (string, os.FileInfo) {
+	sourceTagged := false
+	if tagMode == tagSources || tagMode == tagBoth {
+		tag, err := readTag(srcPath)
+		sourceTagged = err == nil && tagMatches(tag, sourceHash)
+	}
+	for _, path := range outputCandidates(srcPath, out) {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if sourceTagged {
+			return path, info
+		}
+		if tag, err := readTag(path); err == nil && tagMatches(tag, sourceHash) {
+			return path, info
+		}
+	}
+	return "", nil
+}
+
+// tagFinished marks the outputs and source of a finished result as -tag
+// says. A file system that can't hold the mark is logged, not a failure.
+func tagFinished(log *fileLog, result fileResult, sourceHash string) {
+	var paths []string
+	if tagMode == tagOutputs || tagMode == tagBoth {
+		for _, path := range []string{result.Output, result.KeptOutput} {
+			if path != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+	if tagMode == tagSources || tagMode == tagBoth {
+		paths = append(paths, result.Source)
+	}
+	tag := processedTag(sourceHash)
+	for _, path := range paths {
+		err := guardWrite(path)
+		if err == nil {
+			err = writeTag(path, tag)
+		}
+		if err != nil {
+			log.Line("  tag %s: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
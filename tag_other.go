@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !windows
+
+package main
+
+const tagSupported = false
+
+func readTag(path string) (string, error) {
+	return "", errTagUnsupported
+}
+
+func writeTag(path, tag string) error {
+	return errTagUnsupported
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTagMatchesSettings(t *testing.T) {
+	saved := currentSettings()
+	defer saved.apply()
+	const hash = "0123abcd"
+	tag := processedTag(hash)
+	if !tagMatches(tag, hash) {
+		t.Fatalf("%q doesn't match the settings it was written with", tag)
+	}
+	if tagMatches(tag, "ffff0000") {
+		t.Errorf("%q matches another source", tag)
+	}
+	if tagMatches("image-compressor v1.0.0 sha256:"+hash+" target:990000", hash) {
+		t.Error("a mark without settings matches")
+	}
+
+	changes := map[string]func(){
+		"target":        func() { targetSize /= 2 },
+		"max-dimension": func() { maxDimension = 800 },
+		"effort":        func() { effort = maxEffort },
+		"format policy": func() { formatPolicies = map[string]string{"png": "jpeg"} },
+		"keep-metadata": func() { keepMetadata = !keepMetadata },
+	}
+	for name, change := range changes {
+		saved.apply()
+		change()
+		if tagMatches(tag, hash) {
+			t.Errorf("the mark still matches after changing %s", name)
+		}
+	}
+}
+
+func TestTagRedoesChangedSettings(t *testing.T) {
+	if !tagSupported {
+		t.Skip("no extended attributes on this platform")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "photo.jpg")
+	writeTestImage(t, src, testImage(400, 300, 20, 1))
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTag(src, "probe"); err != nil {
+		t.Skipf("the temporary directory can't hold marks: %v", err)
+	}
+
+	args := []string{"-target", "20KB", "-tag", "outputs"}
+	if result := compressFile(t, src, out, args...); result.Outcome != outcomeCompressed {
+		t.Fatalf("first run: outcome %v (%s)", result.Outcome, result.Error)
+	}
+	if result := compressFile(t, src, out, args...); result.Outcome != outcomeSkipped {
+		t.Errorf("same settings: outcome %v, want skipped", result.Outcome)
+	}
+	result := compressFile(t, src, out, append(args, "-max-dimension", "200")...)
+	if result.Outcome != outcomeCompressed {
+		t.Fatalf("new -max-dimension: outcome %v (%s), want compressed", result.Outcome, result.Error)
+	}
+	if img, _ := decodeTestImage(t, result.Output); img.Bounds().Dx() != 200 {
+		t.Errorf("output is %v after -max-dimension 200", img.Bounds())
+	}
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package main
+
+import "os"
+
+const tagSupported = true
+
+// tagStream is the NTFS alternate data stream holding -tag marks.
+const tagStream = ":image-compressor"
+
+func readTag(path string) (string, error) {
+	data, err := os.ReadFile(path + tagStream)
+	return string(data), err
+}
+
+// writeTag writes the mark, keeping the file's modification time, which
+// writing a stream would otherwise update.
+func writeTag(path, tag string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+tagStream, []byte(tag), 0644); err != nil {
+		return err
+	}
+	return os.Chtimes(path, info.ModTime(), info.ModTime())
+}
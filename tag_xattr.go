@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd || netbsd
+
+package main
+
+import "golang.org/x/sys/unix"
+
+const tagSupported = true
+
+// tagAttribute is the extended attribute holding -tag marks. Linux only
+// lets unprivileged users set attributes in the user namespace.
+const tagAttribute = "user.image-compressor"
+
+func readTag(path string) (string, error) {
+	buf := make([]byte, 256)
+	n, err := unix.Getxattr(path, tagAttribute, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+func writeTag(path, tag string) error {
+	return unix.Setxattr(path, tagAttribute, []byte(tag), 0)
+}
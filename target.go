@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// uploadLimit is the limit of the platform outputs are meant for; the
+// encoder aims sizeMargin below it, at targetSize.
+var uploadLimit = 1000 * 1000
+
+// sizeMargin is how far under uploadLimit outputs are kept, either a
+// percentage of the limit or a number of bytes.
+var sizeMargin = margin{percent: 1}
+
+type margin struct {
+	percent float64
+	bytes   int
+}
+
+func (m margin) String() string {
+	if m.bytes > 0 {
+		return formatSize(m.bytes)
+	}
+	return strconv.FormatFloat(m.percent, 'f', -1, 64) + "%"
+}
+
+// below returns limit less the margin.
+func (m margin) below(limit int) int {
+	if m.bytes > 0 {
+		return limit - m.bytes
+	}
+	return int(float64(limit) * (1 - m.percent/100))
+}
+
+// updateTarget recomputes targetSize from uploadLimit and sizeMargin.
+func updateTarget() {
+	targetSize = sizeMargin.below(uploadLimit)
+}
+
+// byteUnits are the size suffixes parseSize accepts. KB, MB and GB are
+// decimal; KiB, MiB and GiB are binary, which is how many upload limits
+// are actually counted.
+var byteUnits = map[string]int{
+	"":    1,
+	"b":   1,
+	"k":   1000,
+	"kb":  1000,
+	"m":   1000 * 1000,
+	"mb":  1000 * 1000,
+	"g":   1000 * 1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+}
+
+// parseSize parses a byte count such as 500000, 500KB, 1.5MB or 1MiB.
+func parseSize(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	number, unit := s[:i], strings.ToLower(strings.TrimSpace(s[i:]))
+	scale, ok := byteUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit %q in %q", s[i:], s)
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int(value * float64(scale)), nil
+}
+
+// parseMargin parses a margin given as a percentage (2%) or a size (10KB).
+func parseMargin(s string) (margin, error) {
+	if number, ok := strings.CutSuffix(strings.TrimSpace(s), "%"); ok {
+		percent, err := strconv.ParseFloat(number, 64)
+		if err != nil || percent < 0 || percent >= 100 {
+			return margin{}, fmt.Errorf("invalid margin %q, want a percentage from 0 to under 100", s)
+		}
+		return margin{percent: percent}, nil
+	}
+	size, err := parseSize(s)
+	if err != nil {
+		return margin{}, err
+	}
+	return margin{bytes: size}, nil
+}
+
+// formatSize formats a byte count with the largest unit that keeps it at or
+// above 1. Counts that are whole binary units, like a limit given as 1MiB,
+// are shown in binary units; everything else in decimal ones.
+func formatSize(n int) string {
+	if n%1024 == 0 && n%1000 != 0 {
+		return formatBinarySize(n)
+	}
+	switch {
+	case n >= 1000*1000:
+		return formatUnits(n, 1000*1000, "MB")
+	case n >= 1000:
+		return formatUnits(n, 1000, "KB")
+	}
+	return strconv.Itoa(n) + " B"
+}
+
+// formatBinarySize is formatSize in KiB and MiB.
+func formatBinarySize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return formatUnits(n, 1<<20, "MiB")
+	case n >= 1<<10:
+		return formatUnits(n, 1<<10, "KiB")
+	}
+	return strconv.Itoa(n) + " B"
+}
+
+// formatMB formats a file size in both MB and MiB, so it can be checked
+// against limits counted either way.
+func formatMB(n int64) string {
+	return fmt.Sprintf("%.2f MB, %.2f MiB", float64(n)/(1000*1000), float64(n)/(1<<20))
+}
+
+func formatUnits(n, unit int, name string) string {
+	return strconv.FormatFloat(math.Round(float64(n)/float64(unit)*100)/100, 'f', -1, 64) + " " + name
+}
@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"500000", 500000},
+		{"0", 0},
+		{"512B", 512},
+		{"500KB", 500 * 1000},
+		{"500kb", 500 * 1000},
+		{"500k", 500 * 1000},
+		{"500KiB", 500 * 1024},
+		{"1MB", 1000 * 1000},
+		{"1MiB", 1 << 20},
+		{"1m", 1000 * 1000},
+		{"1.5MB", 1500 * 1000},
+		{"1.5MiB", 3 << 19},
+		{"0.5KB", 500},
+		{".25MB", 250 * 1000},
+		{"2GB", 2 * 1000 * 1000 * 1000},
+		{"1GiB", 1 << 30},
+		{" 8 MB ", 8 * 1000 * 1000},
+	}
+	for _, tt := range tests {
+		if got, err := parseSize(tt.in); err != nil || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "MB", "1TB", "1 megabyte", "1MBs", "1.2.3MB", "-5KB", "1e6", "1,5MB", "0x10"} {
+		if got, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestParseMargin(t *testing.T) {
+	tests := []struct {
+		in   string
+		want margin
+	}{
+		{"1%", margin{percent: 1}},
+		{"0%", margin{}},
+		{"2.5%", margin{percent: 2.5}},
+		{" 99.9% ", margin{percent: 99.9}},
+		{"10KB", margin{bytes: 10 * 1000}},
+		{"16KiB", margin{bytes: 16 << 10}},
+		{"4096", margin{bytes: 4096}},
+		{"0.1MB", margin{bytes: 100 * 1000}},
+	}
+	for _, tt := range tests {
+		if got, err := parseMargin(tt.in); err != nil || got != tt.want {
+			t.Errorf("parseMargin(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "%", "-1%", "-0.5%", "100%", "150%", "x%", "1%%", "-10KB", "10XB"} {
+		if got, err := parseMargin(in); err == nil {
+			t.Errorf("parseMargin(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestMarginBelow(t *testing.T) {
+	tests := []struct {
+		m     margin
+		limit int
+		want  int
+	}{
+		{margin{percent: 1}, 1000 * 1000, 990 * 1000},
+		{margin{}, 1 << 20, 1 << 20},
+		{margin{percent: 2.5}, 200 * 1000, 195 * 1000},
+		{margin{bytes: 10 * 1000}, 1000 * 1000, 990 * 1000},
+		{margin{bytes: 4096}, 1 << 20, 1<<20 - 4096},
+		// checkCompressionFlags rejects what this leaves
+		{margin{bytes: 2000}, 1000, -1000},
+	}
+	for _, tt := range tests {
+		if got := tt.m.below(tt.limit); got != tt.want {
+			t.Errorf("%v below %d = %d, want %d", tt.m, tt.limit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Outputs are written to a hidden temp file next to their destination and
+// renamed into place once complete, so a crash never leaves a truncated
+// image under a real name. tempSuffix marks those files for sweeping.
+const tempSuffix = ".tmp"
+
+// sweptDirs holds a *sync.Once for each directory writeOutput has written
+// to, so each is swept of earlier runs' temp files once, before this run
+// starts any of its own there.
+var sweptDirs sync.Map
+
+// writeOutput atomically replaces path with data.
+func writeOutput(path string, data []byte) error {
+	if err := guardWrite(path); err != nil {
+		return err
+	}
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	once, _ := sweptDirs.LoadOrStore(filepath.Clean(dir), new(sync.Once))
+	once.(*sync.Once).Do(func() {
+		if n := sweepTempFiles(dir); n > 0 {
+			logf("Removed %d unfinished file(s) left by an interrupted run in %s\n", n, dir)
+		}
+	})
+	tmp, err := os.CreateTemp(dir, "."+name+".*"+tempSuffix)
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// isTempOutput reports whether name is a temp file writeOutput creates:
+// "." and the output's name, then the random digits os.CreateTemp puts in
+// place of the * and tempSuffix, e.g. ".photo.jpg.1234567890.tmp".
+func isTempOutput(name string) bool {
+	rest, ok := strings.CutSuffix(name, tempSuffix)
+	if !ok || !strings.HasPrefix(rest, ".") {
+		return false
+	}
+	dot := strings.LastIndexByte(rest, '.')
+	digits := rest[dot+1:]
+	if dot < 2 || digits == "" {
+		return false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// sweepTempFiles removes temp files that earlier runs left in dir, not its
+// subdirectories, when they crashed or were killed mid-write. It returns
+// how many it removed.
+func sweepTempFiles(dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	removed := 0
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && isTempOutput(entry.Name()) && os.Remove(filepath.Join(dir, entry.Name())) == nil {
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsTempOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{".photo.jpg.1234567890.tmp", true},
+		{".a b.png.7.tmp", true},
+		{".photo.jpg.tmp", false},
+		{".notes.tmp", false},
+		{".photo.jpg.12ab.tmp", false},
+		{"photo.jpg.123.tmp", false},
+		{"..123.tmp", false},
+		{".photo.jpg.123.tmp.bak", false},
+	}
+	for _, tt := range tests {
+		if got := isTempOutput(tt.name); got != tt.want {
+			t.Errorf("isTempOutput(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteOutputSweepsOnlyItsDirectory(t *testing.T) {
+	root := t.TempDir()
+	out := filepath.Join(root, "out")
+	other := filepath.Join(out, "sub")
+	if err := os.MkdirAll(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(path string) {
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leftover := filepath.Join(out, ".photo.jpg.42.tmp")
+	userFile := filepath.Join(out, ".notes.tmp")
+	otherLeftover := filepath.Join(other, ".photo.jpg.43.tmp")
+	for _, path := range []string{leftover, userFile, otherLeftover} {
+		write(path)
+	}
+
+	if err := writeOutput(filepath.Join(out, "photo.jpg"), []byte("jpeg")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("leftover temp file in the written directory was kept")
+	}
+	for _, path := range []string{userFile, otherLeftover} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", path, err)
+		}
+	}
+
+	// Each directory is swept once per run, not on every write
+	write(leftover)
+	if err := writeOutput(filepath.Join(out, "photo2.jpg"), []byte("jpeg")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); err != nil {
+		t.Errorf("directory was swept again: %v", err)
+	}
+}
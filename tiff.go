@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io"
+	"sort"
+)
+
+// TIFF field types and tags written by encodeTIFF.
+const (
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffRational  = 5
+	tiffUndefined = 7
+
+	tagImageWidth      = 256
+	tagImageLength     = 257
+	tagBitsPerSample   = 258
+	tagCompression     = 259
+	tagPhotometric     = 262
+	tagStripOffsets    = 273
+	tagSamplesPerPixel = 277
+	tagRowsPerStrip    = 278
+	tagStripByteCounts = 279
+	tagXResolution     = 282
+	tagYResolution     = 283
+	tagPlanarConfig    = 284
+	tagResolutionUnit  = 296
+	tagPredictor       = 317
+	tagExtraSamples    = 338
+	tagICCProfile      = 34675
+)
+
+// tiffStripBytes is roughly how much uncompressed image data goes into each
+// strip.
+const tiffStripBytes = 256 << 10
+
+type tiffField struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	data  []byte
+}
+
+func tiffShorts(tag uint16, values ...uint16) tiffField {
+	data := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(data[2*i:], v)
+	}
+	return tiffField{tag, tiffShort, uint32(len(values)), data}
+}
+
+func tiffLongs(tag uint16, values ...uint32) tiffField {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(data[4*i:], v)
+	}
+	return tiffField{tag, tiffLong, uint32(len(values)), data}
+}
+
+// encodeTIFF writes img as a Deflate-compressed TIFF with horizontal
+// differencing, embedding icc as its color profile if it isn't empty.
+// 16-bit images keep all 16 bits, and alpha is written only when img isn't
+// opaque.
+func encodeTIFF(w io.Writer, img image.Image, icc []byte) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	depth := 8
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		depth = 16
+	}
+	gray := false
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		gray = true
+	}
+	alpha := !gray && !isOpaque(img)
+	samples := 3
+	switch {
+	case gray:
+		samples = 1
+	case alpha:
+		samples = 4
+	}
+	rowBytes := width * samples * depth / 8
+	rowsPerStrip := max(tiffStripBytes/max(rowBytes, 1), 1)
+
+	// Compress the strips first so their sizes are known
+	var strips [][]byte
+	row := make([]byte, rowBytes)
+	for y0 := 0; y0 < height; y0 += rowsPerStrip {
+		var buffer bytes.Buffer
+		zw := zlib.NewWriter(&buffer)
+		for y := y0; y < min(y0+rowsPerStrip, height); y++ {
+			tiffRow(row, img, bounds.Min.Y+y, samples, depth)
+			if _, err := zw.Write(row); err != nil {
+				return err
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		strips = append(strips, buffer.Bytes())
+	}
+
+	bits := make([]uint16, samples)
+	for i := range bits {
+		bits[i] = uint16(depth)
+	}
+	photometric := uint16(2)
+	if gray {
+		photometric = 1
+	}
+	resolution := []byte{0, 0, 0, 72, 0, 0, 0, 1}
+	fields := []tiffField{
+		tiffLongs(tagImageWidth, uint32(width)),
+		tiffLongs(tagImageLength, uint32(height)),
+		tiffShorts(tagBitsPerSample, bits...),
+		tiffShorts(tagCompression, 8),
+		tiffShorts(tagPhotometric, photometric),
+		tiffShorts(tagSamplesPerPixel, uint16(samples)),
+		tiffLongs(tagRowsPerStrip, uint32(rowsPerStrip)),
+		{tagXResolution, tiffRational, 1, resolution},
+		{tagYResolution, tiffRational, 1, resolution},
+		tiffShorts(tagPlanarConfig, 1),
+		tiffShorts(tagResolutionUnit, 2),
+		tiffShorts(tagPredictor, 2),
+	}
+	if alpha {
+		// Unassociated alpha
+		fields = append(fields, tiffShorts(tagExtraSamples, 2))
+	}
+	if len(icc) > 0 {
+		fields = append(fields, tiffField{tagICCProfile, tiffUndefined, uint32(len(icc)), icc})
+	}
+	counts := make([]uint32, len(strips))
+	for i, s := range strips {
+		counts[i] = uint32(len(s))
+	}
+	fields = append(fields, tiffLongs(tagStripByteCounts, counts...))
+	// Offsets are filled in once the layout is known
+	fields = append(fields, tiffLongs(tagStripOffsets, make([]uint32, len(strips))...))
+	sort.Slice(fields, func(i, j int) bool { return fields[i].tag < fields[j].tag })
+	var offsetsField int
+	for i, f := range fields {
+		if f.tag == tagStripOffsets {
+			offsetsField = i
+		}
+	}
+
+	// Header, then the IFD, then values too large to fit in it, then strips
+	ifdSize := 2 + 12*len(fields) + 4
+	next := 8 + ifdSize
+	valueOffsets := make([]int, len(fields))
+	for i, f := range fields {
+		if len(f.data) > 4 {
+			valueOffsets[i] = next
+			next += len(f.data) + len(f.data)%2
+		}
+	}
+	offsets := make([]uint32, len(strips))
+	for i, s := range strips {
+		offsets[i] = uint32(next)
+		next += len(s)
+	}
+	fields[offsetsField] = tiffLongs(tagStripOffsets, offsets...)
+
+	var out bytes.Buffer
+	out.Write([]byte{'M', 'M', 0, 42, 0, 0, 0, 8})
+	binary.Write(&out, binary.BigEndian, uint16(len(fields)))
+	for i, f := range fields {
+		binary.Write(&out, binary.BigEndian, f.tag)
+		binary.Write(&out, binary.BigEndian, f.kind)
+		binary.Write(&out, binary.BigEndian, f.count)
+		if len(f.data) > 4 {
+			binary.Write(&out, binary.BigEndian, uint32(valueOffsets[i]))
+			continue
+		}
+		var value [4]byte
+		copy(value[:], f.data)
+		out.Write(value[:])
+	}
+	out.Write([]byte{0, 0, 0, 0})
+	for _, f := range fields {
+		if len(f.data) > 4 {
+			out.Write(f.data)
+			if len(f.data)%2 == 1 {
+				out.WriteByte(0)
+			}
+		}
+	}
+	if _, err := w.Write(out.Bytes()); err != nil {
+		return err
+	}
+	for _, s := range strips {
+		if _, err := w.Write(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tiffRow fills row with the big-endian samples of row y of img, with
+// horizontal differencing applied.
+func tiffRow(row []byte, img image.Image, y, samples, depth int) {
+	bounds := img.Bounds()
+	var previous [4]uint32
+	i := 0
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		var values [4]uint32
+		c := img.At(x, y)
+		if samples == 1 {
+			g, _, _, _ := c.RGBA()
+			values[0] = g
+		} else {
+			r, g, b, a := c.RGBA()
+			if samples == 4 && a != 0 && a != 0xffff {
+				// Unpremultiply
+				r, g, b = r*0xffff/a, g*0xffff/a, b*0xffff/a
+			}
+			values = [4]uint32{r, g, b, a}
+		}
+		for s := 0; s < samples; s++ {
+			v := values[s]
+			if depth == 8 {
+				v >>= 8
+				row[i] = byte(v - previous[s])
+				i++
+			} else {
+				binary.BigEndian.PutUint16(row[i:], uint16(v-previous[s]))
+				i += 2
+			}
+			previous[s] = v
+		}
+	}
+}
+
+// isOpaque reports whether img has no transparent pixels.
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"image"
+	"math"
+	"os"
+	"runtime/debug"
+)
+
+const defaultTileThresholdMP = 100
+
+// tileThreshold is the pixel count above which images take the tiled path.
+var tileThreshold = defaultTileThresholdMP * 1000 * 1000
+
+// tiledBitsPerPixel is a rough JPEG cost per pixel at mid quality, used to
+// pick how far to shrink a huge image before the quality search starts.
+const tiledBitsPerPixel = 1.0
+
+// tiledDimensions returns the size a width x height image is reduced to so
+// that it can plausibly be encoded within the target size.
+func tiledDimensions(width, height int) (int, int) {
+	budget := float64(targetSize) * 8 / tiledBitsPerPixel
+	scale := math.Sqrt(budget / (float64(width) * float64(height)))
+	if scale >= 1 {
+		return width, height
+	}
+	return max(int(float64(width)*scale), 1), max(int(float64(height)*scale), 1)
+}
+
+// compressLarge handles images above tileThreshold. Sequential JPEGs and
+// non-interlaced PNGs are decoded a band of rows at a time as they are
+// scaled down, so peak memory stays near the size of the reduced image
+// however large the source. Other formats are decoded whole first, kept in
+// the decoder's native layout and reduced strip by strip, then released
+// before the size search.
+func compressLarge(log *fileLog, srcPath, dstPath string, cfg image.Config) (string, error) {
+	width, height := tiledDimensions(cfg.Width, cfg.Height)
+	width, height = cappedSize(width, height)
+	log.Printf("(%dx%d, tiled to %dx%d) ", cfg.Width, cfg.Height, width, height)
+
+	endDecode := startSpan("decode")
+	small, format, err := decodeReduced(srcPath, width, height)
+	endDecode(err)
+	if err != nil {
+		return "", err
+	}
+	recordSharpness(srcPath, small)
+
+	// Regions are redacted in the reduced frame rather than the full one,
+	// which would take another full-resolution copy
+	redacted, err := redactScaled(log, srcPath, small, cfg.Width, cfg.Height)
+	if err != nil {
+		return "", err
+	}
+	return encodeDecoded(log, format, srcPath, dstPath, fitCanvas(log, redacted))
+}
+
+// decodeReduced decodes the image at path scaled down to width x height,
+// in bands where its format allows.
+func decodeReduced(path string, width, height int) (*image.RGBA, string, error) {
+	strips, format, err := openStrips(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if strips != nil {
+		defer strips.close()
+		small := resizeImage(strips, width, height)
+		return small, format, strips.err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	img, format, err := decodeImage(file)
+	file.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	small := resizeImage(img, width, height)
+	img = nil
+	debug.FreeOSMemory()
+	return small, format, nil
+}
@@ -0,0 +1,116 @@
+//go:build otel || full
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracingSupported = true
+
+// traceCtx holds the innermost open span. Exported compression runs on one
+// goroutine at a time (the server serializes requests), so spans nest
+// through this instead of a context threaded through every function.
+// traceMu only guards it against watch mode, which compresses files
+// concurrently but doesn't export spans.
+var (
+	traceCtx = context.Background()
+	traceMu  sync.Mutex
+)
+
+// initTracing exports spans over OTLP/HTTP when an OTLP endpoint is set in
+// the standard OTEL_EXPORTER_OTLP_* environment variables. The returned
+// function flushes pending spans.
+func initTracing() (func(), error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func() {}, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(programName()),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	fmt.Println("Tracing: exporting spans over OTLP")
+	return func() { provider.Shutdown(context.Background()) }, nil
+}
+
+// startSpan opens a span as a child of the innermost open one. attrs are
+// alternating keys and values. The returned function ends the span,
+// recording err if it isn't nil.
+func startSpan(name string, attrs ...any) spanEnd {
+	traceMu.Lock()
+	parent := traceCtx
+	traceMu.Unlock()
+	return startSpanFrom(parent, name, attrs)
+}
+
+// startRequestSpan opens a span continuing the trace in an incoming
+// request's traceparent header, if any.
+func startRequestSpan(header http.Header, name string, attrs ...any) spanEnd {
+	traceMu.Lock()
+	parent := traceCtx
+	traceMu.Unlock()
+	parent = otel.GetTextMapPropagator().Extract(parent, propagation.HeaderCarrier(header))
+	return startSpanFrom(parent, name, attrs)
+}
+
+func startSpanFrom(parent context.Context, name string, attrs []any) spanEnd {
+	ctx, span := otel.Tracer("image-compressor").Start(parent, name, trace.WithAttributes(spanAttributes(attrs)...))
+	traceMu.Lock()
+	previous := traceCtx
+	traceCtx = ctx
+	traceMu.Unlock()
+	return func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		traceMu.Lock()
+		traceCtx = previous
+		traceMu.Unlock()
+	}
+}
+
+func spanAttributes(attrs []any) []attribute.KeyValue {
+	var kvs []attribute.KeyValue
+	for i := 0; i+1 < len(attrs); i += 2 {
+		key := fmt.Sprint(attrs[i])
+		switch v := attrs[i+1].(type) {
+		case string:
+			kvs = append(kvs, attribute.String(key, v))
+		case int:
+			kvs = append(kvs, attribute.Int(key, v))
+		case int64:
+			kvs = append(kvs, attribute.Int64(key, v))
+		case bool:
+			kvs = append(kvs, attribute.Bool(key, v))
+		default:
+			kvs = append(kvs, attribute.String(key, fmt.Sprint(v)))
+		}
+	}
+	return kvs
+}
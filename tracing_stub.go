@@ -0,0 +1,22 @@
+//go:build !otel && !full
+
+package main
+
+import "net/http"
+
+const tracingSupported = false
+
+// initTracing does nothing in builds without OpenTelemetry; see tracing.go.
+func initTracing() (func(), error) {
+	return func() {}, nil
+}
+
+func startSpan(name string, attrs ...any) spanEnd {
+	return endNoSpan
+}
+
+func startRequestSpan(header http.Header, name string, attrs ...any) spanEnd {
+	return endNoSpan
+}
+
+func endNoSpan(error) {}
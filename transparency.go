@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"image"
+)
+
+// flattenTransparent, set by -flatten-background, lets PNGs and GIFs with
+// transparency that are over the target be converted to JPEG like any
+// other, composited onto flattenColor. Otherwise they keep their format and
+// transparency: PNGs are reduced to a palette, which keeps partial
+// transparency, and both are scaled down if that isn't enough.
+var flattenTransparent bool
+
+// parseFlattenBackground sets flattenColor and flattenTransparent.
+func parseFlattenBackground(s string) error {
+	if err := parseFlattenColor(s); err != nil {
+		return err
+	}
+	flattenTransparent = true
+	return nil
+}
+
+// keepTransparency writes img, which has transparency, to dstPath within
+// the target in format, PNG or GIF, instead of converting it to JPEG. If
+// even scaled down it doesn't fit, it fails with errNeedsFlattening.
+func keepTransparency(log *fileLog, format, dstPath string, img image.Image) (string, error) {
+	encode := func(img image.Image) ([]byte, error) {
+		return encodeLossless(format, img)
+	}
+	if format == "png" {
+		log.Printf("(reducing to a palette to keep transparency) ")
+		encode = func(img image.Image) ([]byte, error) {
+			return encodePNG(quantize(img))
+		}
+	}
+	data, err := encodeLosslessWithin(log, img, targetSize, encode)
+	if errors.Is(err, errCannotMeetTarget) {
+		return "", errNeedsFlattening
+	}
+	if err != nil {
+		return "", err
+	}
+	return dstPath, writeOutput(dstPath, data)
+}
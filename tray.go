@@ -0,0 +1,139 @@
+//go:build tray || full
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"runtime"
+	"time"
+
+	"fyne.io/systray"
+)
+
+const traySupported = true
+
+// runTray implements the tray subcommand: watch mode controlled from a
+// system tray icon, for users who never open a terminal.
+func runTray(args []string) error {
+	var opts watchOptions
+	w, err := opts.watcher(watchFlagSet("tray", &opts), args)
+	if skipLocked(err, opts.ifLocked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer w.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer controlPause(w, false)()
+	systray.Run(func() { trayReady(ctx, w) }, cancel)
+	return nil
+}
+
+func trayReady(ctx context.Context, w *watcher) {
+	systray.SetIcon(trayIcon())
+	systray.SetTitle(productName)
+	systray.SetTooltip(productName + " - watching " + w.dir)
+
+	status := systray.AddMenuItem("Starting...", "Queue status")
+	status.Disable()
+	recentMenu := systray.AddMenuItem("Recent", "Recently processed images")
+	recentItems := make([]*systray.MenuItem, maxRecentCompletions)
+	for i := range recentItems {
+		recentItems[i] = recentMenu.AddSubMenuItem("", "")
+		recentItems[i].Disable()
+		recentItems[i].Hide()
+	}
+	systray.AddSeparator()
+	toggle := systray.AddMenuItemCheckbox("Watch folder", "Pause or resume automatic compression", true)
+	openOut := systray.AddMenuItem("Open output folder", w.out)
+	quit := systray.AddMenuItem("Quit", "Stop watching and exit")
+
+	go w.run(ctx)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pending, recent := w.status()
+			// Keep the checkbox in step with pauses from elsewhere
+			if w.isPaused() == toggle.Checked() {
+				if w.isPaused() {
+					toggle.Uncheck()
+				} else {
+					toggle.Check()
+				}
+			}
+			switch {
+			case w.isPaused():
+				status.SetTitle("Paused")
+			case pending > 0:
+				status.SetTitle(fmt.Sprintf("%d image(s) queued", pending))
+			default:
+				status.SetTitle("Idle")
+			}
+			for i, item := range recentItems {
+				if i >= len(recent) {
+					item.Hide()
+					continue
+				}
+				c := recent[i]
+				item.SetTitle(fmt.Sprintf("%s  %s  %s", c.at.Format("15:04"), c.name, c.outcome))
+				item.Show()
+			}
+		case <-toggle.ClickedCh:
+			if toggle.Checked() {
+				toggle.Uncheck()
+				w.setPaused(true)
+			} else {
+				toggle.Check()
+				w.setPaused(false)
+			}
+		case <-openOut.ClickedCh:
+			openDesktop(w.out)
+		case <-quit.ClickedCh:
+			systray.Quit()
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// trayIcon draws a small two-tone icon. Windows wants ICO data; everything
+// else takes PNG, which an ICO file can wrap as-is.
+func trayIcon() []byte {
+	const size = 32
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := color.NRGBA{0x2b, 0x6c, 0xb0, 0xff}
+			if x+y > size {
+				c = color.NRGBA{0x5a, 0xb8, 0x5a, 0xff}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	var pngData bytes.Buffer
+	png.Encode(&pngData, img)
+	if runtime.GOOS != "windows" {
+		return pngData.Bytes()
+	}
+
+	var ico bytes.Buffer
+	binary.Write(&ico, binary.LittleEndian, []uint16{0, 1, 1})
+	ico.Write([]byte{size, size, 0, 0})
+	binary.Write(&ico, binary.LittleEndian, []uint16{1, 32})
+	binary.Write(&ico, binary.LittleEndian, []uint32{uint32(pngData.Len()), 22})
+	ico.Write(pngData.Bytes())
+	return ico.Bytes()
+}
@@ -0,0 +1,11 @@
+//go:build !tray && !full
+
+package main
+
+import "fmt"
+
+const traySupported = false
+
+func runTray(args []string) error {
+	return fmt.Errorf("this build has no tray support; rebuild with -tags tray")
+}
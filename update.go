@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// releaseFeed is where the updater looks for releases by default. Branded
+// builds point it at their own with -ldflags "-X main.releaseFeed=...".
+var releaseFeed = "https://api.github.com/repos/hoangtrieu96/image-compressor/releases/latest"
+
+// maxUpdateSize caps how much the updater downloads for a single binary.
+const maxUpdateSize = 200 << 20
+
+// release is the part of a GitHub release the updater reads.
+type release struct {
+	TagName string         `json:"tag_name"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// updateAssetName is the release asset built for this platform.
+func updateAssetName() string {
+	name := fmt.Sprintf("%s-%s-%s", shortName, runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// updateManifestName is the release asset listing the release's version
+// and the SHA-256 of each of its binaries. Its ed25519 signature is
+// published next to it with a .sig suffix.
+func updateManifestName() string {
+	return shortName + "-manifest.json"
+}
+
+// updateManifest is what a release signs. Signing the version and asset
+// names rather than each binary alone means an older release, or another
+// platform's build, can't be passed off as this update.
+type updateManifest struct {
+	Version string            `json:"version"`
+	Assets  map[string]string `json:"assets"`
+}
+
+// runUpdate implements the update subcommand, which replaces the running
+// binary with the latest signed release.
+func runUpdate(args []string) error {
+	var opts updateOptions
+	updateFlagSet(&opts).Parse(args)
+
+	fmt.Printf("Current version: %s\n", version)
+	rel, err := fetchRelease(opts.feed)
+	if err != nil {
+		return fmt.Errorf("checking for updates: %w", err)
+	}
+	fmt.Printf("Latest version: %s\n", rel.TagName)
+
+	if !opts.force && !newerVersion(rel.TagName, version) {
+		fmt.Println("Already up to date.")
+		return nil
+	}
+	if opts.check {
+		fmt.Println("An update is available. Run without -check to install it.")
+		return nil
+	}
+
+	key, err := releaseKey()
+	if err != nil {
+		return err
+	}
+	urls := make(map[string]string)
+	for _, asset := range rel.Assets {
+		urls[asset.Name] = asset.URL
+	}
+	binURL := urls[updateAssetName()]
+	manifestURL, sigURL := urls[updateManifestName()], urls[updateManifestName()+".sig"]
+	if binURL == "" || manifestURL == "" || sigURL == "" {
+		return fmt.Errorf("release %s has no signed build for %s/%s", rel.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+
+	manifestData, err := download(manifestURL)
+	if err != nil {
+		return err
+	}
+	sig, err := download(sigURL)
+	if err != nil {
+		return err
+	}
+	sum, err := verifyManifest(key, manifestData, sig, rel.TagName, opts.force)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Downloading %s... ", updateAssetName())
+	binary, err := download(binURL)
+	if err != nil {
+		return err
+	}
+	if got := sha256.Sum256(binary); hex.EncodeToString(got[:]) != sum {
+		return fmt.Errorf("%s doesn't match the signed manifest; not installing", updateAssetName())
+	}
+	fmt.Println("verified")
+
+	if err := replaceExecutable(binary); err != nil {
+		return err
+	}
+	fmt.Printf("Updated to %s.\n", rel.TagName)
+	return nil
+}
+
+// releaseKey returns the key release manifests are signed with, which
+// only builds with the updater embed.
+func releaseKey() (ed25519.PublicKey, error) {
+	if !updaterSupported {
+		return nil, errors.New("this build has no updater; download the new version manually, or rebuild with -tags updater")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(updateKey))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("the embedded release key isn't a base64 ed25519 public key, so updates can't be verified")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// verifyManifest checks that data is a manifest signed with key, given as
+// base64 in sig, for release tag and newer than the running version, or
+// no older with force. It returns the SHA-256 the manifest lists for this
+// platform's binary.
+func verifyManifest(key ed25519.PublicKey, data, sig []byte, tag string, force bool) (string, error) {
+	rawSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return "", fmt.Errorf("malformed signature: %w", err)
+	}
+	if !ed25519.Verify(key, data, rawSig) {
+		return "", fmt.Errorf("signature verification failed; not installing")
+	}
+	var manifest updateManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", fmt.Errorf("malformed release manifest: %w", err)
+	}
+	if manifest.Version != tag {
+		return "", fmt.Errorf("release %s carries the signed manifest of %s; not installing", tag, manifest.Version)
+	}
+	if newerVersion(version, manifest.Version) || !force && !newerVersion(manifest.Version, version) {
+		return "", fmt.Errorf("release %s isn't newer than %s; not installing", manifest.Version, version)
+	}
+	sum, ok := manifest.Assets[updateAssetName()]
+	if !ok {
+		return "", fmt.Errorf("release %s has no signed build for %s/%s", tag, runtime.GOOS, runtime.GOARCH)
+	}
+	return strings.ToLower(sum), nil
+}
+
+// updateOptions holds the flags of the update subcommand.
+type updateOptions struct {
+	check bool
+	force bool
+	feed  string
+}
+
+func updateFlagSet(o *updateOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	fs.BoolVar(&o.check, "check", false, "only report whether an update is available")
+	fs.BoolVar(&o.force, "force", false, "reinstall the latest release even if it isn't newer, though never an older one")
+	fs.StringVar(&o.feed, "feed", releaseFeed, "release feed URL")
+	return fs
+}
+
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+func fetchRelease(feed string) (*release, error) {
+	data, err := download(feed)
+	if err != nil {
+		return nil, err
+	}
+	var rel release
+	if err := json.Unmarshal(data, &rel); err != nil {
+		return nil, err
+	}
+	if rel.TagName == "" {
+		return nil, fmt.Errorf("release feed has no tag")
+	}
+	return &rel, nil
+}
+
+func download(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxUpdateSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxUpdateSize {
+		return nil, fmt.Errorf("GET %s: response too large", url)
+	}
+	return data, nil
+}
+
+// newerVersion reports whether release tag a is newer than b, comparing
+// dotted numeric versions with an optional leading "v". A "dev" build is
+// never considered up to date.
+func newerVersion(a, b string) bool {
+	if b == "dev" {
+		return true
+	}
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < max(len(pa), len(pb)); i++ {
+		var na, nb int
+		if i < len(pa) {
+			na, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			nb, _ = strconv.Atoi(pb[i])
+		}
+		if na != nb {
+			return na > nb
+		}
+	}
+	return false
+}
+
+// replaceExecutable swaps the running binary for data. The old binary is
+// moved aside first because Windows won't overwrite a running executable
+// but does allow renaming it.
+func replaceExecutable(data []byte) error {
+	execPath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(execPath); err == nil {
+		execPath = resolved
+	}
+
+	newPath := execPath + ".new"
+	oldPath := execPath + ".old"
+	if err := os.WriteFile(newPath, data, 0755); err != nil {
+		return err
+	}
+	os.Remove(oldPath)
+	if err := os.Rename(execPath, oldPath); err != nil {
+		os.Remove(newPath)
+		return err
+	}
+	if err := os.Rename(newPath, execPath); err != nil {
+		// Put the old binary back so the tool keeps working
+		os.Rename(oldPath, execPath)
+		os.Remove(newPath)
+		return err
+	}
+	// Fails on Windows while the old binary is still running; it is
+	// cleaned up by the next update instead.
+	os.Remove(oldPath)
+	return nil
+}
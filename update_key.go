@@ -0,0 +1,15 @@
+//go:build updater
+
+package main
+
+import _ "embed"
+
+// Builds with -tags updater self-update, and embed the base64 ed25519
+// public key release manifests are signed with from update_key.pub next to
+// this file. They fail to build without it, so no self-updating build can
+// ship unable to verify its updates.
+
+const updaterSupported = true
+
+//go:embed update_key.pub
+var updateKey string
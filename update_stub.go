@@ -0,0 +1,10 @@
+//go:build !updater
+
+package main
+
+// updaterSupported is false in builds without -tags updater, which have no
+// release key and tell users to download new versions themselves; see
+// update_key.go.
+const updaterSupported = false
+
+var updateKey = ""
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestVerifyManifest(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(priv ed25519.PrivateKey, m updateManifest) ([]byte, []byte) {
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data, []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)))
+	}
+	defer func(v string) { version = v }(version)
+	version = "v1.4.0"
+	assets := map[string]string{updateAssetName(): "ABCDEF"}
+
+	tests := []struct {
+		name    string
+		priv    ed25519.PrivateKey
+		m       updateManifest
+		tag     string
+		force   bool
+		wantErr string
+	}{
+		{name: "newer", priv: priv, m: updateManifest{"v1.5.0", assets}, tag: "v1.5.0"},
+		{name: "same with force", priv: priv, m: updateManifest{"v1.4.0", assets}, tag: "v1.4.0", force: true},
+		{name: "same", priv: priv, m: updateManifest{"v1.4.0", assets}, tag: "v1.4.0", wantErr: "isn't newer"},
+		{name: "older with force", priv: priv, m: updateManifest{"v1.3.9", assets}, tag: "v1.3.9", force: true, wantErr: "isn't newer"},
+		{name: "other release's manifest", priv: priv, m: updateManifest{"v1.3.0", assets}, tag: "v1.5.0", wantErr: "signed manifest of v1.3.0"},
+		{name: "wrong key", priv: otherPriv, m: updateManifest{"v1.5.0", assets}, tag: "v1.5.0", wantErr: "signature verification failed"},
+		{name: "no build for platform", priv: priv, m: updateManifest{"v1.5.0", map[string]string{"other": "00"}}, tag: "v1.5.0", wantErr: "no signed build"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, sig := sign(tt.priv, tt.m)
+			sum, err := verifyManifest(pub, data, sig, tt.tag, tt.force)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum != "abcdef" {
+				t.Errorf("sum = %q, want abcdef", sum)
+			}
+		})
+	}
+}
+
+func TestVerifyManifestRejectsTampering(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(`{"version":"v9.0.0","assets":{}}`)
+	sig := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)))
+	tampered := []byte(`{"version":"v9.0.1","assets":{}}`)
+	if _, err := verifyManifest(pub, tampered, sig, "v9.0.1", false); err == nil {
+		t.Fatal("tampered manifest verified")
+	}
+}
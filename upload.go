@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Credentials can come from the environment instead of the command line,
+// where they would end up in shell history.
+const (
+	wordpressPasswordEnv = "IMAGE_COMPRESSOR_WP_PASSWORD"
+	ghostKeyEnv          = "IMAGE_COMPRESSOR_GHOST_KEY"
+)
+
+var uploadTargets = []string{"wordpress", "ghost"}
+
+// uploadOptions holds the flags of the upload subcommand.
+type uploadOptions struct {
+	site     string
+	user     string
+	password string
+	key      string
+	config   string
+}
+
+func uploadFlagSet(o *uploadOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	fs.StringVar(&o.site, "site", "", "site URL, e.g. https://blog.example.com")
+	fs.StringVar(&o.user, "user", "", "WordPress user name")
+	fs.StringVar(&o.password, "password", "", "WordPress application password (or set "+wordpressPasswordEnv+")")
+	fs.StringVar(&o.key, "key", "", "Ghost Admin API key id:secret (or set "+ghostKeyEnv+")")
+	registerConfigFlag(fs, &o.config)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s upload wordpress|ghost -site URL [flags] image...\n", programName())
+		fs.PrintDefaults()
+	}
+	registerCompressionFlags(fs)
+	return fs
+}
+
+// mediaUploader sends one file to a media library and returns its URL.
+type mediaUploader func(path string) (string, error)
+
+// runUpload implements the upload subcommand, which compresses images and
+// adds them to a WordPress or Ghost media library.
+func runUpload(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s upload %s -site URL [flags] image...", programName(), strings.Join(uploadTargets, "|"))
+	}
+	target := args[0]
+	var opts uploadOptions
+	fs := uploadFlagSet(&opts)
+	if _, err := parseLayered(fs, args[1:], &opts.config); err != nil {
+		return err
+	}
+	if opts.site == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("need -site and at least one image")
+	}
+	site := strings.TrimSuffix(opts.site, "/")
+
+	var upload mediaUploader
+	switch target {
+	case "wordpress":
+		if opts.password == "" {
+			opts.password = os.Getenv(wordpressPasswordEnv)
+		}
+		if opts.user == "" || opts.password == "" {
+			return fmt.Errorf("wordpress needs -user and an application password")
+		}
+		upload = func(path string) (string, error) {
+			return uploadWordPress(site, opts.user, opts.password, path)
+		}
+	case "ghost":
+		if opts.key == "" {
+			opts.key = os.Getenv(ghostKeyEnv)
+		}
+		if opts.key == "" {
+			return fmt.Errorf("ghost needs an Admin API key")
+		}
+		upload = func(path string) (string, error) {
+			return uploadGhost(site, opts.key, path)
+		}
+	default:
+		return fmt.Errorf("unknown upload target %q", target)
+	}
+
+	tmpDir, err := os.MkdirTemp("", shortName+"-upload-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var results []fileResult
+	failed := 0
+	for _, path := range fs.Args() {
+		result := processFileRetrying(longPath(path), tmpDir)
+		if result.Outcome != outcomeFailed {
+			fmt.Printf("  uploading %s... ", filepath.Base(result.Output))
+			url, err := upload(result.Output)
+			if err != nil {
+				fmt.Printf("FAILED: %v\n", err)
+				result = result.failed(fmt.Errorf("upload: %w", err))
+			} else {
+				fmt.Printf("%s\n", url)
+				result.URL = url
+			}
+		}
+		// The temp copy is gone once we return
+		result.Output = ""
+		if result.Outcome == outcomeFailed {
+			failed++
+		}
+		results = append(results, result)
+	}
+
+	if reportPath != "" {
+		if err := writeReport(reportPath, results); err != nil {
+			return err
+		}
+		fmt.Printf("Report saved to: %s\n", reportPath)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d image(s) failed", failed, len(results))
+	}
+	return nil
+}
+
+var uploadClient = &http.Client{Timeout: 5 * time.Minute}
+
+// uploadWordPress posts a file to the WordPress REST media endpoint using an
+// application password.
+func uploadWordPress(site, user, password, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", site+"/wp-json/wp/v2/media", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(user, password)
+	req.Header.Set("Content-Type", contentTypeOf(path))
+	req.Header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(path)}))
+
+	var media struct {
+		SourceURL string `json:"source_url"`
+	}
+	if err := doJSON(req, http.StatusCreated, &media); err != nil {
+		return "", err
+	}
+	return media.SourceURL, nil
+}
+
+// uploadGhost posts a file to the Ghost Admin API image upload endpoint.
+func uploadGhost(site, key, path string) (string, error) {
+	token, err := ghostToken(key, time.Now())
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": "file", "filename": filepath.Base(path)}))
+	header.Set("Content-Type", contentTypeOf(path))
+	part, err := form.CreatePart(header)
+	if err != nil {
+		return "", err
+	}
+	part.Write(data)
+	form.WriteField("purpose", "image")
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", site+"/ghost/api/admin/images/upload/", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Ghost "+token)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	var resp struct {
+		Images []struct {
+			URL string `json:"url"`
+		} `json:"images"`
+	}
+	if err := doJSON(req, http.StatusCreated, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Images) == 0 {
+		return "", fmt.Errorf("ghost returned no image")
+	}
+	return resp.Images[0].URL, nil
+}
+
+// ghostToken builds the short-lived HS256 JWT the Ghost Admin API expects,
+// from an Admin API key of the form id:hexsecret.
+func ghostToken(key string, now time.Time) (string, error) {
+	id, secretHex, ok := strings.Cut(key, ":")
+	if !ok {
+		return "", fmt.Errorf("ghost key must look like id:secret")
+	}
+	secret, err := hex.DecodeString(secretHex)
+	if err != nil {
+		return "", fmt.Errorf("ghost key secret: %w", err)
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT", "kid": id})
+	claims, _ := json.Marshal(map[string]any{"iat": now.Unix(), "exp": now.Add(5 * time.Minute).Unix(), "aud": "/admin/"})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+// doJSON sends req and decodes a JSON response with the wanted status.
+func doJSON(req *http.Request, want int, v any) error {
+	resp, err := uploadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != want && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
+
+func contentTypeOf(path string) string {
+	if t := mime.TypeByExtension(strings.ToLower(filepath.Ext(path))); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
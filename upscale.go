@@ -0,0 +1,121 @@
+package main
+
+import (
+	"image"
+	"math"
+	"sort"
+)
+
+// skipUpscaleCheck turns off the detection of images that were blown up
+// from a smaller original.
+var skipUpscaleCheck bool
+
+// Upscale detection only looks at images in this pixel range: smaller ones
+// have little to gain, larger ones take the tiled path or cost too much
+// memory to analyze at full resolution.
+const (
+	minUpscalePixels = 256 * 256
+	maxUpscalePixels = 16 * 1000 * 1000
+)
+
+// An image counts as upscaled by 8/c when the frequencies of its 8x8 blocks
+// from c up carry almost nothing: in all but upscaleOutliers of the blocks,
+// their RMS amplitude stays under upscaleNoise levels. The allowance covers
+// JPEG noise and the ringing of common upscalers, and is far below what any
+// real detail at that frequency produces.
+const (
+	upscaleNoise    = 14.0
+	upscaleOutliers = 0.001
+)
+
+// dctBasis holds the orthonormal 8-point DCT-II basis, dctBasis[u][x].
+var dctBasis = func() (basis [8][8]float64) {
+	for u := range basis {
+		c := math.Sqrt(2.0 / 8)
+		if u == 0 {
+			c = math.Sqrt(1.0 / 8)
+		}
+		for x := range basis[u] {
+			basis[u][x] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return basis
+}()
+
+// effectiveScale returns the factor img can be scaled down by without
+// losing detail: 4/8 through 7/8, or 1 if it needs its full resolution.
+func effectiveScale(img image.Image) float64 {
+	bounds := img.Bounds()
+	pixels := bounds.Dx() * bounds.Dy()
+	if pixels < minUpscalePixels || pixels > maxUpscalePixels {
+		return 1
+	}
+	luma, w, h := luminance(img)
+
+	// bands[c] collects, per block, the RMS of the coefficients at
+	// frequency c and above
+	var bands [8][]float64
+	var block, rows [8][8]float64
+	for by := 0; by+8 <= h; by += 8 {
+		for bx := 0; bx+8 <= w; bx += 8 {
+			for y := range block {
+				copy(block[y][:], luma[(by+y)*w+bx:])
+			}
+			for y := range rows {
+				for u := range rows[y] {
+					var sum float64
+					for x := range block[y] {
+						sum += dctBasis[u][x] * block[y][x]
+					}
+					rows[y][u] = sum
+				}
+			}
+			var energy [8]float64
+			for v := 0; v < 8; v++ {
+				for u := 0; u < 8; u++ {
+					var sum float64
+					for y := range rows {
+						sum += dctBasis[v][y] * rows[y][u]
+					}
+					energy[max(u, v)] += sum * sum
+				}
+			}
+			// Frequencies from c up: 64 - c*c coefficients
+			var above float64
+			for c := 7; c >= 4; c-- {
+				above += energy[c]
+				bands[c] = append(bands[c], math.Sqrt(above/float64(64-c*c)))
+			}
+		}
+	}
+	for c := 4; c <= 7; c++ {
+		values := bands[c]
+		if len(values) == 0 {
+			return 1
+		}
+		sort.Float64s(values)
+		if values[int(float64(len(values))*(1-upscaleOutliers))] < upscaleNoise {
+			return float64(c) / 8
+		}
+	}
+	return 1
+}
+
+// shrinkUpscaled scales img down to its effective resolution when it was
+// evidently enlarged from a smaller original, which saves bytes without any
+// visible loss.
+func shrinkUpscaled(log *fileLog, img image.Image) image.Image {
+	if skipUpscaleCheck {
+		return img
+	}
+	end := startSpan("upscale check")
+	scale := effectiveScale(img)
+	end(nil)
+	if scale == 1 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := max(int(float64(bounds.Dx())*scale), 1), max(int(float64(bounds.Dy())*scale), 1)
+	log.Printf("(upscaled, reducing to %dx%d) ", w, h)
+	return resizeImage(img, w, h)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+const defaultValidateMinSSIM = 0.90
+
+// validateSample is the fraction of outputs to check against their
+// originals after a batch, and validateMinSSIM the average SSIM below
+// which the run fails. Zero disables validation.
+var (
+	validateSample  float64
+	validateMinSSIM = defaultValidateMinSSIM
+)
+
+// parsePercent parses "5%", "5" or "0.05" style fractions. Values above 1
+// are taken as percentages.
+func parsePercent(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	if strings.HasSuffix(s, "%") || v > 1 {
+		v /= 100
+	}
+	if v < 0 || v > 1 {
+		return 0, fmt.Errorf("percentage %q out of range", s)
+	}
+	return v, nil
+}
+
+// validateOutputs compares a random sample of the batch's outputs with their
+// originals and reports whether their average SSIM meets validateMinSSIM.
+func validateOutputs(results []fileResult) bool {
+	var candidates []fileResult
+	for _, r := range results {
+		if r.Output != "" && r.Outcome != outcomeFailed {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		return true
+	}
+	n := max(int(float64(len(candidates))*validateSample+0.5), 1)
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	fmt.Printf("\nValidating %d of %d outputs...\n", n, len(candidates))
+	var total float64
+	checked := 0
+	for _, r := range candidates[:n] {
+		original, err := decodeFile(r.Source)
+		if err != nil {
+			fmt.Printf("  %s: cannot decode original: %v\n", r.Source, err)
+			continue
+		}
+		output, err := decodeFile(r.Output)
+		if err != nil {
+			// An undecodable output is as bad as it gets
+			fmt.Printf("  %s: cannot decode output: %v\n", r.Output, err)
+			checked++
+			continue
+		}
+		score := ssim(original, output)
+		fmt.Printf("  %s: SSIM %.4f\n", r.Output, score)
+		total += score
+		checked++
+	}
+	if checked == 0 {
+		return true
+	}
+	average := total / float64(checked)
+	if average < validateMinSSIM {
+		fmt.Printf("Validation FAILED: average SSIM %.4f is below %.4f\n", average, validateMinSSIM)
+		return false
+	}
+	fmt.Printf("Validation passed: average SSIM %.4f\n", average)
+	return true
+}
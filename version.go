@@ -0,0 +1,5 @@
+package main
+
+// version is the release version, set at build time with
+// -ldflags "-X main.version=v1.2.3". Local builds report "dev".
+var version = "dev"
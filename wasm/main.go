@@ -0,0 +1,124 @@
+//go:build js && wasm
+
+// Command wasm exposes the compressor package to JavaScript, so web apps
+// can compress images in the browser with the same size targeting as the
+// command line. Build it with "make wasm" and load it with Go's
+// wasm_exec.js; it defines a global imageCompressor object:
+//
+//	const result = imageCompressor.compress(bytes, {targetSize: 500000});
+//	if (result.error) { ... }
+//	const blob = new Blob([result.data], {type: "image/jpeg"});
+//
+// bytes is a Uint8Array of a JPEG, PNG or GIF. The options are those of
+// compressor.Options: targetSize, maxQuality, effort, maxDimension,
+// linearResize, and background as "#rrggbb". The result has data (a JPEG
+// Uint8Array), quality, width and height, and error when compression
+// failed. When the target can't be met, data is the best effort and error
+// says so.
+//
+// compress runs synchronously, so call it from a Web Worker to keep pages
+// responsive.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"syscall/js"
+
+	"image-compressor/pkg/compressor"
+)
+
+func main() {
+	js.Global().Set("imageCompressor", js.ValueOf(map[string]any{
+		"compress":   js.FuncOf(compress),
+		"targetSize": compressor.DefaultTargetSize,
+	}))
+	// Keep the exported functions alive
+	select {}
+}
+
+// compress implements imageCompressor.compress(bytes, options).
+func compress(this js.Value, args []js.Value) any {
+	if len(args) == 0 || args[0].Type() != js.TypeObject {
+		return failure(errors.New("compress needs the image as a Uint8Array"))
+	}
+	input := make([]byte, args[0].Get("length").Int())
+	js.CopyBytesToGo(input, args[0])
+	var options js.Value
+	if len(args) > 1 {
+		options = args[1]
+	}
+	opts, err := optionsOf(options)
+	if err != nil {
+		return failure(err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(input))
+	if err != nil {
+		return failure(err)
+	}
+	quality := 0
+	opts.Trace = func(a compressor.Attempt) {
+		if a.Fits {
+			quality = max(quality, a.Quality)
+		} else if a.Next == 0 && quality == 0 {
+			// The lowest quality, kept as the best effort
+			quality = a.Quality
+		}
+	}
+	data, err := compressor.CompressImage(img, opts)
+	if data == nil {
+		return failure(err)
+	}
+	cfg, _, _ := image.DecodeConfig(bytes.NewReader(data))
+	output := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(output, data)
+	result := map[string]any{
+		"data":    output,
+		"quality": quality,
+		"width":   cfg.Width,
+		"height":  cfg.Height,
+	}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	return js.ValueOf(result)
+}
+
+func failure(err error) any {
+	return js.ValueOf(map[string]any{"error": err.Error()})
+}
+
+// optionsOf reads compressor.Options from a JavaScript object, leaving out
+// what it doesn't set.
+func optionsOf(v js.Value) (compressor.Options, error) {
+	var opts compressor.Options
+	if v.Type() != js.TypeObject {
+		return opts, nil
+	}
+	number := func(name string) int {
+		if f := v.Get(name); f.Type() == js.TypeNumber {
+			return f.Int()
+		}
+		return 0
+	}
+	opts.TargetSize = number("targetSize")
+	opts.MaxQuality = number("maxQuality")
+	opts.Effort = number("effort")
+	opts.MaxDimension = number("maxDimension")
+	opts.LinearResize = v.Get("linearResize").Truthy()
+	if background := v.Get("background"); background.Type() == js.TypeString {
+		var r, g, b uint8
+		if _, err := fmt.Sscanf(background.String(), "#%02x%02x%02x", &r, &g, &b); err != nil {
+			return opts, fmt.Errorf("background %q is not #rrggbb", background.String())
+		}
+		opts.Background = color.RGBA{R: r, G: g, B: b, A: 0xff}
+	}
+	return opts, nil
+}
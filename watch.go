@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const maxRecentCompletions = 10
+
+// loadPollInterval is how often a watcher waiting for the machine to have
+// room for another file looks again.
+const loadPollInterval = 2 * time.Second
+
+// watchedFile is what the watcher remembers about a source file to tell
+// whether it changed since the last scan.
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// completion records one file the watcher finished with.
+type completion struct {
+	name    string
+	outcome fileOutcome
+	at      time.Time
+}
+
+// watcher polls a directory and compresses images as they appear. It can be
+// paused and queried from other goroutines, e.g. the tray menu.
+type watcher struct {
+	dir      string
+	out      string
+	interval time.Duration
+
+	// Up to workers files are processed at once, fewer while the machine is
+	// busy or short of memory. With pauseOnBattery, no file is started
+	// while it runs on battery.
+	workers        int
+	pauseOnBattery bool
+	lock           *outputLock
+
+	mu        sync.Mutex
+	paused    bool
+	onBattery bool
+	seen      map[string]watchedFile
+	pending   map[string]watchedFile
+	recent    []completion
+	finished  chan struct{}
+
+	// settings resolves the settings again when their config file changes,
+	// if there is one. It is only reloaded between scans, from the goroutine
+	// running the watcher.
+	settings *configLayers
+
+	// For health and readiness checks
+	lastScan time.Time
+	scanErr  error
+	active   map[string]time.Time
+}
+
+func newWatcher(dir, out string, interval time.Duration) *watcher {
+	return &watcher{
+		dir:      dir,
+		out:      out,
+		interval: interval,
+		workers:  1,
+		seen:     make(map[string]watchedFile),
+		pending:  make(map[string]watchedFile),
+		finished: make(chan struct{}, 1),
+		active:   make(map[string]time.Time),
+	}
+}
+
+// watchOptions holds the flags shared by the watch, tray and service
+// subcommands.
+type watchOptions struct {
+	dir            string
+	out            string
+	interval       time.Duration
+	healthAddr     string
+	config         string
+	workers        int
+	pauseOnBattery bool
+	lowPriority    bool
+	ifLocked       string
+	assertReadonly bool
+}
+
+func (o *watchOptions) register(fs *flag.FlagSet) {
+	registerInputOutput(fs, &o.dir, &o.out)
+	fs.StringVar(&o.dir, "dir", "", "same as -input")
+	fs.StringVar(&o.out, "out", "", "same as -output")
+	fs.DurationVar(&o.interval, "interval", 5*time.Second, "how often to scan for new images")
+	fs.StringVar(&o.config, "config", "", configUsage+"; re-read when it changes or on SIGHUP")
+	fs.StringVar(&o.healthAddr, "health-addr", "", "serve /healthz and /readyz on this address, e.g. :8080, and accept POST /pause and /resume")
+	fs.IntVar(&o.workers, "workers", runtime.NumCPU(), "most images to compress at once; fewer are while the machine is busy or low on memory")
+	fs.BoolVar(&o.pauseOnBattery, "pause-on-battery", false, "don't start compressing images while running on battery")
+	fs.BoolVar(&o.lowPriority, "low-priority", false, lowPriorityUsage)
+	registerIfLocked(fs, &o.ifLocked)
+	fs.BoolVar(&o.assertReadonly, "assert-readonly", false, readonlyUsage)
+	registerCompressionFlags(fs)
+}
+
+func watchFlagSet(name string, opts *watchOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	opts.register(fs)
+	return fs
+}
+
+// runWatch implements the watch subcommand, which keeps compressing images
+// as they appear in a directory until interrupted.
+func runWatch(args []string) error {
+	var opts watchOptions
+	w, err := opts.watcher(watchFlagSet("watch", &opts), args)
+	if skipLocked(err, opts.ifLocked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer w.close()
+
+	printBanner("Watching")
+	printSettings()
+	fmt.Printf("Watching: %s\n", w.dir)
+	fmt.Printf("Output directory: %s\n", w.out)
+	fmt.Printf("Workers: up to %d\n\n", w.workers)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, stopService := serviceContext(ctx)
+	defer stopService()
+	defer controlPause(w, true)()
+	w.run(ctx)
+	fmt.Println("Stopped watching.")
+	return nil
+}
+
+// watcher parses args with fs, validates the options and returns a watcher
+// for them with its output directory created.
+func (o *watchOptions) watcher(fs *flag.FlagSet, args []string) (*watcher, error) {
+	settings, err := parseLayered(fs, args, &o.config)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q: %s watches the one directory given with -input", fs.Arg(0), fs.Name())
+	}
+	if o.interval <= 0 {
+		return nil, fmt.Errorf("-interval must be positive")
+	}
+	if o.workers < 1 {
+		return nil, fmt.Errorf("-workers must be at least 1")
+	}
+	dir, out := o.dir, o.out
+	if dir == "" {
+		execDir, err := executableDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = execDir
+	}
+	if out == "" {
+		out = filepath.Join(dir, "compressed")
+	}
+	dir, out = longPath(dir), longPath(out)
+	if err := protectSource(o.assertReadonly, dir, out, lockPath(out)); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return nil, err
+	}
+	applyLowPriority(o.lowPriority)
+	lock, err := lockOutput(out, o.ifLocked)
+	if err != nil {
+		return nil, err
+	}
+	w := newWatcher(dir, out, o.interval)
+	w.workers, w.pauseOnBattery, w.lock = o.workers, o.pauseOnBattery, lock
+	if settings.path != "" {
+		w.settings = settings
+	}
+	if o.healthAddr != "" {
+		if err := serveHealth(o.healthAddr, w); err != nil {
+			w.close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// close releases the watcher's lock on its output directory.
+func (w *watcher) close() {
+	w.lock.release()
+}
+
+// run scans the directory every interval until ctx is done. Settings are
+// reloaded between scans when the settings file changes or on SIGHUP, without
+// losing track of queued files.
+func (w *watcher) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	if w.settings != nil {
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+	for {
+		if w.settings != nil && w.settings.changed() {
+			w.reload()
+		}
+		if !w.isPaused() && !w.batteryPaused() {
+			err := w.scan(ctx)
+			if err != nil {
+				fmt.Printf("Error scanning %s: %v\n", w.dir, err)
+			}
+			w.scanned(err)
+			if err := manifest.flush(); err != nil {
+				fmt.Printf("Error writing %s: %v\n", manifestName, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.interval):
+		case <-hup:
+			w.reload()
+		}
+	}
+}
+
+func (w *watcher) reload() {
+	if err := w.settings.load(); err != nil {
+		fmt.Printf("Error reloading settings, keeping the current ones: %v\n", err)
+		return
+	}
+	fmt.Printf("Reloaded settings from %s\n", w.settings.path)
+	printSettings()
+}
+
+func (w *watcher) isPaused() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.paused
+}
+
+// setPaused stops or resumes scanning. A file being processed when the
+// watcher is paused still finishes. See controlPause for the ways users
+// get to call it.
+func (w *watcher) setPaused(paused bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused = paused
+}
+
+// status returns how many files are waiting to settle before being
+// processed, and the most recent completions, newest first.
+func (w *watcher) status() (int, []completion) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	recent := make([]completion, len(w.recent))
+	for i, c := range w.recent {
+		recent[len(w.recent)-1-i] = c
+	}
+	return len(w.pending), recent
+}
+
+// batteryPaused reports whether files shouldn't be started because the
+// machine is on battery and -pause-on-battery is set, saying so when that
+// changes.
+func (w *watcher) batteryPaused() bool {
+	if !w.pauseOnBattery {
+		return false
+	}
+	battery := readSystemLoad().onBattery
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if battery != w.onBattery {
+		if battery {
+			fmt.Println("Running on battery, pausing")
+		} else {
+			fmt.Println("Back on mains power, resuming")
+		}
+		w.onBattery = battery
+	}
+	return battery
+}
+
+// scan processes images in the directory that changed since they were last
+// seen. A file is only processed once it looks the same on two consecutive
+// scans, so images still being copied in are left alone. Files run
+// concurrently as acquire allows, and scan returns once all of them are
+// done, so settings are only ever reloaded between files.
+func (w *watcher) scan(ctx context.Context) error {
+	files, err := os.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, file := range files {
+		if file.IsDir() || !isSupportedImage(filepath.Join(w.dir, file.Name())) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		if w.isPaused() {
+			return nil
+		}
+		if !w.check(file.Name(), info) {
+			continue
+		}
+		name, srcPath := file.Name(), filepath.Join(w.dir, file.Name())
+		if !w.acquire(ctx, name, estimateMemory(srcPath)) {
+			// Pick the file up again on the next scan
+			w.forget(name)
+			return nil
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := processFileRetrying(srcPath, w.out)
+			w.finish(name, result.Outcome)
+		}()
+	}
+	return nil
+}
+
+// check updates the watcher's view of a file and reports whether the file
+// is ready to be processed now.
+func (w *watcher) check(name string, info os.FileInfo) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	state := watchedFile{size: info.Size(), modTime: info.ModTime()}
+	if w.seen[name] == state {
+		return false
+	}
+	if _, known := w.seen[name]; !known && outputUpToDate(filepath.Join(w.dir, name), w.out, info.ModTime()) {
+		w.seen[name] = state
+		return false
+	}
+	if w.pending[name] != state {
+		w.pending[name] = state
+		return false
+	}
+	delete(w.pending, name)
+	w.seen[name] = state
+	return true
+}
+
+// acquire waits until name, needing roughly memory bytes, may be processed
+// and marks it started. The first file always may; another only while fewer
+// than workers are running and the machine has room for it. acquire returns
+// false without starting the file if the watcher is paused, ctx is done or
+// the machine goes on battery in the meantime.
+func (w *watcher) acquire(ctx context.Context, name string, memory uint64) bool {
+	for {
+		if w.isPaused() || w.batteryPaused() {
+			return false
+		}
+		w.mu.Lock()
+		running := len(w.active)
+		w.mu.Unlock()
+		if running == 0 || running < w.workers && readSystemLoad().hasRoomFor(running, memory) {
+			w.start(name)
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-w.finished:
+		case <-time.After(loadPollInterval):
+		}
+	}
+}
+
+// forget drops a file that was ready but not started, so the next scans
+// treat it as new.
+func (w *watcher) forget(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.seen, name)
+}
+
+func (w *watcher) scanned(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastScan = time.Now()
+	w.scanErr = err
+}
+
+func (w *watcher) start(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.active[name] = time.Now()
+}
+
+func (w *watcher) finish(name string, outcome fileOutcome) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.active, name)
+	select {
+	case w.finished <- struct{}{}:
+	default:
+	}
+	w.recent = append(w.recent, completion{name: name, outcome: outcome, at: time.Now()})
+	if len(w.recent) > maxRecentCompletions {
+		w.recent = w.recent[1:]
+	}
+}
+
+// outputUpToDate reports whether out already holds an output for srcPath
+// written after the source was last modified, so restarting the watcher
+// doesn't redo the whole directory.
+func outputUpToDate(srcPath, out string, modTime time.Time) bool {
+	for _, candidate := range outputCandidates(srcPath, out) {
+		info, err := os.Stat(candidate)
+		if err == nil && !info.ModTime().Before(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// outputCandidates returns the paths in out an output for srcPath may have:
+// in its own format or converted to JPEG or PNG, renamed by -name or not.
+func outputCandidates(srcPath, out string) []string {
+	name := outputFileName(srcPath)
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	candidates := []string{name, base + ".jpg", base + ".png"}
+	if names, err := readManifest(out); err == nil {
+		// Outputs renamed by -name are found through the manifest
+		for i, candidate := range candidates {
+			if named, ok := names[candidate]; ok {
+				candidates[i] = named
+			}
+		}
+	}
+	for i, candidate := range candidates {
+		candidates[i] = filepath.Join(out, candidate)
+	}
+	return candidates
+}
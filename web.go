@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const webUsage = "instead of compressing the images next to the binary, open a page in the browser to drop images on, compare them before and after, and download the results as a zip"
+
+// maxWebResults bounds how many compressed images the web UI keeps for
+// downloading; the oldest are dropped first.
+const maxWebResults = 500
+
+// webUI is the local page -web serves. Images dropped on it are compressed
+// by the same server as serve uses, at the target picked with its slider,
+// and kept in memory until they're downloaded.
+type webUI struct {
+	server *server
+	host   string
+
+	mu      sync.Mutex
+	results map[string]serverOutput
+	order   []string
+}
+
+// runWebUI serves the web UI on a free localhost port, opens it in the
+// browser and serves until the process is stopped.
+func runWebUI() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	ui := &webUI{
+		server:  &server{base: currentSettings()},
+		host:    listener.Addr().String(),
+		results: make(map[string]serverOutput),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ui.handlePage)
+	mux.HandleFunc("/settings", ui.handleSettings)
+	mux.HandleFunc("/compress", ui.handleCompress)
+	mux.HandleFunc("/zip", ui.handleZip)
+
+	url := "http://" + ui.host + "/"
+	fmt.Printf("Web UI: %s\n", url)
+	fmt.Println("Press Ctrl+C to stop.")
+	openDesktop(url)
+	return http.Serve(listener, ui.localOnly(mux))
+}
+
+// localOnly refuses requests addressed to any other host than the
+// listener, so pages elsewhere can't reach the UI by DNS rebinding.
+func (ui *webUI) localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Host != ui.host {
+			http.Error(rw, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func (ui *webUI) handlePage(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(rw, r)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(rw, webPage)
+}
+
+// handleSettings tells the page the target the slider starts at.
+func (ui *webUI) handleSettings(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]any{
+		"product": productName,
+		"target":  ui.server.base.uploadLimit,
+	})
+}
+
+// handleCompress compresses the image POSTed to it within the target in
+// its query, keeps the result under a new ID for handleZip, and sends it
+// back with the ID in X-Result-Id.
+func (ui *webUI) handleCompress(rw http.ResponseWriter, r *http.Request) {
+	q := ui.server.newRequest(rw, r)
+	in, ok := ui.server.accept(q)
+	if !ok {
+		return
+	}
+	if limit, err := strconv.Atoi(r.URL.Query().Get("target")); err == nil && limit > 0 {
+		in.settings.uploadLimit = limit
+		in.settings.targetSize = in.settings.sizeMargin.below(limit)
+	}
+	if in.settings.targetSize <= 0 {
+		q.fail("target too small", http.StatusBadRequest)
+		return
+	}
+	output, err := ui.server.compress(r.Header, in.body, in.format, in.settings)
+	if err != nil {
+		q.fail(err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	name := filepath.Base(r.URL.Query().Get("name"))
+	if name == "." || name == string(filepath.Separator) {
+		name = "image"
+	}
+	// Outputs only change extension when they were converted
+	if filepath.Ext(output.name) != "."+in.format {
+		output.name = strings.TrimSuffix(name, filepath.Ext(name)) + filepath.Ext(output.name)
+	} else {
+		output.name = name
+	}
+
+	rw.Header().Set("Content-Type", contentTypeOf(output.name))
+	rw.Header().Set("Content-Length", strconv.Itoa(len(output.data)))
+	rw.Header().Set("X-Result-Id", ui.keep(output))
+	rw.Header().Set("X-Result-Name", output.name)
+	rw.Write(output.data)
+}
+
+// keep stores output for handleZip and returns its ID.
+func (ui *webUI) keep(output serverOutput) string {
+	var b [8]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.results[id] = output
+	ui.order = append(ui.order, id)
+	if len(ui.order) > maxWebResults {
+		delete(ui.results, ui.order[0])
+		ui.order = ui.order[1:]
+	}
+	return id
+}
+
+// handleZip sends the results whose IDs are POSTed as a JSON array as one
+// zip, numbering names that would collide.
+func (ui *webUI) handleZip(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "POST result IDs", http.StatusMethodNotAllowed)
+		return
+	}
+	var ids []string
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ui.mu.Lock()
+	outputs := make([]serverOutput, 0, len(ids))
+	for _, id := range ids {
+		if output, ok := ui.results[id]; ok {
+			outputs = append(outputs, output)
+		}
+	}
+	ui.mu.Unlock()
+	if len(outputs) == 0 {
+		http.Error(rw, "no results to download; compress them again", http.StatusNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/zip")
+	rw.Header().Set("Content-Disposition", `attachment; filename="compressed.zip"`)
+	archive := zip.NewWriter(rw)
+	used := make(map[string]bool)
+	for _, output := range outputs {
+		name := output.name
+		ext := filepath.Ext(name)
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(output.name, ext), n, ext)
+		}
+		used[strings.ToLower(name)] = true
+		// Compressed images don't shrink further, so they're stored as-is
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+		if err != nil {
+			return
+		}
+		w.Write(output.data)
+	}
+	archive.Close()
+}
@@ -0,0 +1,157 @@
+package main
+
+// webPage is the web UI. It posts each dropped image to /compress, shows
+// the original next to the result, compresses everything again when the
+// target slider is moved, and downloads the results from /zip.
+const webPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Image Compressor</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 0 auto; max-width: 960px; padding: 1.5em; color: #222; }
+h1 { font-size: 1.4em; }
+#drop { border: 2px dashed #8aa; border-radius: 8px; padding: 2.5em; text-align: center; color: #567; cursor: pointer; }
+#drop.over { background: #eef6ff; border-color: #2b6cb0; }
+#controls { display: flex; gap: 1em; align-items: center; margin: 1em 0; flex-wrap: wrap; }
+#target { flex: 1; min-width: 200px; }
+button { padding: 0.5em 1em; }
+.row { display: grid; grid-template-columns: 1fr 1fr; gap: 1em; border-top: 1px solid #ddd; padding: 1em 0; }
+.row h2 { grid-column: 1 / 3; font-size: 1em; margin: 0; }
+figure { margin: 0; }
+figure img { max-width: 100%; max-height: 300px; display: block; background: repeating-conic-gradient(#eee 0 25%, #fff 0 50%) 0 0 / 16px 16px; }
+figcaption { font-size: 0.9em; color: #555; margin-top: 0.3em; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Image Compressor</h1>
+<div id="drop">Drop images here, or click to choose them
+<input id="files" type="file" accept="image/*" multiple hidden></div>
+<div id="controls">
+<label for="target">Target size</label>
+<input id="target" type="range" min="0" max="1000" step="1">
+<output id="targetLabel"></output>
+<button id="zip" disabled>Download zip</button>
+</div>
+<div id="results"></div>
+<script>
+"use strict";
+// The slider runs from 20 KB to 20 MB on a log scale
+const minTarget = 20000, targetRange = 1000;
+const drop = document.getElementById("drop");
+const picker = document.getElementById("files");
+const slider = document.getElementById("target");
+const label = document.getElementById("targetLabel");
+const zipButton = document.getElementById("zip");
+const list = document.getElementById("results");
+const images = [];
+let queue = Promise.resolve();
+
+function targetBytes() {
+	return Math.round(minTarget * Math.pow(targetRange, slider.value / 1000));
+}
+
+function formatSize(n) {
+	if (n >= 1000000) return (n / 1000000).toFixed(2) + " MB";
+	if (n >= 1000) return (n / 1000).toFixed(1) + " KB";
+	return n + " B";
+}
+
+function showTarget() {
+	label.textContent = formatSize(targetBytes());
+}
+
+function figure(caption) {
+	const f = document.createElement("figure");
+	const img = document.createElement("img");
+	const c = document.createElement("figcaption");
+	c.textContent = caption;
+	f.append(img, c);
+	return f;
+}
+
+function add(file) {
+	const row = document.createElement("div");
+	row.className = "row";
+	const title = document.createElement("h2");
+	title.textContent = file.name;
+	const before = figure("Original: " + formatSize(file.size));
+	before.querySelector("img").src = URL.createObjectURL(file);
+	const after = figure("Waiting...");
+	row.append(title, before, after);
+	list.append(row);
+	const entry = {file, after, id: null, url: null};
+	images.push(entry);
+	compress(entry);
+}
+
+// Images are compressed one at a time, as the server would anyway
+function compress(entry) {
+	const target = targetBytes();
+	queue = queue.then(async () => {
+		const caption = entry.after.querySelector("figcaption");
+		caption.className = "";
+		caption.textContent = "Compressing to " + formatSize(target) + "...";
+		try {
+			const response = await fetch("/compress?target=" + target + "&name=" + encodeURIComponent(entry.file.name), {method: "POST", body: entry.file});
+			if (!response.ok) throw new Error(await response.text());
+			const blob = await response.blob();
+			if (entry.url) URL.revokeObjectURL(entry.url);
+			entry.url = URL.createObjectURL(blob);
+			entry.id = response.headers.get("X-Result-Id");
+			entry.after.querySelector("img").src = entry.url;
+			const saved = 100 - Math.round(blob.size / entry.file.size * 100);
+			caption.textContent = "Compressed: " + formatSize(blob.size) + " (" + saved + "% smaller), " + response.headers.get("X-Result-Name");
+		} catch (err) {
+			entry.id = null;
+			caption.className = "error";
+			caption.textContent = "Failed: " + err.message;
+		}
+		zipButton.disabled = !images.some(e => e.id);
+	});
+}
+
+function addFiles(files) {
+	for (const file of files) {
+		if (file.type.startsWith("image/") || file.type === "") add(file);
+	}
+}
+
+drop.addEventListener("click", () => picker.click());
+picker.addEventListener("change", () => { addFiles(picker.files); picker.value = ""; });
+drop.addEventListener("dragover", e => { e.preventDefault(); drop.classList.add("over"); });
+drop.addEventListener("dragleave", () => drop.classList.remove("over"));
+drop.addEventListener("drop", e => {
+	e.preventDefault();
+	drop.classList.remove("over");
+	addFiles(e.dataTransfer.files);
+});
+slider.addEventListener("input", showTarget);
+slider.addEventListener("change", () => images.forEach(compress));
+
+zipButton.addEventListener("click", async () => {
+	const ids = images.filter(e => e.id).map(e => e.id);
+	const response = await fetch("/zip", {method: "POST", body: JSON.stringify(ids)});
+	if (!response.ok) {
+		alert(await response.text());
+		return;
+	}
+	const link = document.createElement("a");
+	link.href = URL.createObjectURL(await response.blob());
+	link.download = "compressed.zip";
+	link.click();
+	setTimeout(() => URL.revokeObjectURL(link.href), 60000);
+});
+
+fetch("/settings").then(r => r.json()).then(settings => {
+	document.title = settings.product;
+	document.querySelector("h1").textContent = settings.product;
+	slider.value = Math.round(1000 * Math.log(settings.target / minTarget) / Math.log(targetRange));
+	showTarget();
+});
+</script>
+</body>
+</html>
+`
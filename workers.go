@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"runtime"
+	"sync"
+)
+
+const workersUsage = "most images of a batch to compress at once; their messages still print in file order"
+
+// registerWorkers registers -workers, storing its value in workers.
+func registerWorkers(fs *flag.FlagSet, workers *int) {
+	fs.IntVar(workers, "workers", runtime.NumCPU(), workersUsage)
+}
+
+// heldOutput holds the messages about files processBatch is processing by
+// source path, so that it can print them in order.
+var heldOutput sync.Map
+
+// settingsMu is held for reading while a batch's workers process files
+// under the global settings, and for writing while processJobFile swaps in
+// the settings of a file with its own, which then runs alone.
+var settingsMu sync.RWMutex
+
+// processBatch calls process for each of paths, up to workers at once, and
+// done with each result in the order of paths. The messages about a file
+// are held until every file before it is done, so the output reads as if
+// the files had been processed one at a time. wait is called before each
+// file is started.
+func processBatch(paths []string, workers int, wait func(), process func(path string) fileResult, done func(path string, result fileResult)) {
+	results := make([]chan fileResult, len(paths))
+	held := make([]*bytes.Buffer, len(paths))
+	for i, path := range paths {
+		results[i] = make(chan fileResult, 1)
+		held[i] = new(bytes.Buffer)
+		heldOutput.Store(path, held[i])
+	}
+	go func() {
+		slots := make(chan struct{}, workers)
+		for i, path := range paths {
+			wait()
+			slots <- struct{}{}
+			go func() {
+				defer func() { <-slots }()
+				results[i] <- process(path)
+			}()
+		}
+	}()
+	for i, path := range paths {
+		result := <-results[i]
+		heldOutput.Delete(path)
+		logMu.Lock()
+		logOutput.Write(held[i].Bytes())
+		logMu.Unlock()
+		done(path, result)
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// GIMP's XCF has no composite, so its layers are flattened here, with their
+// opacity and masks, by flattenLayers. Every layer mode is treated as
+// Normal, which is what almost every layer of a handed-off design uses;
+// other modes come out approximated.
+func init() {
+	image.RegisterFormat("xcf", xcfSignature, decodeXCF, decodeXCFConfig)
+}
+
+// xcfSignature starts XCF files, before the version.
+const xcfSignature = "gimp xcf "
+
+// XCF properties, of the image and of its layers.
+const (
+	xcfPropEnd               = 0
+	xcfPropColormap          = 1
+	xcfPropFloatingSelection = 5
+	xcfPropOpacity           = 6
+	xcfPropVisible           = 8
+	xcfPropApplyMask         = 11
+	xcfPropOffsets           = 15
+	xcfPropCompression       = 17
+	xcfPropGroupItem         = 29
+	xcfPropItemPath          = 30
+	xcfPropFloatOpacity      = 33
+)
+
+// XCF base types, the color of the image.
+const (
+	xcfRGB     = 0
+	xcfGray    = 1
+	xcfIndexed = 2
+)
+
+// xcfTileSize is the width and height of the tiles layer pixels are stored
+// in.
+const xcfTileSize = 64
+
+// xcfPrecision is how samples are stored.
+type xcfPrecision struct {
+	bytes  int
+	float  bool
+	linear bool
+}
+
+// xcfPrecisionOf returns the precision code of a file's version means. The
+// codes of versions 4 to 6 are renumbered to those of later versions first.
+func xcfPrecisionOf(version, code int) (xcfPrecision, error) {
+	switch {
+	case version < 4:
+		code = 150
+	case version == 4:
+		codes := []int{150, 250, 300, 500, 600}
+		if code < 0 || code >= len(codes) {
+			return xcfPrecision{}, fmt.Errorf("xcf: unknown precision %d", code)
+		}
+		code = codes[code]
+	case version <= 6 && code >= 400:
+		code += 100
+	}
+	p := xcfPrecision{linear: code%100 == 0}
+	switch code / 100 {
+	case 1:
+		p.bytes = 1
+	case 2:
+		p.bytes = 2
+	case 3:
+		p.bytes = 4
+	case 5:
+		p.bytes, p.float = 2, true
+	case 6:
+		p.bytes, p.float = 4, true
+	case 7:
+		p.bytes, p.float = 8, true
+	default:
+		return xcfPrecision{}, fmt.Errorf("xcf: unknown precision %d", code)
+	}
+	return p, nil
+}
+
+// value returns the big-endian sample in b from 0 to 1.
+func (p xcfPrecision) value(b []byte) float64 {
+	switch {
+	case p.bytes == 1:
+		return float64(b[0]) / 0xff
+	case p.bytes == 2 && p.float:
+		return halfToFloat(binary.BigEndian.Uint16(b))
+	case p.bytes == 2:
+		return float64(binary.BigEndian.Uint16(b)) / 0xffff
+	case p.bytes == 4 && p.float:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case p.bytes == 4:
+		return float64(binary.BigEndian.Uint32(b)) / 0xffffffff
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b))
+}
+
+// halfToFloat converts an IEEE 754 half-precision float.
+func halfToFloat(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exponent, fraction := int(h>>10&0x1f), float64(h&0x3ff)
+	switch exponent {
+	case 0:
+		return sign * math.Ldexp(fraction, -24)
+	case 0x1f:
+		if fraction != 0 {
+			return math.NaN()
+		}
+		return math.Inf(int(sign))
+	}
+	return sign * math.Ldexp(1024+fraction, exponent-25)
+}
+
+// xcfReader reads big-endian values at a position of a whole XCF file,
+// keeping the first error. Pointers are 64-bit from version 11.
+type xcfReader struct {
+	data []byte
+	pos  int
+	wide bool
+	err  error
+}
+
+func (x *xcfReader) read(n int) []byte {
+	if x.err != nil || n < 0 || n > len(x.data)-x.pos {
+		if x.err == nil {
+			x.err = io.ErrUnexpectedEOF
+		}
+		// Only fixed-size fields are handed zeros; n comes from the file
+		if n > 8 {
+			return nil
+		}
+		return make([]byte, max(n, 0))
+	}
+	b := x.data[x.pos : x.pos+n]
+	x.pos += n
+	return b
+}
+
+func (x *xcfReader) u32() int { return int(binary.BigEndian.Uint32(x.read(4))) }
+
+func (x *xcfReader) pointer() int {
+	if x.wide {
+		return int(binary.BigEndian.Uint64(x.read(8)))
+	}
+	return x.u32()
+}
+
+// pointers reads a list of pointers ended by 0.
+func (x *xcfReader) pointers() []int {
+	var list []int
+	for x.err == nil {
+		p := x.pointer()
+		if p == 0 {
+			break
+		}
+		list = append(list, p)
+	}
+	return list
+}
+
+func (x *xcfReader) seek(pos int) {
+	if pos < 0 || pos > len(x.data) {
+		x.err = errors.New("pointer out of range")
+	}
+	x.pos = pos
+}
+
+// properties reads a list of properties up to PROP_END, calling f with each
+// one's type and payload.
+func (x *xcfReader) properties(f func(kind int, payload []byte)) {
+	for x.err == nil {
+		kind, size := x.u32(), x.u32()
+		if kind == xcfPropEnd {
+			return
+		}
+		payload := x.read(size)
+		if x.err == nil {
+			f(kind, payload)
+		}
+	}
+}
+
+// xcfHeader is the start of an XCF file.
+type xcfHeader struct {
+	version       int
+	width, height int
+	baseType      int
+	precision     xcfPrecision
+}
+
+func readXCFHeader(x *xcfReader) (xcfHeader, error) {
+	b := x.read(14)
+	if x.err != nil {
+		return xcfHeader{}, fmt.Errorf("xcf: %w", x.err)
+	}
+	if string(b[:9]) != xcfSignature || b[13] != 0 {
+		return xcfHeader{}, errors.New("xcf: invalid signature")
+	}
+	h := xcfHeader{}
+	if version := string(b[9:13]); version != "file" {
+		n, err := strconv.Atoi(version[1:])
+		if version[0] != 'v' || err != nil {
+			return xcfHeader{}, fmt.Errorf("xcf: unknown version %q", version)
+		}
+		h.version = n
+	}
+	h.width, h.height, h.baseType = x.u32(), x.u32(), x.u32()
+	code := 0
+	if h.version >= 4 {
+		code = x.u32()
+	}
+	if x.err != nil {
+		return xcfHeader{}, fmt.Errorf("xcf: %w", x.err)
+	}
+	precision, err := xcfPrecisionOf(h.version, code)
+	if err != nil {
+		return xcfHeader{}, err
+	}
+	h.precision = precision
+	x.wide = h.version >= 11
+	return h, nil
+}
+
+func decodeXCFConfig(r io.Reader) (image.Config, error) {
+	// The header is all there is to read
+	header := make([]byte, 30)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return image.Config{}, err
+	}
+	h, err := readXCFHeader(&xcfReader{data: header[:n]})
+	if err != nil {
+		return image.Config{}, err
+	}
+	cfg := image.Config{Width: h.width, Height: h.height, ColorModel: color.NRGBAModel}
+	if h.precision.bytes > 1 {
+		cfg.ColorModel = color.NRGBA64Model
+	}
+	return cfg, nil
+}
+
+// xcfLayer is a layer or layer group as stored, without its pixels.
+type xcfLayer struct {
+	width, height int
+	kind          int
+	offset        image.Point
+	floating      bool
+	depth         int
+	applyMask     bool
+	hierarchy     int
+	mask          int
+}
+
+// xcfImage is the state of decoding one file.
+type xcfImage struct {
+	x           *xcfReader
+	header      xcfHeader
+	colormap    []byte
+	compression int
+}
+
+func decodeXCF(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	x := &xcfReader{data: data}
+	h, err := readXCFHeader(x)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDecodeSize(image.Config{Width: h.width, Height: h.height}); err != nil {
+		return nil, err
+	}
+	if h.baseType > xcfIndexed {
+		return nil, fmt.Errorf("xcf: unknown base type %d", h.baseType)
+	}
+	d := &xcfImage{x: x, header: h}
+	x.properties(func(kind int, payload []byte) {
+		switch kind {
+		case xcfPropColormap:
+			if len(payload) >= 4 {
+				n := int(binary.BigEndian.Uint32(payload))
+				d.colormap = payload[4:min(4+3*n, len(payload))]
+			}
+		case xcfPropCompression:
+			if len(payload) >= 1 {
+				d.compression = int(payload[0])
+			}
+		}
+	})
+	pointers := x.pointers()
+	if x.err != nil {
+		return nil, fmt.Errorf("xcf: %w", x.err)
+	}
+
+	// Layers are listed top first, each group followed by its members, so
+	// depth nests them
+	var top []*docLayer
+	var groups []*docLayer
+	for _, p := range pointers {
+		layer, stored, err := d.readLayer(p)
+		if err != nil {
+			return nil, err
+		}
+		if stored.floating {
+			continue
+		}
+		depth := stored.depth
+		if depth <= 0 || depth > len(groups) {
+			depth = 0
+			top = append(top, layer)
+		} else {
+			parent := groups[depth-1]
+			parent.children = append(parent.children, layer)
+		}
+		if layer.group {
+			groups = append(groups[:depth], layer)
+		}
+	}
+
+	canvas, err := flattenLayers(h.width, h.height, top)
+	if err != nil {
+		return nil, fmt.Errorf("xcf: %w", err)
+	}
+	if h.precision.bytes == 1 {
+		return toNRGBA(canvas), nil
+	}
+	return canvas, nil
+}
+
+// readLayer reads the layer at pointer p.
+func (d *xcfImage) readLayer(p int) (*docLayer, *xcfLayer, error) {
+	x := d.x
+	x.seek(p)
+	layer := &docLayer{opacity: 1}
+	stored := &xcfLayer{}
+	stored.width, stored.height, stored.kind = x.u32(), x.u32(), x.u32()
+	layer.name = strings.TrimRight(string(x.read(x.u32())), "\x00")
+	x.properties(func(kind int, payload []byte) {
+		switch {
+		case kind == xcfPropOpacity && len(payload) >= 4:
+			layer.opacity = float64(binary.BigEndian.Uint32(payload)) / 0xff
+		case kind == xcfPropFloatOpacity && len(payload) >= 4:
+			layer.opacity = float64(math.Float32frombits(binary.BigEndian.Uint32(payload)))
+		case kind == xcfPropVisible && len(payload) >= 4:
+			layer.visible = binary.BigEndian.Uint32(payload) != 0
+		case kind == xcfPropOffsets && len(payload) >= 8:
+			stored.offset = image.Pt(int(int32(binary.BigEndian.Uint32(payload))), int(int32(binary.BigEndian.Uint32(payload[4:]))))
+		case kind == xcfPropApplyMask && len(payload) >= 4:
+			stored.applyMask = binary.BigEndian.Uint32(payload) != 0
+		case kind == xcfPropFloatingSelection:
+			stored.floating = true
+		case kind == xcfPropGroupItem:
+			layer.group = true
+		case kind == xcfPropItemPath:
+			stored.depth = len(payload)/4 - 1
+		}
+	})
+	stored.hierarchy = x.pointer()
+	stored.mask = x.pointer()
+	if x.err != nil {
+		return nil, nil, fmt.Errorf("xcf: layer: %w", x.err)
+	}
+	if stored.kind > 5 {
+		return nil, nil, fmt.Errorf("xcf: unknown layer type %d", stored.kind)
+	}
+	layer.opacity = min(max(layer.opacity, 0), 1)
+	layer.load = func() (layerPixels, error) {
+		pixels := layerPixels{offset: stored.offset, maskOffset: stored.offset}
+		if !layer.group {
+			img, err := d.readPixels(stored)
+			if err != nil {
+				return layerPixels{}, err
+			}
+			pixels.img = img
+		}
+		if stored.applyMask && stored.mask != 0 {
+			mask, err := d.readMask(stored.mask)
+			if err != nil {
+				return layerPixels{}, err
+			}
+			pixels.mask = mask
+		}
+		return pixels, nil
+	}
+	return layer, stored, nil
+}
+
+// readMask reads the layer mask channel at pointer p.
+func (d *xcfImage) readMask(p int) (*image.Alpha16, error) {
+	x := d.x
+	x.seek(p)
+	x.u32() // width
+	x.u32() // height
+	x.read(x.u32())
+	x.properties(func(int, []byte) {})
+	hierarchy := x.pointer()
+	if x.err != nil {
+		return nil, fmt.Errorf("xcf: layer mask: %w", x.err)
+	}
+	width, height, samples, err := d.readHierarchy(hierarchy, 1)
+	if err != nil {
+		return nil, err
+	}
+	mask := image.NewAlpha16(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		v := d.header.precision.value(samples[i*d.header.precision.bytes:])
+		mask.SetAlpha16(i%width, i/width, color.Alpha16{A: unitUint16(v)})
+	}
+	return mask, nil
+}
+
+// readPixels reads a layer's pixels, converting linear samples to sRGB.
+func (d *xcfImage) readPixels(layer *xcfLayer) (*image.NRGBA64, error) {
+	channels := []int{3, 4, 1, 2, 1, 2}[layer.kind]
+	width, height, samples, err := d.readHierarchy(layer.hierarchy, channels)
+	if err != nil {
+		return nil, err
+	}
+	p := d.header.precision
+	value := func(i int) float64 {
+		v := p.value(samples[i*p.bytes:])
+		if p.linear {
+			return linearToSRGB(min(max(v, 0), 1))
+		}
+		return v
+	}
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		var r, g, b, a float64
+		a = 1
+		s := i * channels
+		switch layer.kind {
+		case 0, 1:
+			r, g, b = value(s), value(s+1), value(s+2)
+		case 2, 3:
+			r = value(s)
+			g, b = r, r
+		case 4, 5:
+			index := int(samples[s])
+			if 3*index+2 < len(d.colormap) {
+				r = float64(d.colormap[3*index]) / 0xff
+				g = float64(d.colormap[3*index+1]) / 0xff
+				b = float64(d.colormap[3*index+2]) / 0xff
+			}
+		}
+		if layer.kind%2 == 1 {
+			a = p.value(samples[(s+channels-1)*p.bytes:])
+		}
+		img.SetNRGBA64(i%width, i/width, color.NRGBA64{
+			R: unitUint16(r), G: unitUint16(g), B: unitUint16(b), A: unitUint16(a),
+		})
+	}
+	return img, nil
+}
+
+// readHierarchy reads the full-size level of the hierarchy at pointer p,
+// whose pixels have channels samples, as rows of interleaved samples.
+func (d *xcfImage) readHierarchy(p, channels int) (int, int, []byte, error) {
+	x := d.x
+	x.seek(p)
+	x.u32() // width
+	x.u32() // height
+	bpp := x.u32()
+	level := x.pointer()
+	x.seek(level)
+	width, height := x.u32(), x.u32()
+	tiles := x.pointers()
+	if x.err != nil {
+		return 0, 0, nil, fmt.Errorf("xcf: %w", x.err)
+	}
+	if bpp != channels*d.header.precision.bytes {
+		return 0, 0, nil, fmt.Errorf("xcf: %d bytes per pixel for %d channels", bpp, channels)
+	}
+	if err := checkDecodeSize(image.Config{Width: width, Height: height}); err != nil {
+		return 0, 0, nil, fmt.Errorf("xcf: layer %w", err)
+	}
+	columns, rows := (width+xcfTileSize-1)/xcfTileSize, (height+xcfTileSize-1)/xcfTileSize
+	if len(tiles) < columns*rows {
+		return 0, 0, nil, errors.New("xcf: missing tiles")
+	}
+
+	pixels := make([]byte, width*height*bpp)
+	for i := 0; i < columns*rows; i++ {
+		corner := image.Pt(i%columns*xcfTileSize, i/columns*xcfTileSize)
+		bounds := image.Rectangle{Min: corner, Max: image.Pt(min(corner.X+xcfTileSize, width), min(corner.Y+xcfTileSize, height))}
+		end := len(x.data)
+		if i+1 < len(tiles) {
+			end = tiles[i+1]
+		}
+		if tiles[i] > end || end > len(x.data) {
+			return 0, 0, nil, errors.New("xcf: tile out of range")
+		}
+		tile, err := d.readTile(x.data[tiles[i]:end], bounds.Dx()*bounds.Dy(), bpp)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		rowBytes := bounds.Dx() * bpp
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			copy(pixels[(y*width+bounds.Min.X)*bpp:], tile[(y-bounds.Min.Y)*rowBytes:][:rowBytes])
+		}
+	}
+	return width, height, pixels, nil
+}
+
+// readTile decodes a tile of n pixels of bpp bytes into interleaved bytes.
+func (d *xcfImage) readTile(data []byte, n, bpp int) ([]byte, error) {
+	switch d.compression {
+	case 0:
+		if len(data) < n*bpp {
+			return nil, errors.New("xcf: short tile")
+		}
+		return data[:n*bpp], nil
+	case 1:
+		// Each byte of the pixels is run-length encoded on its own
+		tile := make([]byte, n*bpp)
+		for b := 0; b < bpp; b++ {
+			plane, rest, err := unpackXCFRLE(data, n)
+			if err != nil {
+				return nil, err
+			}
+			data = rest
+			for i, v := range plane {
+				tile[i*bpp+b] = v
+			}
+		}
+		return tile, nil
+	case 2:
+		z, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("xcf: %w", err)
+		}
+		tile := make([]byte, n*bpp)
+		if _, err := io.ReadFull(z, tile); err != nil {
+			return nil, fmt.Errorf("xcf: %w", err)
+		}
+		return tile, nil
+	}
+	return nil, fmt.Errorf("xcf: unknown compression %d", d.compression)
+}
+
+// unpackXCFRLE decodes n bytes of GIMP's run-length encoding from src,
+// returning the rest of src.
+func unpackXCFRLE(src []byte, n int) ([]byte, []byte, error) {
+	errShort := errors.New("xcf: truncated run-length tile")
+	dst := make([]byte, 0, n)
+	for len(dst) < n {
+		if len(src) < 1 {
+			return nil, nil, errShort
+		}
+		count := int(src[0])
+		src = src[1:]
+		switch {
+		case count <= 126:
+			if len(src) < 1 {
+				return nil, nil, errShort
+			}
+			dst = append(dst, bytes.Repeat(src[:1], count+1)...)
+			src = src[1:]
+		case count == 127:
+			if len(src) < 3 {
+				return nil, nil, errShort
+			}
+			dst = append(dst, bytes.Repeat(src[2:3], int(src[0])<<8|int(src[1]))...)
+			src = src[3:]
+		default:
+			length := 256 - count
+			if count == 128 {
+				if len(src) < 2 {
+					return nil, nil, errShort
+				}
+				length = int(src[0])<<8 | int(src[1])
+				src = src[2:]
+			}
+			if len(src) < length {
+				return nil, nil, errShort
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+		}
+	}
+	if len(dst) > n {
+		return nil, nil, errors.New("xcf: run-length tile overflows")
+	}
+	return dst, src, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+var xcfSamples = []struct {
+	file  string
+	model color.Model
+}{
+	{"v3-rle.xcf", color.NRGBAModel},
+	{"v11-zlib.xcf", color.NRGBAModel},
+	{"v12-rle16.xcf", color.RGBA64Model},
+}
+
+// TestDecodeXCF flattens the XCF samples, which have no composite, from
+// their visible layers by default and as picked otherwise.
+func TestDecodeXCF(t *testing.T) {
+	visible := map[image.Point]color.NRGBA{
+		{5, 5}: {}, {60, 5}: {128, 128, 128, 255}, {20, 20}: {0, 255, 0, 128},
+		{80, 60}: {0, 0, 255, 255}, {45, 60}: {},
+	}
+	for _, tt := range xcfSamples {
+		t.Run(tt.file, func(t *testing.T) {
+			data := readDocSample(t, "xcf", tt.file)
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil || format != "xcf" || cfg.Width != 100 || cfg.Height != 80 {
+				t.Fatalf("config %dx%d: %v, format %q", cfg.Width, cfg.Height, err, format)
+			}
+			img, err := decodeXCF(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Bounds() != image.Rect(0, 0, 100, 80) || img.ColorModel() != tt.model {
+				t.Fatalf("decoded %v in %v", img.Bounds(), img.ColorModel())
+			}
+			for p, want := range visible {
+				if got := img.At(p.X, p.Y); !nearColor(got, want) {
+					t.Errorf("pixel %v is %v, want %v", p, got, want)
+				}
+			}
+			for _, lt := range docLayerTests {
+				pickLayers(t, lt.hidden, lt.names...)
+				img, err := decodeXCF(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("%s: %v", lt.name, err)
+				}
+				for p, want := range lt.pixels {
+					if got := img.At(p.X, p.Y); !nearColor(got, want) {
+						t.Errorf("%s: pixel %v is %v, want %v", lt.name, p, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// xcfOffsets returns the offsets of the layer table of an XCF file and of
+// the first layer's hierarchy pointer.
+func xcfOffsets(data []byte) (table, hierarchy int) {
+	version := string(data[9:13])
+	wide := version >= "v011"
+	pos := 26
+	if version != "file" && version >= "v004" {
+		pos += 4
+	}
+	x := &xcfReader{data: data, pos: pos, wide: wide}
+	x.properties(func(int, []byte) {})
+	table = x.pos
+	x.seek(x.pointer())
+	x.read(12) // width, height and type
+	x.read(x.u32())
+	x.properties(func(int, []byte) {})
+	return table, x.pos
+}
+
+func TestDecodeXCFCorrupt(t *testing.T) {
+	for _, sample := range xcfSamples {
+		data := readDocSample(t, "xcf", sample.file)
+		table, hierarchy := xcfOffsets(data)
+		pointerSize := 4
+		if sample.file != "v3-rle.xcf" {
+			pointerSize = 8
+		}
+		// setPointer points the pointer at pos at p
+		setPointer := func(d []byte, pos, p int) {
+			if pointerSize == 8 {
+				binary.BigEndian.PutUint64(d[pos:], uint64(p))
+			} else {
+				binary.BigEndian.PutUint32(d[pos:], uint32(p))
+			}
+		}
+		pointer := func(pos int) int {
+			if pointerSize == 8 {
+				return int(binary.BigEndian.Uint64(data[pos:]))
+			}
+			return int(binary.BigEndian.Uint32(data[pos:]))
+		}
+		layer := pointer(table)
+		levels := pointer(hierarchy) + 12
+
+		tests := []struct {
+			name   string
+			change func(d []byte)
+			err    string
+		}{
+			{"signature", func(d []byte) { d[0] = 'G' }, "invalid signature"},
+			{"version", func(d []byte) { copy(d[9:], "vxyz") }, `unknown version "vxyz"`},
+			{"too large", func(d []byte) { binary.BigEndian.PutUint32(d[14:], 1<<30) }, "too large"},
+			{"base type", func(d []byte) { binary.BigEndian.PutUint32(d[22:], 9) }, "unknown base type 9"},
+			{"layer pointer", func(d []byte) { setPointer(d, table, len(d)+1) }, "pointer out of range"},
+			{"layer table end", func(d []byte) { copy(d[table:], bytes.Repeat([]byte{0xff}, 4*pointerSize)) }, "pointer out of range"},
+			{"layer type", func(d []byte) { binary.BigEndian.PutUint32(d[layer+8:], 9) }, "unknown layer type 9"},
+			{"layer name", func(d []byte) { binary.BigEndian.PutUint32(d[layer+12:], 0xfffffff0) }, "xcf: layer:"},
+			{"hierarchy pointer", func(d []byte) { setPointer(d, hierarchy, len(d)+1) }, "pointer out of range"},
+			{"bytes per pixel", func(d []byte) { binary.BigEndian.PutUint32(d[pointer(hierarchy)+8:], 7) }, "7 bytes per pixel"},
+			{"level size", func(d []byte) { binary.BigEndian.PutUint32(d[pointer(levels):], 1<<30) }, "xcf: layer"},
+			{"missing tiles", func(d []byte) { setPointer(d, pointer(levels)+8, 0) }, "missing tiles"},
+			{"tile pointer", func(d []byte) { setPointer(d, pointer(levels)+8, len(d)+1) }, "tile out of range"},
+			{"tile data", func(d []byte) {
+				tile := pointer(pointer(levels) + 8)
+				copy(d[tile:], bytes.Repeat([]byte{0x80, 0xff, 0xff}, 4))
+			}, "xcf:"},
+		}
+		if sample.file == "v12-rle16.xcf" {
+			tests = append(tests, struct {
+				name   string
+				change func(d []byte)
+				err    string
+			}{"precision", func(d []byte) { binary.BigEndian.PutUint32(d[26:], 999) }, "unknown precision 999"})
+		}
+		for _, tt := range tests {
+			t.Run(sample.file+"/"+tt.name, func(t *testing.T) {
+				// Every layer is read, the hidden one first
+				pickLayers(t, true)
+				d := bytes.Clone(data)
+				tt.change(d)
+				if _, err := decodeXCF(bytes.NewReader(d)); err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %v, want an error containing %q", err, tt.err)
+				}
+			})
+		}
+	}
+}